@@ -1,6 +1,27 @@
 package broker
 
 const (
-	OrderCreatedEvent = "order.created"
-	OrderPaidEvent    = "order.paid"
+	OrderCreatedEvent   = "order.created"
+	OrderPaidEvent      = "order.paid"
+	OrderCancelledEvent = "order.cancelled"
+
+	// The payment events carry a PaymentEvent, a paid payment is told with
+	// order.paid.
+	PaymentFailedEvent   = "payment.failed"
+	PaymentExpiredEvent  = "payment.expired"
+	PaymentRefundedEvent = "payment.refunded"
+	PaymentDisputedEvent = "payment.disputed"
+
+	StockItemUpdatedEvent = "stock.item_updated"
+
+	// StockChangedEvent tells every stock instance which items had their
+	// stock changed, so it can update the clients watching them.
+	StockChangedEvent = "stock.changed"
+
+	// StockAlertsExchange is a topic exchange, the alerts are told apart by
+	// their routing key.
+	StockAlertsExchange   = "stock.alerts"
+	StockLowEvent         = "stock.low"
+	StockDepletedEvent    = "stock.depleted"
+	StockBackInStockEvent = "stock.back_in_stock"
 )
@@ -12,6 +12,9 @@ import (
 
 const MaxRetryCount = 3
 const DLQ = "dlq_main"
+const originalExchangeHeader = "x-original-exchange"
+const originalRoutingKeyHeader = "x-original-routing-key"
+const deadLetterReasonHeader = "x-dead-letter-reason"
 
 func Connect(user, pass, host, port string) (*amqp.Channel, func() error) {
 	address := fmt.Sprintf("amqp://%s:%s@%s:%s", user, pass, host, port)
@@ -36,15 +39,120 @@ func Connect(user, pass, host, port string) (*amqp.Channel, func() error) {
 		log.Fatal(err)
 	}
 
+	err = ch.ExchangeDeclare(OrderCancelledEvent, "fanout", true, false, false, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, event := range []string{PaymentFailedEvent, PaymentExpiredEvent, PaymentRefundedEvent, PaymentDisputedEvent} {
+		err = ch.ExchangeDeclare(event, "fanout", true, false, false, false, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = ch.ExchangeDeclare(StockItemUpdatedEvent, "fanout", true, false, false, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ch.ExchangeDeclare(StockChangedEvent, "fanout", true, false, false, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ch.ExchangeDeclare(StockAlertsExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	err = createDLQAndDLX(ch)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go exitOnClose(conn.NotifyClose(make(chan *amqp.Error, 1)), ch.NotifyClose(make(chan *amqp.Error, 1)))
+
 	return ch, conn.Close
 }
 
+// exitOnClose ends the process when the broker closes the connection or the
+// channel, so it is restarted and connects again. Nothing reopens them, and
+// consumers would stop while publishes keep failing. Closing them ourselves
+// is not an error and is ignored.
+func exitOnClose(connClosed, chClosed chan *amqp.Error) {
+	select {
+	case err := <-connClosed:
+		if err != nil {
+			log.Fatalf("AMQP connection closed: %v", err)
+		}
+	case err := <-chClosed:
+		if err != nil {
+			log.Fatalf("AMQP channel closed: %v", err)
+		}
+	}
+}
+
 func HandleRetry(ch *amqp.Channel, d *amqp.Delivery) error {
+	return retry(ch, d, d.Exchange, d.RoutingKey)
+}
+
+// HandleQueueRetry works like HandleRetry, but publishes the retried message
+// straight to the given queue through the default exchange. Consumers of
+// fanout exchanges use it so a retry does not reach every other bound queue.
+// The original exchange and routing key are kept in headers, see
+// DeliveryExchange and DeliveryRoutingKey.
+func HandleQueueRetry(ch *amqp.Channel, d *amqp.Delivery, queue string) error {
+	if d.Headers == nil {
+		d.Headers = amqp.Table{}
+	}
+	if _, ok := d.Headers[originalExchangeHeader]; !ok {
+		d.Headers[originalExchangeHeader] = d.Exchange
+		d.Headers[originalRoutingKeyHeader] = d.RoutingKey
+	}
+
+	return retry(ch, d, "", queue)
+}
+
+// DeliveryExchange returns the exchange a message was first published to,
+// even when it has been redelivered by HandleQueueRetry.
+func DeliveryExchange(d *amqp.Delivery) string {
+	if exchange, ok := d.Headers[originalExchangeHeader].(string); ok {
+		return exchange
+	}
+
+	return d.Exchange
+}
+
+// DeliveryRoutingKey returns the routing key a message was first published
+// with, even when it has been redelivered by HandleQueueRetry.
+func DeliveryRoutingKey(d *amqp.Delivery) string {
+	if routingKey, ok := d.Headers[originalRoutingKeyHeader].(string); ok {
+		return routingKey
+	}
+
+	return d.RoutingKey
+}
+
+// DeadLetter moves a message straight to the DLQ, for failures retrying
+// can't fix. The reason is kept in a header.
+func DeadLetter(ch *amqp.Channel, d *amqp.Delivery, reason string) error {
+	if d.Headers == nil {
+		d.Headers = amqp.Table{}
+	}
+	d.Headers[deadLetterReasonHeader] = reason
+
+	log.Printf("Moving message to DLQ %s: %s", DLQ, reason)
+
+	return ch.PublishWithContext(context.Background(), "", DLQ, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Headers:      d.Headers,
+		Body:         d.Body,
+		DeliveryMode: amqp.Persistent,
+	})
+}
+
+func retry(ch *amqp.Channel, d *amqp.Delivery, exchange, routingKey string) error {
 	if d.Headers == nil {
 		d.Headers = amqp.Table{}
 	}
@@ -59,22 +167,15 @@ func HandleRetry(ch *amqp.Channel, d *amqp.Delivery) error {
 	log.Printf("Retrying message %s, retry count: %d", d.Body, retryCount)
 
 	if retryCount >= MaxRetryCount {
-		log.Printf("Moving message to DLQ %s", DLQ)
-
-		return ch.PublishWithContext(context.Background(), "", DLQ, false, false, amqp.Publishing{
-			ContentType:  "application/json",
-			Headers:      d.Headers,
-			Body:         d.Body,
-			DeliveryMode: amqp.Persistent,
-		})
+		return DeadLetter(ch, d, "too many retries")
 	}
 
 	time.Sleep(time.Second * time.Duration(retryCount))
 
 	return ch.PublishWithContext(
 		context.Background(),
-		d.Exchange,
-		d.RoutingKey,
+		exchange,
+		routingKey,
 		false,
 		false,
 		amqp.Publishing{
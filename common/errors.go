@@ -3,6 +3,9 @@ package common
 import "errors"
 
 var (
-	ErrNoItems = errors.New("items must have at least one item")
-	ErrNoStock = errors.New("some item is not in stock")
-)
\ No newline at end of file
+	ErrNoItems      = errors.New("items must have at least one item")
+	ErrNoStock      = errors.New("some item is not in stock")
+	ErrItemNotFound = errors.New("item not found")
+
+	ErrInvalidPaymentMethod = errors.New("payment method must be card or cash")
+)
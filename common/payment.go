@@ -0,0 +1,30 @@
+package common
+
+// Payment methods an order can be paid with.
+const (
+	// PaymentMethodCard pays online through the checkout of the payment
+	// processor. Orders that don't name a payment method are paid by card.
+	PaymentMethodCard = "card"
+	// PaymentMethodCash pays at the counter, staff confirm the payment once
+	// they collected it.
+	PaymentMethodCash = "cash"
+)
+
+// PaymentMethodOrDefault is the payment method of an order, card when it
+// names none.
+func PaymentMethodOrDefault(method string) string {
+	if method == "" {
+		return PaymentMethodCard
+	}
+
+	return method
+}
+
+func IsValidPaymentMethod(method string) bool {
+	switch PaymentMethodOrDefault(method) {
+	case PaymentMethodCard, PaymentMethodCash:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"go.opentelemetry.io/otel"
+	otelCodes "go.opentelemetry.io/otel/codes"
+)
+
+// defaultAdminActor is recorded as the author of admin changes when the
+// request does not name one in the X-Admin-Actor header.
+const defaultAdminActor = "admin"
+
+func (h *handler) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/items", h.requireAdmin(h.handleListItems))
+	mux.HandleFunc("POST /api/admin/items", h.requireAdmin(h.handleCreateItem))
+	mux.HandleFunc("PUT /api/admin/items/{itemID}", h.requireAdmin(h.handleUpdateItem))
+	mux.HandleFunc("PATCH /api/admin/items/{itemID}", h.requireAdmin(h.handlePatchItem))
+	mux.HandleFunc("DELETE /api/admin/items/{itemID}", h.requireAdmin(h.handleDeleteItem))
+	mux.HandleFunc("POST /api/admin/items/{itemID}/adjustments", h.requireAdmin(h.handleAdjustQuantity))
+	mux.HandleFunc("GET /api/admin/items/{itemID}/movements", h.requireAdmin(h.handleListStockMovements))
+	mux.HandleFunc("GET /api/admin/price-lists", h.requireAdmin(h.handleListPriceLists))
+	mux.HandleFunc("PUT /api/admin/price-lists/{priceListID}", h.requireAdmin(h.handlePutPriceList))
+	mux.HandleFunc("DELETE /api/admin/price-lists/{priceListID}", h.requireAdmin(h.handleDeletePriceList))
+	mux.HandleFunc("POST /api/admin/payments/webhooks/requeue", h.requireAdmin(h.handleRequeueWebhooks))
+	mux.HandleFunc("POST /api/admin/payments/{paymentID}/refunds", h.requireAdmin(h.handleRefundPayment))
+	mux.HandleFunc("POST /api/admin/payments/{paymentID}/confirmations", h.requireAdmin(h.handleConfirmManualPayment))
+	mux.HandleFunc("GET /api/admin/risk-decisions", h.requireAdmin(h.handleListRiskDecisions))
+	mux.HandleFunc("POST /api/admin/risk-decisions/{decisionID}/review", h.requireAdmin(h.handleReviewRiskDecision))
+}
+
+// requireAdmin only lets through requests carrying the admin token as a
+// bearer token. Admin routes are closed when no token is configured.
+func (h *handler) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		adminToken := h.adminToken.Token()
+		if adminToken == "" || !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			common.WriteError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (h *handler) handleListItems(w http.ResponseWriter, r *http.Request) {
+	pageSize, err := queryInt(r, "pageSize")
+	if err != nil {
+		common.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.stockGateway.ListItems(ctx, &pb.ListItemsRequest{
+		PageSize:        int32(pageSize),
+		PageToken:       r.URL.Query().Get("pageToken"),
+		IncludeArchived: r.URL.Query().Get("includeArchived") == "true",
+		LocationID:      r.URL.Query().Get("locationID"),
+	})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) handleCreateItem(w http.ResponseWriter, r *http.Request) {
+	var req pb.CreateItemRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	i, err := h.stockGateway.CreateItem(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusCreated, i)
+}
+
+func (h *handler) handleUpdateItem(w http.ResponseWriter, r *http.Request) {
+	var req pb.UpdateItemRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.ID = r.PathValue("itemID")
+	req.LocationID = r.URL.Query().Get("locationID")
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	i, err := h.stockGateway.UpdateItem(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, i)
+}
+
+// handlePatchItem updates only the fields present in the request body,
+// leaving the others as they are.
+func (h *handler) handlePatchItem(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	var req pb.UpdateItemRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	for name := range fields {
+		req.Fields = append(req.Fields, name)
+	}
+	if len(req.Fields) == 0 {
+		common.WriteError(w, http.StatusBadRequest, "no fields to update")
+		return
+	}
+	sort.Strings(req.Fields)
+	req.ID = r.PathValue("itemID")
+	req.LocationID = r.URL.Query().Get("locationID")
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	i, err := h.stockGateway.UpdateItem(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, i)
+}
+
+func (h *handler) handleDeleteItem(w http.ResponseWriter, r *http.Request) {
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	i, err := h.stockGateway.DeleteItem(ctx, &pb.DeleteItemRequest{
+		ID:         r.PathValue("itemID"),
+		LocationID: r.URL.Query().Get("locationID"),
+		Actor:      adminActor(r),
+	})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, i)
+}
+
+func (h *handler) handleAdjustQuantity(w http.ResponseWriter, r *http.Request) {
+	var req pb.AdjustQuantityRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.ItemID = r.PathValue("itemID")
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	i, err := h.stockGateway.AdjustQuantity(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, i)
+}
+
+func (h *handler) handleListStockMovements(w http.ResponseWriter, r *http.Request) {
+	pageSize, err := queryInt(r, "pageSize")
+	if err != nil {
+		common.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.stockGateway.ListStockMovements(ctx, &pb.ListStockMovementsRequest{
+		ItemID:     r.PathValue("itemID"),
+		PageSize:   int32(pageSize),
+		PageToken:  r.URL.Query().Get("pageToken"),
+		LocationID: r.URL.Query().Get("locationID"),
+	})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) handleListPriceLists(w http.ResponseWriter, r *http.Request) {
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.stockGateway.ListPriceLists(ctx, &pb.ListPriceListsRequest{})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) handlePutPriceList(w http.ResponseWriter, r *http.Request) {
+	var req pb.PriceList
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.ID = r.PathValue("priceListID")
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	l, err := h.stockGateway.PutPriceList(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, l)
+}
+
+func (h *handler) handleDeletePriceList(w http.ResponseWriter, r *http.Request) {
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	_, err := h.stockGateway.DeletePriceList(ctx, &pb.DeletePriceListRequest{ID: r.PathValue("priceListID")})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRequeueWebhooks sends the payment webhooks that failed back to be
+// processed, those named in the body or all of them.
+func (h *handler) handleRequeueWebhooks(w http.ResponseWriter, r *http.Request) {
+	var req pb.RequeueWebhooksRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.paymentsGateway.RequeueWebhooks(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) handleRefundPayment(w http.ResponseWriter, r *http.Request) {
+	var req pb.RefundPaymentRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.PaymentID = r.PathValue("paymentID")
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	refund, err := h.paymentsGateway.RefundPayment(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusCreated, refund)
+}
+
+// handleConfirmManualPayment tells that staff collected a cash payment. The
+// payment is answered with 202 as it was, it is paid and the order told once
+// the confirmation is processed.
+func (h *handler) handleConfirmManualPayment(w http.ResponseWriter, r *http.Request) {
+	var req pb.ConfirmManualPaymentRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.PaymentID = r.PathValue("paymentID")
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	payment, err := h.paymentsGateway.ConfirmManualPayment(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusAccepted, payment)
+}
+
+func (h *handler) handleListRiskDecisions(w http.ResponseWriter, r *http.Request) {
+	pageSize, err := queryInt(r, "pageSize")
+	if err != nil {
+		common.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.paymentsGateway.ListRiskDecisions(ctx, &pb.ListRiskDecisionsRequest{
+		Status:   r.URL.Query().Get("status"),
+		PageSize: int32(pageSize),
+	})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+// handleReviewRiskDecision releases an order held by the risk rules to
+// payment, or rejects it.
+func (h *handler) handleReviewRiskDecision(w http.ResponseWriter, r *http.Request) {
+	var req pb.ReviewRiskDecisionRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	req.DecisionID = r.PathValue("decisionID")
+	req.Actor = adminActor(r)
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	decision, err := h.paymentsGateway.ReviewRiskDecision(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, decision)
+}
+
+func adminActor(r *http.Request) string {
+	if actor := r.Header.Get("X-Admin-Actor"); actor != "" {
+		return actor
+	}
+
+	return defaultAdminActor
+}
+
+func queryInt(r *http.Request, key string) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+
+	return n, nil
+}
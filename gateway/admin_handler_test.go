@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/gateway/gateway"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeConfig is a config store holding a single admin token.
+type fakeConfig struct {
+	token string
+	err   error
+}
+
+func (c *fakeConfig) GetValue(ctx context.Context, key string) (string, error) {
+	if key != adminTokenKey {
+		return "", errors.New("unexpected key " + key)
+	}
+
+	return c.token, c.err
+}
+
+// fakeStockGateway records the item updates it gets. The other calls are
+// left to the embedded nil gateway and panic.
+type fakeStockGateway struct {
+	gateway.StockGateway
+	updates []*pb.UpdateItemRequest
+}
+
+func (g *fakeStockGateway) UpdateItem(ctx context.Context, req *pb.UpdateItemRequest) (*pb.Item, error) {
+	g.updates = append(g.updates, req)
+
+	return &pb.Item{ID: req.ID, Name: req.Name, PriceID: req.PriceID}, nil
+}
+
+// fakePaymentsGateway records the webhook requeues and refunds it gets.
+type fakePaymentsGateway struct {
+	gateway.PaymentsGateway
+	requeues []*pb.RequeueWebhooksRequest
+	refunds  []*pb.RefundPaymentRequest
+	err      error
+}
+
+func (g *fakePaymentsGateway) RequeueWebhooks(ctx context.Context, req *pb.RequeueWebhooksRequest) (*pb.RequeueWebhooksResponse, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	g.requeues = append(g.requeues, req)
+
+	return &pb.RequeueWebhooksResponse{Requeued: int64(len(req.IDs))}, nil
+}
+
+func (g *fakePaymentsGateway) RefundPayment(ctx context.Context, req *pb.RefundPaymentRequest) (*pb.Refund, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	g.refunds = append(g.refunds, req)
+
+	return &pb.Refund{ID: "r1", PaymentID: req.PaymentID, Amount: req.Amount, Status: "succeeded"}, nil
+}
+
+func newAdminMux(t *testing.T, config *fakeConfig, stock *fakeStockGateway, payments *fakePaymentsGateway) *http.ServeMux {
+	t.Helper()
+
+	token := NewAdminToken(config)
+	if err := token.Load(context.Background()); err != nil && config.err == nil {
+		t.Fatalf("loading the admin token: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	NewHandler(nil, stock, payments, token).registerAdminRoutes(mux)
+
+	return mux
+}
+
+func patchItem(mux *http.ServeMux, auth, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/api/admin/items/burger", strings.NewReader(body))
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	r.Header.Set("X-Admin-Actor", "jane")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *fakeConfig
+		auth   string
+		want   int
+	}{
+		{"matching token", &fakeConfig{token: "secret"}, "Bearer secret", http.StatusOK},
+		{"wrong token", &fakeConfig{token: "secret"}, "Bearer guess", http.StatusUnauthorized},
+		{"no bearer prefix", &fakeConfig{token: "secret"}, "secret", http.StatusUnauthorized},
+		{"no header", &fakeConfig{token: "secret"}, "", http.StatusUnauthorized},
+		{"no token configured", &fakeConfig{}, "Bearer ", http.StatusUnauthorized},
+		{"token not read", &fakeConfig{err: errors.New("consul is down")}, "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stock := &fakeStockGateway{}
+			mux := newAdminMux(t, tt.config, stock, nil)
+
+			w := patchItem(mux, tt.auth, `{"Name": "Cheeseburger"}`)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK && len(stock.updates) > 0 {
+				t.Errorf("an unauthorized request reached the stock service: %+v", stock.updates)
+			}
+		})
+	}
+}
+
+func TestAdminTokenReload(t *testing.T) {
+	config := &fakeConfig{token: "first"}
+	token := NewAdminToken(config)
+	ctx := context.Background()
+
+	if err := token.Load(ctx); err != nil {
+		t.Fatalf("loading the token: %v", err)
+	}
+
+	config.token = "second"
+	if err := token.Load(ctx); err != nil {
+		t.Fatalf("loading the rotated token: %v", err)
+	}
+	if got := token.Token(); got != "second" {
+		t.Errorf("got token %q after rotating it, want %q", got, "second")
+	}
+
+	// a failed read keeps the token in force
+	config.err = errors.New("consul is down")
+	if err := token.Load(ctx); err == nil {
+		t.Error("loading the token while consul is down succeeded")
+	}
+	if got := token.Token(); got != "second" {
+		t.Errorf("got token %q after a failed read, want %q", got, "second")
+	}
+
+	// an empty key closes the admin routes
+	config.token, config.err = "", nil
+	if err := token.Load(ctx); err != nil {
+		t.Fatalf("loading the emptied token: %v", err)
+	}
+	if got := token.Token(); got != "" {
+		t.Errorf("got token %q after the key was emptied, want none", got)
+	}
+}
+
+func TestPatchItem(t *testing.T) {
+	stock := &fakeStockGateway{}
+	mux := newAdminMux(t, &fakeConfig{token: "secret"}, stock, nil)
+
+	w := patchItem(mux, "Bearer secret", `{"PriceID": "price_2", "Name": "Cheeseburger"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if len(stock.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(stock.updates))
+	}
+	req := stock.updates[0]
+	if req.ID != "burger" || req.Actor != "jane" || req.Name != "Cheeseburger" || req.PriceID != "price_2" {
+		t.Errorf("got update %+v, want the body for burger by jane", req)
+	}
+	if want := []string{"Name", "PriceID"}; !slices.Equal(req.Fields, want) {
+		t.Errorf("got fields %v, want %v", req.Fields, want)
+	}
+
+	for _, body := range []string{`{}`, `not json`, `["Name"]`} {
+		if w := patchItem(mux, "Bearer secret", body); w.Code != http.StatusBadRequest {
+			t.Errorf("patching with %s got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(stock.updates) != 1 {
+		t.Errorf("invalid patches reached the stock service: %+v", stock.updates[1:])
+	}
+}
+
+func TestRequeueWebhooks(t *testing.T) {
+	payments := &fakePaymentsGateway{}
+	mux := newAdminMux(t, &fakeConfig{token: "secret"}, nil, payments)
+
+	requeue := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/payments/webhooks/requeue", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := requeue(`{"IDs": ["stripe:evt_1", "stripe:evt_2"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"Requeued":2`) {
+		t.Errorf("got body %s, want 2 requeued", w.Body)
+	}
+	if len(payments.requeues) != 1 || !slices.Equal(payments.requeues[0].IDs, []string{"stripe:evt_1", "stripe:evt_2"}) {
+		t.Errorf("got requeues %+v, want both webhooks", payments.requeues)
+	}
+
+	if w := requeue(`not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("requeueing with an invalid body got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	payments.err = status.Error(codes.InvalidArgument, "invalid webhook ID")
+	if w := requeue(`{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("requeueing got status %d on an invalid argument, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRefundPayment(t *testing.T) {
+	payments := &fakePaymentsGateway{}
+	mux := newAdminMux(t, &fakeConfig{token: "secret"}, nil, payments)
+
+	refund := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/payments/p1/refunds", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("X-Admin-Actor", "jane")
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := refund(`{"Amount": 500, "Reason": "cold"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if len(payments.refunds) != 1 {
+		t.Fatalf("got %d refunds, want 1", len(payments.refunds))
+	}
+	if req := payments.refunds[0]; req.PaymentID != "p1" || req.Amount != 500 || req.Actor != "jane" {
+		t.Errorf("got refund request %+v, want 500 of p1 by jane", req)
+	}
+
+	if w := refund(`not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("refunding with an invalid body got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	payments.err = status.Error(codes.FailedPrecondition, "payment is open")
+	if w := refund(`{}`); w.Code != http.StatusConflict {
+		t.Errorf("refunding an unpaid payment got status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
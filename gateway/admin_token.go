@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// adminTokenKey is the Consul key holding the admin bearer token.
+	adminTokenKey = "gateway/ADMIN_TOKEN"
+	// adminTokenRefresh is how often the admin token is read from Consul.
+	adminTokenRefresh = time.Minute
+)
+
+type ConfigStore interface {
+	GetValue(ctx context.Context, key string) (string, error)
+}
+
+// adminToken keeps the admin token read from the config store, so it can be
+// rotated without restarting the gateway.
+type adminToken struct {
+	config ConfigStore
+	mu     sync.RWMutex
+	token  string
+}
+
+func NewAdminToken(config ConfigStore) *adminToken {
+	return &adminToken{config: config}
+}
+
+// Load reads the token again. The token in force is kept when it can't be
+// read.
+func (t *adminToken) Load(ctx context.Context) error {
+	token, err := t.config.GetValue(ctx, adminTokenKey)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", adminTokenKey, err)
+	}
+
+	t.mu.Lock()
+	t.token = token
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Token is the admin token in force, empty while admin routes are closed.
+func (t *adminToken) Token() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.token
+}
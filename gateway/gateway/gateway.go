@@ -10,3 +10,31 @@ type OrdersGateway interface {
 	CreateOrder(context.Context, *pb.CreateOrderRequest) (*pb.Order, error)
 	GetOrder(ctx context.Context, orderID, customerID string)(*pb.Order, error)
 }
+
+type StockGateway interface {
+	ListItems(context.Context, *pb.ListItemsRequest) (*pb.ListItemsResponse, error)
+	CreateItem(context.Context, *pb.CreateItemRequest) (*pb.Item, error)
+	UpdateItem(context.Context, *pb.UpdateItemRequest) (*pb.Item, error)
+	DeleteItem(context.Context, *pb.DeleteItemRequest) (*pb.Item, error)
+	AdjustQuantity(context.Context, *pb.AdjustQuantityRequest) (*pb.Item, error)
+	ListStockMovements(context.Context, *pb.ListStockMovementsRequest) (*pb.ListStockMovementsResponse, error)
+	GetMenu(context.Context, *pb.GetMenuRequest) (*pb.GetMenuResponse, error)
+	ListLocations(context.Context, *pb.ListLocationsRequest) (*pb.ListLocationsResponse, error)
+	FindFulfillmentLocation(context.Context, *pb.FindFulfillmentLocationRequest) (*pb.FindFulfillmentLocationResponse, error)
+	ListPriceLists(context.Context, *pb.ListPriceListsRequest) (*pb.ListPriceListsResponse, error)
+	PutPriceList(context.Context, *pb.PriceList) (*pb.PriceList, error)
+	DeletePriceList(context.Context, *pb.DeletePriceListRequest) (*pb.DeletePriceListResponse, error)
+	// WatchStock calls fn with every stock update of the watched items until
+	// ctx is done or the stream fails.
+	WatchStock(ctx context.Context, p *pb.WatchStockRequest, fn func(*pb.StockUpdate) error) error
+	JoinWaitlist(context.Context, *pb.JoinWaitlistRequest) (*pb.WaitlistEntry, error)
+	LeaveWaitlist(context.Context, *pb.LeaveWaitlistRequest) (*pb.LeaveWaitlistResponse, error)
+}
+
+type PaymentsGateway interface {
+	RequeueWebhooks(context.Context, *pb.RequeueWebhooksRequest) (*pb.RequeueWebhooksResponse, error)
+	RefundPayment(context.Context, *pb.RefundPaymentRequest) (*pb.Refund, error)
+	ConfirmManualPayment(context.Context, *pb.ConfirmManualPaymentRequest) (*pb.Payment, error)
+	ListRiskDecisions(context.Context, *pb.ListRiskDecisionsRequest) (*pb.ListRiskDecisionsResponse, error)
+	ReviewRiskDecision(context.Context, *pb.ReviewRiskDecisionRequest) (*pb.RiskDecision, error)
+}
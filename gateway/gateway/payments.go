@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"context"
+	"log"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/discovery"
+	"google.golang.org/grpc"
+)
+
+type paymentsGateway struct {
+	registry discovery.Registry
+}
+
+func NewPaymentsGateway(registry discovery.Registry) *paymentsGateway {
+	return &paymentsGateway{registry}
+}
+
+func (g *paymentsGateway) RequeueWebhooks(ctx context.Context, p *pb.RequeueWebhooksRequest) (*pb.RequeueWebhooksResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.RequeueWebhooks(ctx, p)
+}
+
+func (g *paymentsGateway) RefundPayment(ctx context.Context, p *pb.RefundPaymentRequest) (*pb.Refund, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.RefundPayment(ctx, p)
+}
+
+func (g *paymentsGateway) ConfirmManualPayment(ctx context.Context, p *pb.ConfirmManualPaymentRequest) (*pb.Payment, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ConfirmManualPayment(ctx, p)
+}
+
+func (g *paymentsGateway) ListRiskDecisions(ctx context.Context, p *pb.ListRiskDecisionsRequest) (*pb.ListRiskDecisionsResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ListRiskDecisions(ctx, p)
+}
+
+func (g *paymentsGateway) ReviewRiskDecision(ctx context.Context, p *pb.ReviewRiskDecisionRequest) (*pb.RiskDecision, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ReviewRiskDecision(ctx, p)
+}
+
+func (g *paymentsGateway) client() (*grpc.ClientConn, pb.PaymentServiceClient) {
+	conn, err := discovery.ServiceConnection(context.Background(), "payment", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+
+	return conn, pb.NewPaymentServiceClient(conn)
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"context"
+	"log"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/discovery"
+	"google.golang.org/grpc"
+)
+
+type stockGateway struct {
+	registry discovery.Registry
+}
+
+func NewStockGateway(registry discovery.Registry) *stockGateway {
+	return &stockGateway{registry}
+}
+
+func (g *stockGateway) ListItems(ctx context.Context, p *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ListItems(ctx, p)
+}
+
+func (g *stockGateway) CreateItem(ctx context.Context, p *pb.CreateItemRequest) (*pb.Item, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.CreateItem(ctx, p)
+}
+
+func (g *stockGateway) UpdateItem(ctx context.Context, p *pb.UpdateItemRequest) (*pb.Item, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.UpdateItem(ctx, p)
+}
+
+func (g *stockGateway) DeleteItem(ctx context.Context, p *pb.DeleteItemRequest) (*pb.Item, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.DeleteItem(ctx, p)
+}
+
+func (g *stockGateway) AdjustQuantity(ctx context.Context, p *pb.AdjustQuantityRequest) (*pb.Item, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.AdjustQuantity(ctx, p)
+}
+
+func (g *stockGateway) ListStockMovements(ctx context.Context, p *pb.ListStockMovementsRequest) (*pb.ListStockMovementsResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ListStockMovements(ctx, p)
+}
+
+func (g *stockGateway) GetMenu(ctx context.Context, p *pb.GetMenuRequest) (*pb.GetMenuResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.GetMenu(ctx, p)
+}
+
+func (g *stockGateway) ListLocations(ctx context.Context, p *pb.ListLocationsRequest) (*pb.ListLocationsResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ListLocations(ctx, p)
+}
+
+func (g *stockGateway) FindFulfillmentLocation(ctx context.Context, p *pb.FindFulfillmentLocationRequest) (*pb.FindFulfillmentLocationResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.FindFulfillmentLocation(ctx, p)
+}
+
+func (g *stockGateway) ListPriceLists(ctx context.Context, p *pb.ListPriceListsRequest) (*pb.ListPriceListsResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.ListPriceLists(ctx, p)
+}
+
+func (g *stockGateway) PutPriceList(ctx context.Context, p *pb.PriceList) (*pb.PriceList, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.PutPriceList(ctx, p)
+}
+
+func (g *stockGateway) DeletePriceList(ctx context.Context, p *pb.DeletePriceListRequest) (*pb.DeletePriceListResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.DeletePriceList(ctx, p)
+}
+
+func (g *stockGateway) WatchStock(ctx context.Context, p *pb.WatchStockRequest, fn func(*pb.StockUpdate) error) error {
+	conn, c := g.client()
+	defer conn.Close()
+
+	stream, err := c.WatchStock(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	for {
+		u, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *stockGateway) JoinWaitlist(ctx context.Context, p *pb.JoinWaitlistRequest) (*pb.WaitlistEntry, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.JoinWaitlist(ctx, p)
+}
+
+func (g *stockGateway) LeaveWaitlist(ctx context.Context, p *pb.LeaveWaitlistRequest) (*pb.LeaveWaitlistResponse, error) {
+	conn, c := g.client()
+	defer conn.Close()
+
+	return c.LeaveWaitlist(ctx, p)
+}
+
+func (g *stockGateway) client() (*grpc.ClientConn, pb.StockServiceClient) {
+	conn, err := discovery.ServiceConnection(context.Background(), "stock", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+
+	return conn, pb.NewStockServiceClient(conn)
+}
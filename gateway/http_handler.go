@@ -15,12 +15,18 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// defaultChannel prices the requests that don't name a channel.
+const defaultChannel = "web"
+
 type handler struct {
-	gateway gateway.OrdersGateway
+	gateway         gateway.OrdersGateway
+	stockGateway    gateway.StockGateway
+	paymentsGateway gateway.PaymentsGateway
+	adminToken      *adminToken
 }
 
-func NewHandler(gateway gateway.OrdersGateway) *handler {
-	return &handler{gateway}
+func NewHandler(gateway gateway.OrdersGateway, stockGateway gateway.StockGateway, paymentsGateway gateway.PaymentsGateway, adminToken *adminToken) *handler {
+	return &handler{gateway, stockGateway, paymentsGateway, adminToken}
 }
 
 func (h *handler) registerRoutes(mux *http.ServeMux) {
@@ -29,6 +35,14 @@ func (h *handler) registerRoutes(mux *http.ServeMux) {
 
 	mux.HandleFunc("POST /api/customers/{customerID}/orders", h.handleCreateOrder)
 	mux.HandleFunc("GET /api/customers/{customerID}/orders/{orderID}", h.handleGetOrder)
+	mux.HandleFunc("POST /api/customers/{customerID}/waitlist", h.handleJoinWaitlist)
+	mux.HandleFunc("DELETE /api/customers/{customerID}/waitlist/{itemID}", h.handleLeaveWaitlist)
+	mux.HandleFunc("GET /api/items", h.handleGetMenu)
+	mux.HandleFunc("GET /api/items/stream", h.handleWatchStock)
+	mux.HandleFunc("GET /api/locations", h.handleListLocations)
+	mux.HandleFunc("POST /api/locations/fulfillment", h.handleFindFulfillmentLocation)
+
+	h.registerAdminRoutes(mux)
 }
 
 func (h *handler) handleGetOrder(w http.ResponseWriter, r *http.Request) {
@@ -61,7 +75,10 @@ func (h *handler) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	customerID := r.PathValue("customerID")
 
 	var req struct {
-		Items []*pb.ItemsWithQuantity `json:"Items"`
+		Items         []*pb.ItemsWithQuantity `json:"Items"`
+		LocationID    string                  `json:"LocationID"`
+		Channel       string                  `json:"Channel"`
+		PaymentMethod string                  `json:"PaymentMethod"`
 	}
 
 	if err := common.ReadJSON(r, &req); err != nil {
@@ -74,6 +91,10 @@ func (h *handler) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 		common.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !common.IsValidPaymentMethod(req.PaymentMethod) {
+		common.WriteError(w, http.StatusBadRequest, common.ErrInvalidPaymentMethod.Error())
+		return
+	}
 	log.Printf("Items: %+v", req.Items)
 
 	// Create a tracer span
@@ -82,19 +103,23 @@ func (h *handler) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	defer span.End()
 
 	o, err := h.gateway.CreateOrder(ctx, &pb.CreateOrderRequest{
-		CustomerID: customerID,
-		Items:      req.Items,
+		CustomerID:    customerID,
+		Items:         req.Items,
+		LocationID:    req.LocationID,
+		Channel:       channelOrDefault(req.Channel),
+		PaymentMethod: req.PaymentMethod,
 	})
-	rStatus := status.Convert(err)
-	if rStatus != nil {
+	if err != nil {
 		span.SetStatus(otelCodes.Error, err.Error())
 
-		if rStatus.Code() != codes.InvalidArgument {
+		// the orders service returns plain errors, such as ErrNoItems, for
+		// the orders it refuses
+		if rStatus := status.Convert(err); rStatus.Code() == codes.Unknown {
 			common.WriteError(w, http.StatusBadRequest, rStatus.Message())
 			return
 		}
 
-		common.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeStatusError(w, err)
 		return
 	}
 
@@ -106,6 +131,129 @@ func (h *handler) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	common.WriteJSON(w, http.StatusOK, res)
 }
 
+// handleJoinWaitlist puts the customer on the waitlist of an item that is
+// out of stock, they are told once it is back. Items that can be ordered are
+// refused with 409.
+func (h *handler) handleJoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	var req pb.JoinWaitlistRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if req.ItemID == "" {
+		common.WriteError(w, http.StatusBadRequest, "item ID is required")
+		return
+	}
+	req.CustomerID = r.PathValue("customerID")
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	e, err := h.stockGateway.JoinWaitlist(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusCreated, e)
+}
+
+// handleLeaveWaitlist takes the customer off the waitlist of an item at the
+// locationID query parameter, or at the default location.
+func (h *handler) handleLeaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	_, err := h.stockGateway.LeaveWaitlist(ctx, &pb.LeaveWaitlistRequest{
+		ItemID:     r.PathValue("itemID"),
+		LocationID: r.URL.Query().Get("locationID"),
+		CustomerID: r.PathValue("customerID"),
+	})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetMenu returns the items that can be ordered right now, grouped by
+// category. The quantities are the stock of the locationID query parameter,
+// or of the default location, and the prices those of the channel query
+// parameter right now.
+func (h *handler) handleGetMenu(w http.ResponseWriter, r *http.Request) {
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.stockGateway.GetMenu(ctx, &pb.GetMenuRequest{
+		LocationID: r.URL.Query().Get("locationID"),
+		Channel:    channelOrDefault(r.URL.Query().Get("channel")),
+	})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) handleListLocations(w http.ResponseWriter, r *http.Request) {
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.stockGateway.ListLocations(ctx, &pb.ListLocationsRequest{})
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+// handleFindFulfillmentLocation picks the location that can fulfil a basket,
+// the nearest one to Origin when it is given.
+func (h *handler) handleFindFulfillmentLocation(w http.ResponseWriter, r *http.Request) {
+	var req pb.FindFulfillmentLocationRequest
+	if err := common.ReadJSON(r, &req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	if err := validateItems(req.Items); err != nil {
+		common.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	res, err := h.stockGateway.FindFulfillmentLocation(ctx, &req)
+	if err != nil {
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	}
+
+	common.WriteJSON(w, http.StatusOK, res)
+}
+
+func channelOrDefault(channel string) string {
+	if channel == "" {
+		return defaultChannel
+	}
+
+	return channel
+}
+
 func validateItems(items []*pb.ItemsWithQuantity) error {
 	if len(items) == 0 {
 		return common.ErrNoItems
@@ -123,3 +271,57 @@ func validateItems(items []*pb.ItemsWithQuantity) error {
 
 	return nil
 }
+
+// writeStatusError writes a gRPC error with the HTTP status that matches its
+// code. Orders rejected because of their items get the result of each line,
+// see writeStockCheckError.
+func writeStatusError(w http.ResponseWriter, err error) {
+	rStatus := status.Convert(err)
+
+	for _, d := range rStatus.Details() {
+		if failure, ok := d.(*pb.StockCheckFailure); ok {
+			writeStockCheckError(w, rStatus, failure)
+			return
+		}
+	}
+
+	httpStatus := http.StatusInternalServerError
+	switch rStatus.Code() {
+	case codes.InvalidArgument:
+		httpStatus = http.StatusBadRequest
+	case codes.NotFound:
+		httpStatus = http.StatusNotFound
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		httpStatus = http.StatusConflict
+	case codes.Unauthenticated:
+		httpStatus = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		httpStatus = http.StatusForbidden
+	}
+
+	common.WriteError(w, httpStatus, rStatus.Message())
+}
+
+// writeStockCheckError answers 422 when some items can't be ordered at all,
+// and 409 when they only lack stock, with every line so a UI can point at the
+// offending ones.
+func writeStockCheckError(w http.ResponseWriter, rStatus *status.Status, failure *pb.StockCheckFailure) {
+	httpStatus := http.StatusConflict
+	if rStatus.Code() == codes.InvalidArgument {
+		httpStatus = http.StatusUnprocessableEntity
+	}
+
+	// sold out items can be waited for, see handleJoinWaitlist
+	waitlist := []string{}
+	for _, l := range failure.Lines {
+		if l.Reason == "out_of_stock" {
+			waitlist = append(waitlist, l.ItemID)
+		}
+	}
+
+	common.WriteJSON(w, httpStatus, map[string]any{
+		"error":    rStatus.Message(),
+		"lines":    failure.Lines,
+		"waitlist": waitlist,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/scuba13/oms/common/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteStatusError(t *testing.T) {
+	failure := &pb.StockCheckFailure{Lines: []*pb.StockCheckLine{
+		{ItemID: "1", Found: true, Requested: 30, Available: 20, Reason: "insufficient_stock"},
+	}}
+	withLines := func(code codes.Code) error {
+		st, err := status.New(code, "some item is not in stock").WithDetails(failure)
+		if err != nil {
+			t.Fatalf("attaching the lines: %v", err)
+		}
+		return st.Err()
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		want      int
+		wantLines bool
+	}{
+		{"short stock", withLines(codes.FailedPrecondition), http.StatusConflict, true},
+		{"items that can't be ordered", withLines(codes.InvalidArgument), http.StatusUnprocessableEntity, true},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad"), http.StatusBadRequest, false},
+		{"not found", status.Error(codes.NotFound, "missing"), http.StatusNotFound, false},
+		{"internal", status.Error(codes.Internal, "boom"), http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeStatusError(w, tt.err)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+
+			var body struct {
+				Error string
+				Lines []*pb.StockCheckLine
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("decoding the body: %v", err)
+			}
+			if tt.wantLines && (len(body.Lines) != 1 || body.Lines[0].ItemID != "1" || body.Lines[0].Reason != "insufficient_stock") {
+				t.Errorf("got lines %+v, want the failed line", body.Lines)
+			}
+			if !tt.wantLines && len(body.Lines) > 0 {
+				t.Errorf("got lines %+v, want none", body.Lines)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"net/http"
+	"time"
 
 	//_ "github.com/joho/godotenv/autoload"
 	common "github.com/scuba13/oms/common"
@@ -60,10 +61,31 @@ func main() {
 	logger.Sugar().Infof("Service registered with Consul: %s", instanceID)
 	defer cancelMonitor()
 
+	// Admin routes stay closed until an admin token is set in Consul, the
+	// token is read again every adminTokenRefresh so it can be rotated
+	adminToken := NewAdminToken(registry)
+	if err := adminToken.Load(ctx); err != nil {
+		logger.Sugar().Warnf("Admin routes disabled until the token is read: %v", err)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(adminTokenRefresh):
+			}
+			if err := adminToken.Load(ctx); err != nil {
+				logger.Sugar().Warnf("Failed to reload the admin token: %v", err)
+			}
+		}
+	}()
+
 	// Set up HTTP server
 	mux := http.NewServeMux()
 	ordersGateway := gateway.NewGRPCGateway(registry)
-	handler := NewHandler(ordersGateway)
+	stockGateway := gateway.NewStockGateway(registry)
+	paymentsGateway := gateway.NewPaymentsGateway(registry)
+	handler := NewHandler(ordersGateway, stockGateway, paymentsGateway, adminToken)
 	handler.registerRoutes(mux)
 
 	server := common.SetupHTTPServer(httpAddr, mux)
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"go.opentelemetry.io/otel"
+	otelCodes "go.opentelemetry.io/otel/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// stockStreamFlushInterval is how often the stock stream sends what
+	// changed, only the latest update of an item is sent.
+	stockStreamFlushInterval = 500 * time.Millisecond
+	// stockStreamKeepAlive keeps idle streams open through proxies.
+	stockStreamKeepAlive = 15 * time.Second
+	// stockStreamRetry is how long browsers wait before reconnecting.
+	stockStreamRetry = 3 * time.Second
+)
+
+// stockBuffer keeps the latest update of each item until it is sent.
+type stockBuffer struct {
+	mu      sync.Mutex
+	pending map[string]*pb.StockUpdate
+	ready   chan struct{}
+}
+
+func newStockBuffer() *stockBuffer {
+	return &stockBuffer{
+		pending: make(map[string]*pb.StockUpdate),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (b *stockBuffer) put(u *pb.StockUpdate) error {
+	b.mu.Lock()
+	b.pending[u.ItemID] = u
+	b.mu.Unlock()
+
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// take empties the buffer, the updates come sorted by item ID.
+func (b *stockBuffer) take() []*pb.StockUpdate {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	updates := make([]*pb.StockUpdate, 0, len(b.pending))
+	for _, u := range b.pending {
+		updates = append(updates, u)
+	}
+	clear(b.pending)
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].ItemID < updates[j].ItemID
+	})
+
+	return updates
+}
+
+// handleWatchStock relays the stock of the items in the comma separated ids
+// query parameter as Server-Sent Events. Every watched item is sent first,
+// then the items whose available quantity or orderability changed, at most
+// once per item and flush interval. The stock is that of the locationID
+// query parameter, or of the default location.
+func (h *handler) handleWatchStock(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		common.WriteError(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		common.WriteError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	tr := otel.Tracer("http")
+	ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s %s", r.Method, r.RequestURI))
+	defer span.End()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	buf := newStockBuffer()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.stockGateway.WatchStock(ctx, &pb.WatchStockRequest{
+			ItemIDs:    ids,
+			LocationID: r.URL.Query().Get("locationID"),
+		}, buf.put)
+	}()
+
+	// the stream only starts once the stock service accepted the watch, so
+	// unknown items and locations still get an error status
+	select {
+	case <-buf.ready:
+	case err := <-done:
+		span.SetStatus(otelCodes.Error, err.Error())
+		writeStatusError(w, err)
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", stockStreamRetry.Milliseconds())
+	writeStockEvents(w, buf.take())
+	flusher.Flush()
+
+	flush := time.NewTicker(stockStreamFlushInterval)
+	defer flush.Stop()
+	keepAlive := time.NewTicker(stockStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-done:
+			// the browser reconnects and gets every item again
+			if ctx.Err() == nil {
+				span.SetStatus(otelCodes.Error, err.Error())
+				log.Printf("Stock stream of %v ended: %v", ids, err)
+			}
+			return
+		case <-flush.C:
+			if updates := buf.take(); len(updates) > 0 {
+				writeStockEvents(w, updates)
+				flusher.Flush()
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// stockEventJSON writes the zero values too, so a sold out item reads as
+// Available 0 and Orderable false rather than as missing fields.
+var stockEventJSON = protojson.MarshalOptions{EmitUnpopulated: true}
+
+func writeStockEvents(w http.ResponseWriter, updates []*pb.StockUpdate) {
+	for _, u := range updates {
+		data, err := stockEventJSON.Marshal(u)
+		if err != nil {
+			log.Printf("Failed to marshal the stock update of item %s: %v", u.ItemID, err)
+			continue
+		}
+
+		fmt.Fprintf(w, "event: stock\ndata: %s\n\n", data)
+	}
+}
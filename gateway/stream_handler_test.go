@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+func TestStockBufferKeepsLatest(t *testing.T) {
+	b := newStockBuffer()
+	b.put(&pb.StockUpdate{ItemID: "fries", Available: 3})
+	b.put(&pb.StockUpdate{ItemID: "burger", Available: 5})
+	b.put(&pb.StockUpdate{ItemID: "burger", Available: 4})
+
+	got := b.take()
+	if len(got) != 2 || got[0].ItemID != "burger" || got[0].Available != 4 || got[1].ItemID != "fries" {
+		t.Errorf("got updates %v, want the latest burger and the fries", got)
+	}
+	if got := b.take(); len(got) != 0 {
+		t.Errorf("got updates %v after taking them, want none", got)
+	}
+}
+
+func TestWriteStockEvents(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeStockEvents(w, []*pb.StockUpdate{{ItemID: "burger"}})
+
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "event: stock\ndata: ") || !strings.HasSuffix(body, "\n\n") {
+		t.Errorf("got %q, want a stock event", body)
+	}
+
+	var event map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(body), "event: stock\ndata: ")), &event); err != nil {
+		t.Fatalf("decoding the event: %v", err)
+	}
+	if available, ok := event["Available"]; !ok || available != 0.0 {
+		t.Errorf("got %q, want the sold out item's stock sent", body)
+	}
+}
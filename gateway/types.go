@@ -3,6 +3,6 @@ package main
 import pb "github.com/scuba13/oms/common/api"
 
 type CreateOrderRequest struct {
-	Order         *pb.Order `"json": order`
-	RedirectToURL string    `"json": redirectToURL`
+	Order         *pb.Order `json:"order"`
+	RedirectToURL string    `json:"redirectToURL"`
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"go.opentelemetry.io/otel"
+)
+
+// queueName is shared by every notifications instance, so each alert and
+// back in stock event is delivered once.
+const queueName = "notifications.stock_alerts"
+
+type Consumer struct {
+	notifier Notifier
+}
+
+func NewConsumer(notifier Notifier) *Consumer {
+	return &Consumer{notifier}
+}
+
+func (c *Consumer) Listen(ch *amqp.Channel) {
+	q, err := ch.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, event := range []string{broker.StockLowEvent, broker.StockDepletedEvent, broker.StockBackInStockEvent} {
+		err = ch.QueueBind(
+			q.Name,                     // queue name
+			event,                      // routing key
+			broker.StockAlertsExchange, // exchange
+			false,                      // no-wait
+			nil,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var forever chan struct{}
+
+	go func() {
+		for d := range msgs {
+			// Extract headers
+			ctx := broker.ExtractAMQPHeader(context.Background(), d.Headers)
+
+			// Create a new span
+			tr := otel.Tracer("amqp")
+			ctx, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", q.Name))
+
+			event := broker.DeliveryRoutingKey(&d)
+
+			itemID, err := c.handleEvent(ctx, event, d.Body)
+			if errors.Is(err, errMalformedEvent) {
+				log.Printf("failed to unmarshal %s: %v", event, err)
+				d.Nack(false, false)
+				messageSpan.End()
+				continue
+			}
+
+			if err != nil {
+				log.Printf("failed to notify %s for item %s: %v", event, itemID, err)
+
+				if err := broker.HandleQueueRetry(ch, &d, q.Name); err != nil {
+					log.Printf("Error handling retry: %v", err)
+					d.Nack(false, true)
+				} else {
+					d.Ack(false)
+				}
+
+				messageSpan.End()
+				continue
+			}
+
+			d.Ack(false)
+
+			messageSpan.AddEvent(fmt.Sprintf("%s notified: %s", event, itemID))
+			messageSpan.End()
+		}
+	}()
+
+	log.Printf("AMQP Listening. To exit press CTRL+C")
+	<-forever
+}
+
+var errMalformedEvent = errors.New("malformed event")
+
+// handleEvent hands an event to the notifier, returning the ID of the item
+// it is about.
+func (c *Consumer) handleEvent(ctx context.Context, event string, body []byte) (string, error) {
+	if event == broker.StockBackInStockEvent {
+		b := &pb.BackInStock{}
+		if err := json.Unmarshal(body, b); err != nil {
+			return "", fmt.Errorf("%w: %v", errMalformedEvent, err)
+		}
+
+		return b.ItemID, c.notifier.NotifyBackInStock(ctx, b)
+	}
+
+	a := &pb.StockAlert{}
+	if err := json.Unmarshal(body, a); err != nil {
+		return "", fmt.Errorf("%w: %v", errMalformedEvent, err)
+	}
+
+	return a.ItemID, c.notifier.NotifyStockAlert(ctx, event, a)
+}
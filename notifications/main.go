@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+
+	_ "github.com/joho/godotenv/autoload"
+	common "github.com/scuba13/oms/common"
+	"github.com/scuba13/oms/common/broker"
+	"go.uber.org/zap"
+)
+
+var (
+	serviceName = "notifications"
+	amqpUser    = common.EnvString("RABBITMQ_USER", "guest")
+	amqpPass    = common.EnvString("RABBITMQ_PASS", "guest")
+	amqpHost    = common.EnvString("RABBITMQ_HOST", "localhost")
+	amqpPort    = common.EnvString("RABBITMQ_PORT", "5672")
+	jaegerAddr  = common.EnvString("JAEGER_ADDR", "localhost:4318")
+	webhookURL  = common.EnvString("NOTIFICATIONS_WEBHOOK_URL", "")
+	smtpAddr    = common.EnvString("NOTIFICATIONS_SMTP_ADDR", "")
+	smtpFrom    = common.EnvString("NOTIFICATIONS_SMTP_FROM", "")
+	smtpUser    = common.EnvString("NOTIFICATIONS_SMTP_USER", "")
+	smtpPass    = common.EnvString("NOTIFICATIONS_SMTP_PASS", "")
+)
+
+func main() {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	zap.ReplaceGlobals(logger)
+
+	if err := common.SetGlobalTracer(context.TODO(), serviceName, jaegerAddr); err != nil {
+		logger.Fatal("could set global tracer", zap.Error(err))
+	}
+
+	ch, close := broker.Connect(amqpUser, amqpPass, amqpHost, amqpPort)
+	defer func() {
+		close()
+		ch.Close()
+	}()
+
+	var notifier Notifier = NewLogNotifier(logger)
+	if webhookURL != "" {
+		notifier = NewWebhookNotifier(webhookURL, notifier)
+	}
+	if smtpAddr != "" {
+		if smtpFrom == "" {
+			logger.Fatal("NOTIFICATIONS_SMTP_FROM is required to send emails")
+		}
+		notifier = NewEmailNotifier(SMTPConfig{
+			Addr:     smtpAddr,
+			From:     smtpFrom,
+			Username: smtpUser,
+			Password: smtpPass,
+		}, notifier, logger)
+	} else {
+		logger.Warn("NOTIFICATIONS_SMTP_ADDR is not set, customers are not told when items are back in stock")
+	}
+
+	consumer := NewConsumer(notifier)
+	consumer.Listen(ch)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"go.uber.org/zap"
+)
+
+// Notifier delivers the stock alerts to whoever has to act on them, and the
+// back in stock messages to the customers waiting for an item. Only the
+// customer channel gets the customers' contact details, staff channels are
+// told how many were waiting.
+type Notifier interface {
+	NotifyStockAlert(ctx context.Context, event string, a *pb.StockAlert) error
+	NotifyBackInStock(ctx context.Context, b *pb.BackInStock) error
+}
+
+type logNotifier struct {
+	logger *zap.Logger
+}
+
+func NewLogNotifier(logger *zap.Logger) *logNotifier {
+	return &logNotifier{logger}
+}
+
+func (n *logNotifier) NotifyStockAlert(ctx context.Context, event string, a *pb.StockAlert) error {
+	n.logger.Warn("Stock alert",
+		zap.String("event", event),
+		zap.String("itemID", a.ItemID),
+		zap.String("name", a.Name),
+		zap.Int32("available", a.Available),
+		zap.Int32("reorderThreshold", a.ReorderThreshold),
+	)
+
+	return nil
+}
+
+// NotifyBackInStock logs how many customers were waiting, the customers
+// themselves are only told through the customer channel.
+func (n *logNotifier) NotifyBackInStock(ctx context.Context, b *pb.BackInStock) error {
+	n.logger.Info("Back in stock",
+		zap.String("itemID", b.ItemID),
+		zap.String("name", b.Name),
+		zap.String("locationID", b.LocationID),
+		zap.Int("waiting", len(b.Waitlist)),
+	)
+
+	return nil
+}
+
+// webhookNotifier posts the alerts as JSON to an HTTP endpoint, such as a
+// chat incoming webhook, after handing them to the next notifier.
+type webhookNotifier struct {
+	url    string
+	next   Notifier
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string, next Notifier) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		next:   next,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *webhookNotifier) NotifyStockAlert(ctx context.Context, event string, a *pb.StockAlert) error {
+	if err := n.next.NotifyStockAlert(ctx, event, a); err != nil {
+		return err
+	}
+
+	return n.post(ctx, map[string]any{
+		"event": event,
+		"alert": a,
+		"text":  fmt.Sprintf("%s: %s (%s) has %d left", event, a.Name, a.ItemID, a.Available),
+	})
+}
+
+func (n *webhookNotifier) post(ctx context.Context, message map[string]any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+// NotifyBackInStock posts how many customers were waiting. The webhook is
+// read by staff, so the customers are left out of it.
+func (n *webhookNotifier) NotifyBackInStock(ctx context.Context, b *pb.BackInStock) error {
+	if err := n.next.NotifyBackInStock(ctx, b); err != nil {
+		return err
+	}
+
+	return n.post(ctx, map[string]any{
+		"event":      broker.StockBackInStockEvent,
+		"itemID":     b.ItemID,
+		"locationID": b.LocationID,
+		"waiting":    len(b.Waitlist),
+		"text":       fmt.Sprintf("%s is back in stock at %s, %d customers were waiting", b.Name, b.LocationID, len(b.Waitlist)),
+	})
+}
+
+// SMTPConfig is the mail server the customer messages are sent through.
+type SMTPConfig struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// emailNotifier tells the waiting customers by email that an item is back,
+// after handing the event to the next notifier. It is the only notifier
+// that sees their addresses.
+type emailNotifier struct {
+	config SMTPConfig
+	next   Notifier
+	logger *zap.Logger
+}
+
+func NewEmailNotifier(config SMTPConfig, next Notifier, logger *zap.Logger) *emailNotifier {
+	return &emailNotifier{config, next, logger}
+}
+
+func (n *emailNotifier) NotifyStockAlert(ctx context.Context, event string, a *pb.StockAlert) error {
+	return n.next.NotifyStockAlert(ctx, event, a)
+}
+
+// NotifyBackInStock sends one email per waiting customer. A failed email
+// retries the whole event, so customers before it may get the message twice.
+func (n *emailNotifier) NotifyBackInStock(ctx context.Context, b *pb.BackInStock) error {
+	if err := n.next.NotifyBackInStock(ctx, b); err != nil {
+		return err
+	}
+
+	skipped := 0
+	for _, e := range b.Waitlist {
+		if e.Email == "" {
+			skipped++
+			continue
+		}
+		if err := n.send(e.Email, fmt.Sprintf("%s is back in stock", b.Name),
+			fmt.Sprintf("Good news, %s is back in stock at %s.", b.Name, b.LocationID)); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		n.logger.Info("Back in stock customers without an email",
+			zap.String("itemID", b.ItemID),
+			zap.Int("skipped", skipped),
+		)
+	}
+
+	return nil
+}
+
+func (n *emailNotifier) send(to, subject, body string) error {
+	var auth smtp.Auth
+	if n.config.Username != "" {
+		host, _, err := net.SplitHostPort(n.config.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.config.Username, n.config.Password, host)
+	}
+
+	// item names end up in the subject, a line break would start a header
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", n.config.From, to, subject, body)
+
+	return smtp.SendMail(n.config.Addr, auth, n.config.From, []string{to}, []byte(message))
+}
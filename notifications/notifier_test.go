@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+)
+
+// notifierFunc lets a function stand in for the next notifier. Back in
+// stock messages are handed to it as a stock.back_in_stock alert.
+type notifierFunc func(ctx context.Context, event string, a *pb.StockAlert) error
+
+func (f notifierFunc) NotifyStockAlert(ctx context.Context, event string, a *pb.StockAlert) error {
+	return f(ctx, event, a)
+}
+
+func (f notifierFunc) NotifyBackInStock(ctx context.Context, b *pb.BackInStock) error {
+	return f(ctx, broker.StockBackInStockEvent, &pb.StockAlert{ItemID: b.ItemID, Name: b.Name, Available: b.Available})
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding the webhook body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	var forwarded int
+	next := notifierFunc(func(ctx context.Context, event string, a *pb.StockAlert) error {
+		forwarded++
+		return nil
+	})
+
+	n := NewWebhookNotifier(srv.URL, next)
+	a := &pb.StockAlert{ItemID: "burger", Name: "Burger", Available: 2, ReorderThreshold: 3}
+	if err := n.NotifyStockAlert(context.Background(), "stock.low", a); err != nil {
+		t.Fatalf("notifying: %v", err)
+	}
+	if forwarded != 1 {
+		t.Errorf("the next notifier got %d alerts, want 1", forwarded)
+	}
+	if want := "stock.low: Burger (burger) has 2 left"; got["event"] != "stock.low" || got["text"] != want {
+		t.Errorf("got body %v, want the stock.low event and text %q", got, want)
+	}
+}
+
+func TestWebhookNotifierErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ok := notifierFunc(func(ctx context.Context, event string, a *pb.StockAlert) error { return nil })
+	a := &pb.StockAlert{ItemID: "burger"}
+	if err := NewWebhookNotifier(srv.URL, ok).NotifyStockAlert(context.Background(), "stock.low", a); err == nil {
+		t.Error("notifying through a failing webhook succeeded")
+	}
+
+	// the webhook isn't called when the next notifier fails
+	var called bool
+	quiet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer quiet.Close()
+
+	failing := notifierFunc(func(ctx context.Context, event string, a *pb.StockAlert) error { return errors.New("log closed") })
+	if err := NewWebhookNotifier(quiet.URL, failing).NotifyStockAlert(context.Background(), "stock.low", a); err == nil {
+		t.Error("notifying after the next notifier failed succeeded")
+	}
+	if called {
+		t.Error("the webhook was called after the next notifier failed")
+	}
+}
+
+func TestWebhookNotifierBackInStock(t *testing.T) {
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the webhook body: %v", err)
+		}
+		posts = append(posts, string(body))
+	}))
+	defer srv.Close()
+
+	var forwarded int
+	next := notifierFunc(func(ctx context.Context, event string, a *pb.StockAlert) error {
+		forwarded++
+		return nil
+	})
+
+	b := &pb.BackInStock{ItemID: "burger", Name: "Burger", LocationID: "main", Waitlist: []*pb.WaitlistEntry{
+		{CustomerID: "c1", Email: "c1@example.com"},
+		{CustomerID: "c2"},
+	}}
+	if err := NewWebhookNotifier(srv.URL, next).NotifyBackInStock(context.Background(), b); err != nil {
+		t.Fatalf("notifying: %v", err)
+	}
+	if forwarded != 1 {
+		t.Errorf("the next notifier got %d events, want 1", forwarded)
+	}
+	if len(posts) != 1 {
+		t.Fatalf("got %d posts, want one for the item", len(posts))
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(posts[0]), &got); err != nil {
+		t.Fatalf("decoding the webhook body: %v", err)
+	}
+	if got["event"] != broker.StockBackInStockEvent || got["waiting"] != 2.0 {
+		t.Errorf("got body %v, want %s with 2 waiting", got, broker.StockBackInStockEvent)
+	}
+	if strings.Contains(posts[0], "c1") {
+		t.Errorf("got body %s, want the customers left out", posts[0])
+	}
+}
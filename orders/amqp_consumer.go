@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
@@ -26,9 +27,18 @@ func (c *consumer) Listen(ch *amqp.Channel) {
 		log.Fatal(err)
 	}
 
-	err = ch.QueueBind(q.Name, "", broker.OrderPaidEvent, false, nil)
-	if err != nil {
-		log.Fatal(err)
+	exchanges := []string{
+		broker.OrderPaidEvent,
+		broker.PaymentFailedEvent,
+		broker.PaymentExpiredEvent,
+		broker.PaymentRefundedEvent,
+		broker.PaymentDisputedEvent,
+	}
+	for _, exchange := range exchanges {
+		err = ch.QueueBind(q.Name, "", exchange, false, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
@@ -48,21 +58,40 @@ func (c *consumer) Listen(ch *amqp.Channel) {
 			tr := otel.Tracer("amqp")
 			_, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", q.Name))
 
-			o := &pb.Order{}
-			if err := json.Unmarshal(d.Body, o); err != nil {
+			event := broker.DeliveryExchange(&d)
+
+			o, err := orderUpdate(event, d.Body)
+			if err != nil {
 				d.Nack(false, false)
-				log.Printf("failed to unmarshal order: %v", err)
+				log.Printf("failed to unmarshal %s: %v", event, err)
+				messageSpan.End()
 				continue
 			}
 
-			_, err := c.service.UpdateOrder(context.Background(), o)
+			_, err = c.service.UpdateOrder(context.Background(), o)
+			if errors.Is(err, ErrOrderNotFound) || errors.Is(err, ErrInvalidStatus) {
+				// the order has moved on, such as a late payment event of a
+				// cancelled order
+				log.Printf("Skipping %s for order %s: %v", event, o.ID, err)
+				d.Ack(false)
+				messageSpan.End()
+				continue
+			}
+			if err == nil && releasesReservation(o.Status) {
+				// the order is updated again on the retry, which is harmless
+				err = publishOrderCancelled(ctx, ch, o)
+			}
 			if err != nil {
 				log.Printf("failed to update order: %v", err)
 
-				if err := broker.HandleRetry(ch, &d); err != nil {
+				if err := broker.HandleQueueRetry(ch, &d, q.Name); err != nil {
 					log.Printf("Error handling retry: %v", err)
+					d.Nack(false, true)
+				} else {
+					d.Ack(false)
 				}
 
+				messageSpan.End()
 				continue
 			}
 
@@ -76,3 +105,42 @@ func (c *consumer) Listen(ch *amqp.Channel) {
 
 	<-forever
 }
+
+// orderUpdate reads the order change carried by an event. order.paid carries
+// the order itself, the payment events carry the payment of an order.
+func orderUpdate(event string, body []byte) (*pb.Order, error) {
+	if event == broker.OrderPaidEvent {
+		o := &pb.Order{}
+		if err := json.Unmarshal(body, o); err != nil {
+			return nil, err
+		}
+
+		return o, nil
+	}
+
+	e := &pb.PaymentEvent{}
+	if err := json.Unmarshal(body, e); err != nil {
+		return nil, err
+	}
+
+	var status string
+	switch event {
+	case broker.PaymentFailedEvent:
+		status = "payment_failed"
+	case broker.PaymentExpiredEvent:
+		status = "payment_expired"
+	case broker.PaymentRefundedEvent:
+		// refunded or partially_refunded
+		status = e.Status
+	case broker.PaymentDisputedEvent:
+		status = "disputed"
+	default:
+		return nil, fmt.Errorf("unexpected event %s", event)
+	}
+
+	return &pb.Order{
+		ID:         e.OrderID,
+		CustomerID: e.CustomerID,
+		Status:     status,
+	}, nil
+}
@@ -2,10 +2,13 @@ package gateway
 
 import (
 	"context"
+	"time"
 
 	pb "github.com/scuba13/oms/common/api"
 )
 
 type StockGateway interface {
 	CheckIfItemIsInStock(ctx context.Context, customerID string, items []*pb.ItemsWithQuantity) (bool, []*pb.Item, error)
+	ReserveItems(ctx context.Context, orderID, locationID, channel string, items []*pb.ItemsWithQuantity, ttl time.Duration) (*pb.ReserveItemsResponse, error)
+	ReleaseReservation(ctx context.Context, orderID string) error
 }
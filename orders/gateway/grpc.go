@@ -3,6 +3,7 @@ package gateway
 import (
 	"context"
 	"log"
+	"time"
 
 	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/common/discovery"
@@ -31,3 +32,36 @@ func (g *Gateway) CheckIfItemIsInStock(ctx context.Context, customerID string, i
 
 	return res.InStock, res.Items, err
 }
+
+func (g *Gateway) ReserveItems(ctx context.Context, orderID, locationID, channel string, items []*pb.ItemsWithQuantity, ttl time.Duration) (*pb.ReserveItemsResponse, error) {
+	conn, err := discovery.ServiceConnection(context.Background(), "stock", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewStockServiceClient(conn)
+
+	return c.ReserveItems(ctx, &pb.ReserveItemsRequest{
+		OrderID:    orderID,
+		Items:      items,
+		TTLSeconds: int64(ttl.Seconds()),
+		LocationID: locationID,
+		Channel:    channel,
+	})
+}
+
+func (g *Gateway) ReleaseReservation(ctx context.Context, orderID string) error {
+	conn, err := discovery.ServiceConnection(context.Background(), "stock", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewStockServiceClient(conn)
+
+	_, err = c.ReleaseReservation(ctx, &pb.ReleaseReservationRequest{
+		OrderID: orderID,
+	})
+	return err
+}
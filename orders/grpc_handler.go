@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/common/broker"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type grpcHandler struct {
@@ -29,7 +33,47 @@ func NewGRPCHandler(grpcServer *grpc.Server, service OrdersService, channel *amq
 }
 
 func (h *grpcHandler) UpdateOrder(ctx context.Context, p *pb.Order) (*pb.Order, error) {
-	return h.service.UpdateOrder(ctx, p)
+	o, err := h.service.UpdateOrder(ctx, p)
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrInvalidStatus):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	// let the stock service give back the items held for the order
+	if releasesReservation(o.Status) {
+		if err := publishOrderCancelled(ctx, h.channel, o); err != nil {
+			log.Printf("Failed to publish %s for order %s: %v", broker.OrderCancelledEvent, o.ID, err)
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// publishOrderCancelled tells the stock service to release the items held
+// for an order.
+func publishOrderCancelled(ctx context.Context, ch *amqp.Channel, o *pb.Order) error {
+	tr := otel.Tracer("amqp")
+	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", broker.OrderCancelledEvent))
+	defer messageSpan.End()
+
+	marshalledOrder, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	headers := broker.InjectAMQPHeaders(amqpContext)
+
+	return ch.PublishWithContext(amqpContext, broker.OrderCancelledEvent, "", false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         marshalledOrder,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
 }
 
 func (h *grpcHandler) GetOrder(ctx context.Context, p *pb.GetOrderRequest) (*pb.Order, error) {
@@ -52,9 +96,10 @@ func (h *grpcHandler) CreateOrder(ctx context.Context, p *pb.CreateOrderRequest)
 	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", q.Name))
 	defer messageSpan.End()
 
-	// Step 3: Validate order
+	// Step 3: Validate order, reserving its items under the new order ID
 	log.Println("Validating order")
-	items, err := h.service.ValidateOrder(amqpContext, p)
+	orderID := primitive.NewObjectID().Hex()
+	items, err := h.service.ValidateOrder(amqpContext, orderID, p)
 	if err != nil {
 		log.Printf("Order validation failed: %v", err)
 		return nil, err
@@ -62,7 +107,7 @@ func (h *grpcHandler) CreateOrder(ctx context.Context, p *pb.CreateOrderRequest)
 
 	// Step 4: Create order
 	log.Println("Creating order")
-	o, err := h.service.CreateOrder(amqpContext, p, items)
+	o, err := h.service.CreateOrder(amqpContext, orderID, p, items)
 	if err != nil {
 		log.Printf("Order creation failed: %v", err)
 		return nil, err
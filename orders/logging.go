@@ -34,20 +34,20 @@ func (s *LoggingMiddleware) UpdateOrder(ctx context.Context, o *pb.Order) (*pb.O
 	return s.next.UpdateOrder(ctx, o)
 }
 
-func (s *LoggingMiddleware) CreateOrder(ctx context.Context, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error) {
+func (s *LoggingMiddleware) CreateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error) {
 	start := time.Now()
 	defer func() {
 		zap.L().Info("CreateOrder", zap.Duration("took", time.Since(start)))
 	}()
 
-	return s.next.CreateOrder(ctx, p, items)
+	return s.next.CreateOrder(ctx, orderID, p, items)
 }
 
-func (s *LoggingMiddleware) ValidateOrder(ctx context.Context, p *pb.CreateOrderRequest) ([]*pb.Item, error) {
+func (s *LoggingMiddleware) ValidateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest) ([]*pb.Item, error) {
 	start := time.Now()
 	defer func() {
 		zap.L().Info("ValidateOrder", zap.Duration("took", time.Since(start)))
 	}()
 
-	return s.next.ValidateOrder(ctx, p)
+	return s.next.ValidateOrder(ctx, orderID, p)
 }
@@ -20,17 +20,18 @@ import (
 )
 
 var (
-	serviceName = "orders"
-	grpcAddr    = common.EnvString("GRPC_ADDR", "localhost:2000")
-	consulAddr  = common.EnvString("CONSUL_ADDR", "localhost:8500")
-	amqpUser    = common.EnvString("RABBITMQ_USER", "guest")
-	amqpPass    = common.EnvString("RABBITMQ_PASS", "guest")
-	amqpHost    = common.EnvString("RABBITMQ_HOST", "localhost")
-	amqpPort    = common.EnvString("RABBITMQ_PORT", "5672")
-	mongoUser   = common.EnvString("MONGO_DB_USER", "root")
-	mongoPass   = common.EnvString("MONGO_DB_PASS", "example")
-	mongoAddr   = common.EnvString("MONGO_DB_HOST", "localhost:27017")
-	jaegerAddr  = common.EnvString("JAEGER_ADDR", "localhost:4318")
+	serviceName    = "orders"
+	grpcAddr       = common.EnvString("GRPC_ADDR", "localhost:2000")
+	consulAddr     = common.EnvString("CONSUL_ADDR", "localhost:8500")
+	amqpUser       = common.EnvString("RABBITMQ_USER", "guest")
+	amqpPass       = common.EnvString("RABBITMQ_PASS", "guest")
+	amqpHost       = common.EnvString("RABBITMQ_HOST", "localhost")
+	amqpPort       = common.EnvString("RABBITMQ_PORT", "5672")
+	mongoUser      = common.EnvString("MONGO_DB_USER", "root")
+	mongoPass      = common.EnvString("MONGO_DB_PASS", "example")
+	mongoAddr      = common.EnvString("MONGO_DB_HOST", "localhost:27017")
+	jaegerAddr     = common.EnvString("JAEGER_ADDR", "localhost:4318")
+	reservationTTL = common.EnvString("STOCK_RESERVATION_TTL", "30m")
 )
 
 func main() {
@@ -86,10 +87,15 @@ func main() {
 	}
 	defer l.Close()
 
+	ttl, err := time.ParseDuration(reservationTTL)
+	if err != nil {
+		logger.Fatal("invalid stock reservation TTL", zap.Error(err))
+	}
+
 	gateway := gateway.NewGateway(registry)
 
 	store := NewStore(mongoClient)
-	svc := NewService(store, gateway)
+	svc := NewService(store, gateway, ttl)
 	svcWithTelemetry := NewTelemetryMiddleware(svc)
 	svcWithLogging := NewLoggingMiddleware(svcWithTelemetry)
 
@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
+	"log"
+	"time"
 
 	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/orders/gateway"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type service struct {
-	store   OrdersStore
-	gateway gateway.StockGateway
+	store          OrdersStore
+	gateway        gateway.StockGateway
+	reservationTTL time.Duration
 }
 
-func NewService(store OrdersStore, gateway gateway.StockGateway) *service {
-	return &service{store, gateway}
+func NewService(store OrdersStore, gateway gateway.StockGateway, reservationTTL time.Duration) *service {
+	return &service{store, gateway, reservationTTL}
 }
 
 func (s *service) GetOrder(ctx context.Context, p *pb.GetOrderRequest) (*pb.Order, error) {
@@ -27,7 +33,15 @@ func (s *service) GetOrder(ctx context.Context, p *pb.GetOrderRequest) (*pb.Orde
 }
 
 func (s *service) UpdateOrder(ctx context.Context, o *pb.Order) (*pb.Order, error) {
-	err := s.store.Update(ctx, o.ID, o)
+	var from []string
+	if o.Status != "" {
+		var ok bool
+		if from, ok = allowedFrom(o.Status); !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown order status %q", o.Status)
+		}
+	}
+
+	err := s.store.Update(ctx, o.ID, o, from)
 	if err != nil {
 		return nil, err
 	}
@@ -35,44 +49,90 @@ func (s *service) UpdateOrder(ctx context.Context, o *pb.Order) (*pb.Order, erro
 	return o, nil
 }
 
-func (s *service) CreateOrder(ctx context.Context, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error) {
+func (s *service) CreateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error) {
+	oID, err := primitive.ObjectIDFromHex(orderID)
+	if err != nil {
+		return nil, err
+	}
+
 	id, err := s.store.Create(ctx, Order{
-		CustomerID:  p.CustomerID,
-		Status:      "pending",
-		Items:       items,
-		PaymentLink: "",
+		ID:            oID,
+		CustomerID:    p.CustomerID,
+		Status:        "pending",
+		Items:         items,
+		PaymentLink:   "",
+		LocationID:    p.LocationID,
+		Channel:       p.Channel,
+		PaymentMethod: common.PaymentMethodOrDefault(p.PaymentMethod),
 	})
 	if err != nil {
+		// the items were reserved during validation
+		if err := s.gateway.ReleaseReservation(ctx, orderID); err != nil {
+			log.Printf("failed to release reservation of order %s: %v", orderID, err)
+		}
 		return nil, err
 	}
 
 	o := &pb.Order{
-		ID:         id.Hex(),
-		CustomerID: p.CustomerID,
-		Status:     "pending",
-		Items:      items,
+		ID:            id.Hex(),
+		CustomerID:    p.CustomerID,
+		Status:        "pending",
+		Items:         items,
+		LocationID:    p.LocationID,
+		Channel:       p.Channel,
+		PaymentMethod: common.PaymentMethodOrDefault(p.PaymentMethod),
 	}
 
 	return o, nil
 }
 
-func (s *service) ValidateOrder(ctx context.Context, p *pb.CreateOrderRequest) ([]*pb.Item, error) {
+func (s *service) ValidateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest) ([]*pb.Item, error) {
 	if len(p.Items) == 0 {
 		return nil, common.ErrNoItems
 	}
+	if !common.IsValidPaymentMethod(p.PaymentMethod) {
+		return nil, status.Error(codes.InvalidArgument, common.ErrInvalidPaymentMethod.Error())
+	}
 
 	mergedItems := mergeItemsQuantities(p.Items)
 
-	// validate with the stock service
-	inStock, items, err := s.gateway.CheckIfItemIsInStock(ctx, p.CustomerID, mergedItems)
+	// validate with the stock service, holding the items until the order is
+	// paid, cancelled or the reservation expires. The items come back with
+	// the prices of the channel at this moment, which the order keeps.
+	res, err := s.gateway.ReserveItems(ctx, orderID, p.LocationID, p.Channel, mergedItems, s.reservationTTL)
 	if err != nil {
 		return nil, err
 	}
-	if !inStock {
-		return items, common.ErrNoStock
+	if !res.Reserved {
+		return nil, stockCheckError(res.Lines)
+	}
+	// the order keeps the location its items are held at
+	if res.LocationID != "" {
+		p.LocationID = res.LocationID
+	}
+
+	return res.Items, nil
+}
+
+// stockCheckError is the status of an order rejected because of its items,
+// with the result of each line attached as a StockCheckFailure. Unknown,
+// unorderable or unavailable items make the request invalid, the rest is a
+// stock conflict.
+func stockCheckError(lines []*pb.StockCheckLine) error {
+	code := codes.FailedPrecondition
+	for _, l := range lines {
+		switch l.Reason {
+		case "not_found", "archived", "not_orderable", "unavailable":
+			code = codes.InvalidArgument
+		}
+	}
+
+	st, err := status.New(code, common.ErrNoStock.Error()).WithDetails(&pb.StockCheckFailure{Lines: lines})
+	if err != nil {
+		return status.Error(code, common.ErrNoStock.Error())
 	}
 
-	return items, nil
+	return st.Err()
 }
 
 func mergeItemsQuantities(items []*pb.ItemsWithQuantity) []*pb.ItemsWithQuantity {
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/orders/gateway"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStockCheckError(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   codes.Code
+	}{
+		{"out_of_stock", codes.FailedPrecondition},
+		{"insufficient_stock", codes.FailedPrecondition},
+		{"not_found", codes.InvalidArgument},
+		{"archived", codes.InvalidArgument},
+		{"not_orderable", codes.InvalidArgument},
+		{"unavailable", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			lines := []*pb.StockCheckLine{
+				{ItemID: "1", Found: true, Requested: 1, Available: 5},
+				{ItemID: "2", Requested: 1, Reason: tt.reason},
+			}
+			st := status.Convert(stockCheckError(lines))
+
+			if st.Code() != tt.want {
+				t.Errorf("got code %s, want %s", st.Code(), tt.want)
+			}
+
+			var failure *pb.StockCheckFailure
+			for _, d := range st.Details() {
+				if f, ok := d.(*pb.StockCheckFailure); ok {
+					failure = f
+				}
+			}
+			if failure == nil || len(failure.Lines) != 2 || failure.Lines[1].Reason != tt.reason {
+				t.Errorf("got details %v, want both lines", st.Details())
+			}
+		})
+	}
+}
+
+// reservingGateway answers reservations with the location it was built
+// with, the other calls aren't expected.
+type reservingGateway struct {
+	gateway.StockGateway
+	locationID string
+}
+
+func (g *reservingGateway) ReserveItems(ctx context.Context, orderID, locationID, channel string, items []*pb.ItemsWithQuantity, ttl time.Duration) (*pb.ReserveItemsResponse, error) {
+	return &pb.ReserveItemsResponse{Reserved: true, LocationID: g.locationID}, nil
+}
+
+func TestValidateOrderKeepsLocation(t *testing.T) {
+	s := NewService(nil, &reservingGateway{locationID: "main"}, time.Minute)
+
+	p := &pb.CreateOrderRequest{CustomerID: "c1", Items: []*pb.ItemsWithQuantity{{ID: "1", Quantity: 1}}}
+	if _, err := s.ValidateOrder(context.Background(), "o1", p); err != nil {
+		t.Fatalf("validating: %v", err)
+	}
+	if p.LocationID != "main" {
+		t.Errorf("the order is at %q, want the location its items were reserved at", p.LocationID)
+	}
+}
+
+// memoryStore keeps the status and payment link of orders, updating them
+// the way the Mongo store does.
+type memoryStore struct {
+	orders map[string]*Order
+}
+
+func (s *memoryStore) Create(ctx context.Context, o Order) (primitive.ObjectID, error) {
+	s.orders[o.ID.Hex()] = &o
+	return o.ID, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id, customerID string) (*Order, error) {
+	o, ok := s.orders[id]
+	if !ok || o.CustomerID != customerID {
+		return nil, ErrOrderNotFound
+	}
+
+	return o, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, newOrder *pb.Order, allowedFrom []string) error {
+	o, ok := s.orders[id]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if len(allowedFrom) > 0 && !slices.Contains(allowedFrom, o.Status) {
+		return ErrInvalidStatus
+	}
+
+	if newOrder.PaymentLink != "" {
+		o.PaymentLink = newOrder.PaymentLink
+	}
+	if newOrder.Status != "" {
+		o.Status = newOrder.Status
+	}
+	return nil
+}
+
+func TestUpdateOrder(t *testing.T) {
+	ctx := context.Background()
+	id := primitive.NewObjectID()
+	store := &memoryStore{orders: map[string]*Order{}}
+	if _, err := store.Create(ctx, Order{ID: id, CustomerID: "c1", Status: "pending"}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(store, nil, time.Minute)
+
+	steps := []struct {
+		update  *pb.Order
+		want    string
+		wantErr error
+	}{
+		{&pb.Order{ID: id.Hex(), Status: "waiting_payment", PaymentLink: "https://pay"}, "waiting_payment", nil},
+		// a payment event carries no link, the order keeps its own
+		{&pb.Order{ID: id.Hex(), Status: "payment_expired"}, "payment_expired", nil},
+		{&pb.Order{ID: id.Hex(), Status: "payment_expired"}, "payment_expired", nil},
+		{&pb.Order{ID: id.Hex(), Status: "paid"}, "payment_expired", ErrInvalidStatus},
+		{&pb.Order{ID: id.Hex(), Status: "cancelled"}, "payment_expired", ErrInvalidStatus},
+		{&pb.Order{ID: primitive.NewObjectID().Hex(), Status: "paid"}, "payment_expired", ErrOrderNotFound},
+	}
+	for n, step := range steps {
+		if _, err := s.UpdateOrder(ctx, step.update); !errors.Is(err, step.wantErr) {
+			t.Fatalf("step %d: updating to %s returned %v, want %v", n, step.update.Status, err, step.wantErr)
+		}
+
+		o, _ := store.Get(ctx, id.Hex(), "c1")
+		if o.Status != step.want || o.PaymentLink != "https://pay" {
+			t.Fatalf("step %d: the order is %s with link %q, want %s with its link", n, o.Status, o.PaymentLink, step.want)
+		}
+	}
+
+	if _, err := s.UpdateOrder(ctx, &pb.Order{ID: id.Hex(), Status: "lost"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("updating to an unknown status returned %v, want %s", err, codes.InvalidArgument)
+	}
+}
+
+func TestUpdateOrderHeld(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{orders: map[string]*Order{}}
+	s := NewService(store, nil, time.Minute)
+
+	held := func() string {
+		id := primitive.NewObjectID()
+		if _, err := store.Create(ctx, Order{ID: id, CustomerID: "c1", Status: "pending"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpdateOrder(ctx, &pb.Order{ID: id.Hex(), Status: "on_hold"}); err != nil {
+			t.Fatalf("holding the order: %v", err)
+		}
+		return id.Hex()
+	}
+
+	// a held order has no link to pay with
+	id := held()
+	if _, err := s.UpdateOrder(ctx, &pb.Order{ID: id, Status: "paid"}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("paying a held order returned %v, want %v", err, ErrInvalidStatus)
+	}
+
+	// a review releases it to payment, or rejects it
+	for _, status := range []string{"waiting_payment", "payment_failed", "cancelled"} {
+		id := held()
+		if _, err := s.UpdateOrder(ctx, &pb.Order{ID: id, Status: status}); err != nil {
+			t.Errorf("moving a held order to %s: %v", status, err)
+		}
+		if _, err := s.UpdateOrder(ctx, &pb.Order{ID: id, Status: "on_hold"}); !errors.Is(err, ErrInvalidStatus) {
+			t.Errorf("holding a %s order again returned %v, want %v", status, err, ErrInvalidStatus)
+		}
+	}
+}
+
+func TestOrderUpdate(t *testing.T) {
+	tests := []struct {
+		event      string
+		body       string
+		wantStatus string
+		releases   bool
+	}{
+		{broker.OrderPaidEvent, `{"ID":"o1","Status":"paid"}`, "paid", false},
+		{broker.PaymentFailedEvent, `{"OrderID":"o1","Status":"failed"}`, "payment_failed", true},
+		{broker.PaymentExpiredEvent, `{"OrderID":"o1","Status":"expired"}`, "payment_expired", true},
+		{broker.PaymentRefundedEvent, `{"OrderID":"o1","Status":"partially_refunded"}`, "partially_refunded", false},
+		{broker.PaymentDisputedEvent, `{"OrderID":"o1","Status":"disputed"}`, "disputed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			o, err := orderUpdate(tt.event, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("reading the event: %v", err)
+			}
+			if o.ID != "o1" || o.Status != tt.wantStatus {
+				t.Errorf("got order %s %s, want o1 %s", o.ID, o.Status, tt.wantStatus)
+			}
+			if releasesReservation(o.Status) != tt.releases {
+				t.Errorf("%s releases the reservation: %v, want %v", o.Status, !tt.releases, tt.releases)
+			}
+		})
+	}
+
+	if _, err := orderUpdate("order.unknown", []byte(`{}`)); err == nil {
+		t.Error("reading an unknown event succeeded")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrInvalidStatus = errors.New("invalid order status transition")
+)
+
+// orderTransitions are the statuses an order can move to each status from.
+// Every status can be set again, so an update delivered twice succeeds. An
+// order put on_hold by the payment risk checks has no payment link until a
+// review releases it, or fails its payment.
+var orderTransitions = map[string][]string{
+	"on_hold":            {"pending"},
+	"waiting_payment":    {"pending", "on_hold"},
+	"paid":               {"pending", "waiting_payment"},
+	"ready":              {"paid"},
+	"cancelled":          {"pending", "waiting_payment", "on_hold"},
+	"payment_failed":     {"pending", "waiting_payment", "on_hold"},
+	"payment_expired":    {"pending", "waiting_payment"},
+	"partially_refunded": {"paid", "ready", "disputed"},
+	"refunded":           {"paid", "ready", "partially_refunded", "disputed"},
+	"disputed":           {"paid", "ready", "partially_refunded", "refunded"},
+}
+
+// allowedFrom returns the statuses an order can be moved to status from.
+func allowedFrom(status string) ([]string, bool) {
+	from, ok := orderTransitions[status]
+	if !ok {
+		return nil, false
+	}
+
+	return append(slices.Clone(from), status), true
+}
+
+// releasesReservation tells whether an order moved to status gives back the
+// items held for it. A failed or expired payment isn't retried, so its
+// order is as good as cancelled.
+func releasesReservation(status string) bool {
+	switch status {
+	case "cancelled", "payment_failed", "payment_expired":
+		return true
+	}
+
+	return false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 
 	pb "github.com/scuba13/oms/common/api"
 	"go.mongodb.org/mongo-driver/bson"
@@ -26,9 +27,12 @@ func (s *store) Create(ctx context.Context, o Order) (primitive.ObjectID, error)
 	col := s.db.Database(DbName).Collection(CollName)
 
 	newOrder, err := col.InsertOne(ctx, o)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
 
 	id := newOrder.InsertedID.(primitive.ObjectID)
-	return id, err
+	return id, nil
 }
 
 func (s *store) Get(ctx context.Context, id, customerID string) (*Order, error) {
@@ -45,17 +49,48 @@ func (s *store) Get(ctx context.Context, id, customerID string) (*Order, error)
 	return &o, err
 }
 
-func (s *store) Update(ctx context.Context, id string, newOrder *pb.Order) error {
+// Update sets the status and payment link the order update carries, leaving
+// out the empty ones. With allowedFrom the order is only updated from one of
+// those statuses.
+func (s *store) Update(ctx context.Context, id string, newOrder *pb.Order, allowedFrom []string) error {
 	col := s.db.Database(DbName).Collection(CollName)
 
-	oID, _ := primitive.ObjectIDFromHex(id)
-
-	_, err := col.UpdateOne(ctx,
-		bson.M{"_id": oID},
-		bson.M{"$set": bson.M{
-			"paymentLink": newOrder.PaymentLink,
-			"status":      newOrder.Status,
-		}})
-
-	return err
+	oID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrOrderNotFound
+	}
+
+	set := bson.M{}
+	if newOrder.PaymentLink != "" {
+		set["paymentLink"] = newOrder.PaymentLink
+	}
+	if newOrder.Status != "" {
+		set["status"] = newOrder.Status
+	}
+	if len(set) == 0 {
+		return nil
+	}
+
+	filter := bson.M{"_id": oID}
+	if len(allowedFrom) > 0 {
+		filter["status"] = bson.M{"$in": allowedFrom}
+	}
+
+	res, err := col.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		// either there is no such order or it has moved on
+		n, err := col.CountDocuments(ctx, bson.M{"_id": oID})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrOrderNotFound
+		}
+		return fmt.Errorf("%w: order %s can't move to %s", ErrInvalidStatus, id, newOrder.Status)
+	}
+
+	return nil
 }
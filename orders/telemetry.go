@@ -30,16 +30,16 @@ func (s *TelemetryMiddleware) UpdateOrder(ctx context.Context, o *pb.Order) (*pb
 	return s.next.UpdateOrder(ctx, o)
 }
 
-func (s *TelemetryMiddleware) CreateOrder(ctx context.Context, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error) {
+func (s *TelemetryMiddleware) CreateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error) {
 	span := trace.SpanFromContext(ctx)
-	span.AddEvent(fmt.Sprintf("CreateOrder: %v, items: %v", p, items))
+	span.AddEvent(fmt.Sprintf("CreateOrder: %s, %v, items: %v", orderID, p, items))
 
-	return s.next.CreateOrder(ctx, p, items)
+	return s.next.CreateOrder(ctx, orderID, p, items)
 }
 
-func (s *TelemetryMiddleware) ValidateOrder(ctx context.Context, p *pb.CreateOrderRequest) ([]*pb.Item, error) {
+func (s *TelemetryMiddleware) ValidateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest) ([]*pb.Item, error) {
 	span := trace.SpanFromContext(ctx)
-	span.AddEvent(fmt.Sprintf("ValidateOrder: %v", p))
+	span.AddEvent(fmt.Sprintf("ValidateOrder: %s, %v", orderID, p))
 
-	return s.next.ValidateOrder(ctx, p)
+	return s.next.ValidateOrder(ctx, orderID, p)
 }
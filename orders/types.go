@@ -3,21 +3,30 @@ package main
 import (
 	"context"
 
+	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type OrdersService interface {
-	CreateOrder(context.Context, *pb.CreateOrderRequest, []*pb.Item) (*pb.Order, error)
-	ValidateOrder(context.Context, *pb.CreateOrderRequest) ([]*pb.Item, error)
+	CreateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest, items []*pb.Item) (*pb.Order, error)
+	// ValidateOrder checks the order items against the stock and reserves
+	// them under the given order ID. The request LocationID is set to the
+	// location the items were reserved at.
+	ValidateOrder(ctx context.Context, orderID string, p *pb.CreateOrderRequest) ([]*pb.Item, error)
 	GetOrder(context.Context, *pb.GetOrderRequest) (*pb.Order, error)
+	// UpdateOrder sets the status and payment link of an order, leaving out
+	// the empty ones. An order can only move to a status from the statuses
+	// leading to it, ErrInvalidStatus tells it has moved on.
 	UpdateOrder(context.Context, *pb.Order) (*pb.Order, error)
 }
 
 type OrdersStore interface {
 	Create(context.Context, Order) (primitive.ObjectID, error)
 	Get(ctx context.Context, id, customerID string) (*Order, error)
-	Update(ctx context.Context, id string, o *pb.Order) error
+	// Update sets the status and payment link of o on the order, when its
+	// status is one of allowedFrom. Without allowedFrom any status is.
+	Update(ctx context.Context, id string, o *pb.Order, allowedFrom []string) error
 }
 
 type Order struct {
@@ -26,13 +35,22 @@ type Order struct {
 	Status      string             `bson:"status,omitempty"`
 	PaymentLink string             `bson:"paymentLink,omitempty"`
 	Items       []*pb.Item         `bson:"items,omitempty"`
+	LocationID  string             `bson:"locationID,omitempty"`
+	Channel     string             `bson:"channel,omitempty"`
+	// PaymentMethod is empty for orders placed before payment methods, they
+	// were paid by card.
+	PaymentMethod string `bson:"paymentMethod,omitempty"`
 }
 
 func (o *Order) ToProto() *pb.Order {
 	return &pb.Order{
-		ID:          o.ID.Hex(),
-		CustomerID:  o.CustomerID,
-		Status:      o.Status,
-		PaymentLink: o.PaymentLink,
+		ID:            o.ID.Hex(),
+		CustomerID:    o.CustomerID,
+		Status:        o.Status,
+		PaymentLink:   o.PaymentLink,
+		Items:         o.Items,
+		LocationID:    o.LocationID,
+		Channel:       o.Channel,
+		PaymentMethod: common.PaymentMethodOrDefault(o.PaymentMethod),
 	}
 }
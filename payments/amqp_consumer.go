@@ -3,21 +3,25 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
 	"go.opentelemetry.io/otel"
 )
 
 type consumer struct {
-	service PaymentsService
+	service   PaymentsService
+	publisher EventPublisher
 }
 
-func NewConsumer(service PaymentsService) *consumer {
-	return &consumer{service}
+func NewConsumer(service PaymentsService, publisher EventPublisher) *consumer {
+	return &consumer{service, publisher}
 }
 
 func (c *consumer) Listen(ch *amqp.Channel) {
@@ -39,25 +43,23 @@ func (c *consumer) Listen(ch *amqp.Channel) {
 			ctx := broker.ExtractAMQPHeader(context.Background(), d.Headers)
 
 			tr := otel.Tracer("amqp")
-			_, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", q.Name))
+			ctx, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", q.Name))
 
 			o := &pb.Order{}
 			if err := json.Unmarshal(d.Body, o); err != nil {
 				d.Nack(false, false)
 				log.Printf("failed to unmarshal order: %v", err)
+				messageSpan.End()
 				continue
 			}
 
-			paymentLink, err := c.service.CreatePayment(context.Background(), o)
+			paymentLink, err := c.service.CreatePayment(ctx, o)
 			if err != nil {
 				log.Printf("failed to create payment: %v", err)
 
-				if err := broker.HandleRetry(ch, &d); err != nil {
-					log.Printf("Error handling retry: %v", err)
-				}
-
-				d.Nack(false, false)
+				c.handleCreateError(ctx, ch, &d, o, err)
 
+				messageSpan.End()
 				continue
 			}
 
@@ -71,3 +73,52 @@ func (c *consumer) Listen(ch *amqp.Channel) {
 
 	<-forever
 }
+
+// handleCreateError decides what becomes of an order whose payment could not
+// be created, from the kind of processor error. Requests the processor
+// refused for good fail the payment of the order right away, as retrying
+// can't help. Authentication errors go to the DLQ, to be replayed once the
+// credentials are fixed. Anything else, such as timeouts or the database
+// being down, is retried and dead-lettered after broker.MaxRetryCount
+// attempts.
+func (c *consumer) handleCreateError(ctx context.Context, ch *amqp.Channel, d *amqp.Delivery, o *pb.Order, err error) {
+	switch {
+	case errors.Is(err, processor.ErrInvalidRequest), errors.Is(err, processor.ErrPermanent):
+		log.Printf("Failing the payment of order %s: %v", o.ID, err)
+
+		e := &pb.PaymentEvent{
+			OrderID:    o.ID,
+			CustomerID: o.CustomerID,
+			Status:     string(PaymentFailed),
+			Reason:     err.Error(),
+			CreatedAt:  time.Now().Unix(),
+		}
+		if err := c.publisher.Publish(ctx, broker.PaymentFailedEvent, e); err != nil {
+			log.Printf("failed to publish %s for order %s: %v", broker.PaymentFailedEvent, o.ID, err)
+			retry(ch, d)
+			return
+		}
+
+		d.Ack(false)
+	case errors.Is(err, processor.ErrAuth):
+		if err := broker.DeadLetter(ch, d, err.Error()); err != nil {
+			log.Printf("Error moving message to DLQ: %v", err)
+			d.Nack(false, true)
+			return
+		}
+
+		d.Ack(false)
+	default:
+		retry(ch, d)
+	}
+}
+
+func retry(ch *amqp.Channel, d *amqp.Delivery) {
+	if err := broker.HandleRetry(ch, d); err != nil {
+		log.Printf("Error handling retry: %v", err)
+		d.Nack(false, true)
+		return
+	}
+
+	d.Ack(false)
+}
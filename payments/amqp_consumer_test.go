@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+)
+
+// memoryAcknowledger records how a delivery was settled.
+type memoryAcknowledger struct {
+	acked, nacked bool
+}
+
+func (a *memoryAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *memoryAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	return nil
+}
+
+func (a *memoryAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacked = true
+	return nil
+}
+
+func TestHandleCreateErrorRefused(t *testing.T) {
+	for _, kind := range []error{processor.ErrInvalidRequest, processor.ErrPermanent} {
+		publisher := &memoryPublisher{}
+		c := NewConsumer(nil, publisher)
+		ack := &memoryAcknowledger{}
+		o := &pb.Order{ID: "order-1", CustomerID: "customer-1"}
+
+		// a refused request fails the payment without touching the channel
+		c.handleCreateError(context.Background(), nil, &amqp.Delivery{Acknowledger: ack}, o, processor.NewError(kind, errors.New("no such price")))
+
+		events := publisher.published(broker.PaymentFailedEvent)
+		if len(events) != 1 {
+			t.Fatalf("published %d %s for %v, want 1", len(events), broker.PaymentFailedEvent, kind)
+		}
+		e := events[0].(*pb.PaymentEvent)
+		if e.OrderID != o.ID || e.Status != string(PaymentFailed) || e.Reason == "" {
+			t.Errorf("published %+v for %v, want the payment of %s failed with a reason", e, kind, o.ID)
+		}
+		if !ack.acked || ack.nacked {
+			t.Errorf("got the message acked %t, nacked %t for %v, want it acked", ack.acked, ack.nacked, kind)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/scuba13/oms/payments/processor/fake"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// newFakeCheckout serves the fake checkout and the payments webhook endpoint
+// to each other, the fake signing its webhooks with secret.
+func newFakeCheckout(t *testing.T, secret string, prices map[string]int64) (*PaymentHTTPHandler, *memoryStore, *memoryPublisher) {
+	t.Helper()
+
+	webhookMux := http.NewServeMux()
+	webhookServer := httptest.NewServer(webhookMux)
+	t.Cleanup(webhookServer.Close)
+
+	checkoutMux := http.NewServeMux()
+	checkoutServer := httptest.NewServer(checkoutMux)
+	t.Cleanup(checkoutServer.Close)
+
+	fakeProcessor := fake.NewProcessor(checkoutServer.URL, webhookServer.URL+"/webhook", secret, "http://gateway.test", prices)
+	checkoutMux.Handle("/", fakeProcessor.Handler())
+
+	store := newMemoryStore()
+	publisher := &memoryPublisher{}
+	handler := NewPaymentHTTPHandler(publisher, NewService(byMethod(fakeProcessor), &memoryOrders{}, store, store, publisher, noRiskRules{}), NewWebhookInbox(store), newWebhookProviders(t))
+	handler.registerRoutes(webhookMux)
+
+	return handler, store, publisher
+}
+
+// pay presses the Pay button of a checkout page.
+func pay(t *testing.T, link string) *http.Response {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Post(link+"/pay", "", nil)
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+// TestFakeCheckout pays an order through the fake checkout, from the priced
+// session to the signed webhook and the order.paid it publishes.
+func TestFakeCheckout(t *testing.T) {
+	ctx := context.Background()
+	handler, store, publisher := newFakeCheckout(t, endpointStripeSecret, map[string]int64{"price_burger": 1250, "price_fries": 450})
+	svc := handler.service
+
+	o := &pb.Order{
+		ID:         "order-1",
+		CustomerID: "customer-1",
+		LocationID: "downtown",
+		Items: []*pb.Item{
+			{ID: "burger", Quantity: 2, PriceID: "price_burger"},
+			{ID: "fries", Quantity: 1, PriceID: "price_fries"},
+			{ID: "water", Quantity: 1, PriceID: "price_unknown"},
+		},
+	}
+	link, err := svc.CreatePayment(ctx, o)
+	if err != nil {
+		t.Fatalf("creating the payment: %v", err)
+	}
+
+	payments, _ := store.ListByOrder(ctx, o.ID)
+	if len(payments) != 1 {
+		t.Fatalf("got %d payments, want 1", len(payments))
+	}
+	want := int64(2*1250 + 450 + processor.UnitAmount)
+	if payments[0].Amount != want || payments[0].Processor != fake.ProcessorName {
+		t.Fatalf("got payment %+v, want %d charged by %s", payments[0], want, fake.ProcessorName)
+	}
+
+	if resp := pay(t, link); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("paying answered %s, want 303", resp.Status)
+	}
+	if resp := pay(t, link); resp.StatusCode != http.StatusConflict {
+		t.Errorf("paying again answered %s, want 409", resp.Status)
+	}
+
+	var stored []*Webhook
+	for _, w := range store.webhooks {
+		stored = append(stored, w)
+	}
+	if len(stored) != 1 || stored[0].Status != WebhookPending || stored[0].Type != "checkout.session.completed" {
+		t.Fatalf("got webhooks %+v, want a pending checkout.session.completed", stored)
+	}
+
+	var event stripe.Event
+	if err := json.Unmarshal(stored[0].Payload, &event); err != nil {
+		t.Fatalf("reading the webhook: %v", err)
+	}
+	var session stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+		t.Fatalf("reading the session: %v", err)
+	}
+	if session.ID != payments[0].SessionID || session.AmountTotal != want || session.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		t.Errorf("got session %s paid %s for %d, want %s paid for %d", session.ID, session.PaymentStatus, session.AmountTotal, payments[0].SessionID, want)
+	}
+	if session.Metadata["orderID"] != o.ID || session.Metadata["locationID"] != o.LocationID {
+		t.Errorf("got metadata %v, want order %s at %s", session.Metadata, o.ID, o.LocationID)
+	}
+
+	processed, err := handler.ProcessWebhooks(ctx)
+	if err != nil || processed != 1 {
+		t.Fatalf("processed %d webhooks, %v, want 1", processed, err)
+	}
+	if p, _ := store.Get(ctx, payments[0].ID); p.Status != PaymentPaid {
+		t.Fatalf("payment is %s, want %s", p.Status, PaymentPaid)
+	}
+
+	events := publisher.published(broker.OrderPaidEvent)
+	if len(events) != 1 {
+		t.Fatalf("published %d %s, want 1", len(events), broker.OrderPaidEvent)
+	}
+	paid := events[0].(*pb.Order)
+	if paid.ID != o.ID || paid.CustomerID != o.CustomerID || paid.LocationID != o.LocationID {
+		t.Errorf("published %s for %+v, want order %s", broker.OrderPaidEvent, paid, o.ID)
+	}
+}
+
+func TestFakeCheckoutUnsignedWebhook(t *testing.T) {
+	ctx := context.Background()
+	handler, store, _ := newFakeCheckout(t, "whsec_other", nil)
+
+	link, err := handler.service.CreatePayment(ctx, &pb.Order{ID: "order-1", Items: []*pb.Item{{ID: "burger", Quantity: 1}}})
+	if err != nil {
+		t.Fatalf("creating the payment: %v", err)
+	}
+
+	// a webhook the payments service refuses leaves the session open
+	for range 2 {
+		if resp := pay(t, link); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("paying answered %s, want 502", resp.Status)
+		}
+	}
+	if len(store.webhooks) != 0 {
+		t.Errorf("got %d webhooks stored, want the badly signed one refused", len(store.webhooks))
+	}
+}
+
+func TestLoadPrices(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	prices, err := fake.LoadPrices(write("prices.json", `{"price_burger": 1250}`))
+	if err != nil || prices["price_burger"] != 1250 {
+		t.Errorf("got prices %v, %v, want the burger at 1250", prices, err)
+	}
+	if prices, err := fake.LoadPrices(""); err != nil || prices != nil {
+		t.Errorf("got prices %v, %v without a file, want none", prices, err)
+	}
+
+	for name, data := range map[string]string{"negative.json": `{"price_burger": -1}`, "bad.json": `["price_burger"]`} {
+		if _, err := fake.LoadPrices(write(name, data)); err == nil {
+			t.Errorf("loading %s returned no error", name)
+		}
+	}
+}
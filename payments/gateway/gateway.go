@@ -1,7 +1,14 @@
 package gateway
 
-import "context"
+import (
+	"context"
+
+	pb "github.com/scuba13/oms/common/api"
+)
 
 type OrdersGateway interface {
 	UpdateOrderAfterPaymentLink(ctx context.Context, orderID, paymentLink string) error
+	GetOrder(ctx context.Context, orderID, customerID string) (*pb.Order, error)
+	// HoldOrder puts an order on hold for review, without a payment link.
+	HoldOrder(ctx context.Context, orderID string) error
 }
\ No newline at end of file
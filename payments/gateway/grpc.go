@@ -32,3 +32,34 @@ func (g *gateway) UpdateOrderAfterPaymentLink(ctx context.Context, orderID, paym
 	})
 	return err
 }
+
+func (g *gateway) GetOrder(ctx context.Context, orderID, customerID string) (*pb.Order, error) {
+	conn, err := discovery.ServiceConnection(context.Background(), "orders", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	ordersClient := pb.NewOrderServiceClient(conn)
+
+	return ordersClient.GetOrder(ctx, &pb.GetOrderRequest{
+		OrderID:    orderID,
+		CustomerID: customerID,
+	})
+}
+
+func (g *gateway) HoldOrder(ctx context.Context, orderID string) error {
+	conn, err := discovery.ServiceConnection(context.Background(), "orders", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	ordersClient := pb.NewOrderServiceClient(conn)
+
+	_, err = ordersClient.UpdateOrder(ctx, &pb.Order{
+		ID:     orderID,
+		Status: "on_hold",
+	})
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/scuba13/oms/common/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type grpcHandler struct {
+	pb.UnimplementedPaymentServiceServer
+
+	service PaymentsService
+}
+
+func NewGRPCHandler(grpcServer *grpc.Server, service PaymentsService) {
+	handler := &grpcHandler{service: service}
+	pb.RegisterPaymentServiceServer(grpcServer, handler)
+}
+
+func (h *grpcHandler) GetPayment(ctx context.Context, p *pb.GetPaymentRequest) (*pb.Payment, error) {
+	if p.ID == "" {
+		return nil, status.Error(codes.InvalidArgument, "payment ID is required")
+	}
+
+	payment, err := h.service.GetPayment(ctx, p.ID)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return payment.ToProto(), nil
+}
+
+func (h *grpcHandler) ListPaymentsForOrder(ctx context.Context, p *pb.ListPaymentsForOrderRequest) (*pb.ListPaymentsForOrderResponse, error) {
+	if p.OrderID == "" {
+		return nil, status.Error(codes.InvalidArgument, "order ID is required")
+	}
+
+	payments, err := h.service.ListPaymentsForOrder(ctx, p.OrderID)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	res := &pb.ListPaymentsForOrderResponse{Payments: make([]*pb.Payment, 0, len(payments))}
+	for _, payment := range payments {
+		res.Payments = append(res.Payments, payment.ToProto())
+	}
+
+	return res, nil
+}
+
+func (h *grpcHandler) RequeueWebhooks(ctx context.Context, p *pb.RequeueWebhooksRequest) (*pb.RequeueWebhooksResponse, error) {
+	requeued, err := h.service.RequeueWebhooks(ctx, p.IDs)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.RequeueWebhooksResponse{Requeued: requeued}, nil
+}
+
+func (h *grpcHandler) RefundPayment(ctx context.Context, p *pb.RefundPaymentRequest) (*pb.Refund, error) {
+	refund, err := h.service.RefundPayment(ctx, &RefundRequest{
+		PaymentID: p.PaymentID,
+		Amount:    p.Amount,
+		Items:     refundItemsFromProto(p.Items),
+		Reason:    p.Reason,
+		Actor:     p.Actor,
+	})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return refund.ToProto(), nil
+}
+
+func (h *grpcHandler) ConfirmManualPayment(ctx context.Context, p *pb.ConfirmManualPaymentRequest) (*pb.Payment, error) {
+	payment, err := h.service.ConfirmManualPayment(ctx, &ManualConfirmation{
+		PaymentID: p.PaymentID,
+		Amount:    p.Amount,
+		Currency:  p.Currency,
+		Actor:     p.Actor,
+	})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return payment.ToProto(), nil
+}
+
+func (h *grpcHandler) ListRiskDecisions(ctx context.Context, p *pb.ListRiskDecisionsRequest) (*pb.ListRiskDecisionsResponse, error) {
+	decisions, err := h.service.ListRiskDecisions(ctx, RiskDecisionStatus(p.Status), int(p.PageSize))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	res := &pb.ListRiskDecisionsResponse{Decisions: make([]*pb.RiskDecision, 0, len(decisions))}
+	for _, d := range decisions {
+		res.Decisions = append(res.Decisions, d.ToProto())
+	}
+
+	return res, nil
+}
+
+func (h *grpcHandler) ReviewRiskDecision(ctx context.Context, p *pb.ReviewRiskDecisionRequest) (*pb.RiskDecision, error) {
+	decision, err := h.service.ReviewRiskDecision(ctx, &RiskReview{
+		DecisionID: p.DecisionID,
+		Approve:    p.Approve,
+		Note:       p.Note,
+		Actor:      p.Actor,
+	})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return decision.ToProto(), nil
+}
+
+// toStatusError maps the payments service errors to gRPC status codes.
+func toStatusError(err error) error {
+	switch {
+	case errors.Is(err, ErrPaymentNotFound), errors.Is(err, ErrRiskDecisionNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrInvalidStatus), errors.Is(err, ErrPaymentConflict):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrInvalidArgument):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// errors of the services called, such as orders, keep their code
+	if s, ok := status.FromError(err); ok {
+		return s.Err()
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,92 +10,183 @@ import (
 	"os"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
-	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/common/broker"
-	"github.com/stripe/stripe-go/v78"
-	"github.com/stripe/stripe-go/v78/webhook"
-	"go.opentelemetry.io/otel"
+	"github.com/scuba13/oms/payments/processor"
 )
 
 type PaymentHTTPHandler struct {
-	channel *amqp.Channel
+	publisher EventPublisher
+	service   PaymentsService
+	webhooks  *webhookInbox
+	providers *processor.WebhookRegistry
 }
 
-func NewPaymentHTTPHandler(channel *amqp.Channel) *PaymentHTTPHandler {
-	return &PaymentHTTPHandler{channel}
+func NewPaymentHTTPHandler(publisher EventPublisher, service PaymentsService, webhooks *webhookInbox, providers *processor.WebhookRegistry) *PaymentHTTPHandler {
+	return &PaymentHTTPHandler{publisher, service, webhooks, providers}
 }
 
+// registerRoutes serves the webhook route of every provider that has one.
 func (h *PaymentHTTPHandler) registerRoutes(router *http.ServeMux) {
-	router.HandleFunc("/webhook", h.handleCheckoutWebhook)
-}
-
-func (h *PaymentHTTPHandler) handleCheckoutWebhook(w http.ResponseWriter, r *http.Request) {
-	const MaxBodyBytes = int64(65536)
-	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading request body: %v\n", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
+	for _, p := range h.providers.Providers() {
+		if p.Route != "" {
+			router.HandleFunc(p.Route, h.handleWebhookRequest(p))
+		}
 	}
+}
 
-	event, err := webhook.ConstructEvent(body, r.Header.Get("Stripe-Signature"), endpointStripeSecret)
+// handleWebhookRequest verifies the webhooks posted by a processor and
+// stores them before the processor is told they arrived. They are processed
+// from the store, so they survive a restart or a broker outage.
+func (h *PaymentHTTPHandler) handleWebhookRequest(p *processor.WebhookProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const MaxBodyBytes = int64(65536)
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error verifying webhook signature: %v\n", err)
-		w.WriteHeader(http.StatusBadRequest) // Return a 400 error on a bad signature
-		return
-	}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading request body: %v\n", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
-	if event.Type == "checkout.session.completed" {
-		var session stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &session)
+		id, eventType, err := p.Verifier.Verify(r.Header, body)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(os.Stderr, "Error verifying %s webhook signature: %v\n", p.Processor, err)
+			w.WriteHeader(http.StatusBadRequest) // Return a 400 error on a bad signature
 			return
 		}
 
-		if session.PaymentStatus == "paid" {
-			log.Printf("Payment for Checkout Session %v succeeded!", session.ID)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = h.webhooks.SaveWebhook(ctx, NewWebhook(p.Processor, id, eventType, body))
+		switch {
+		case errors.Is(err, ErrWebhookExists):
+			log.Printf("Skipping %s %s event %s, it was already received", p.Processor, eventType, id)
+		case err != nil:
+			// the processor sends the event again
+			log.Printf("Failed to store %s %s event %s: %v", p.Processor, eventType, id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-			orderID := session.Metadata["orderID"]
-			customerID := session.Metadata["customerID"]
+		w.WriteHeader(http.StatusOK)
+	}
+}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
+// eventOutcomes are the payment status and the event published for each
+// kind of processor event. Paid payments publish order.paid.
+var eventOutcomes = map[processor.EventKind]struct {
+	status   PaymentStatus
+	exchange string
+}{
+	processor.EventPaid:       {PaymentPaid, broker.OrderPaidEvent},
+	processor.EventProcessing: {PaymentProcessing, ""},
+	processor.EventFailed:     {PaymentFailed, broker.PaymentFailedEvent},
+	processor.EventExpired:    {PaymentExpired, broker.PaymentExpiredEvent},
+	processor.EventRefunded:   {PaymentPartiallyRefunded, broker.PaymentRefundedEvent},
+	processor.EventDisputed:   {PaymentDisputed, broker.PaymentDisputedEvent},
+}
 
-			o := &pb.Order{
-				ID:          orderID,
-				CustomerID:  customerID,
-				Status:      "paid",
-				PaymentLink: "",
-			}
+// handleEvent records what a webhook tells about a payment and tells the
+// orders about it, whichever processor sent it.
+func (h *PaymentHTTPHandler) handleEvent(ctx context.Context, processorName, eventID string, e *processor.Event) error {
+	if e.Kind == processor.EventCardUsed {
+		return h.handleCardUsed(ctx, processorName, eventID, e)
+	}
 
-			marshalledOrder, err := json.Marshal(o)
-			if err != nil {
-				log.Fatal(err.Error())
-			}
+	outcome, ok := eventOutcomes[e.Kind]
+	if !ok {
+		return fmt.Errorf("%w: unknown event kind %q", ErrMalformedWebhook, e.Kind)
+	}
 
-			tr := otel.Tracer("amqp")
-			amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", broker.OrderPaidEvent))
-			defer messageSpan.End()
+	u := &PaymentUpdate{
+		Processor:       processorName,
+		SessionID:       e.SessionID,
+		PaymentIntentID: e.PaymentIntentID,
+		Status:          outcome.status,
+		EventID:         eventID,
+		AmountRefunded:  e.AmountRefunded,
+		Reason:          e.Reason,
+	}
+	if e.Collected {
+		u.Amount = e.Amount
+		u.Currency = e.Currency
+	}
+	if e.Kind == processor.EventRefunded && e.FullyRefunded {
+		u.Status = PaymentRefunded
+	}
 
-			headers := broker.InjectAMQPHeaders(amqpContext)
+	p, err := h.service.UpdatePayment(ctx, u)
+	switch {
+	case errors.Is(err, ErrPaymentNotFound) && e.Metadata["orderID"] != "":
+		// sessions created before payments were recorded have no record,
+		// their metadata still tells the order
+		log.Printf("No payment recorded for %s session %s", processorName, e.SessionID)
+		p = &Payment{
+			OrderID:    e.Metadata["orderID"],
+			CustomerID: e.Metadata["customerID"],
+			LocationID: e.Metadata["locationID"],
+			Processor:  processorName,
+			SessionID:  e.SessionID,
+			Amount:     e.Amount,
+			Currency:   e.Currency,
+			Status:     u.Status,
+			UpdatedAt:  time.Now(),
+		}
+	case errors.Is(err, ErrPaymentNotFound), errors.Is(err, ErrInvalidStatus):
+		log.Printf("Skipping %s event %s: %v", processorName, eventID, err)
+		return nil
+	case err != nil:
+		return err
+	}
 
-			// publish a message
-			h.channel.PublishWithContext(amqpContext, broker.OrderPaidEvent, "", false, false, amqp.Publishing{
-				ContentType:  "application/json",
-				Body:         marshalledOrder,
-				DeliveryMode: amqp.Persistent,
-				Headers:      headers,
-			})
+	if e.Kind == processor.EventRefunded && p.ID != "" {
+		recorded, err := h.service.RecordedRefunds(ctx, p.ID)
+		if err != nil {
+			return err
+		}
+		if p.AmountRefunded <= recorded {
+			// RefundPayment tells the orders, with the refunded items
+			log.Printf("Refunds of payment %s were made through RefundPayment", p.ID)
+			return nil
+		}
+	}
 
-			log.Println("Message published order.paid")
+	switch outcome.exchange {
+	case "":
+		log.Printf("Payment %s of order %s is %s, waiting for it to settle", p.ID, p.OrderID, p.Status)
+		return nil
+	case broker.OrderPaidEvent:
+		log.Printf("Payment %s of order %s succeeded!", p.ID, p.OrderID)
+
+		o := p.PaidOrder()
+		if o.LocationID == "" {
+			// payments recorded before locations were
+			o.LocationID = e.Metadata["locationID"]
 		}
+
+		return h.publisher.Publish(ctx, broker.OrderPaidEvent, o)
+	}
+
+	return h.publisher.Publish(ctx, outcome.exchange, p.Event(u.Reason))
+}
+
+// handleCardUsed records the card of a charge for the customer the charge
+// metadata names, the risk rules count their cards.
+func (h *PaymentHTTPHandler) handleCardUsed(ctx context.Context, processorName, eventID string, e *processor.Event) error {
+	customerID := e.Metadata["customerID"]
+	if customerID == "" {
+		log.Printf("Skipping %s event %s, the charge has no customer", processorName, eventID)
+		return nil
 	}
 
-	w.WriteHeader(http.StatusOK)
+	return h.service.RecordCardUse(ctx, &CardUse{
+		ID:          eventID,
+		CustomerID:  customerID,
+		OrderID:     e.Metadata["orderID"],
+		Processor:   processorName,
+		Fingerprint: e.CardFingerprint,
+		SeenAt:      time.Now(),
+	})
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -13,8 +14,14 @@ import (
 	"github.com/scuba13/oms/common/discovery"
 	"github.com/scuba13/oms/common/discovery/consul"
 	"github.com/scuba13/oms/payments/gateway"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/scuba13/oms/payments/processor/counter"
+	"github.com/scuba13/oms/payments/processor/fake"
 	stripeProcessor "github.com/scuba13/oms/payments/processor/stripe"
 	"github.com/stripe/stripe-go/v78"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"google.golang.org/grpc"
 )
 
@@ -30,8 +37,25 @@ var (
 	httpAddr             = common.EnvString("HTTP_ADDR", "localhost:8081")
 	endpointStripeSecret = common.EnvString("STRIPE_ENDPOINT_SECRET", "whsec_18962801c0f8937ff95cdd9b9c7dad0a302bc11a131edefce3dd5f0d490f17d4")
 	jaegerAddr           = common.EnvString("JAEGER_ADDR", "localhost:4318")
+	mongoUser            = common.EnvString("MONGO_DB_USER", "root")
+	mongoPass            = common.EnvString("MONGO_DB_PASS", "example")
+	mongoAddr            = common.EnvString("MONGO_DB_HOST", "localhost:27017")
+	// paymentProcessorName is "stripe", or "fake" to check out against the local
+	// fake checkout server served at fakeCheckoutAddr, charging the unit
+	// amounts the JSON file fakeCheckoutPrices gives each price ID.
+	paymentProcessorName = common.EnvString("PAYMENT_PROCESSOR", "stripe")
+	fakeCheckoutAddr     = common.EnvString("FAKE_CHECKOUT_ADDR", "localhost:8083")
+	fakeCheckoutPrices   = common.EnvString("FAKE_CHECKOUT_PRICES_FILE", "")
+	gatewayHTTPAddr      = common.EnvString("GATEWAY_HTTP_ADDRESS", "http://localhost:8080")
+	// payments still open or processing reconcileAfter after they were
+	// created are checked with the processor every reconcileInterval
+	reconcileAfter    = common.EnvString("PAYMENT_RECONCILE_AFTER", "30m")
+	reconcileInterval = common.EnvString("PAYMENT_RECONCILE_INTERVAL", "5m")
 )
 
+// riskRulesRefresh is how often the risk rules are read from Consul.
+const riskRulesRefresh = time.Minute
+
 func main() {
 	if err := common.SetGlobalTracer(context.TODO(), serviceName, jaegerAddr); err != nil {
 		log.Fatal("failed to set global tracer")
@@ -70,20 +94,118 @@ func main() {
 		ch.Close()
 	}()
 
-	stripeProcessor := stripeProcessor.NewProcessor()
+	// mongo db conn
+	uri := fmt.Sprintf("mongodb://%s:%s@%s", mongoUser, mongoPass, mongoAddr)
+	mongoClient, err := connectToMongoDB(uri)
+	if err != nil {
+		log.Fatalf("failed to connect to mongo db: %v", err)
+	}
+
+	store := NewStore(mongoClient)
+	if err := store.EnsureIndexes(ctx); err != nil {
+		log.Fatalf("failed to create the payments indexes: %v", err)
+	}
+
+	// card payments go through the checkout of the online processor
+	var paymentProcessor processor.PaymentProcessor = stripeProcessor.NewProcessor()
+	if paymentProcessorName == "fake" {
+		prices, err := fake.LoadPrices(fakeCheckoutPrices)
+		if err != nil {
+			log.Fatalf("failed to load the fake checkout prices: %v", err)
+		}
+
+		fakeProcessor := fake.NewProcessor(
+			"http://"+fakeCheckoutAddr,
+			"http://"+httpAddr+"/webhook",
+			endpointStripeSecret,
+			gatewayHTTPAddr,
+			prices,
+		)
+		paymentProcessor = fakeProcessor
+
+		go func() {
+			log.Printf("Starting fake checkout server at %s", fakeCheckoutAddr)
+			if err := http.ListenAndServe(fakeCheckoutAddr, fakeProcessor.Handler()); err != nil {
+				log.Fatal("failed to start fake checkout server")
+			}
+		}()
+	}
+
+	publisher, err := NewPublisher(ch)
+	if err != nil {
+		log.Fatalf("failed to enable publisher confirms: %v", err)
+	}
 	gateway := gateway.NewGateway(registry)
-	svc := NewService(stripeProcessor, gateway)
+	processors := map[string]processor.PaymentProcessor{
+		common.PaymentMethodCard: paymentProcessor,
+		common.PaymentMethodCash: counter.NewProcessor(),
+	}
+	// risk rules are read from Consul again every riskRulesRefresh, no rules
+	// are checked until the key is set
+	rules := NewRiskRules(registry)
+	if err := rules.Load(ctx); err != nil {
+		log.Printf("No risk rules checked, could not load them: %v", err)
+	}
+	go func() {
+		for {
+			time.Sleep(riskRulesRefresh)
+			if err := rules.Load(ctx); err != nil {
+				log.Printf("Failed to reload risk rules: %v", err)
+			}
+		}
+	}()
+
+	// cash confirmations are stored by the service, and processed as soon
+	// as the webhooks posted by the processors are
+	webhooks := NewWebhookInbox(store)
+
+	svc := NewService(processors, gateway, store, webhooks, publisher, rules)
 	svcWithTelemetry := NewTelemetryMiddleware(svc)
 
-	amqpConsumer := NewConsumer(svcWithTelemetry)
+	amqpConsumer := NewConsumer(svcWithTelemetry, publisher)
 	go amqpConsumer.Listen(ch)
 
 	// http server
 	mux := http.NewServeMux()
 
-	httpServer := NewPaymentHTTPHandler(ch)
+	// every processor that sends webhooks registers how to receive and read
+	// them
+	webhookProviders := processor.NewWebhookRegistry()
+	for _, p := range []*processor.WebhookProvider{
+		stripeProcessor.NewWebhookProvider("/webhook", endpointStripeSecret),
+		counter.NewWebhookProvider(),
+	} {
+		if err := webhookProviders.Register(p); err != nil {
+			log.Fatalf("failed to register webhook provider: %v", err)
+		}
+	}
+
+	httpServer := NewPaymentHTTPHandler(publisher, svcWithTelemetry, webhooks, webhookProviders)
 	httpServer.registerRoutes(mux)
 
+	go httpServer.RunWebhooks(ctx)
+
+	after, err := time.ParseDuration(reconcileAfter)
+	if err != nil {
+		log.Fatalf("invalid PAYMENT_RECONCILE_AFTER %q: %v", reconcileAfter, err)
+	}
+	interval, err := time.ParseDuration(reconcileInterval)
+	if err != nil {
+		log.Fatalf("invalid PAYMENT_RECONCILE_INTERVAL %q: %v", reconcileInterval, err)
+	}
+
+	go func() {
+		for {
+			report, err := svcWithTelemetry.ReconcilePayments(ctx, time.Now().Add(-after))
+			if err != nil {
+				log.Printf("Failed to reconcile payments: %v", err)
+			} else if len(report.Discrepancies) > 0 {
+				log.Printf("Reconciliation %s checked %d payments, found %d discrepancies", report.ID, report.Checked, len(report.Discrepancies))
+			}
+			time.Sleep(interval)
+		}
+	}()
+
 	go func() {
 		log.Printf("Starting HTTP server at %s", httpAddr)
 		if err := http.ListenAndServe(httpAddr, mux); err != nil {
@@ -93,6 +215,7 @@ func main() {
 
 	// gRPC server
 	grpcServer := grpc.NewServer()
+	NewGRPCHandler(grpcServer, svcWithTelemetry)
 
 	l, err := net.Listen("tcp", grpcAddr)
 	if err != nil {
@@ -105,3 +228,15 @@ func main() {
 		log.Fatal(err.Error())
 	}
 }
+
+func connectToMongoDB(uri string) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Ping(ctx, readpref.Primary())
+	return client, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	"github.com/scuba13/oms/payments/processor/counter"
+)
+
+// currencyPattern is a three-letter ISO 4217 code, lowercase as processors
+// record them.
+var currencyPattern = regexp.MustCompile(`^[a-z]{3}$`)
+
+// ManualConfirmation tells that staff collected the payment of an order paid
+// at the counter.
+type ManualConfirmation struct {
+	PaymentID string
+	// Amount is what was collected, in the smallest unit of Currency.
+	Amount   int64
+	Currency string
+	Actor    string
+}
+
+// ConfirmManualPayment stores the confirmation of an open cash payment in the
+// webhook inbox as a webhook of the counter, where it is processed like the
+// webhooks of the other processors, right away. A payment can only be
+// confirmed once, in its currency and for its amount when it has one. The
+// payment is returned as it was before the confirmation is processed.
+func (s *service) ConfirmManualPayment(ctx context.Context, c *ManualConfirmation) (*Payment, error) {
+	switch {
+	case c.PaymentID == "":
+		return nil, fmt.Errorf("%w: payment ID is required", ErrInvalidArgument)
+	case c.Amount <= 0:
+		return nil, fmt.Errorf("%w: amount collected must be positive", ErrInvalidArgument)
+	case !currencyPattern.MatchString(strings.ToLower(c.Currency)):
+		return nil, fmt.Errorf("%w: currency %q is not a three-letter ISO code", ErrInvalidArgument, c.Currency)
+	}
+	currency := strings.ToLower(c.Currency)
+
+	p, err := s.store.Get(ctx, c.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if common.PaymentMethodOrDefault(p.PaymentMethod) != common.PaymentMethodCash {
+		return nil, fmt.Errorf("%w: payment %s is not paid at the counter", ErrInvalidArgument, p.ID)
+	}
+	if !p.Status.CanMoveTo(PaymentPaid) {
+		return nil, fmt.Errorf("%w: payment %s is %s, can't be confirmed", ErrInvalidStatus, p.ID, p.Status)
+	}
+	// the counter doesn't price orders, a payment only has an amount when
+	// something did
+	if p.Currency != "" && currency != p.Currency {
+		return nil, fmt.Errorf("%w: payment %s is in %s, not %s", ErrInvalidArgument, p.ID, p.Currency, currency)
+	}
+	if p.Amount > 0 && c.Amount != p.Amount {
+		return nil, fmt.Errorf("%w: order of payment %s comes to %d %s, %d was collected", ErrInvalidArgument, p.ID, p.Amount, p.Currency, c.Amount)
+	}
+
+	payload, err := json.Marshal(&counter.Confirmation{
+		PaymentID:   p.ID,
+		SessionID:   p.SessionID,
+		Amount:      c.Amount,
+		Currency:    currency,
+		Actor:       c.Actor,
+		ConfirmedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the confirmation is named after the payment, so it is only stored once
+	w := NewWebhook(counter.ProcessorName, "confirm-"+p.ID, counter.ConfirmationEvent, payload)
+	err = s.webhooks.SaveWebhook(ctx, w)
+	if errors.Is(err, ErrWebhookExists) {
+		return nil, fmt.Errorf("%w: payment %s was already confirmed", ErrInvalidStatus, p.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storing the confirmation of payment %s: %w", p.ID, err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor/inmem"
+)
+
+func TestConfirmManualPayment(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	publisher := &memoryPublisher{}
+	inbox := NewWebhookInbox(store)
+	svc := NewService(byMethod(inmem.NewInmem()), &memoryOrders{}, store, inbox, publisher, noRiskRules{})
+	handler := NewPaymentHTTPHandler(publisher, svc, inbox, newWebhookProviders(t))
+
+	for _, o := range []*pb.Order{
+		{ID: "cash", CustomerID: "customer-1", LocationID: "downtown", PaymentMethod: common.PaymentMethodCash},
+		{ID: "card", CustomerID: "customer-1"},
+	} {
+		if _, err := svc.CreatePayment(ctx, o); err != nil {
+			t.Fatalf("creating the payment of %s: %v", o.ID, err)
+		}
+	}
+	cash, _ := store.ListByOrder(ctx, "cash")
+	card, _ := store.ListByOrder(ctx, "card")
+	p := cash[0]
+
+	// the counter has nothing to tell about a cash payment until it expires
+	report, err := svc.ReconcilePayments(ctx, time.Now().Add(time.Minute))
+	if err != nil || report.Checked != 1 {
+		t.Fatalf("reconciled %+v, %v, want the card payment only", report, err)
+	}
+
+	rejected := []struct {
+		name string
+		c    *ManualConfirmation
+	}{
+		{"no amount", &ManualConfirmation{PaymentID: p.ID, Currency: "usd"}},
+		{"a currency that isn't an ISO code", &ManualConfirmation{PaymentID: p.ID, Amount: 1250, Currency: "dollars"}},
+		{"a card payment", &ManualConfirmation{PaymentID: card[0].ID, Amount: 1250, Currency: "usd"}},
+	}
+	for _, tt := range rejected {
+		if _, err := svc.ConfirmManualPayment(ctx, tt.c); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("confirming %s returned %v, want %v", tt.name, err, ErrInvalidArgument)
+		}
+	}
+
+	if _, err := svc.ConfirmManualPayment(ctx, &ManualConfirmation{PaymentID: p.ID, Amount: 1250, Currency: "USD", Actor: "jane"}); err != nil {
+		t.Fatalf("confirming: %v", err)
+	}
+	select {
+	case <-inbox.wake:
+	default:
+		t.Error("storing the confirmation didn't wake the webhook processing")
+	}
+	if _, err := svc.ConfirmManualPayment(ctx, &ManualConfirmation{PaymentID: p.ID, Amount: 1250, Currency: "usd"}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("confirming again returned %v, want %v", err, ErrInvalidStatus)
+	}
+
+	if processed, err := handler.ProcessWebhooks(ctx); err != nil || processed != 1 {
+		t.Fatalf("processed %d webhooks, %v, want the confirmation", processed, err)
+	}
+	if p, _ = store.Get(ctx, p.ID); p.Status != PaymentPaid || p.Amount != 1250 || p.Currency != "usd" {
+		t.Errorf("got payment %s for %d %s, want 1250 usd paid", p.Status, p.Amount, p.Currency)
+	}
+
+	paid := publisher.published(broker.OrderPaidEvent)
+	if len(paid) != 1 || paid[0].(*pb.Order).ID != "cash" || paid[0].(*pb.Order).LocationID != "downtown" {
+		t.Errorf("published %s %+v, want the cash order at downtown", broker.OrderPaidEvent, paid)
+	}
+
+	// cash is refunded at the counter
+	if _, err := svc.RefundPayment(ctx, &RefundRequest{PaymentID: p.ID, Amount: 100}); err == nil {
+		t.Error("refunding a cash payment returned no error")
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scuba13/oms/common"
+)
+
+// memoryStore keeps payments, reconciliation reports, refunds, risk
+// decisions, card uses and webhooks in memory, with the version checks of
+// the Mongo store.
+type memoryStore struct {
+	mu              sync.Mutex
+	payments        map[string]*Payment
+	reconciliations []*ReconciliationReport
+	refunds         map[string]*Refund
+	decisions       map[string]*RiskDecision
+	cardUses        map[string]*CardUse
+	webhooks        map[string]*Webhook
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		payments:  map[string]*Payment{},
+		refunds:   map[string]*Refund{},
+		decisions: map[string]*RiskDecision{},
+		cardUses:  map[string]*CardUse{},
+		webhooks:  map[string]*Webhook{},
+	}
+}
+
+func copyPayment(p *Payment) *Payment {
+	c := *p
+	c.Transitions = append([]*Transition{}, p.Transitions...)
+	c.EventIDs = append([]string{}, p.EventIDs...)
+	return &c
+}
+
+func (s *memoryStore) Create(ctx context.Context, p *Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.payments[p.ID] = copyPayment(p)
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*Payment, error) {
+	return s.find(func(p *Payment) bool { return p.ID == id })
+}
+
+func (s *memoryStore) GetBySession(ctx context.Context, processor, sessionID string) (*Payment, error) {
+	return s.find(func(p *Payment) bool { return p.Processor == processor && p.SessionID == sessionID })
+}
+
+func (s *memoryStore) GetByPaymentIntent(ctx context.Context, processor, paymentIntentID string) (*Payment, error) {
+	return s.find(func(p *Payment) bool { return p.Processor == processor && p.PaymentIntentID == paymentIntentID })
+}
+
+func (s *memoryStore) find(match func(*Payment) bool) (*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.payments {
+		if match(p) {
+			return copyPayment(p), nil
+		}
+	}
+
+	return nil, ErrPaymentNotFound
+}
+
+func (s *memoryStore) ListByOrder(ctx context.Context, orderID string) ([]*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := []*Payment{}
+	for _, p := range s.payments {
+		if p.OrderID == orderID {
+			res = append(res, copyPayment(p))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+
+	return res, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, p *Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.payments[p.ID]
+	if !ok {
+		return ErrPaymentNotFound
+	}
+	if stored.Version != p.Version {
+		return ErrPaymentConflict
+	}
+
+	p.Version++
+	s.payments[p.ID] = copyPayment(p)
+	return nil
+}
+
+func (s *memoryStore) ListStale(ctx context.Context, before time.Time, limit int) ([]*Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := []*Payment{}
+	for _, p := range s.payments {
+		if p.Status != PaymentOpen && p.Status != PaymentProcessing || !p.CreatedAt.Before(before) {
+			continue
+		}
+		if p.PaymentMethod == common.PaymentMethodCash && !p.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+		res = append(res, copyPayment(p))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].LastReconciledAt.Equal(res[j].LastReconciledAt) {
+			return res[i].LastReconciledAt.Before(res[j].LastReconciledAt)
+		}
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+
+	return res, nil
+}
+
+func (s *memoryStore) MarkReconciled(ctx context.Context, ids []string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if p, ok := s.payments[id]; ok {
+			p.LastReconciledAt = at
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveReconciliation(ctx context.Context, r *ReconciliationReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reconciliations = append(s.reconciliations, r)
+	return nil
+}
+
+func (s *memoryStore) CreateRefund(ctx context.Context, r *Refund) error {
+	return s.UpdateRefund(ctx, r)
+}
+
+func (s *memoryStore) UpdateRefund(ctx context.Context, r *Refund) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *r
+	s.refunds[r.ID] = &c
+	return nil
+}
+
+func (s *memoryStore) ListRefunds(ctx context.Context, paymentID string) ([]*Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := []*Refund{}
+	for _, r := range s.refunds {
+		if r.PaymentID == paymentID {
+			c := *r
+			res = append(res, &c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+
+	return res, nil
+}
+
+func (s *memoryStore) CountOrders(ctx context.Context, customerID string, since time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := map[string]bool{}
+	for _, d := range s.decisions {
+		if d.CustomerID == customerID && !d.CreatedAt.Before(since) {
+			orders[d.OrderID] = true
+		}
+	}
+
+	return int64(len(orders)), nil
+}
+
+func (s *memoryStore) HasPaid(ctx context.Context, customerID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.payments {
+		switch p.Status {
+		case PaymentPaid, PaymentPartiallyRefunded, PaymentRefunded, PaymentDisputed:
+			if p.CustomerID == customerID {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryStore) SaveCardUse(ctx context.Context, c *CardUse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.cardUses[c.ID]; ok {
+		return ErrCardUseExists
+	}
+	cc := *c
+	s.cardUses[c.ID] = &cc
+	return nil
+}
+
+func (s *memoryStore) CountCards(ctx context.Context, customerID string, since time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cards := map[string]bool{}
+	for _, c := range s.cardUses {
+		if c.CustomerID == customerID && !c.SeenAt.Before(since) {
+			cards[c.Fingerprint] = true
+		}
+	}
+
+	return int64(len(cards)), nil
+}
+
+func (s *memoryStore) CreateRiskDecision(ctx context.Context, d *RiskDecision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.decisions {
+		if other.OrderID == d.OrderID {
+			return ErrRiskDecisionExists
+		}
+	}
+	c := *d
+	s.decisions[d.ID] = &c
+	return nil
+}
+
+func (s *memoryStore) GetRiskDecision(ctx context.Context, id string) (*RiskDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.decisions[id]
+	if !ok {
+		return nil, ErrRiskDecisionNotFound
+	}
+
+	c := *d
+	return &c, nil
+}
+
+func (s *memoryStore) GetRiskDecisionByOrder(ctx context.Context, orderID string) (*RiskDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.decisions {
+		if d.OrderID == orderID {
+			c := *d
+			return &c, nil
+		}
+	}
+
+	return nil, ErrRiskDecisionNotFound
+}
+
+func (s *memoryStore) ListRiskDecisions(ctx context.Context, status RiskDecisionStatus, limit int) ([]*RiskDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := []*RiskDecision{}
+	for _, d := range s.decisions {
+		if status == "" || d.Status == status {
+			c := *d
+			res = append(res, &c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.After(res[j].CreatedAt) })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+
+	return res, nil
+}
+
+func (s *memoryStore) UpdateRiskDecision(ctx context.Context, d *RiskDecision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.decisions[d.ID]; !ok || old.Status != RiskHeld {
+		return fmt.Errorf("%w: risk decision %s was already reviewed", ErrInvalidStatus, d.ID)
+	}
+	c := *d
+	s.decisions[d.ID] = &c
+	return nil
+}
+
+func (s *memoryStore) SaveWebhook(ctx context.Context, w *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[w.ID]; ok {
+		return ErrWebhookExists
+	}
+
+	c := *w
+	s.webhooks[w.ID] = &c
+	return nil
+}
+
+func (s *memoryStore) ClaimWebhook(ctx context.Context, now time.Time, lease time.Duration) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due *Webhook
+	for _, w := range s.webhooks {
+		if w.Status == WebhookPending && !w.NextAttemptAt.After(now) && (due == nil || w.NextAttemptAt.Before(due.NextAttemptAt)) {
+			due = w
+		}
+	}
+	if due == nil {
+		return nil, nil
+	}
+
+	due.Attempts++
+	due.NextAttemptAt = now.Add(lease)
+
+	c := *due
+	return &c, nil
+}
+
+func (s *memoryStore) UpdateWebhook(ctx context.Context, w *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *w
+	s.webhooks[w.ID] = &c
+	return nil
+}
+
+func (s *memoryStore) RequeueWebhooks(ctx context.Context, ids []string, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, w := range s.webhooks {
+		if w.Status != WebhookFailed {
+			continue
+		}
+		if len(ids) > 0 && !slices.Contains(ids, w.ID) {
+			continue
+		}
+
+		w.Status = WebhookPending
+		w.Attempts = 0
+		w.NextAttemptAt = now
+		n++
+	}
+
+	return n, nil
+}
+
+func (s *memoryStore) webhook(id string) *Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *s.webhooks[id]
+	return &c
+}
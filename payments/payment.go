@@ -0,0 +1,185 @@
+package main
+
+import (
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+)
+
+type PaymentStatus string
+
+const (
+	// PaymentOpen is a session the customer has not paid yet.
+	PaymentOpen PaymentStatus = "open"
+	// PaymentProcessing is a completed session whose payment method, such
+	// as a bank transfer, settles later.
+	PaymentProcessing        PaymentStatus = "processing"
+	PaymentPaid              PaymentStatus = "paid"
+	PaymentFailed            PaymentStatus = "failed"
+	PaymentExpired           PaymentStatus = "expired"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentRefunded          PaymentStatus = "refunded"
+	PaymentDisputed          PaymentStatus = "disputed"
+)
+
+// paymentTransitions are the statuses a payment can move to from each
+// status. A partially refunded payment can be refunded again.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentOpen:              {PaymentProcessing, PaymentPaid, PaymentFailed, PaymentExpired},
+	PaymentProcessing:        {PaymentPaid, PaymentFailed},
+	PaymentPaid:              {PaymentPartiallyRefunded, PaymentRefunded, PaymentDisputed},
+	PaymentPartiallyRefunded: {PaymentPartiallyRefunded, PaymentRefunded, PaymentDisputed},
+	PaymentDisputed:          {PaymentPartiallyRefunded, PaymentRefunded},
+}
+
+func (s PaymentStatus) CanMoveTo(to PaymentStatus) bool {
+	for _, next := range paymentTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Payment records a checkout session created for an order and what happened
+// to it since.
+type Payment struct {
+	ID         string `bson:"_id"`
+	OrderID    string `bson:"orderID"`
+	CustomerID string `bson:"customerID"`
+	LocationID string `bson:"locationID,omitempty"`
+	// PaymentMethod is the payment method of the order, empty for payments
+	// recorded before payment methods, which were paid by card.
+	PaymentMethod string `bson:"paymentMethod,omitempty"`
+	Processor     string `bson:"processor"`
+	SessionID     string `bson:"sessionID"`
+	PaymentLink   string `bson:"paymentLink"`
+	// PaymentIntentID is the processor payment behind a paid session,
+	// charges and refunds refer to it.
+	PaymentIntentID string        `bson:"paymentIntentID,omitempty"`
+	Amount          int64         `bson:"amount"`
+	AmountRefunded  int64         `bson:"amountRefunded"`
+	Currency        string        `bson:"currency"`
+	Status          PaymentStatus `bson:"status"`
+	Transitions     []*Transition `bson:"transitions"`
+	// EventIDs are the webhook events applied to the payment.
+	EventIDs  []string  `bson:"eventIDs"`
+	CreatedAt time.Time `bson:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+	// ExpiresAt is when the session can no longer be paid.
+	ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+	// LastReconciledAt is when a reconciliation last asked the processor
+	// about the payment.
+	LastReconciledAt time.Time `bson:"lastReconciledAt,omitempty"`
+	// Version is bumped on every update, so concurrent updates can't
+	// overwrite each other.
+	Version int `bson:"version"`
+}
+
+type Transition struct {
+	From    PaymentStatus `bson:"from"`
+	To      PaymentStatus `bson:"to"`
+	At      time.Time     `bson:"at"`
+	EventID string        `bson:"eventID,omitempty"`
+	Reason  string        `bson:"reason,omitempty"`
+}
+
+// PaymentUpdate is what a processor webhook event tells about a payment.
+// The payment is found by its session ID, or by its payment intent ID for
+// the events about charges.
+type PaymentUpdate struct {
+	Processor       string
+	SessionID       string
+	PaymentIntentID string
+	Status          PaymentStatus
+	EventID         string
+	// AmountRefunded is the total refunded so far, for refunds.
+	AmountRefunded int64
+	// Amount and Currency are what was collected for a payment whose amount
+	// is only known once paid, such as a cash payment, they replace the
+	// recorded ones.
+	Amount   int64
+	Currency string
+	Reason   string
+}
+
+func (p *Payment) HasEvent(eventID string) bool {
+	for _, id := range p.EventIDs {
+		if id == eventID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Payment) ToProto() *pb.Payment {
+	transitions := make([]*pb.PaymentTransition, 0, len(p.Transitions))
+	for _, t := range p.Transitions {
+		transitions = append(transitions, &pb.PaymentTransition{
+			From:    string(t.From),
+			To:      string(t.To),
+			At:      t.At.Unix(),
+			EventID: t.EventID,
+			Reason:  t.Reason,
+		})
+	}
+
+	return &pb.Payment{
+		ID:              p.ID,
+		OrderID:         p.OrderID,
+		CustomerID:      p.CustomerID,
+		Processor:       p.Processor,
+		SessionID:       p.SessionID,
+		PaymentLink:     p.PaymentLink,
+		Amount:          p.Amount,
+		Currency:        p.Currency,
+		Status:          string(p.Status),
+		Transitions:     transitions,
+		EventIDs:        p.EventIDs,
+		CreatedAt:       p.CreatedAt.Unix(),
+		UpdatedAt:       p.UpdatedAt.Unix(),
+		PaymentIntentID: p.PaymentIntentID,
+		AmountRefunded:  p.AmountRefunded,
+		ExpiresAt:       unixOrZero(p.ExpiresAt),
+		PaymentMethod:   common.PaymentMethodOrDefault(p.PaymentMethod),
+	}
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// PaidOrder is the order.paid event of the payment.
+func (p *Payment) PaidOrder() *pb.Order {
+	return &pb.Order{
+		ID:          p.OrderID,
+		CustomerID:  p.CustomerID,
+		Status:      "paid",
+		PaymentLink: "",
+		LocationID:  p.LocationID,
+	}
+}
+
+// Event is the broker event told about the payment once it moved to its
+// current status.
+func (p *Payment) Event(reason string) *pb.PaymentEvent {
+	return &pb.PaymentEvent{
+		OrderID:        p.OrderID,
+		CustomerID:     p.CustomerID,
+		PaymentID:      p.ID,
+		Processor:      p.Processor,
+		Status:         string(p.Status),
+		Amount:         p.Amount,
+		AmountRefunded: p.AmountRefunded,
+		Currency:       p.Currency,
+		Reason:         reason,
+		CreatedAt:      p.UpdatedAt.Unix(),
+	}
+}
@@ -0,0 +1,136 @@
+package counter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/payments/processor"
+)
+
+// ProcessorName names the counter in payments and webhooks.
+const ProcessorName = "counter"
+
+var errRefund = errors.New("payments made at the counter are refunded at the counter")
+
+// Counter takes payments at the counter, in cash. Nothing is charged through
+// it: a session stays open until staff confirm they collected the payment
+// with ConfirmManualPayment, or expires. The amount is only known once it is
+// collected.
+//
+// Counter keeps no state, a session ID tells the order and when the session
+// expires.
+type Counter struct{}
+
+func NewProcessor() *Counter {
+	return &Counter{}
+}
+
+// QuoteOrder quotes no amount, it is only known once collected.
+func (c *Counter) QuoteOrder(ctx context.Context, o *pb.Order) (*processor.Quote, error) {
+	return &processor.Quote{}, nil
+}
+
+func (c *Counter) CreateCheckoutSession(ctx context.Context, o *pb.Order) (*processor.Session, error) {
+	expiresAt := time.Now().Add(processor.SessionTTL)
+
+	return &processor.Session{
+		Processor: ProcessorName,
+		ID:        fmt.Sprintf("%s_%s_%d", ProcessorName, o.ID, expiresAt.Unix()),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// ExpireSession does nothing, the payment not being confirmed is enough.
+func (c *Counter) ExpireSession(ctx context.Context, sessionID string) error {
+	_, err := sessionExpiry(sessionID)
+	return err
+}
+
+// GetSessionStatus tells whether a session expired. A session confirmed by
+// staff is only known to be paid by its payment.
+func (c *Counter) GetSessionStatus(ctx context.Context, sessionID string) (*processor.SessionStatus, error) {
+	expiresAt, err := sessionExpiry(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &processor.SessionStatus{
+		Status:        processor.SessionOpen,
+		PaymentStatus: processor.PaymentStatusUnpaid,
+	}
+	if time.Now().After(expiresAt) {
+		status.Status = processor.SessionExpired
+	}
+
+	return status, nil
+}
+
+func (c *Counter) Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*processor.Refund, error) {
+	return nil, processor.NewError(processor.ErrInvalidRequest, errRefund)
+}
+
+func sessionExpiry(sessionID string) (time.Time, error) {
+	i := strings.LastIndex(sessionID, "_")
+	if !strings.HasPrefix(sessionID, ProcessorName+"_") || i < 0 {
+		return time.Time{}, processor.ErrSessionNotFound
+	}
+
+	expiresAt, err := strconv.ParseInt(sessionID[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, processor.ErrSessionNotFound
+	}
+
+	return time.Unix(expiresAt, 0), nil
+}
+
+// ConfirmationEvent is the webhook type of a Confirmation.
+const ConfirmationEvent = "payment.confirmed"
+
+// Confirmation tells that staff collected the payment of a session. It is
+// stored as a webhook of the counter.
+type Confirmation struct {
+	PaymentID string `json:"paymentID"`
+	SessionID string `json:"sessionID"`
+	// Amount is what was collected, in the smallest unit of Currency.
+	Amount      int64     `json:"amount"`
+	Currency    string    `json:"currency"`
+	Actor       string    `json:"actor"`
+	ConfirmedAt time.Time `json:"confirmedAt"`
+}
+
+// NewWebhookProvider reads the confirmations of the counter. They are
+// stored by the payments service itself, so the counter has no route.
+func NewWebhookProvider() *processor.WebhookProvider {
+	return &processor.WebhookProvider{
+		Processor:  ProcessorName,
+		Translator: translator{},
+	}
+}
+
+type translator struct{}
+
+func (translator) Translate(eventType string, payload []byte) (*processor.Event, error) {
+	if eventType != ConfirmationEvent {
+		return nil, nil
+	}
+
+	var c Confirmation
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, err
+	}
+
+	return &processor.Event{
+		Kind:      processor.EventPaid,
+		SessionID: c.SessionID,
+		Amount:    c.Amount,
+		Currency:  c.Currency,
+		Collected: true,
+		Reason:    fmt.Sprintf("paid at the counter, confirmed by %s", c.Actor),
+	}, nil
+}
@@ -0,0 +1,456 @@
+// Package fake is a checkout processor that runs locally. It serves its own
+// hosted checkout page and sends Stripe-shaped webhooks, signed with the
+// webhook secret, to the payments service, so the whole order to kitchen flow
+// runs without a network or a Stripe account.
+package fake
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/webhook"
+)
+
+const (
+	// ProcessorName is the processor recorded on fake payments. Webhooks are
+	// Stripe-shaped, so they are handled as Stripe ones.
+	ProcessorName = "stripe"
+	Currency      = "usd"
+)
+
+type session struct {
+	ID            string
+	Order         *pb.Order
+	Amount        int64
+	Refunded      int64
+	Currency      string
+	Status        stripe.CheckoutSessionStatus
+	PaymentStatus stripe.CheckoutSessionPaymentStatus
+	PaymentIntent string
+	SuccessURL    string
+	CancelURL     string
+	ExpiresAt     time.Time
+}
+
+// Processor creates checkout sessions kept in memory and serves their pages
+// from Handler. Paying a session sends checkout.session.completed to the
+// webhook URL, cancelling or expiring it sends checkout.session.expired and a
+// refund sends charge.refunded.
+type Processor struct {
+	baseURL     string
+	webhookURL  string
+	secret      string
+	gatewayAddr string
+	// prices are the unit amounts of the price IDs, the units of the others
+	// cost processor.UnitAmount
+	prices map[string]int64
+	client *http.Client
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	// refunds are the refunds made, by idempotency key
+	refunds map[string]*processor.Refund
+}
+
+// NewProcessor returns a processor whose checkout pages are reachable at
+// baseURL, such as http://localhost:8083. Webhooks go to webhookURL signed
+// with secret, and customers are sent back to the gateway at gatewayAddr.
+// Items are charged the unit amount prices gives their price ID, see
+// LoadPrices.
+func NewProcessor(baseURL, webhookURL, secret, gatewayAddr string, prices map[string]int64) *Processor {
+	return &Processor{
+		baseURL:     baseURL,
+		webhookURL:  webhookURL,
+		secret:      secret,
+		gatewayAddr: gatewayAddr,
+		prices:      prices,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		sessions:    make(map[string]*session),
+		refunds:     make(map[string]*processor.Refund),
+	}
+}
+
+func (p *Processor) QuoteOrder(ctx context.Context, o *pb.Order) (*processor.Quote, error) {
+	return &processor.Quote{Amount: p.orderAmount(o), Currency: Currency}, nil
+}
+
+func (p *Processor) CreateCheckoutSession(ctx context.Context, o *pb.Order) (*processor.Session, error) {
+	s := &session{
+		ID:            "cs_fake_" + randomID(),
+		Order:         o,
+		Amount:        p.orderAmount(o),
+		Currency:      Currency,
+		Status:        stripe.CheckoutSessionStatusOpen,
+		PaymentStatus: stripe.CheckoutSessionPaymentStatusUnpaid,
+		SuccessURL:    fmt.Sprintf("%s/success.html?customerID=%s&orderID=%s", p.gatewayAddr, o.CustomerID, o.ID),
+		CancelURL:     fmt.Sprintf("%s/cancel.html", p.gatewayAddr),
+		ExpiresAt:     time.Now().Add(processor.SessionTTL),
+	}
+
+	p.mu.Lock()
+	p.sessions[s.ID] = s
+	p.mu.Unlock()
+
+	log.Printf("Created fake checkout session %s for order %s", s.ID, o.ID)
+
+	return &processor.Session{
+		Processor: ProcessorName,
+		ID:        s.ID,
+		URL:       p.sessionURL(s.ID),
+		Amount:    s.Amount,
+		Currency:  s.Currency,
+		ExpiresAt: s.ExpiresAt,
+	}, nil
+}
+
+func (p *Processor) ExpireSession(ctx context.Context, sessionID string) error {
+	err := p.closeSession(ctx, sessionID, false)
+	switch {
+	case err == nil, errors.Is(err, processor.ErrSessionNotFound):
+		return err
+	case errors.Is(err, errSessionClosed):
+		return processor.NewError(processor.ErrInvalidRequest, err)
+	}
+
+	// the webhook wasn't accepted, the session is still open
+	return processor.NewError(processor.ErrRetryable, err)
+}
+
+func (p *Processor) GetSessionStatus(ctx context.Context, sessionID string) (*processor.SessionStatus, error) {
+	s, ok := p.session(sessionID)
+	if !ok {
+		return nil, processor.ErrSessionNotFound
+	}
+
+	return &processor.SessionStatus{
+		Status:          string(s.Status),
+		PaymentStatus:   string(s.PaymentStatus),
+		PaymentIntentID: s.PaymentIntent,
+	}, nil
+}
+
+// Refund refunds a paid session and sends charge.refunded. The refund stands
+// even when the webhook isn't accepted, as it would at Stripe.
+func (p *Processor) Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*processor.Refund, error) {
+	p.mu.Lock()
+	if r, ok := p.refunds[idempotencyKey]; ok {
+		refund := *r
+		p.mu.Unlock()
+		return &refund, nil
+	}
+
+	var paid *session
+	for _, s := range p.sessions {
+		if s.PaymentIntent == paymentIntentID {
+			paid = s
+			break
+		}
+	}
+	if paid == nil {
+		p.mu.Unlock()
+		return nil, processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("no payment %s", paymentIntentID))
+	}
+
+	left := paid.Amount - paid.Refunded
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		p.mu.Unlock()
+		return nil, processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("can't refund %d of payment %s, %d left", amount, paymentIntentID, left))
+	}
+	paid.Refunded += amount
+	refunded := *paid
+
+	r := &processor.Refund{
+		ID:     "re_fake_" + randomID(),
+		Amount: amount,
+		Status: "succeeded",
+	}
+	if idempotencyKey != "" {
+		p.refunds[idempotencyKey] = r
+	}
+	p.mu.Unlock()
+
+	charge := map[string]any{
+		"id":              "ch_fake_" + refunded.ID,
+		"object":          "charge",
+		"amount":          refunded.Amount,
+		"amount_refunded": refunded.Refunded,
+		"currency":        refunded.Currency,
+		"payment_intent":  refunded.PaymentIntent,
+		"refunded":        refunded.Refunded == refunded.Amount,
+	}
+	if err := p.sendEvent(ctx, "charge.refunded", charge); err != nil {
+		log.Printf("Failed to send charge.refunded for refund %s: %v", r.ID, err)
+	}
+
+	refund := *r
+	return &refund, nil
+}
+
+// orderAmount adds up the items of an order at the prices of their price IDs.
+func (p *Processor) orderAmount(o *pb.Order) int64 {
+	var amount int64
+	for _, item := range o.Items {
+		unitAmount, ok := p.prices[item.PriceID]
+		if !ok {
+			unitAmount = processor.UnitAmount
+		}
+		amount += int64(item.Quantity) * unitAmount
+	}
+
+	return amount
+}
+
+// LoadPrices reads the unit amounts of price IDs, in cents, from a JSON
+// object such as {"price_burger": 1250}. There are none without a path.
+func LoadPrices(path string) (map[string]int64, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := map[string]int64{}
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("reading prices from %s: %w", path, err)
+	}
+	for id, amount := range prices {
+		if amount < 0 {
+			return nil, fmt.Errorf("price %s in %s is negative", id, path)
+		}
+	}
+
+	return prices, nil
+}
+
+// Handler serves the hosted checkout pages.
+func (p *Processor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /checkout/{sessionID}", p.handleCheckout)
+	mux.HandleFunc("POST /checkout/{sessionID}/pay", p.handlePay)
+	mux.HandleFunc("POST /checkout/{sessionID}/cancel", p.handleCancel)
+
+	return mux
+}
+
+func (p *Processor) sessionURL(id string) string {
+	return fmt.Sprintf("%s/checkout/%s", p.baseURL, id)
+}
+
+func (p *Processor) session(id string) (session, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.sessions[id]
+	if !ok {
+		return session{}, false
+	}
+
+	return *s, true
+}
+
+var checkoutPage = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Checkout {{.ID}}</title></head>
+<body>
+<h1>Fake checkout</h1>
+<p>Order {{.Order.ID}} of customer {{.Order.CustomerID}}</p>
+<ul>
+{{range .Order.Items}}<li>{{.Quantity}} x {{if .Name}}{{.Name}}{{else}}{{.ID}}{{end}}</li>
+{{end}}</ul>
+<p>Total: {{.Amount}} {{.Currency}} (cents)</p>
+{{if eq .Status "open"}}
+<form method="post" action="/checkout/{{.ID}}/pay"><button type="submit">Pay</button></form>
+<form method="post" action="/checkout/{{.ID}}/cancel"><button type="submit">Cancel</button></form>
+{{else}}
+<p>This session is {{.Status}}, payment {{.PaymentStatus}}.</p>
+{{end}}
+</body>
+</html>
+`))
+
+func (p *Processor) handleCheckout(w http.ResponseWriter, r *http.Request) {
+	s, ok := p.session(r.PathValue("sessionID"))
+	if !ok {
+		http.Error(w, "checkout session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := checkoutPage.Execute(w, s); err != nil {
+		log.Printf("Failed to render checkout session %s: %v", s.ID, err)
+	}
+}
+
+func (p *Processor) handlePay(w http.ResponseWriter, r *http.Request) {
+	p.handleClose(w, r, true)
+}
+
+func (p *Processor) handleCancel(w http.ResponseWriter, r *http.Request) {
+	p.handleClose(w, r, false)
+}
+
+// handleClose pays or cancels a session and sends the customer back to the
+// gateway.
+func (p *Processor) handleClose(w http.ResponseWriter, r *http.Request, paid bool) {
+	id := r.PathValue("sessionID")
+
+	err := p.closeSession(r.Context(), id, paid)
+	switch {
+	case errors.Is(err, processor.ErrSessionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errSessionClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to close fake session %s: %v", id, err)
+		http.Error(w, fmt.Sprintf("the payments service did not accept the webhook: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	s, _ := p.session(id)
+	redirect := s.CancelURL
+	if paid {
+		redirect = s.SuccessURL
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+var errSessionClosed = errors.New("checkout session is not open")
+
+// closeSession pays or expires an open session and sends the matching
+// webhook. The session stays open when the webhook isn't accepted, so it can
+// be closed again.
+func (p *Processor) closeSession(ctx context.Context, id string, paid bool) error {
+	p.mu.Lock()
+	s, ok := p.sessions[id]
+	if !ok {
+		p.mu.Unlock()
+		return processor.ErrSessionNotFound
+	}
+	if s.Status != stripe.CheckoutSessionStatusOpen {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: %s is %s", errSessionClosed, id, s.Status)
+	}
+
+	closed := *s
+	eventType := "checkout.session.expired"
+	if paid {
+		closed.Status = stripe.CheckoutSessionStatusComplete
+		closed.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+		closed.PaymentIntent = "pi_fake_" + randomID()
+		eventType = "checkout.session.completed"
+	} else {
+		closed.Status = stripe.CheckoutSessionStatusExpired
+	}
+	p.mu.Unlock()
+
+	if err := p.sendEvent(ctx, eventType, p.sessionObject(&closed)); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if s.Status == stripe.CheckoutSessionStatusOpen {
+		*s = closed
+	}
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *Processor) sessionObject(s *session) map[string]any {
+	object := map[string]any{
+		"id":             s.ID,
+		"object":         "checkout.session",
+		"amount_total":   s.Amount,
+		"currency":       s.Currency,
+		"mode":           "payment",
+		"status":         s.Status,
+		"payment_status": s.PaymentStatus,
+		"url":            p.sessionURL(s.ID),
+		"success_url":    s.SuccessURL,
+		"cancel_url":     s.CancelURL,
+		"expires_at":     s.ExpiresAt.Unix(),
+		"metadata": map[string]string{
+			"orderID":    s.Order.ID,
+			"customerID": s.Order.CustomerID,
+			"locationID": s.Order.LocationID,
+		},
+	}
+	if s.PaymentIntent != "" {
+		object["payment_intent"] = s.PaymentIntent
+	}
+
+	return object
+}
+
+// sendEvent posts a Stripe event about an object to the webhook URL, signed
+// the way Stripe signs it.
+func (p *Processor) sendEvent(ctx context.Context, eventType string, object map[string]any) error {
+	payload, err := json.Marshal(map[string]any{
+		"id":          "evt_fake_" + randomID(),
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"livemode":    false,
+		"type":        eventType,
+		"data":        map[string]any{"object": object},
+	})
+	if err != nil {
+		return err
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  p.secret,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
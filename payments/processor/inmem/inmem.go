@@ -1,13 +1,172 @@
 package inmem
 
-import pb "github.com/scuba13/oms/common/api"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
 
-type Inmem struct {}
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/payments/processor"
+)
+
+type session struct {
+	processor.Session
+	status processor.SessionStatus
+}
+
+// Inmem keeps its sessions in memory and never talks to anyone. Sessions
+// are never paid, unless Pay is called.
+type Inmem struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	// created numbers the sessions, so an order paid again gets a new one
+	created int
+	// refunded is what was refunded of each payment intent
+	refunded map[string]int64
+	// refunds are the refunds made, by idempotency key
+	refunds map[string]*processor.Refund
+}
 
 func NewInmem() *Inmem {
-	return &Inmem{}
+	return &Inmem{
+		sessions: make(map[string]*session),
+		refunded: make(map[string]int64),
+		refunds:  make(map[string]*processor.Refund),
+	}
+}
+
+func (i *Inmem) QuoteOrder(ctx context.Context, o *pb.Order) (*processor.Quote, error) {
+	return &processor.Quote{Amount: orderAmount(o), Currency: "usd"}, nil
+}
+
+func (i *Inmem) CreateCheckoutSession(ctx context.Context, o *pb.Order) (*processor.Session, error) {
+	amount := orderAmount(o)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.created++
+	s := &session{
+		Session: processor.Session{
+			Processor: "inmem",
+			ID:        fmt.Sprintf("dummy-session-%s-%d", o.ID, i.created),
+			URL:       "dummy-link",
+			Amount:    amount,
+			Currency:  "usd",
+			ExpiresAt: time.Now().Add(processor.SessionTTL),
+		},
+		status: processor.SessionStatus{
+			Status:        processor.SessionOpen,
+			PaymentStatus: processor.PaymentStatusUnpaid,
+		},
+	}
+
+	i.sessions[s.ID] = s
+
+	session := s.Session
+	return &session, nil
+}
+
+// Pay completes an open session as if the customer paid it.
+func (i *Inmem) Pay(sessionID string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s, ok := i.sessions[sessionID]
+	if !ok {
+		return processor.ErrSessionNotFound
+	}
+	if s.status.Status != processor.SessionOpen {
+		return fmt.Errorf("session %s is %s", sessionID, s.status.Status)
+	}
+
+	s.status = processor.SessionStatus{
+		Status:          processor.SessionComplete,
+		PaymentStatus:   processor.PaymentStatusPaid,
+		PaymentIntentID: "dummy-intent-" + sessionID,
+	}
+
+	return nil
 }
 
-func (i *Inmem) CreatePaymentLink(*pb.Order) (string, error) {
-	return "dummy-link", nil
-}
\ No newline at end of file
+func (i *Inmem) ExpireSession(ctx context.Context, sessionID string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s, ok := i.sessions[sessionID]
+	if !ok {
+		return processor.ErrSessionNotFound
+	}
+	if s.status.Status != processor.SessionOpen {
+		return processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("session %s is %s", sessionID, s.status.Status))
+	}
+
+	s.status.Status = processor.SessionExpired
+	return nil
+}
+
+func (i *Inmem) GetSessionStatus(ctx context.Context, sessionID string) (*processor.SessionStatus, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s, ok := i.sessions[sessionID]
+	if !ok {
+		return nil, processor.ErrSessionNotFound
+	}
+
+	status := s.status
+	return &status, nil
+}
+
+func (i *Inmem) Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*processor.Refund, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if r, ok := i.refunds[idempotencyKey]; ok {
+		refund := *r
+		return &refund, nil
+	}
+
+	var paid *session
+	for _, s := range i.sessions {
+		if s.status.PaymentIntentID == paymentIntentID {
+			paid = s
+			break
+		}
+	}
+	if paid == nil {
+		return nil, processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("no payment %s", paymentIntentID))
+	}
+
+	left := paid.Amount - i.refunded[paymentIntentID]
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		return nil, processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("can't refund %d of payment %s, %d left", amount, paymentIntentID, left))
+	}
+	i.refunded[paymentIntentID] += amount
+
+	r := &processor.Refund{
+		ID:     fmt.Sprintf("dummy-refund-%s-%d", paymentIntentID, i.refunded[paymentIntentID]),
+		Amount: amount,
+		Status: "succeeded",
+	}
+	if idempotencyKey != "" {
+		i.refunds[idempotencyKey] = r
+	}
+
+	refund := *r
+	return &refund, nil
+}
+
+// orderAmount prices every unit of an order at processor.UnitAmount.
+func orderAmount(o *pb.Order) int64 {
+	var amount int64
+	for _, item := range o.Items {
+		amount += int64(item.Quantity) * processor.UnitAmount
+	}
+
+	return amount
+}
@@ -1,7 +1,124 @@
 package processor
 
-import pb "github.com/scuba13/oms/common/api"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+var ErrSessionNotFound = errors.New("checkout session not found")
+
+const (
+	// SessionTTL is how long the sessions of the processors that run
+	// locally can be paid, as long as Stripe's.
+	SessionTTL = 24 * time.Hour
+	// UnitAmount is what a unit of an order costs, in cents, at the
+	// processors that run locally and don't know its price.
+	UnitAmount = 1000
+)
+
+// Kinds of processor errors, match them with errors.Is.
+var (
+	// ErrRetryable is a failure that may go away, such as a timeout, a
+	// network error, rate limiting or a processor outage.
+	ErrRetryable = errors.New("processor temporarily unavailable")
+	// ErrPermanent is a request the processor refused for good, such as a
+	// declined card.
+	ErrPermanent = errors.New("processor refused the request")
+	// ErrInvalidRequest is a request the processor can't make sense of, such
+	// as an unknown price, and won't ever accept as is.
+	ErrInvalidRequest = errors.New("invalid processor request")
+	// ErrAuth is a processor refusing our credentials, it needs an operator.
+	ErrAuth = errors.New("processor authentication failed")
+)
+
+// Error is a processor failure of one of the kinds above.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func NewError(kind, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// Session is the checkout session a processor created for an order.
+type Session struct {
+	// Processor names the processor that created the session.
+	Processor string
+	ID        string
+	URL       string
+	// Amount is in the smallest unit of Currency, such as cents.
+	Amount   int64
+	Currency string
+	// ExpiresAt is when the session can no longer be paid.
+	ExpiresAt time.Time
+}
+
+// Quote is what a checkout session of an order would charge.
+type Quote struct {
+	// Amount is in the smallest unit of Currency. It is 0 for the
+	// processors that only know it once the order is paid.
+	Amount   int64
+	Currency string
+}
+
+// Session statuses, as Stripe names them.
+const (
+	SessionOpen     = "open"
+	SessionComplete = "complete"
+	SessionExpired  = "expired"
+
+	PaymentStatusPaid   = "paid"
+	PaymentStatusUnpaid = "unpaid"
+	// PaymentStatusFailed is a complete session whose payment failed to
+	// settle.
+	PaymentStatusFailed = "failed"
+)
+
+// SessionStatus is where a checkout session stands at the processor.
+type SessionStatus struct {
+	// Status is SessionOpen, SessionComplete or SessionExpired.
+	Status string
+	// PaymentStatus is PaymentStatusPaid, PaymentStatusUnpaid or
+	// PaymentStatusFailed. A complete session can still be unpaid while its
+	// payment settles.
+	PaymentStatus string
+	// PaymentIntentID is the payment behind the session, once there is one.
+	PaymentIntentID string
+}
+
+// Refund is money given back for a payment.
+type Refund struct {
+	ID     string
+	Amount int64
+	// Status is pending, succeeded or failed, as the processor reports it.
+	Status string
+}
 
 type PaymentProcessor interface {
-	CreatePaymentLink(*pb.Order) (string, error)
+	// QuoteOrder tells what the checkout session of an order would charge,
+	// without creating it.
+	QuoteOrder(ctx context.Context, o *pb.Order) (*Quote, error)
+	// CreateCheckoutSession creates the session the customer pays an order
+	// through.
+	CreateCheckoutSession(ctx context.Context, o *pb.Order) (*Session, error)
+	// ExpireSession closes an open session, so it can't be paid anymore.
+	ExpireSession(ctx context.Context, sessionID string) error
+	GetSessionStatus(ctx context.Context, sessionID string) (*SessionStatus, error)
+	// Refund gives back amount of a paid payment, or all of what was not
+	// refunded yet when amount is 0. A refund asked again with the same
+	// idempotency key is not made twice, the first one is returned.
+	Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*Refund, error)
 }
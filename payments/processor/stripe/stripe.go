@@ -1,13 +1,20 @@
 package stripe
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"time"
 
 	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/payments/processor"
 	"github.com/stripe/stripe-go/v78"
 	"github.com/stripe/stripe-go/v78/checkout/session"
+	"github.com/stripe/stripe-go/v78/price"
+	"github.com/stripe/stripe-go/v78/refund"
 )
 
 var gatewayHTTPAddr = common.EnvString("GATEWAY_HTTP_ADDRESS", "http://localhost:8080")
@@ -20,8 +27,37 @@ func NewProcessor() *Stripe {
 	return &Stripe{}
 }
 
+// QuoteOrder adds up the prices of the order items, as the checkout session
+// would.
+func (s *Stripe) QuoteOrder(ctx context.Context, o *pb.Order) (*processor.Quote, error) {
+	quote := &processor.Quote{}
+	prices := map[string]*stripe.Price{}
+	for _, item := range o.Items {
+		p, ok := prices[item.PriceID]
+		if !ok {
+			params := &stripe.PriceParams{}
+			params.Context = ctx
+
+			var err error
+			p, err = price.Get(item.PriceID, params)
+			if err != nil {
+				return nil, classify(err)
+			}
+			prices[item.PriceID] = p
+		}
+
+		currency := string(p.Currency)
+		if quote.Currency != "" && currency != quote.Currency {
+			return nil, processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("order %s mixes %s and %s prices", o.ID, quote.Currency, currency))
+		}
+		quote.Currency = currency
+		quote.Amount += p.UnitAmount * int64(item.Quantity)
+	}
+
+	return quote, nil
+}
 
-func (s *Stripe) CreatePaymentLink(o *pb.Order) (string, error) {
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, o *pb.Order) (*processor.Session, error) {
 	log.Printf("Creating payment link for order %v", o)
 
 	gatewaySuccessURL := fmt.Sprintf("%s/success.html?customerID=%s&orderID=%s", gatewayHTTPAddr, o.CustomerID, o.ID)
@@ -35,21 +71,137 @@ func (s *Stripe) CreatePaymentLink(o *pb.Order) (string, error) {
 		})
 	}
 
+	metadata := map[string]string{
+		"orderID":    o.ID,
+		"customerID": o.CustomerID,
+		"locationID": o.LocationID,
+	}
+
 	params := &stripe.CheckoutSessionParams{
-		Metadata: map[string]string{
-			"orderID":    o.ID,
-			"customerID": o.CustomerID,
+		Metadata: metadata,
+		// the charges of the payment intent are given its metadata, which
+		// tells whose cards they are
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: metadata,
 		},
 		LineItems:  items,
 		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
 		SuccessURL: stripe.String(gatewaySuccessURL),
 		CancelURL:  stripe.String(gatewayCancelURL),
 	}
+	params.Context = ctx
 
 	result, err := session.New(params)
 	if err != nil {
-		return "", nil
+		return nil, classify(err)
+	}
+
+	return &processor.Session{
+		Processor: ProcessorName,
+		ID:        result.ID,
+		URL:       result.URL,
+		Amount:    result.AmountTotal,
+		Currency:  string(result.Currency),
+		ExpiresAt: time.Unix(result.ExpiresAt, 0),
+	}, nil
+}
+
+func (s *Stripe) ExpireSession(ctx context.Context, sessionID string) error {
+	params := &stripe.CheckoutSessionExpireParams{}
+	params.Context = ctx
+
+	if _, err := session.Expire(sessionID, params); err != nil {
+		return classifySession(err)
+	}
+
+	return nil
+}
+
+func (s *Stripe) GetSessionStatus(ctx context.Context, sessionID string) (*processor.SessionStatus, error) {
+	params := &stripe.CheckoutSessionParams{}
+	params.AddExpand("payment_intent")
+	params.Context = ctx
+
+	result, err := session.Get(sessionID, params)
+	if err != nil {
+		return nil, classifySession(err)
+	}
+
+	status := &processor.SessionStatus{
+		Status:        string(result.Status),
+		PaymentStatus: string(result.PaymentStatus),
+	}
+	if result.PaymentIntent != nil {
+		status.PaymentIntentID = result.PaymentIntent.ID
+
+		// a failed asynchronous payment leaves the session unpaid and its
+		// payment intent waiting for another payment method
+		failed := result.PaymentIntent.Status == stripe.PaymentIntentStatusRequiresPaymentMethod ||
+			result.PaymentIntent.Status == stripe.PaymentIntentStatusCanceled
+		if result.Status == stripe.CheckoutSessionStatusComplete && result.PaymentStatus == stripe.CheckoutSessionPaymentStatusUnpaid && failed {
+			status.PaymentStatus = processor.PaymentStatusFailed
+		}
+	}
+
+	return status, nil
+}
+
+func (s *Stripe) Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*processor.Refund, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(paymentIntentID),
+	}
+	if amount > 0 {
+		params.Amount = stripe.Int64(amount)
+	}
+	params.Context = ctx
+	params.SetIdempotencyKey(idempotencyKey)
+
+	result, err := refund.New(params)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	return &processor.Refund{
+		ID:     result.ID,
+		Amount: result.Amount,
+		Status: string(result.Status),
+	}, nil
+}
+
+// classifySession is classify for the requests about a checkout session,
+// a session Stripe doesn't know, answered with resource_missing, is
+// processor.ErrSessionNotFound.
+func classifySession(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		return fmt.Errorf("%w: %v", processor.ErrSessionNotFound, err)
+	}
+
+	return classify(err)
+}
+
+// classify tells the kind of a Stripe API error, see processor.ErrRetryable
+// and the other kinds.
+func classify(err error) error {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		// the request didn't get an answer, such as on network errors
+		return processor.NewError(processor.ErrRetryable, err)
+	}
+
+	switch {
+	case stripeErr.HTTPStatusCode == http.StatusTooManyRequests,
+		stripeErr.HTTPStatusCode == http.StatusConflict,
+		stripeErr.HTTPStatusCode >= http.StatusInternalServerError,
+		stripeErr.Type == stripe.ErrorTypeAPI:
+		return processor.NewError(processor.ErrRetryable, err)
+	case stripeErr.HTTPStatusCode == http.StatusUnauthorized,
+		stripeErr.HTTPStatusCode == http.StatusForbidden:
+		return processor.NewError(processor.ErrAuth, err)
+	case stripeErr.Type == stripe.ErrorTypeInvalidRequest,
+		stripeErr.Type == stripe.ErrorTypeIdempotency:
+		return processor.NewError(processor.ErrInvalidRequest, err)
 	}
 
-	return result.URL, nil
+	return processor.NewError(processor.ErrPermanent, err)
 }
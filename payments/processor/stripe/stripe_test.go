@@ -0,0 +1,83 @@
+package stripe
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/stripe/stripe-go/v78"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"network error", errors.New("connection reset"), processor.ErrRetryable},
+		{"rate limited", &stripe.Error{HTTPStatusCode: http.StatusTooManyRequests}, processor.ErrRetryable},
+		{"server error", &stripe.Error{HTTPStatusCode: http.StatusBadGateway, Type: stripe.ErrorTypeAPI}, processor.ErrRetryable},
+		{"bad key", &stripe.Error{HTTPStatusCode: http.StatusUnauthorized, Type: stripe.ErrorTypeInvalidRequest}, processor.ErrAuth},
+		{"unknown price", &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Type: stripe.ErrorTypeInvalidRequest}, processor.ErrInvalidRequest},
+		{"card declined", &stripe.Error{HTTPStatusCode: http.StatusPaymentRequired, Type: stripe.ErrorTypeCard}, processor.ErrPermanent},
+	}
+	for _, tt := range tests {
+		if err := classify(tt.err); !errors.Is(err, tt.want) || !errors.Is(err, tt.err) {
+			t.Errorf("classified %s as %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestClassifySession(t *testing.T) {
+	missing := &stripe.Error{HTTPStatusCode: http.StatusNotFound, Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing}
+	if err := classifySession(missing); !errors.Is(err, processor.ErrSessionNotFound) {
+		t.Errorf("classified a missing session as %v, want %v", err, processor.ErrSessionNotFound)
+	}
+
+	// a 404 for anything but the session, such as a wrong API path
+	notFound := &stripe.Error{HTTPStatusCode: http.StatusNotFound, Type: stripe.ErrorTypeInvalidRequest}
+	if err := classifySession(notFound); errors.Is(err, processor.ErrSessionNotFound) || !errors.Is(err, processor.ErrInvalidRequest) {
+		t.Errorf("classified a 404 as %v, want %v", err, processor.ErrInvalidRequest)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	w := &webhooks{}
+	tests := []struct {
+		name    string
+		payload string
+		want    processor.EventKind
+	}{
+		{"a paid session", `{"type": "checkout.session.completed", "data": {"object": {"id": "cs_1", "payment_status": "paid", "amount_total": 1250, "metadata": {"orderID": "order-1"}}}}`, processor.EventPaid},
+		{"a session waiting for its payment", `{"type": "checkout.session.completed", "data": {"object": {"id": "cs_1", "payment_status": "unpaid"}}}`, processor.EventProcessing},
+		{"a failed payment", `{"type": "checkout.session.async_payment_failed", "data": {"object": {"id": "cs_1"}}}`, processor.EventFailed},
+		{"an expired session", `{"type": "checkout.session.expired", "data": {"object": {"id": "cs_1"}}}`, processor.EventExpired},
+		{"a refund", `{"type": "charge.refunded", "data": {"object": {"payment_intent": "pi_1", "amount_refunded": 500}}}`, processor.EventRefunded},
+		{"a dispute", `{"type": "charge.dispute.created", "data": {"object": {"payment_intent": "pi_1", "reason": "fraudulent"}}}`, processor.EventDisputed},
+	}
+	for _, tt := range tests {
+		e, err := w.Translate("", []byte(tt.payload))
+		if err != nil || e == nil || e.Kind != tt.want {
+			t.Errorf("translated %s to %+v, %v, want %s", tt.name, e, err, tt.want)
+		}
+	}
+
+	e, _ := w.Translate("", []byte(tests[0].payload))
+	if e.SessionID != "cs_1" || e.Amount != 1250 || e.Metadata["orderID"] != "order-1" {
+		t.Errorf("got paid event %+v, want session cs_1 of order-1 for 1250", e)
+	}
+
+	// events that don't concern payments are ignored
+	for _, payload := range []string{
+		`{"type": "customer.created", "data": {"object": {"id": "cus_1"}}}`,
+		`{"type": "charge.refunded", "data": {"object": {"amount_refunded": 500}}}`,
+	} {
+		if e, err := w.Translate("", []byte(payload)); e != nil || err != nil {
+			t.Errorf("translated %s to %+v, %v, want nothing", payload, e, err)
+		}
+	}
+	if _, err := w.Translate("", []byte("not json")); err == nil {
+		t.Error("translating a malformed payload returned no error")
+	}
+}
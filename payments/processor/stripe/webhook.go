@@ -0,0 +1,145 @@
+package stripe
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/webhook"
+)
+
+// ProcessorName names Stripe in payments and webhooks.
+const ProcessorName = "stripe"
+
+// NewWebhookProvider receives the Stripe webhooks posted to route, signed
+// with the endpoint secret.
+func NewWebhookProvider(route, endpointSecret string) *processor.WebhookProvider {
+	w := &webhooks{endpointSecret}
+
+	return &processor.WebhookProvider{
+		Processor:  ProcessorName,
+		Route:      route,
+		Verifier:   w,
+		Translator: w,
+	}
+}
+
+type webhooks struct {
+	endpointSecret string
+}
+
+func (w *webhooks) Verify(header http.Header, payload []byte) (string, string, error) {
+	event, err := webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), w.endpointSecret)
+	if err != nil {
+		return "", "", err
+	}
+
+	return event.ID, string(event.Type), nil
+}
+
+func (w *webhooks) Translate(eventType string, payload []byte) (*processor.Event, error) {
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded",
+		"checkout.session.async_payment_failed", "checkout.session.expired":
+		var session stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+			return nil, err
+		}
+		return sessionEvent(event, &session), nil
+
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, err
+		}
+		if charge.PaymentIntent == nil {
+			// charges made outside of a checkout session
+			return nil, nil
+		}
+
+		return &processor.Event{
+			Kind:            processor.EventRefunded,
+			PaymentIntentID: charge.PaymentIntent.ID,
+			AmountRefunded:  charge.AmountRefunded,
+			FullyRefunded:   charge.Refunded,
+		}, nil
+
+	case "charge.succeeded", "charge.failed":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, err
+		}
+		details := charge.PaymentMethodDetails
+		if details == nil || details.Card == nil || details.Card.Fingerprint == "" {
+			// paid with something else than a card
+			return nil, nil
+		}
+
+		e := &processor.Event{
+			Kind:            processor.EventCardUsed,
+			CardFingerprint: details.Card.Fingerprint,
+			Reason:          charge.FailureMessage,
+			Metadata:        charge.Metadata,
+		}
+		if charge.PaymentIntent != nil {
+			e.PaymentIntentID = charge.PaymentIntent.ID
+		}
+
+		return e, nil
+
+	case "charge.dispute.created":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return nil, err
+		}
+		if dispute.PaymentIntent == nil {
+			return nil, nil
+		}
+
+		return &processor.Event{
+			Kind:            processor.EventDisputed,
+			PaymentIntentID: dispute.PaymentIntent.ID,
+			Reason:          string(dispute.Reason),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// sessionEvent tells what happened to a checkout session. A session
+// completed before its payment settled is processing, until an asynchronous
+// payment event tells how it went.
+func sessionEvent(event stripe.Event, session *stripe.CheckoutSession) *processor.Event {
+	e := &processor.Event{
+		SessionID: session.ID,
+		Amount:    session.AmountTotal,
+		Currency:  string(session.Currency),
+		Metadata:  session.Metadata,
+	}
+	if session.PaymentIntent != nil {
+		e.PaymentIntentID = session.PaymentIntent.ID
+	}
+
+	switch event.Type {
+	case "checkout.session.completed":
+		e.Kind = processor.EventProcessing
+		if session.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid {
+			e.Kind = processor.EventPaid
+		}
+	case "checkout.session.async_payment_succeeded":
+		e.Kind = processor.EventPaid
+	case "checkout.session.async_payment_failed":
+		e.Kind = processor.EventFailed
+		e.Reason = "asynchronous payment failed"
+	case "checkout.session.expired":
+		e.Kind = processor.EventExpired
+	}
+
+	return e
+}
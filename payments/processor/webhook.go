@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// EventKind is what happened to a payment, whatever the processor calls it.
+type EventKind string
+
+const (
+	// EventPaid is a payment the processor captured.
+	EventPaid EventKind = "paid"
+	// EventProcessing is a completed session whose payment settles later.
+	EventProcessing EventKind = "processing"
+	EventFailed     EventKind = "failed"
+	EventExpired    EventKind = "expired"
+	EventRefunded   EventKind = "refunded"
+	EventDisputed   EventKind = "disputed"
+	// EventCardUsed is a card charged for a payment, whether the charge went
+	// through or not. It doesn't change the payment status.
+	EventCardUsed EventKind = "card_used"
+)
+
+// Event is what a processor webhook tells about a payment, translated from
+// the processor's own event. The webhook ID tells the event apart.
+type Event struct {
+	Kind EventKind
+	// SessionID names the payment, or PaymentIntentID for events about
+	// charges, which don't know their session.
+	SessionID       string
+	PaymentIntentID string
+	// Amount and Currency are what the session is worth, or what was
+	// collected for payments whose amount is only known once paid.
+	Amount   int64
+	Currency string
+	// Collected tells that Amount is what was collected, which replaces the
+	// amount recorded on the payment. The amounts of the other events are
+	// only informative.
+	Collected bool
+	// AmountRefunded is the total refunded so far, for EventRefunded, and
+	// FullyRefunded tells whether that is everything.
+	AmountRefunded int64
+	FullyRefunded  bool
+	// CardFingerprint tells the card charged apart from other cards, for
+	// EventCardUsed.
+	CardFingerprint string
+	Reason          string
+	// Metadata is what the session was created with. It tells the order of
+	// sessions whose payment was never recorded, and the customer of charges.
+	Metadata map[string]string
+}
+
+// WebhookVerifier checks that a webhook comes from its processor.
+type WebhookVerifier interface {
+	// Verify checks the signature of a webhook and tells its event ID and
+	// type.
+	Verify(header http.Header, payload []byte) (id, eventType string, err error)
+}
+
+// EventTranslator reads the webhooks of a processor.
+type EventTranslator interface {
+	// Translate turns the payload of a verified webhook into the payment
+	// event it tells about, or nil for events that don't concern payments.
+	// Errors are payloads that can't be read.
+	Translate(eventType string, payload []byte) (*Event, error)
+}
+
+// WebhookProvider is how the webhooks of a processor are received and read.
+type WebhookProvider struct {
+	// Processor names the processor, as its payments record it.
+	Processor string
+	// Route is the path the processor posts its webhooks to, with its
+	// Verifier. It is empty for processors whose events are not received
+	// over HTTP, such as manual confirmations.
+	Route      string
+	Verifier   WebhookVerifier
+	Translator EventTranslator
+}
+
+// WebhookRegistry holds the webhook provider of every processor.
+type WebhookRegistry struct {
+	providers map[string]*WebhookProvider
+}
+
+func NewWebhookRegistry() *WebhookRegistry {
+	return &WebhookRegistry{providers: make(map[string]*WebhookProvider)}
+}
+
+// Register adds the provider of a processor. A processor or a route can only
+// be registered once.
+func (r *WebhookRegistry) Register(p *WebhookProvider) error {
+	if p.Processor == "" || p.Translator == nil {
+		return errors.New("webhook provider needs a processor and a translator")
+	}
+	if p.Route != "" && p.Verifier == nil {
+		return fmt.Errorf("webhook provider %s has a route but no verifier", p.Processor)
+	}
+	if _, ok := r.providers[p.Processor]; ok {
+		return fmt.Errorf("webhook provider %s is already registered", p.Processor)
+	}
+	for _, other := range r.providers {
+		if p.Route != "" && other.Route == p.Route {
+			return fmt.Errorf("webhook route %s is already taken by %s", p.Route, other.Processor)
+		}
+	}
+
+	r.providers[p.Processor] = p
+	return nil
+}
+
+func (r *WebhookRegistry) Provider(processor string) (*WebhookProvider, bool) {
+	p, ok := r.providers[processor]
+	return p, ok
+}
+
+// Providers returns every provider, by processor name.
+func (r *WebhookRegistry) Providers() []*WebhookProvider {
+	res := make([]*WebhookProvider, 0, len(r.providers))
+	for _, p := range r.providers {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Processor < res[j].Processor })
+
+	return res
+}
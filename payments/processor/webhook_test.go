@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"net/http"
+	"testing"
+)
+
+type noTranslator struct{}
+
+func (noTranslator) Translate(eventType string, payload []byte) (*Event, error) {
+	return nil, nil
+}
+
+type noVerifier struct{}
+
+func (noVerifier) Verify(header http.Header, payload []byte) (string, string, error) {
+	return "", "", nil
+}
+
+func TestWebhookRegistry(t *testing.T) {
+	r := NewWebhookRegistry()
+	for _, p := range []*WebhookProvider{
+		{Processor: "stripe", Route: "/webhook", Verifier: noVerifier{}, Translator: noTranslator{}},
+		{Processor: "counter", Translator: noTranslator{}},
+	} {
+		if err := r.Register(p); err != nil {
+			t.Fatalf("registering %s: %v", p.Processor, err)
+		}
+	}
+
+	rejected := []struct {
+		name string
+		p    *WebhookProvider
+	}{
+		{"no processor", &WebhookProvider{Translator: noTranslator{}}},
+		{"no translator", &WebhookProvider{Processor: "adyen"}},
+		{"a route without a verifier", &WebhookProvider{Processor: "adyen", Route: "/adyen", Translator: noTranslator{}}},
+		{"a processor registered twice", &WebhookProvider{Processor: "counter", Translator: noTranslator{}}},
+		{"a route taken", &WebhookProvider{Processor: "adyen", Route: "/webhook", Verifier: noVerifier{}, Translator: noTranslator{}}},
+	}
+	for _, tt := range rejected {
+		if err := r.Register(tt.p); err == nil {
+			t.Errorf("registering %s returned no error", tt.name)
+		}
+	}
+
+	if p, ok := r.Provider("stripe"); !ok || p.Route != "/webhook" {
+		t.Errorf("got provider %+v, want stripe on /webhook", p)
+	}
+	if _, ok := r.Provider("adyen"); ok {
+		t.Error("got a provider of adyen, which was never registered")
+	}
+
+	providers := r.Providers()
+	if len(providers) != 2 || providers[0].Processor != "counter" || providers[1].Processor != "stripe" {
+		t.Errorf("got %d providers, want counter and stripe in order", len(providers))
+	}
+}
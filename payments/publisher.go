@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/scuba13/oms/common/broker"
+	"go.opentelemetry.io/otel"
+)
+
+type amqpPublisher struct {
+	channel *amqp.Channel
+}
+
+// NewPublisher puts the channel in confirm mode, so Publish only succeeds
+// once the broker took the message.
+func NewPublisher(channel *amqp.Channel) (*amqpPublisher, error) {
+	if err := channel.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	return &amqpPublisher{channel}, nil
+}
+
+func (p *amqpPublisher) Publish(ctx context.Context, exchange string, v any) error {
+	marshalled, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tr := otel.Tracer("amqp")
+	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", exchange))
+	defer messageSpan.End()
+
+	headers := broker.InjectAMQPHeaders(amqpContext)
+
+	// publish a message
+	confirmation, err := p.channel.PublishWithDeferredConfirmWithContext(amqpContext, exchange, "", false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         marshalled,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	// a message the broker drops fails the caller, such as a webhook, which
+	// is retried
+	acked, err := confirmation.WaitContext(amqpContext)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker did not take the message published to %s", exchange)
+	}
+
+	log.Printf("Message published %s", exchange)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reconcileBatchSize is how many payments a reconciliation checks at most,
+// the least recently checked first. The rest are checked by the next runs.
+const reconcileBatchSize = 100
+
+// Discrepancy is a payment whose recorded status didn't match what the
+// processor tells about its session.
+type Discrepancy struct {
+	PaymentID     string        `bson:"paymentID"`
+	OrderID       string        `bson:"orderID"`
+	SessionID     string        `bson:"sessionID"`
+	Recorded      PaymentStatus `bson:"recorded"`
+	SessionStatus string        `bson:"sessionStatus,omitempty"`
+	PaymentStatus string        `bson:"paymentStatus,omitempty"`
+	// Action is what the reconciliation did about it, empty when it could
+	// not do anything.
+	Action string `bson:"action,omitempty"`
+	Error  string `bson:"error,omitempty"`
+}
+
+// ReconciliationReport is the outcome of a reconciliation run.
+type ReconciliationReport struct {
+	ID string `bson:"_id"`
+	// Before is the creation time the checked payments are older than.
+	Before        time.Time      `bson:"before"`
+	StartedAt     time.Time      `bson:"startedAt"`
+	FinishedAt    time.Time      `bson:"finishedAt"`
+	Checked       int            `bson:"checked"`
+	Discrepancies []*Discrepancy `bson:"discrepancies"`
+}
+
+// ReconcilePayments asks the processor about the payments created before a
+// time that are still open or processing, in case a webhook was lost. Paid
+// sessions publish order.paid, failed and expired ones payment.failed and
+// payment.expired, and the payments are moved to the status the processor
+// tells. The event is published before the payment is updated, so it is
+// published again by the next run rather than lost when the update fails.
+// The report is stored and returned.
+func (s *service) ReconcilePayments(ctx context.Context, before time.Time) (*ReconciliationReport, error) {
+	report := &ReconciliationReport{
+		ID:            primitive.NewObjectID().Hex(),
+		Before:        before,
+		StartedAt:     time.Now(),
+		Discrepancies: []*Discrepancy{},
+	}
+
+	payments, err := s.store.ListStale(ctx, before, reconcileBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	checked := make([]string, 0, len(payments))
+	for _, p := range payments {
+		report.Checked++
+		if d := s.reconcilePayment(ctx, p); d != nil {
+			report.Discrepancies = append(report.Discrepancies, d)
+		}
+		checked = append(checked, p.ID)
+	}
+	report.FinishedAt = time.Now()
+
+	if len(checked) > 0 {
+		if err := s.store.MarkReconciled(ctx, checked, report.StartedAt); err != nil {
+			// the same payments come first again next run
+			log.Printf("Failed to mark %d payments reconciled: %v", len(checked), err)
+		}
+	}
+
+	if err := s.store.SaveReconciliation(ctx, report); err != nil {
+		return report, fmt.Errorf("storing reconciliation %s: %w", report.ID, err)
+	}
+
+	return report, nil
+}
+
+func (s *service) reconcilePayment(ctx context.Context, p *Payment) *Discrepancy {
+	d := &Discrepancy{
+		PaymentID: p.ID,
+		OrderID:   p.OrderID,
+		SessionID: p.SessionID,
+		Recorded:  p.Status,
+	}
+
+	paymentProcessor, err := s.processor(p.PaymentMethod)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+
+	status, err := paymentProcessor.GetSessionStatus(ctx, p.SessionID)
+	if err != nil {
+		d.Error = fmt.Sprintf("getting the session status: %v", err)
+		return d
+	}
+	d.SessionStatus = status.Status
+	d.PaymentStatus = status.PaymentStatus
+
+	var to PaymentStatus
+	var exchange string
+	switch {
+	case status.Status == processor.SessionComplete && status.PaymentStatus == processor.PaymentStatusPaid:
+		to, exchange = PaymentPaid, broker.OrderPaidEvent
+	case status.Status == processor.SessionComplete && status.PaymentStatus == processor.PaymentStatusFailed:
+		to, exchange = PaymentFailed, broker.PaymentFailedEvent
+	case status.Status == processor.SessionComplete:
+		to = PaymentProcessing
+	case status.Status == processor.SessionExpired:
+		to, exchange = PaymentExpired, broker.PaymentExpiredEvent
+	default:
+		// still open, the customer can still pay
+		return nil
+	}
+	if to == p.Status {
+		return nil
+	}
+	if !p.Status.CanMoveTo(to) {
+		d.Error = fmt.Sprintf("payment is %s, can't move to %s", p.Status, to)
+		return d
+	}
+
+	u := &PaymentUpdate{
+		Processor:       p.Processor,
+		SessionID:       p.SessionID,
+		PaymentIntentID: status.PaymentIntentID,
+		Status:          to,
+		EventID:         fmt.Sprintf("reconcile-%s-%s", p.SessionID, to),
+		Reason:          "reconciled with the processor",
+	}
+
+	if exchange != "" {
+		// the event is about the payment once updated
+		updated := *p
+		updated.Status = to
+		updated.UpdatedAt = time.Now()
+
+		var v any = updated.Event(u.Reason)
+		if exchange == broker.OrderPaidEvent {
+			v = updated.PaidOrder()
+		}
+		if err := s.publisher.Publish(ctx, exchange, v); err != nil {
+			d.Error = fmt.Sprintf("publishing %s: %v", exchange, err)
+			return d
+		}
+		d.Action = fmt.Sprintf("published %s", exchange)
+	}
+
+	if _, err := s.UpdatePayment(ctx, u); err != nil {
+		d.Error = fmt.Sprintf("moving the payment to %s: %v", to, err)
+		return d
+	}
+
+	if d.Action != "" {
+		d.Action += ", "
+	}
+	d.Action += fmt.Sprintf("moved to %s", to)
+
+	log.Printf("Reconciled payment %s of order %s: %s", p.ID, p.OrderID, d.Action)
+	return d
+}
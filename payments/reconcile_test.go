@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor/inmem"
+)
+
+func TestReconcilePayments(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	publisher := &memoryPublisher{}
+	sessions := inmem.NewInmem()
+	svc := NewService(byMethod(sessions), &memoryOrders{}, store, store, publisher, noRiskRules{})
+
+	session := make(map[string]string)
+	for _, id := range []string{"paid", "expired", "open"} {
+		if _, err := svc.CreatePayment(ctx, &pb.Order{ID: id, CustomerID: "customer-1", LocationID: "downtown"}); err != nil {
+			t.Fatalf("creating the payment of %s: %v", id, err)
+		}
+		payments, _ := store.ListByOrder(ctx, id)
+		session[id] = payments[0].SessionID
+	}
+	if err := sessions.Pay(session["paid"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.ExpireSession(ctx, session["expired"]); err != nil {
+		t.Fatal(err)
+	}
+	// a payment whose session the processor doesn't know can't be settled
+	lost := &Payment{ID: "lost", OrderID: "lost", Processor: "inmem", SessionID: "unknown", Status: PaymentOpen, CreatedAt: time.Now()}
+	if err := store.Create(ctx, lost); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := svc.ReconcilePayments(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("reconciling: %v", err)
+	}
+	if report.Checked != 4 || len(report.Discrepancies) != 3 {
+		t.Fatalf("checked %d payments with discrepancies %+v, want 4 with 3", report.Checked, report.Discrepancies)
+	}
+	for _, d := range report.Discrepancies {
+		if d.OrderID == "lost" && d.Error == "" {
+			t.Errorf("got discrepancy %+v, want the unknown session reported", d)
+		}
+		if d.OrderID != "lost" && (d.Error != "" || d.Action == "") {
+			t.Errorf("got discrepancy %+v, want it settled", d)
+		}
+	}
+	if len(store.reconciliations) != 1 {
+		t.Errorf("stored %d reports, want 1", len(store.reconciliations))
+	}
+
+	want := map[string]PaymentStatus{"paid": PaymentPaid, "expired": PaymentExpired, "open": PaymentOpen, "lost": PaymentOpen}
+	for order, status := range want {
+		payments, _ := store.ListByOrder(ctx, order)
+		if payments[0].Status != status {
+			t.Errorf("the payment of %s is %s, want %s", order, payments[0].Status, status)
+		}
+		if payments[0].LastReconciledAt.IsZero() {
+			t.Errorf("the payment of %s isn't marked reconciled", order)
+		}
+	}
+
+	paid := publisher.published(broker.OrderPaidEvent)
+	if len(paid) != 1 || paid[0].(*pb.Order).ID != "paid" || paid[0].(*pb.Order).LocationID != "downtown" {
+		t.Errorf("published %s %+v, want the paid order at downtown", broker.OrderPaidEvent, paid)
+	}
+	if expired := publisher.published(broker.PaymentExpiredEvent); len(expired) != 1 {
+		t.Errorf("published %d %s, want 1", len(expired), broker.PaymentExpiredEvent)
+	}
+
+	// the settled payments aren't stale anymore
+	if report, err = svc.ReconcilePayments(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("reconciling again: %v", err)
+	}
+	if report.Checked != 2 || len(publisher.published(broker.OrderPaidEvent)) != 1 {
+		t.Errorf("checked %d payments again, want only the open and lost ones", report.Checked)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Refund records money given back for a payment through RefundPayment.
+type Refund struct {
+	ID        string `bson:"_id"`
+	PaymentID string `bson:"paymentID"`
+	OrderID   string `bson:"orderID"`
+	// ProcessorRefundID is the refund at the payment processor.
+	ProcessorRefundID string `bson:"processorRefundID"`
+	Amount            int64  `bson:"amount"`
+	Currency          string `bson:"currency"`
+	// Status is RefundRequested until the processor answers, then what the
+	// processor reports, or RefundFailed when it refused the refund.
+	Status    string        `bson:"status"`
+	Reason    string        `bson:"reason,omitempty"`
+	Items     []*RefundItem `bson:"items,omitempty"`
+	Actor     string        `bson:"actor,omitempty"`
+	CreatedAt time.Time     `bson:"createdAt"`
+}
+
+// Statuses of a refund, besides the ones the processor reports.
+const (
+	// RefundRequested is a refund recorded before asking the processor for
+	// it, and whose answer is not known yet. Asking for the same refund again
+	// retries it with the same idempotency key.
+	RefundRequested = "requested"
+	RefundFailed    = "failed"
+	RefundCanceled  = "canceled"
+)
+
+// Void tells whether a refund gave nothing back.
+func (r *Refund) Void() bool {
+	return r.Status == RefundFailed || r.Status == RefundCanceled
+}
+
+// RefundItem is an order line given back, for Amount.
+type RefundItem struct {
+	ItemID   string `bson:"itemID"`
+	Quantity int32  `bson:"quantity"`
+	Amount   int64  `bson:"amount"`
+}
+
+// RefundRequest asks for Amount, or for the sum of the Items amounts, to be
+// given back. With neither, everything not refunded yet is.
+type RefundRequest struct {
+	PaymentID string
+	Amount    int64
+	Items     []*RefundItem
+	Reason    string
+	Actor     string
+}
+
+func (r *Refund) ToProto() *pb.Refund {
+	return &pb.Refund{
+		ID:                r.ID,
+		PaymentID:         r.PaymentID,
+		OrderID:           r.OrderID,
+		ProcessorRefundID: r.ProcessorRefundID,
+		Amount:            r.Amount,
+		Currency:          r.Currency,
+		Status:            r.Status,
+		Reason:            r.Reason,
+		Items:             refundItemsToProto(r.Items),
+		Actor:             r.Actor,
+		CreatedAt:         r.CreatedAt.Unix(),
+	}
+}
+
+func refundItemsToProto(items []*RefundItem) []*pb.RefundItem {
+	res := make([]*pb.RefundItem, 0, len(items))
+	for _, i := range items {
+		res = append(res, &pb.RefundItem{
+			ItemID:   i.ItemID,
+			Quantity: i.Quantity,
+			Amount:   i.Amount,
+		})
+	}
+
+	return res
+}
+
+func refundItemsFromProto(items []*pb.RefundItem) []*RefundItem {
+	res := make([]*RefundItem, 0, len(items))
+	for _, i := range items {
+		res = append(res, &RefundItem{
+			ItemID:   i.ItemID,
+			Quantity: i.Quantity,
+			Amount:   i.Amount,
+		})
+	}
+
+	return res
+}
+
+// RefundPayment gives back money of a paid payment through its processor,
+// records the refund and publishes payment.refunded with the refunded items.
+// Refunds can't add up to more than what was captured, and an item can't be
+// refunded more times than it was ordered.
+//
+// The refund is recorded before the processor is asked for it, and its ID is
+// the idempotency key, so asking again for a refund whose answer was lost
+// doesn't give the money back twice.
+func (s *service) RefundPayment(ctx context.Context, r *RefundRequest) (*Refund, error) {
+	switch {
+	case r.PaymentID == "":
+		return nil, fmt.Errorf("%w: payment ID is required", ErrInvalidArgument)
+	case r.Amount < 0:
+		return nil, fmt.Errorf("%w: amount can't be negative", ErrInvalidArgument)
+	case r.Amount > 0 && len(r.Items) > 0:
+		return nil, fmt.Errorf("%w: refund either an amount or items", ErrInvalidArgument)
+	}
+
+	p, err := s.store.Get(ctx, r.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Status {
+	case PaymentPaid, PaymentPartiallyRefunded, PaymentDisputed:
+	default:
+		return nil, fmt.Errorf("%w: payment %s is %s, only paid payments can be refunded", ErrInvalidStatus, p.ID, p.Status)
+	}
+	if p.PaymentIntentID == "" {
+		return nil, fmt.Errorf("%w: payment %s has no captured payment to refund", ErrInvalidStatus, p.ID)
+	}
+
+	paymentProcessor, err := s.processor(p.PaymentMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	refunds, err := s.store.ListRefunds(ctx, p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := requestedRefund(refunds, r)
+	if refund == nil {
+		refund, err = s.newRefund(ctx, p, refunds, r)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.store.CreateRefund(ctx, refund); err != nil {
+			return nil, err
+		}
+	}
+
+	processorRefund, err := paymentProcessor.Refund(ctx, p.PaymentIntentID, refund.Amount, refund.ID)
+	if errors.Is(err, processor.ErrInvalidRequest) || errors.Is(err, processor.ErrPermanent) {
+		refund.Status = RefundFailed
+		if err := s.store.UpdateRefund(ctx, refund); err != nil {
+			log.Printf("Failed to record refund %s as failed: %v", refund.ID, err)
+		}
+	}
+	if err != nil {
+		// unless it failed, the refund stays requested and asking again
+		// retries it
+		return nil, err
+	}
+
+	refund.ProcessorRefundID = processorRefund.ID
+	refund.Amount = processorRefund.Amount
+	refund.Status = processorRefund.Status
+	if err := s.store.UpdateRefund(ctx, refund); err != nil {
+		return nil, fmt.Errorf("refund %s was made, but recording it: %w", processorRefund.ID, err)
+	}
+	if refund.Void() {
+		return refund, nil
+	}
+
+	updated, err := s.applyRefund(ctx, p.ID, refund)
+	if err != nil {
+		return nil, fmt.Errorf("refund %s was recorded, but updating payment %s: %w", refund.ID, p.ID, err)
+	}
+
+	// the processor webhook leaves the refunds made here to this event
+	e := updated.Event(refund.Reason)
+	e.RefundID = refund.ID
+	e.Items = refundItemsToProto(refund.Items)
+	if err := s.publisher.Publish(ctx, broker.PaymentRefundedEvent, e); err != nil {
+		return nil, fmt.Errorf("refund %s was recorded, but publishing %s: %w", refund.ID, broker.PaymentRefundedEvent, err)
+	}
+
+	return refund, nil
+}
+
+func (s *service) RecordedRefunds(ctx context.Context, paymentID string) (int64, error) {
+	refunds, err := s.store.ListRefunds(ctx, paymentID)
+	if err != nil {
+		return 0, err
+	}
+
+	var amount int64
+	for _, r := range refunds {
+		if !r.Void() {
+			amount += r.Amount
+		}
+	}
+
+	return amount, nil
+}
+
+// newRefund checks a refund request against what is left to refund of the
+// payment, counting the refunds still requested too, and returns the refund
+// to ask the processor for.
+func (s *service) newRefund(ctx context.Context, p *Payment, refunds []*Refund, r *RefundRequest) (*Refund, error) {
+	amount := r.Amount
+	if len(r.Items) > 0 {
+		var err error
+		amount, err = s.refundItemsAmount(ctx, p, refunds, r.Items)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var recorded int64
+	for _, refund := range refunds {
+		if !refund.Void() {
+			recorded += refund.Amount
+		}
+	}
+
+	left := p.Amount - max(p.AmountRefunded, recorded)
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		return nil, fmt.Errorf("%w: %d %s can be refunded at most", ErrInvalidArgument, max(left, 0), p.Currency)
+	}
+
+	return &Refund{
+		ID:        primitive.NewObjectID().Hex(),
+		PaymentID: p.ID,
+		OrderID:   p.OrderID,
+		Amount:    amount,
+		Currency:  p.Currency,
+		Status:    RefundRequested,
+		Reason:    r.Reason,
+		Items:     r.Items,
+		Actor:     r.Actor,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// requestedRefund returns the refund still requested that asks for the same
+// as r, the one to retry, if any.
+func requestedRefund(refunds []*Refund, r *RefundRequest) *Refund {
+	for _, refund := range refunds {
+		if refund.Status != RefundRequested || len(refund.Items) != len(r.Items) {
+			continue
+		}
+		if r.Amount > 0 && refund.Amount != r.Amount {
+			continue
+		}
+
+		same := true
+		for i, item := range r.Items {
+			if *item != *refund.Items[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return refund
+		}
+	}
+
+	return nil
+}
+
+// applyRefund adds a refund to the amount refunded of its payment, unless
+// the processor webhook already recorded it. The amount is the sum of the
+// refunds made, read again on every conflict, so it doesn't matter which of
+// them comes first.
+func (s *service) applyRefund(ctx context.Context, paymentID string, refund *Refund) (*Payment, error) {
+	eventID := "refund-" + refund.ID
+
+	for {
+		p, err := s.store.Get(ctx, paymentID)
+		if err != nil {
+			return nil, err
+		}
+		if p.HasEvent(eventID) {
+			return p, nil
+		}
+
+		refunds, err := s.store.ListRefunds(ctx, paymentID)
+		if err != nil {
+			return nil, err
+		}
+
+		var refunded int64
+		for _, r := range refunds {
+			if r.ProcessorRefundID != "" && !r.Void() {
+				refunded += r.Amount
+			}
+		}
+		refunded = min(refunded, p.Amount)
+		if refunded <= p.AmountRefunded {
+			// the processor webhook recorded it first
+			return p, nil
+		}
+
+		status := PaymentPartiallyRefunded
+		if refunded >= p.Amount {
+			status = PaymentRefunded
+		}
+		if !p.Status.CanMoveTo(status) {
+			return nil, fmt.Errorf("%w: payment %s is %s, can't move to %s", ErrInvalidStatus, p.ID, p.Status, status)
+		}
+
+		now := time.Now()
+		p.Transitions = append(p.Transitions, &Transition{
+			From:    p.Status,
+			To:      status,
+			At:      now,
+			EventID: eventID,
+			Reason:  refund.Reason,
+		})
+		p.EventIDs = append(p.EventIDs, eventID)
+		p.AmountRefunded = refunded
+		p.Status = status
+		p.UpdatedAt = now
+
+		err = s.store.Update(ctx, p)
+		if errors.Is(err, ErrPaymentConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+}
+
+// refundItemsAmount checks the refunded items against the order and the
+// earlier refunds of the payment, and adds up their amounts.
+func (s *service) refundItemsAmount(ctx context.Context, p *Payment, refunds []*Refund, items []*RefundItem) (int64, error) {
+	o, err := s.gateway.GetOrder(ctx, p.OrderID, p.CustomerID)
+	if err != nil {
+		return 0, err
+	}
+
+	left := make(map[string]int32, len(o.Items))
+	for _, i := range o.Items {
+		left[i.ID] += i.Quantity
+	}
+
+	for _, r := range refunds {
+		if r.Void() {
+			continue
+		}
+		for _, i := range r.Items {
+			left[i.ItemID] -= i.Quantity
+		}
+	}
+
+	var amount int64
+	for _, i := range items {
+		switch {
+		case i.ItemID == "":
+			return 0, fmt.Errorf("%w: item ID is required", ErrInvalidArgument)
+		case i.Quantity <= 0:
+			return 0, fmt.Errorf("%w: quantity of item %s must be positive", ErrInvalidArgument, i.ItemID)
+		case i.Amount <= 0:
+			return 0, fmt.Errorf("%w: amount of item %s must be positive", ErrInvalidArgument, i.ItemID)
+		}
+
+		if i.Quantity > left[i.ItemID] {
+			return 0, fmt.Errorf("%w: %d of item %s can be refunded at most", ErrInvalidArgument, max(left[i.ItemID], 0), i.ItemID)
+		}
+		left[i.ItemID] -= i.Quantity
+		amount += i.Amount
+	}
+
+	return amount, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/scuba13/oms/payments/processor/inmem"
+)
+
+// lostRefunds makes its refunds at the processor, but loses the answer of
+// the first one, as a timeout would.
+type lostRefunds struct {
+	processor.PaymentProcessor
+	lost bool
+}
+
+func (p *lostRefunds) Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*processor.Refund, error) {
+	r, err := p.PaymentProcessor.Refund(ctx, paymentIntentID, amount, idempotencyKey)
+	if err == nil && !p.lost {
+		p.lost = true
+		return nil, errors.New("timeout")
+	}
+
+	return r, err
+}
+
+// newPaidPayment pays an order of 2 burgers and a shake, 3000 cents at the
+// in-memory processor.
+func newPaidPayment(t *testing.T, paymentProcessor processor.PaymentProcessor, sessions *inmem.Inmem) (*service, *memoryStore, *memoryPublisher, *Payment) {
+	t.Helper()
+	ctx := context.Background()
+
+	o := &pb.Order{ID: "order-1", CustomerID: "customer-1", Items: []*pb.Item{{ID: "burger", Quantity: 2}, {ID: "shake", Quantity: 1}}}
+	store := newMemoryStore()
+	publisher := &memoryPublisher{}
+	orders := &memoryOrders{orders: map[string]*pb.Order{o.ID: o}}
+	svc := NewService(byMethod(paymentProcessor), orders, store, store, publisher, noRiskRules{})
+
+	if _, err := svc.CreatePayment(ctx, o); err != nil {
+		t.Fatalf("creating the payment: %v", err)
+	}
+	payments, _ := store.ListByOrder(ctx, o.ID)
+	session := payments[0].SessionID
+	if err := sessions.Pay(session); err != nil {
+		t.Fatal(err)
+	}
+
+	paid, err := svc.UpdatePayment(ctx, &PaymentUpdate{Processor: "inmem", SessionID: session, PaymentIntentID: "dummy-intent-" + session, Status: PaymentPaid, EventID: "evt_paid"})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+
+	return svc, store, publisher, paid
+}
+
+func TestRefundPayment(t *testing.T) {
+	ctx := context.Background()
+	sessions := inmem.NewInmem()
+	svc, store, publisher, p := newPaidPayment(t, sessions, sessions)
+
+	refund, err := svc.RefundPayment(ctx, &RefundRequest{
+		PaymentID: p.ID,
+		Items:     []*RefundItem{{ItemID: "burger", Quantity: 1, Amount: 1000}},
+		Reason:    "cold",
+		Actor:     "jane",
+	})
+	if err != nil {
+		t.Fatalf("refunding a burger: %v", err)
+	}
+	if refund.Amount != 1000 || refund.Status != "succeeded" || refund.ProcessorRefundID == "" {
+		t.Errorf("got refund %+v, want 1000 refunded at the processor", refund)
+	}
+	if p, _ = store.Get(ctx, p.ID); p.Status != PaymentPartiallyRefunded || p.AmountRefunded != 1000 {
+		t.Errorf("got payment %s with %d refunded, want 1000 partially refunded", p.Status, p.AmountRefunded)
+	}
+
+	events := publisher.published(broker.PaymentRefundedEvent)
+	if len(events) != 1 {
+		t.Fatalf("published %d %s, want 1", len(events), broker.PaymentRefundedEvent)
+	}
+	e := events[0].(*pb.PaymentEvent)
+	if e.RefundID != refund.ID || len(e.Items) != 1 || e.Items[0].ItemID != "burger" {
+		t.Errorf("published %+v, want refund %s of the burger", e, refund.ID)
+	}
+
+	rejected := []struct {
+		name string
+		req  *RefundRequest
+	}{
+		{"more burgers than were ordered", &RefundRequest{Items: []*RefundItem{{ItemID: "burger", Quantity: 2, Amount: 2000}}}},
+		{"an item not ordered", &RefundRequest{Items: []*RefundItem{{ItemID: "fries", Quantity: 1, Amount: 500}}}},
+		{"more than is left", &RefundRequest{Amount: 2001}},
+		{"an amount and items", &RefundRequest{Amount: 100, Items: []*RefundItem{{ItemID: "shake", Quantity: 1, Amount: 100}}}},
+	}
+	for _, tt := range rejected {
+		tt.req.PaymentID = p.ID
+		if _, err := svc.RefundPayment(ctx, tt.req); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("refunding %s returned %v, want %v", tt.name, err, ErrInvalidArgument)
+		}
+	}
+
+	// without an amount or items, the rest is given back
+	if refund, err = svc.RefundPayment(ctx, &RefundRequest{PaymentID: p.ID}); err != nil {
+		t.Fatalf("refunding the rest: %v", err)
+	}
+	if refund.Amount != 2000 {
+		t.Errorf("refunded %d, want the 2000 left", refund.Amount)
+	}
+	if p, _ = store.Get(ctx, p.ID); p.Status != PaymentRefunded || p.AmountRefunded != 3000 {
+		t.Errorf("got payment %s with %d refunded, want all of it refunded", p.Status, p.AmountRefunded)
+	}
+
+	// the processor webhook of refunds made here publishes nothing more
+	handler := NewPaymentHTTPHandler(publisher, svc, NewWebhookInbox(store), newWebhookProviders(t))
+	refunded := &processor.Event{Kind: processor.EventRefunded, PaymentIntentID: p.PaymentIntentID, AmountRefunded: 3000, FullyRefunded: true}
+	if err := handler.handleEvent(ctx, "inmem", "evt_refunded", refunded); err != nil {
+		t.Fatalf("handling the refund webhook: %v", err)
+	}
+	if events := publisher.published(broker.PaymentRefundedEvent); len(events) != 2 {
+		t.Errorf("published %d %s, want the 2 refunds only", len(events), broker.PaymentRefundedEvent)
+	}
+
+	if _, err := svc.RefundPayment(ctx, &RefundRequest{PaymentID: p.ID, Amount: 1}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("refunding a refunded payment returned %v, want %v", err, ErrInvalidStatus)
+	}
+}
+
+func TestRefundPaymentRetried(t *testing.T) {
+	ctx := context.Background()
+	sessions := inmem.NewInmem()
+	svc, store, publisher, p := newPaidPayment(t, &lostRefunds{PaymentProcessor: sessions}, sessions)
+
+	req := &RefundRequest{PaymentID: p.ID, Amount: 500}
+	if _, err := svc.RefundPayment(ctx, req); err == nil {
+		t.Fatal("refunding returned no error, want the answer lost")
+	}
+	refunds, _ := store.ListRefunds(ctx, p.ID)
+	if len(refunds) != 1 || refunds[0].Status != RefundRequested {
+		t.Fatalf("got refunds %+v, want one requested", refunds)
+	}
+
+	// another refund can't take what the requested one may have given back
+	if _, err := svc.RefundPayment(ctx, &RefundRequest{PaymentID: p.ID, Amount: 2600}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("refunding past the requested refund returned %v, want %v", err, ErrInvalidArgument)
+	}
+
+	refund, err := svc.RefundPayment(ctx, req)
+	if err != nil {
+		t.Fatalf("refunding again: %v", err)
+	}
+	if refund.ID != refunds[0].ID || refund.Status != "succeeded" {
+		t.Errorf("got refund %+v, want requested refund %s retried", refund, refunds[0].ID)
+	}
+	if p, _ = store.Get(ctx, p.ID); p.AmountRefunded != 500 {
+		t.Errorf("got %d refunded, want 500 once", p.AmountRefunded)
+	}
+	if events := publisher.published(broker.PaymentRefundedEvent); len(events) != 1 {
+		t.Errorf("published %d %s, want 1", len(events), broker.PaymentRefundedEvent)
+	}
+
+	// the processor gave the money back once
+	if _, err := sessions.Refund(ctx, p.PaymentIntentID, 2500, "rest"); err != nil {
+		t.Errorf("refunding the 2500 left at the processor: %v", err)
+	}
+}
+
+// refusedRefunds refuses every refund, as a processor would one it can't make.
+type refusedRefunds struct {
+	processor.PaymentProcessor
+}
+
+func (p *refusedRefunds) Refund(ctx context.Context, paymentIntentID string, amount int64, idempotencyKey string) (*processor.Refund, error) {
+	return nil, processor.NewError(processor.ErrPermanent, errors.New("charge disputed"))
+}
+
+func TestRefundPaymentRefused(t *testing.T) {
+	ctx := context.Background()
+	sessions := inmem.NewInmem()
+	svc, store, publisher, p := newPaidPayment(t, &refusedRefunds{PaymentProcessor: sessions}, sessions)
+
+	if _, err := svc.RefundPayment(ctx, &RefundRequest{PaymentID: p.ID, Amount: 3000}); !errors.Is(err, processor.ErrPermanent) {
+		t.Fatalf("refunding returned %v, want %v", err, processor.ErrPermanent)
+	}
+	refunds, _ := store.ListRefunds(ctx, p.ID)
+	if len(refunds) != 1 || refunds[0].Status != RefundFailed {
+		t.Fatalf("got refunds %+v, want one failed", refunds)
+	}
+	if p, _ = store.Get(ctx, p.ID); p.Status != PaymentPaid || p.AmountRefunded != 0 {
+		t.Errorf("got payment %s with %d refunded, want it paid in full", p.Status, p.AmountRefunded)
+	}
+	if events := publisher.published(broker.PaymentRefundedEvent); len(events) != 0 {
+		t.Errorf("published %d %s, want none", len(events), broker.PaymentRefundedEvent)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// riskRulesKey is the Consul key holding the risk rules as JSON.
+	riskRulesKey = "payments/RISK_RULES"
+	// cardsWindow is how far back the distinct cards of a customer are
+	// counted.
+	cardsWindow = 24 * time.Hour
+	// defaultRiskDecisionsPageSize is how many decisions ListRiskDecisions
+	// returns when the request doesn't say.
+	defaultRiskDecisionsPageSize = 50
+)
+
+// RiskRules are the limits an order is checked against before its payment
+// link is given. A limit of 0 is not checked.
+type RiskRules struct {
+	// MaxAmount is the largest order amount, in the smallest unit of the
+	// currency.
+	MaxAmount int64 `json:"maxAmount" bson:"maxAmount"`
+	// MaxOrdersPerHour is how many orders a customer can place in an hour.
+	MaxOrdersPerHour int64 `json:"maxOrdersPerHour" bson:"maxOrdersPerHour"`
+	// MaxDistinctCards is how many cards a customer can have tried in the
+	// last 24 hours.
+	MaxDistinctCards int64 `json:"maxDistinctCards" bson:"maxDistinctCards"`
+	// NewCustomerMaxAmount and NewCustomerMaxOrdersPerHour are tighter
+	// limits for customers who never paid an order.
+	NewCustomerMaxAmount        int64 `json:"newCustomerMaxAmount" bson:"newCustomerMaxAmount"`
+	NewCustomerMaxOrdersPerHour int64 `json:"newCustomerMaxOrdersPerHour" bson:"newCustomerMaxOrdersPerHour"`
+}
+
+// riskRules keeps the risk rules read from the config store, so orders are
+// not held up by it.
+type riskRules struct {
+	config ConfigStore
+	mu     sync.RWMutex
+	rules  RiskRules
+}
+
+func NewRiskRules(config ConfigStore) *riskRules {
+	return &riskRules{config: config}
+}
+
+// Load reads the rules again. The rules in force are kept when they can't
+// be read.
+func (r *riskRules) Load(ctx context.Context) error {
+	value, err := r.config.GetValue(ctx, riskRulesKey)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", riskRulesKey, err)
+	}
+
+	var rules RiskRules
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return fmt.Errorf("reading %s: %w", riskRulesKey, err)
+	}
+
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *riskRules) RiskRules() RiskRules {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.rules
+}
+
+type RiskDecisionStatus string
+
+const (
+	RiskApproved RiskDecisionStatus = "approved"
+	// RiskHeld is an order put on hold until someone reviews it.
+	RiskHeld     RiskDecisionStatus = "held"
+	RiskReleased RiskDecisionStatus = "released"
+	RiskRejected RiskDecisionStatus = "rejected"
+)
+
+// RiskDecision records why an order was approved or held, with every check
+// made and the rules in force at the time. PaymentID is the payment the
+// order is paid through, created with its checkout session once the order is
+// approved or released by a review.
+type RiskDecision struct {
+	ID         string             `bson:"_id"`
+	OrderID    string             `bson:"orderID"`
+	CustomerID string             `bson:"customerID"`
+	PaymentID  string             `bson:"paymentID"`
+	Amount     int64              `bson:"amount"`
+	Currency   string             `bson:"currency"`
+	Status     RiskDecisionStatus `bson:"status"`
+	// Reasons explain why the order was held, one per failed check.
+	Reasons    []string     `bson:"reasons"`
+	Checks     []*RiskCheck `bson:"checks"`
+	Rules      RiskRules    `bson:"rules"`
+	ReviewedBy string       `bson:"reviewedBy,omitempty"`
+	ReviewNote string       `bson:"reviewNote,omitempty"`
+	ReviewedAt *time.Time   `bson:"reviewedAt,omitempty"`
+	CreatedAt  time.Time    `bson:"createdAt"`
+}
+
+// RiskCheck is a rule an order was checked against.
+type RiskCheck struct {
+	Rule        string `bson:"rule"`
+	Value       int64  `bson:"value"`
+	Limit       int64  `bson:"limit"`
+	Passed      bool   `bson:"passed"`
+	Explanation string `bson:"explanation"`
+}
+
+// RiskReview is the outcome of reviewing a held order.
+type RiskReview struct {
+	DecisionID string
+	Approve    bool
+	Note       string
+	Actor      string
+}
+
+// CardUse is a card charged for an order of a customer, as a processor
+// webhook told it.
+type CardUse struct {
+	// ID is the webhook event that told it.
+	ID          string    `bson:"_id"`
+	CustomerID  string    `bson:"customerID"`
+	OrderID     string    `bson:"orderID,omitempty"`
+	Processor   string    `bson:"processor"`
+	Fingerprint string    `bson:"fingerprint"`
+	SeenAt      time.Time `bson:"seenAt"`
+}
+
+func (d *RiskDecision) ToProto() *pb.RiskDecision {
+	checks := make([]*pb.RiskCheck, 0, len(d.Checks))
+	for _, c := range d.Checks {
+		checks = append(checks, &pb.RiskCheck{
+			Rule:        c.Rule,
+			Value:       c.Value,
+			Limit:       c.Limit,
+			Passed:      c.Passed,
+			Explanation: c.Explanation,
+		})
+	}
+
+	res := &pb.RiskDecision{
+		ID:         d.ID,
+		OrderID:    d.OrderID,
+		CustomerID: d.CustomerID,
+		PaymentID:  d.PaymentID,
+		Amount:     d.Amount,
+		Currency:   d.Currency,
+		Status:     string(d.Status),
+		Reasons:    d.Reasons,
+		Checks:     checks,
+		ReviewedBy: d.ReviewedBy,
+		ReviewNote: d.ReviewNote,
+		CreatedAt:  d.CreatedAt.Unix(),
+	}
+	if d.ReviewedAt != nil {
+		res.ReviewedAt = d.ReviewedAt.Unix()
+	}
+
+	return res
+}
+
+// riskFacts are what is known about an order and its customer when it is
+// checked.
+type riskFacts struct {
+	// Amount is 0 when it is only known once paid, such as for cash.
+	Amount   int64
+	Currency string
+	// OrdersLastHour counts the order being checked.
+	OrdersLastHour int64
+	DistinctCards  int64
+	NewCustomer    bool
+}
+
+// evaluateRisk checks the facts of an order against every rule with a
+// limit.
+func evaluateRisk(rules RiskRules, f riskFacts) []*RiskCheck {
+	checks := []*RiskCheck{}
+	check := func(rule string, value, limit int64, explain string) {
+		if limit <= 0 {
+			return
+		}
+
+		c := &RiskCheck{Rule: rule, Value: value, Limit: limit, Passed: value <= limit}
+		if c.Passed {
+			c.Explanation = fmt.Sprintf("%s %d is within the limit of %d", explain, value, limit)
+		} else {
+			c.Explanation = fmt.Sprintf("%s %d is over the limit of %d", explain, value, limit)
+		}
+		checks = append(checks, c)
+	}
+
+	if f.Amount > 0 {
+		check("max_amount", f.Amount, rules.MaxAmount, fmt.Sprintf("order amount (%s)", f.Currency))
+	}
+	check("max_orders_per_hour", f.OrdersLastHour, rules.MaxOrdersPerHour, "orders in the last hour")
+	check("max_distinct_cards", f.DistinctCards, rules.MaxDistinctCards, "distinct cards in the last 24 hours")
+
+	if f.NewCustomer {
+		if f.Amount > 0 {
+			check("new_customer_max_amount", f.Amount, rules.NewCustomerMaxAmount, fmt.Sprintf("order amount (%s) of a new customer", f.Currency))
+		}
+		check("new_customer_max_orders_per_hour", f.OrdersLastHour, rules.NewCustomerMaxOrdersPerHour, "orders in the last hour of a new customer")
+	}
+
+	return checks
+}
+
+// riskDecision returns the risk decision of an order, which is made the
+// first time the order is seen, at the amount its processor quotes.
+func (s *service) riskDecision(ctx context.Context, paymentProcessor processor.PaymentProcessor, o *pb.Order) (*RiskDecision, error) {
+	d, err := s.store.GetRiskDecisionByOrder(ctx, o.ID)
+	if !errors.Is(err, ErrRiskDecisionNotFound) {
+		return d, err
+	}
+
+	quote, err := paymentProcessor.QuoteOrder(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.assessRisk(ctx, o, quote)
+}
+
+// assessRisk checks an order, at the amount quoted for it, against the risk
+// rules in force and records the decision, with the ID of the payment to
+// create for the order.
+func (s *service) assessRisk(ctx context.Context, o *pb.Order, quote *processor.Quote) (*RiskDecision, error) {
+	rules := s.rules.RiskRules()
+	now := time.Now()
+
+	f := riskFacts{Amount: quote.Amount, Currency: quote.Currency}
+
+	var err error
+	if rules.MaxOrdersPerHour > 0 || rules.NewCustomerMaxOrdersPerHour > 0 {
+		f.OrdersLastHour, err = s.store.CountOrders(ctx, o.CustomerID, now.Add(-time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		// the order being checked has no decision yet
+		f.OrdersLastHour++
+	}
+	if rules.MaxDistinctCards > 0 {
+		f.DistinctCards, err = s.store.CountCards(ctx, o.CustomerID, now.Add(-cardsWindow))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rules.NewCustomerMaxAmount > 0 || rules.NewCustomerMaxOrdersPerHour > 0 {
+		paid, err := s.store.HasPaid(ctx, o.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+		f.NewCustomer = !paid
+	}
+
+	d := &RiskDecision{
+		ID:         primitive.NewObjectID().Hex(),
+		OrderID:    o.ID,
+		CustomerID: o.CustomerID,
+		PaymentID:  primitive.NewObjectID().Hex(),
+		Amount:     quote.Amount,
+		Currency:   quote.Currency,
+		Status:     RiskApproved,
+		Reasons:    []string{},
+		Checks:     evaluateRisk(rules, f),
+		Rules:      rules,
+		CreatedAt:  now,
+	}
+	for _, c := range d.Checks {
+		if !c.Passed {
+			d.Status = RiskHeld
+			d.Reasons = append(d.Reasons, c.Explanation)
+		}
+	}
+
+	err = s.store.CreateRiskDecision(ctx, d)
+	if errors.Is(err, ErrRiskDecisionExists) {
+		// a delivery of the same order decided it first, its decision and
+		// payment ID are the ones to go on with
+		return s.store.GetRiskDecisionByOrder(ctx, o.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("recording the risk decision of order %s: %w", o.ID, err)
+	}
+
+	return d, nil
+}
+
+func (s *service) ListRiskDecisions(ctx context.Context, status RiskDecisionStatus, limit int) ([]*RiskDecision, error) {
+	if limit <= 0 {
+		limit = defaultRiskDecisionsPageSize
+	}
+
+	return s.store.ListRiskDecisions(ctx, status, limit)
+}
+
+// ReviewRiskDecision releases a held order, creating its checkout session and
+// giving it the link, or rejects it, which publishes payment.failed.
+func (s *service) ReviewRiskDecision(ctx context.Context, r *RiskReview) (*RiskDecision, error) {
+	if r.DecisionID == "" {
+		return nil, fmt.Errorf("%w: decision ID is required", ErrInvalidArgument)
+	}
+
+	d, err := s.store.GetRiskDecision(ctx, r.DecisionID)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != RiskHeld {
+		return nil, fmt.Errorf("%w: risk decision %s is %s, only held orders can be reviewed", ErrInvalidStatus, d.ID, d.Status)
+	}
+
+	if r.Approve {
+		if err := s.releaseOrder(ctx, d); err != nil {
+			return nil, err
+		}
+		d.Status = RiskReleased
+	} else {
+		if err := s.rejectOrder(ctx, d, r); err != nil {
+			return nil, err
+		}
+		d.Status = RiskRejected
+	}
+
+	now := time.Now()
+	d.ReviewedBy = r.Actor
+	d.ReviewNote = r.Note
+	d.ReviewedAt = &now
+
+	if err := s.store.UpdateRiskDecision(ctx, d); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Risk decision %s of order %s was %s by %s", d.ID, d.OrderID, d.Status, d.ReviewedBy)
+	return d, nil
+}
+
+// releaseOrder creates the checkout session of an order released by a
+// review and gives the order its link. A review tried again reuses the
+// session.
+func (s *service) releaseOrder(ctx context.Context, d *RiskDecision) error {
+	o, err := s.gateway.GetOrder(ctx, d.OrderID, d.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	paymentProcessor, err := s.processor(o.PaymentMethod)
+	if err != nil {
+		return err
+	}
+
+	p, err := s.checkout(ctx, paymentProcessor, o, d.PaymentID)
+	if err != nil {
+		return err
+	}
+	if p.Status != PaymentOpen {
+		return fmt.Errorf("%w: payment %s is %s, it can't be paid anymore", ErrInvalidStatus, p.ID, p.Status)
+	}
+
+	return s.gateway.UpdateOrderAfterPaymentLink(ctx, o.ID, p.PaymentLink)
+}
+
+// rejectOrder tells the orders a rejected order failed its payment, so it
+// moves to payment_failed. Held orders have no session, except those held
+// before sessions waited for the review, whose payment is failed too.
+func (s *service) rejectOrder(ctx context.Context, d *RiskDecision, r *RiskReview) error {
+	reason := "rejected in risk review"
+	if r.Note != "" {
+		reason = fmt.Sprintf("%s: %s", reason, r.Note)
+	}
+
+	p, err := s.store.Get(ctx, d.PaymentID)
+	if err == nil {
+		return s.rejectPayment(ctx, d, p, reason)
+	}
+	if !errors.Is(err, ErrPaymentNotFound) {
+		return err
+	}
+
+	e := &pb.PaymentEvent{
+		OrderID:    d.OrderID,
+		CustomerID: d.CustomerID,
+		Status:     string(PaymentFailed),
+		Amount:     d.Amount,
+		Currency:   d.Currency,
+		Reason:     reason,
+		CreatedAt:  time.Now().Unix(),
+	}
+	if err := s.publisher.Publish(ctx, broker.PaymentFailedEvent, e); err != nil {
+		return fmt.Errorf("order %s was rejected, but publishing %s: %w", d.OrderID, broker.PaymentFailedEvent, err)
+	}
+
+	return nil
+}
+
+// rejectPayment fails the payment of a rejected order and closes its
+// session. Payments that already expired are left as they are.
+func (s *service) rejectPayment(ctx context.Context, d *RiskDecision, p *Payment, reason string) error {
+	// a review tried again finds the payment already failed by it, and
+	// publishes again
+	eventID := "risk-" + d.ID
+	if !p.HasEvent(eventID) && !p.Status.CanMoveTo(PaymentFailed) {
+		return nil
+	}
+
+	updated, err := s.UpdatePayment(ctx, &PaymentUpdate{
+		Processor: p.Processor,
+		SessionID: p.SessionID,
+		Status:    PaymentFailed,
+		EventID:   eventID,
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.publisher.Publish(ctx, broker.PaymentFailedEvent, updated.Event(reason)); err != nil {
+		return fmt.Errorf("payment %s was failed, but publishing %s: %w", p.ID, broker.PaymentFailedEvent, err)
+	}
+
+	paymentProcessor, err := s.processor(p.PaymentMethod)
+	if err == nil {
+		err = paymentProcessor.ExpireSession(ctx, p.SessionID)
+	}
+	if err != nil {
+		// the customer never got the link, the session expires on its own
+		log.Printf("Failed to expire session %s of rejected payment %s: %v", p.SessionID, p.ID, err)
+	}
+
+	return nil
+}
+
+// RecordCardUse records a card charged for an order of a customer. A card
+// use told twice is only recorded once.
+func (s *service) RecordCardUse(ctx context.Context, c *CardUse) error {
+	err := s.store.SaveCardUse(ctx, c)
+	if errors.Is(err, ErrCardUseExists) {
+		return nil
+	}
+
+	return err
+}
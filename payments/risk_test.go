@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/scuba13/oms/payments/processor/inmem"
+)
+
+// fixedRiskRules are risk rules that never change.
+type fixedRiskRules RiskRules
+
+func (r fixedRiskRules) RiskRules() RiskRules {
+	return RiskRules(r)
+}
+
+// memoryConfig answers GetValue with the values it was given.
+type memoryConfig map[string]string
+
+func (c memoryConfig) GetValue(ctx context.Context, key string) (string, error) {
+	v, ok := c[key]
+	if !ok {
+		return "", errors.New("key not found")
+	}
+	return v, nil
+}
+
+func TestEvaluateRisk(t *testing.T) {
+	rules := RiskRules{MaxAmount: 5000, MaxOrdersPerHour: 3, NewCustomerMaxAmount: 2000}
+
+	checks := evaluateRisk(rules, riskFacts{Amount: 3000, Currency: "usd", OrdersLastHour: 4, NewCustomer: true})
+	failed := map[string]bool{}
+	for _, c := range checks {
+		if !c.Passed {
+			failed[c.Rule] = true
+		}
+		if c.Explanation == "" {
+			t.Errorf("check %s has no explanation", c.Rule)
+		}
+	}
+	if len(checks) != 3 || len(failed) != 2 || !failed["max_orders_per_hour"] || !failed["new_customer_max_amount"] {
+		t.Errorf("got checks %+v, want the orders per hour and new customer amount failed", checks)
+	}
+
+	// an amount only known once paid, such as cash, isn't checked
+	if checks := evaluateRisk(rules, riskFacts{OrdersLastHour: 1}); len(checks) != 1 || !checks[0].Passed {
+		t.Errorf("got checks %+v, want only the orders per hour checked", checks)
+	}
+}
+
+func TestRiskRulesLoad(t *testing.T) {
+	config := memoryConfig{riskRulesKey: `{"maxAmount": 5000}`}
+	rules := NewRiskRules(config)
+	if err := rules.Load(context.Background()); err != nil || rules.RiskRules().MaxAmount != 5000 {
+		t.Fatalf("loaded %+v, %v, want a max amount of 5000", rules.RiskRules(), err)
+	}
+
+	// rules that can't be read leave the ones in force
+	config[riskRulesKey] = "not json"
+	if err := rules.Load(context.Background()); err == nil || rules.RiskRules().MaxAmount != 5000 {
+		t.Errorf("loaded %+v, %v, want an error and the rules kept", rules.RiskRules(), err)
+	}
+}
+
+func TestCreatePaymentHeld(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	orders := &memoryOrders{}
+	publisher := &memoryPublisher{}
+	svc := NewService(byMethod(inmem.NewInmem()), orders, store, store, publisher, fixedRiskRules{MaxAmount: 2500})
+
+	held := &pb.Order{ID: "held", CustomerID: "customer-1", Items: []*pb.Item{{ID: "burger", Quantity: 3}}}
+	orders.orders = map[string]*pb.Order{held.ID: held}
+
+	// delivering the order again finds it held, without a session
+	for range 2 {
+		if link, err := svc.CreatePayment(ctx, held); err != nil || link != "" {
+			t.Fatalf("creating the payment returned %q, %v, want the order held", link, err)
+		}
+	}
+	if !orders.held[held.ID] {
+		t.Error("the order wasn't put on hold")
+	}
+	if payments, _ := store.ListByOrder(ctx, held.ID); len(payments) != 0 {
+		t.Errorf("got %d payments of a held order, want none", len(payments))
+	}
+	decisions, _ := svc.ListRiskDecisions(ctx, RiskHeld, 0)
+	if len(decisions) != 1 || decisions[0].Amount != 3*processor.UnitAmount || len(decisions[0].Reasons) != 1 {
+		t.Fatalf("got held decisions %+v, want one over the max amount", decisions)
+	}
+	d := decisions[0]
+
+	if _, err := svc.ReviewRiskDecision(ctx, &RiskReview{DecisionID: d.ID, Approve: true, Actor: "jane"}); err != nil {
+		t.Fatalf("releasing the order: %v", err)
+	}
+	payments, _ := store.ListByOrder(ctx, held.ID)
+	if len(payments) != 1 || payments[0].ID != d.PaymentID || orders.link(held.ID) != payments[0].PaymentLink {
+		t.Fatalf("got payments %+v, want payment %s linked to the released order", payments, d.PaymentID)
+	}
+	if d, _ = store.GetRiskDecision(ctx, d.ID); d.Status != RiskReleased || d.ReviewedBy != "jane" {
+		t.Errorf("got decision %s reviewed by %q, want released by jane", d.Status, d.ReviewedBy)
+	}
+	if _, err := svc.ReviewRiskDecision(ctx, &RiskReview{DecisionID: d.ID}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("reviewing again returned %v, want %v", err, ErrInvalidStatus)
+	}
+
+	// the released order delivered again keeps its session
+	if link, err := svc.CreatePayment(ctx, held); err != nil || link != payments[0].PaymentLink {
+		t.Errorf("creating the payment again returned %q, %v, want link %q", link, err, payments[0].PaymentLink)
+	}
+}
+
+func TestReviewRiskDecisionRejected(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	publisher := &memoryPublisher{}
+	svc := NewService(byMethod(inmem.NewInmem()), &memoryOrders{}, store, store, publisher, fixedRiskRules{MaxAmount: 500})
+
+	o := &pb.Order{ID: "order-1", CustomerID: "customer-1", Items: []*pb.Item{{ID: "burger", Quantity: 1}}}
+	if _, err := svc.CreatePayment(ctx, o); err != nil {
+		t.Fatalf("creating the payment: %v", err)
+	}
+	decision, _ := store.GetRiskDecisionByOrder(ctx, o.ID)
+
+	d, err := svc.ReviewRiskDecision(ctx, &RiskReview{DecisionID: decision.ID, Note: "stolen card", Actor: "jane"})
+	if err != nil {
+		t.Fatalf("rejecting the order: %v", err)
+	}
+	if d.Status != RiskRejected {
+		t.Errorf("got decision %s, want %s", d.Status, RiskRejected)
+	}
+
+	failed := publisher.published(broker.PaymentFailedEvent)
+	if len(failed) != 1 || failed[0].(*pb.PaymentEvent).OrderID != o.ID || failed[0].(*pb.PaymentEvent).Reason == "" {
+		t.Fatalf("published %s %+v, want order-1 failed with a reason", broker.PaymentFailedEvent, failed)
+	}
+
+	// a rejected order delivered again gets no session
+	if link, err := svc.CreatePayment(ctx, o); err != nil || link != "" {
+		t.Errorf("creating the payment again returned %q, %v, want nothing", link, err)
+	}
+	if payments, _ := store.ListByOrder(ctx, o.ID); len(payments) != 0 {
+		t.Errorf("got %d payments of a rejected order, want none", len(payments))
+	}
+}
+
+func TestAssessRiskDecidedConcurrently(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	svc := NewService(byMethod(inmem.NewInmem()), &memoryOrders{}, store, store, &memoryPublisher{}, noRiskRules{})
+
+	// another delivery of the order recorded its decision first
+	first := &RiskDecision{ID: "first", OrderID: "order-1", CustomerID: "customer-1", PaymentID: "payment-1", Status: RiskApproved, CreatedAt: time.Now()}
+	if err := store.CreateRiskDecision(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := svc.assessRisk(ctx, &pb.Order{ID: "order-1", CustomerID: "customer-1"}, &processor.Quote{Amount: 1000, Currency: "usd"})
+	if err != nil {
+		t.Fatalf("assessing the risk: %v", err)
+	}
+	if d.ID != first.ID || d.PaymentID != first.PaymentID {
+		t.Errorf("got decision %s paid through %s, want the first decision reused", d.ID, d.PaymentID)
+	}
+}
+
+func TestRiskCountsCards(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	svc := NewService(byMethod(inmem.NewInmem()), &memoryOrders{}, store, store, &memoryPublisher{}, fixedRiskRules{MaxDistinctCards: 2})
+
+	// the event of card-b is delivered twice
+	for _, fingerprint := range []string{"card-a", "card-b", "card-b", "card-c"} {
+		use := &CardUse{ID: "evt-" + fingerprint, CustomerID: "customer-1", Processor: "stripe", Fingerprint: fingerprint, SeenAt: time.Now()}
+		if err := svc.RecordCardUse(ctx, use); err != nil {
+			t.Fatalf("recording card %s: %v", fingerprint, err)
+		}
+	}
+
+	o := &pb.Order{ID: "order-1", CustomerID: "customer-1", Items: []*pb.Item{{ID: "burger", Quantity: 1}}}
+	if link, err := svc.CreatePayment(ctx, o); err != nil || link != "" {
+		t.Fatalf("creating the payment returned %q, %v, want the order held for its 3 cards", link, err)
+	}
+	d, _ := store.GetRiskDecisionByOrder(ctx, o.ID)
+	if d.Status != RiskHeld || len(d.Checks) != 1 || d.Checks[0].Value != 3 {
+		t.Errorf("got decision %s with checks %+v, want held for 3 cards", d.Status, d.Checks)
+	}
+}
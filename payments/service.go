@@ -2,32 +2,186 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 
+	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/payments/gateway"
 	"github.com/scuba13/oms/payments/processor"
 )
 
 type service struct {
-	processor processor.PaymentProcessor
-	gateway   gateway.OrdersGateway
+	// processors are the payment processors of each payment method
+	processors map[string]processor.PaymentProcessor
+	gateway    gateway.OrdersGateway
+	store      PaymentsStore
+	webhooks   WebhookStore
+	publisher  EventPublisher
+	rules      RiskRulesSource
 }
 
-func NewService(processor processor.PaymentProcessor, gateway gateway.OrdersGateway) *service {
-	return &service{processor, gateway}
+func NewService(processors map[string]processor.PaymentProcessor, gateway gateway.OrdersGateway, store PaymentsStore, webhooks WebhookStore, publisher EventPublisher, rules RiskRulesSource) *service {
+	return &service{processors, gateway, store, webhooks, publisher, rules}
 }
 
+// processor is the payment processor of a payment method.
+func (s *service) processor(method string) (processor.PaymentProcessor, error) {
+	method = common.PaymentMethodOrDefault(method)
+
+	p, ok := s.processors[method]
+	if !ok {
+		return nil, processor.NewError(processor.ErrInvalidRequest, fmt.Errorf("no payment processor for payment method %q", method))
+	}
+
+	return p, nil
+}
+
+// CreatePayment checks an order against the risk rules, at the amount its
+// processor quotes, and gives the order the link of a new checkout session
+// when it passes. Risky orders are held without a session until someone
+// reviews them. An order delivered again finds the risk decision and the
+// payment of the earlier delivery, so it never gets a second session.
 func (s *service) CreatePayment(ctx context.Context, o *pb.Order) (string, error) {
-	link, err := s.processor.CreatePaymentLink(o)
+	paymentProcessor, err := s.processor(o.PaymentMethod)
+	if err != nil {
+		return "", err
+	}
+
+	decision, err := s.riskDecision(ctx, paymentProcessor, o)
+	if err != nil {
+		return "", err
+	}
+
+	switch decision.Status {
+	case RiskHeld:
+		log.Printf("Holding order %s for review, risk decision %s: %v", o.ID, decision.ID, decision.Reasons)
+		return "", s.gateway.HoldOrder(ctx, o.ID)
+	case RiskRejected:
+		log.Printf("Order %s was rejected in risk review, risk decision %s", o.ID, decision.ID)
+		return "", nil
+	}
+
+	p, err := s.checkout(ctx, paymentProcessor, o, decision.PaymentID)
 	if err != nil {
 		return "", err
 	}
 
 	// update order with the link
-	err = s.gateway.UpdateOrderAfterPaymentLink(ctx, o.ID, link)
+	err = s.gateway.UpdateOrderAfterPaymentLink(ctx, o.ID, p.PaymentLink)
 	if err != nil {
 		return "", err
 	}
 
-	return link, nil
+	return p.PaymentLink, nil
+}
+
+// checkout creates the checkout session of an order and records it as the
+// payment with the given ID. A payment already recorded is returned as it
+// is.
+func (s *service) checkout(ctx context.Context, paymentProcessor processor.PaymentProcessor, o *pb.Order, paymentID string) (*Payment, error) {
+	p, err := s.store.Get(ctx, paymentID)
+	if !errors.Is(err, ErrPaymentNotFound) {
+		return p, err
+	}
+
+	session, err := paymentProcessor.CreateCheckoutSession(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p = &Payment{
+		ID:            paymentID,
+		OrderID:       o.ID,
+		CustomerID:    o.CustomerID,
+		LocationID:    o.LocationID,
+		PaymentMethod: common.PaymentMethodOrDefault(o.PaymentMethod),
+		Processor:     session.Processor,
+		SessionID:     session.ID,
+		PaymentLink:   session.URL,
+		Amount:        session.Amount,
+		Currency:      session.Currency,
+		Status:        PaymentOpen,
+		Transitions:   []*Transition{},
+		EventIDs:      []string{},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		ExpiresAt:     session.ExpiresAt,
+	}
+	if err := s.store.Create(ctx, p); err != nil {
+		// the link is never given, the next delivery creates another session
+		if err := paymentProcessor.ExpireSession(ctx, session.ID); err != nil {
+			log.Printf("Failed to expire unrecorded session %s of order %s: %v", session.ID, o.ID, err)
+		}
+
+		return nil, fmt.Errorf("recording the payment of order %s: %w", o.ID, err)
+	}
+
+	return p, nil
+}
+
+func (s *service) GetPayment(ctx context.Context, id string) (*Payment, error) {
+	return s.store.Get(ctx, id)
+}
+
+func (s *service) ListPaymentsForOrder(ctx context.Context, orderID string) ([]*Payment, error) {
+	return s.store.ListByOrder(ctx, orderID)
+}
+
+func (s *service) UpdatePayment(ctx context.Context, u *PaymentUpdate) (*Payment, error) {
+	var p *Payment
+	var err error
+	if u.SessionID != "" {
+		p, err = s.store.GetBySession(ctx, u.Processor, u.SessionID)
+	} else {
+		p, err = s.store.GetByPaymentIntent(ctx, u.Processor, u.PaymentIntentID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u.EventID != "" && p.HasEvent(u.EventID) {
+		return p, nil
+	}
+	if (u.Status == PaymentPartiallyRefunded || u.Status == PaymentRefunded) && u.AmountRefunded <= p.AmountRefunded {
+		// the same refund told twice, through RefundPayment and the
+		// processor webhook
+		return nil, fmt.Errorf("%w: payment %s already has %d refunded", ErrInvalidStatus, p.ID, p.AmountRefunded)
+	}
+	if !p.Status.CanMoveTo(u.Status) {
+		return nil, fmt.Errorf("%w: payment %s is %s, can't move to %s", ErrInvalidStatus, p.ID, p.Status, u.Status)
+	}
+
+	now := time.Now()
+	p.Transitions = append(p.Transitions, &Transition{
+		From:    p.Status,
+		To:      u.Status,
+		At:      now,
+		EventID: u.EventID,
+		Reason:  u.Reason,
+	})
+	if u.EventID != "" {
+		p.EventIDs = append(p.EventIDs, u.EventID)
+	}
+	if u.PaymentIntentID != "" {
+		p.PaymentIntentID = u.PaymentIntentID
+	}
+	if u.AmountRefunded > 0 {
+		p.AmountRefunded = u.AmountRefunded
+	}
+	if u.Amount > 0 {
+		p.Amount = u.Amount
+		p.Currency = u.Currency
+	}
+	p.Status = u.Status
+	p.UpdatedAt = now
+
+	if err := s.store.Update(ctx, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/scuba13/oms/payments/processor/counter"
+	"github.com/scuba13/oms/payments/processor/inmem"
+)
+
+// byMethod takes card payments with p and cash payments at the counter, as
+// main does.
+func byMethod(p processor.PaymentProcessor) map[string]processor.PaymentProcessor {
+	return map[string]processor.PaymentProcessor{
+		common.PaymentMethodCard: p,
+		common.PaymentMethodCash: counter.NewProcessor(),
+	}
+}
+
+// memoryOrders keeps the payment link of each order and the orders held,
+// and answers GetOrder with the orders it was given.
+type memoryOrders struct {
+	mu     sync.Mutex
+	links  map[string]string
+	held   map[string]bool
+	orders map[string]*pb.Order
+}
+
+func (g *memoryOrders) UpdateOrderAfterPaymentLink(ctx context.Context, orderID, paymentLink string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.links == nil {
+		g.links = map[string]string{}
+	}
+	g.links[orderID] = paymentLink
+	return nil
+}
+
+func (g *memoryOrders) GetOrder(ctx context.Context, orderID, customerID string) (*pb.Order, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if o, ok := g.orders[orderID]; ok {
+		return o, nil
+	}
+	return &pb.Order{ID: orderID, CustomerID: customerID}, nil
+}
+
+func (g *memoryOrders) HoldOrder(ctx context.Context, orderID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.held == nil {
+		g.held = map[string]bool{}
+	}
+	g.held[orderID] = true
+	return nil
+}
+
+func (g *memoryOrders) link(orderID string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.links[orderID]
+}
+
+// noRiskRules holds no order.
+type noRiskRules struct{}
+
+func (noRiskRules) RiskRules() RiskRules {
+	return RiskRules{}
+}
+
+// memoryPublisher keeps the events published to each exchange.
+type memoryPublisher struct {
+	mu     sync.Mutex
+	events map[string][]any
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, exchange string, v any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.events == nil {
+		p.events = map[string][]any{}
+	}
+	p.events[exchange] = append(p.events[exchange], v)
+	return nil
+}
+
+func (p *memoryPublisher) published(exchange string) []any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.events[exchange]
+}
+
+func TestCreatePayment(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	orders := &memoryOrders{}
+	svc := NewService(byMethod(inmem.NewInmem()), orders, store, store, &memoryPublisher{}, noRiskRules{})
+
+	o := &pb.Order{ID: "order-1", CustomerID: "customer-1", Items: []*pb.Item{{ID: "burger", Quantity: 2}}}
+	link, err := svc.CreatePayment(ctx, o)
+	if err != nil {
+		t.Fatalf("creating the payment: %v", err)
+	}
+	if orders.link(o.ID) != link {
+		t.Errorf("order got link %q, want %q", orders.link(o.ID), link)
+	}
+
+	// the order delivered again gets the same session
+	again, err := svc.CreatePayment(ctx, o)
+	if err != nil {
+		t.Fatalf("creating the payment again: %v", err)
+	}
+	if again != link {
+		t.Errorf("got link %q the second time, want %q", again, link)
+	}
+
+	payments, err := svc.ListPaymentsForOrder(ctx, o.ID)
+	if err != nil {
+		t.Fatalf("listing the payments: %v", err)
+	}
+	if len(payments) != 1 {
+		t.Fatalf("got %d payments, want 1", len(payments))
+	}
+	if p := payments[0]; p.Status != PaymentOpen || p.CustomerID != o.CustomerID || p.Processor != "inmem" || p.Amount != 2*processor.UnitAmount {
+		t.Errorf("got payment %+v, want an open inmem payment of customer-1", p)
+	}
+}
+
+func TestUpdatePayment(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	svc := NewService(byMethod(inmem.NewInmem()), &memoryOrders{}, store, store, &memoryPublisher{}, noRiskRules{})
+
+	if _, err := svc.CreatePayment(ctx, &pb.Order{ID: "order-1"}); err != nil {
+		t.Fatalf("creating the payment: %v", err)
+	}
+	payments, _ := store.ListByOrder(ctx, "order-1")
+	session := payments[0].SessionID
+
+	paid := &PaymentUpdate{Processor: "inmem", SessionID: session, PaymentIntentID: "pi_1", Status: PaymentPaid, EventID: "evt_1"}
+	p, err := svc.UpdatePayment(ctx, paid)
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	if p.Status != PaymentPaid || p.PaymentIntentID != "pi_1" || len(p.Transitions) != 1 || !p.HasEvent("evt_1") {
+		t.Errorf("got payment %+v, want it paid by evt_1", p)
+	}
+
+	// an event delivered twice is applied once
+	if p, err = svc.UpdatePayment(ctx, paid); err != nil {
+		t.Fatalf("applying evt_1 again: %v", err)
+	}
+	if len(p.Transitions) != 1 {
+		t.Errorf("got %d transitions, want 1", len(p.Transitions))
+	}
+
+	// charges find the payment by its payment intent
+	refund := &PaymentUpdate{Processor: "inmem", PaymentIntentID: "pi_1", Status: PaymentPartiallyRefunded, AmountRefunded: 300, EventID: "evt_2"}
+	if p, err = svc.UpdatePayment(ctx, refund); err != nil {
+		t.Fatalf("refunding: %v", err)
+	}
+	if p.Status != PaymentPartiallyRefunded || p.AmountRefunded != 300 {
+		t.Errorf("got payment %+v, want 300 refunded", p)
+	}
+
+	expired := &PaymentUpdate{Processor: "inmem", SessionID: session, Status: PaymentExpired, EventID: "evt_3"}
+	if _, err := svc.UpdatePayment(ctx, expired); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("expiring a refunded payment returned %v, want %v", err, ErrInvalidStatus)
+	}
+	unknown := &PaymentUpdate{Processor: "inmem", SessionID: "unknown", Status: PaymentPaid, EventID: "evt_4"}
+	if _, err := svc.UpdatePayment(ctx, unknown); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("paying an unknown session returned %v, want %v", err, ErrPaymentNotFound)
+	}
+}
+
+func TestPaymentStatusCanMoveTo(t *testing.T) {
+	tests := []struct {
+		from, to PaymentStatus
+		want     bool
+	}{
+		{PaymentOpen, PaymentPaid, true},
+		{PaymentOpen, PaymentExpired, true},
+		{PaymentProcessing, PaymentFailed, true},
+		{PaymentProcessing, PaymentExpired, false},
+		{PaymentPaid, PaymentFailed, false},
+		{PaymentPartiallyRefunded, PaymentPartiallyRefunded, true},
+		{PaymentRefunded, PaymentDisputed, false},
+		{PaymentExpired, PaymentPaid, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanMoveTo(tt.to); got != tt.want {
+			t.Errorf("%s can move to %s: %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DbName           = "payments"
+	CollName         = "payments"
+	WebhooksCollName = "webhooks"
+	// ReconciliationsCollName keeps the reconciliation reports.
+	ReconciliationsCollName = "reconciliations"
+	RefundsCollName         = "refunds"
+	RiskDecisionsCollName   = "risk_decisions"
+	// CardUsesCollName keeps the cards charged for each customer.
+	CardUsesCollName = "card_uses"
+
+	// processedWebhookTTL is how long processed webhooks are kept to spot
+	// the events Stripe sends again, which it does for up to three days.
+	processedWebhookTTL = 30 * 24 * time.Hour
+	// cardUseTTL is how long card uses are kept, longer than the risk rules
+	// look back.
+	cardUseTTL = 30 * 24 * time.Hour
+)
+
+type store struct {
+	db *mongo.Client
+}
+
+func NewStore(db *mongo.Client) *store {
+	return &store{db}
+}
+
+// EnsureIndexes creates the indexes the payment lookups rely on.
+func (s *store) EnsureIndexes(ctx context.Context) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "processor", Value: 1}, {Key: "sessionID", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "orderID", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "processor", Value: 1}, {Key: "paymentIntentID", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "lastReconciledAt", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "customerID", Value: 1}, {Key: "createdAt", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	riskDecisions := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	_, err = riskDecisions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: -1}}},
+		// an order is only decided once, even when it is delivered twice
+		// at the same time
+		{Keys: bson.D{{Key: "orderID", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "customerID", Value: 1}, {Key: "createdAt", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	cardUses := s.db.Database(DbName).Collection(CardUsesCollName)
+
+	_, err = cardUses.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "customerID", Value: 1}, {Key: "seenAt", Value: 1}}},
+		{Keys: bson.D{{Key: "seenAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(cardUseTTL.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+
+	refunds := s.db.Database(DbName).Collection(RefundsCollName)
+
+	_, err = refunds.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "paymentID", Value: 1}, {Key: "createdAt", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	webhooks := s.db.Database(DbName).Collection(WebhooksCollName)
+
+	_, err = webhooks.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "processedAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(processedWebhookTTL.Seconds()))},
+	})
+
+	return err
+}
+
+func (s *store) Create(ctx context.Context, p *Payment) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	_, err := col.InsertOne(ctx, p)
+	return err
+}
+
+func (s *store) Get(ctx context.Context, id string) (*Payment, error) {
+	return s.findOne(ctx, bson.M{"_id": id})
+}
+
+func (s *store) GetBySession(ctx context.Context, processor, sessionID string) (*Payment, error) {
+	return s.findOne(ctx, bson.M{"processor": processor, "sessionID": sessionID})
+}
+
+func (s *store) GetByPaymentIntent(ctx context.Context, processor, paymentIntentID string) (*Payment, error) {
+	return s.findOne(ctx, bson.M{"processor": processor, "paymentIntentID": paymentIntentID})
+}
+
+func (s *store) ListByOrder(ctx context.Context, orderID string) ([]*Payment, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	cursor, err := col.Find(ctx, bson.M{"orderID": orderID}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*Payment{}
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) Update(ctx context.Context, p *Payment) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	filter := bson.M{"_id": p.ID, "version": p.Version}
+	if p.Version == 0 {
+		// payments recorded before there were versions have none
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	p.Version++
+	res, err := col.ReplaceOne(ctx, filter, p)
+	if err != nil {
+		p.Version--
+		return err
+	}
+	if res.MatchedCount == 0 {
+		p.Version--
+		if _, err := s.Get(ctx, p.ID); err != nil {
+			return err
+		}
+		return ErrPaymentConflict
+	}
+
+	return nil
+}
+
+func (s *store) ListStale(ctx context.Context, before time.Time, limit int) ([]*Payment, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	filter := bson.M{
+		"status":    bson.M{"$in": bson.A{PaymentOpen, PaymentProcessing}},
+		"createdAt": bson.M{"$lt": before},
+		// payments at the counter are confirmed by staff, there is nothing to
+		// ask about them until they expire
+		"$or": bson.A{
+			bson.M{"paymentMethod": bson.M{"$ne": common.PaymentMethodCash}},
+			bson.M{"expiresAt": bson.M{"$lt": time.Now()}},
+		},
+	}
+	// payments that stay open, such as sessions the customer may still pay,
+	// go to the back once checked, so they can't keep newer ones out of the
+	// batch
+	opts := options.Find().
+		SetSort(bson.D{{Key: "lastReconciledAt", Value: 1}, {Key: "createdAt", Value: 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*Payment{}
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) MarkReconciled(ctx context.Context, ids []string, at time.Time) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	// the version is left alone, the payment itself doesn't change
+	_, err := col.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"$set": bson.M{"lastReconciledAt": at}})
+	return err
+}
+
+func (s *store) SaveReconciliation(ctx context.Context, r *ReconciliationReport) error {
+	col := s.db.Database(DbName).Collection(ReconciliationsCollName)
+
+	_, err := col.InsertOne(ctx, r)
+	return err
+}
+
+func (s *store) CreateRefund(ctx context.Context, r *Refund) error {
+	col := s.db.Database(DbName).Collection(RefundsCollName)
+
+	_, err := col.InsertOne(ctx, r)
+	return err
+}
+
+func (s *store) UpdateRefund(ctx context.Context, r *Refund) error {
+	col := s.db.Database(DbName).Collection(RefundsCollName)
+
+	_, err := col.ReplaceOne(ctx, bson.M{"_id": r.ID}, r)
+	return err
+}
+
+func (s *store) ListRefunds(ctx context.Context, paymentID string) ([]*Refund, error) {
+	col := s.db.Database(DbName).Collection(RefundsCollName)
+
+	cursor, err := col.Find(ctx, bson.M{"paymentID": paymentID}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*Refund{}
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) SaveWebhook(ctx context.Context, w *Webhook) error {
+	col := s.db.Database(DbName).Collection(WebhooksCollName)
+
+	_, err := col.InsertOne(ctx, w)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrWebhookExists
+	}
+
+	return err
+}
+
+func (s *store) ClaimWebhook(ctx context.Context, now time.Time, lease time.Duration) (*Webhook, error) {
+	col := s.db.Database(DbName).Collection(WebhooksCollName)
+
+	var w Webhook
+	err := col.FindOneAndUpdate(ctx,
+		bson.M{"status": WebhookPending, "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{
+			"$set": bson.M{"nextAttemptAt": now.Add(lease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.M{"nextAttemptAt": 1}).
+			SetReturnDocument(options.After),
+	).Decode(&w)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func (s *store) UpdateWebhook(ctx context.Context, w *Webhook) error {
+	col := s.db.Database(DbName).Collection(WebhooksCollName)
+
+	_, err := col.UpdateOne(ctx,
+		bson.M{"_id": w.ID},
+		bson.M{"$set": bson.M{
+			"status":        w.Status,
+			"nextAttemptAt": w.NextAttemptAt,
+			"lastError":     w.LastError,
+			"processedAt":   w.ProcessedAt,
+		}})
+
+	return err
+}
+
+func (s *store) RequeueWebhooks(ctx context.Context, ids []string, now time.Time) (int64, error) {
+	col := s.db.Database(DbName).Collection(WebhooksCollName)
+
+	filter := bson.M{"status": WebhookFailed}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+
+	// the last error is kept until the next attempt
+	res, err := col.UpdateMany(ctx, filter, bson.M{"$set": bson.M{
+		"status":        WebhookPending,
+		"attempts":      0,
+		"nextAttemptAt": now,
+	}})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+func (s *store) CountOrders(ctx context.Context, customerID string, since time.Time) (int64, error) {
+	col := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	// held orders have no payment, but every order has a decision
+	orderIDs, err := col.Distinct(ctx, "orderID", bson.M{"customerID": customerID, "createdAt": bson.M{"$gte": since}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(orderIDs)), nil
+}
+
+func (s *store) HasPaid(ctx context.Context, customerID string) (bool, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	n, err := col.CountDocuments(ctx, bson.M{
+		"customerID": customerID,
+		"status":     bson.M{"$in": bson.A{PaymentPaid, PaymentPartiallyRefunded, PaymentRefunded, PaymentDisputed}},
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (s *store) SaveCardUse(ctx context.Context, c *CardUse) error {
+	col := s.db.Database(DbName).Collection(CardUsesCollName)
+
+	_, err := col.InsertOne(ctx, c)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCardUseExists
+	}
+
+	return err
+}
+
+func (s *store) CountCards(ctx context.Context, customerID string, since time.Time) (int64, error) {
+	col := s.db.Database(DbName).Collection(CardUsesCollName)
+
+	fingerprints, err := col.Distinct(ctx, "fingerprint", bson.M{"customerID": customerID, "seenAt": bson.M{"$gte": since}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(fingerprints)), nil
+}
+
+func (s *store) CreateRiskDecision(ctx context.Context, d *RiskDecision) error {
+	col := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	_, err := col.InsertOne(ctx, d)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrRiskDecisionExists
+	}
+
+	return err
+}
+
+func (s *store) GetRiskDecision(ctx context.Context, id string) (*RiskDecision, error) {
+	col := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	var d RiskDecision
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRiskDecisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (s *store) GetRiskDecisionByOrder(ctx context.Context, orderID string) (*RiskDecision, error) {
+	col := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	var d RiskDecision
+	err := col.FindOne(ctx, bson.M{"orderID": orderID}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRiskDecisionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (s *store) ListRiskDecisions(ctx context.Context, status RiskDecisionStatus, limit int) ([]*RiskDecision, error) {
+	col := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(int64(limit))
+
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*RiskDecision{}
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) UpdateRiskDecision(ctx context.Context, d *RiskDecision) error {
+	col := s.db.Database(DbName).Collection(RiskDecisionsCollName)
+
+	res, err := col.ReplaceOne(ctx, bson.M{"_id": d.ID, "status": RiskHeld}, d)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%w: risk decision %s was already reviewed", ErrInvalidStatus, d.ID)
+	}
+
+	return nil
+}
+
+func (s *store) findOne(ctx context.Context, filter bson.M) (*Payment, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	var p Payment
+	err := col.FindOne(ctx, filter).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	pb "github.com/scuba13/oms/common/api"
 	"go.opentelemetry.io/otel/trace"
@@ -22,3 +23,80 @@ func (s *TelemetryMiddleware) CreatePayment(ctx context.Context, o *pb.Order) (s
 
 	return s.next.CreatePayment(ctx, o)
 }
+
+func (s *TelemetryMiddleware) GetPayment(ctx context.Context, id string) (*Payment, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("GetPayment: %s", id))
+
+	return s.next.GetPayment(ctx, id)
+}
+
+func (s *TelemetryMiddleware) ListPaymentsForOrder(ctx context.Context, orderID string) ([]*Payment, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ListPaymentsForOrder: %s", orderID))
+
+	return s.next.ListPaymentsForOrder(ctx, orderID)
+}
+
+func (s *TelemetryMiddleware) UpdatePayment(ctx context.Context, u *PaymentUpdate) (*Payment, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("UpdatePayment: %s session %s intent %s to %s, event: %s", u.Processor, u.SessionID, u.PaymentIntentID, u.Status, u.EventID))
+
+	return s.next.UpdatePayment(ctx, u)
+}
+
+func (s *TelemetryMiddleware) RequeueWebhooks(ctx context.Context, ids []string) (int64, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("RequeueWebhooks: %v", ids))
+
+	return s.next.RequeueWebhooks(ctx, ids)
+}
+
+func (s *TelemetryMiddleware) ReconcilePayments(ctx context.Context, before time.Time) (*ReconciliationReport, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ReconcilePayments: %s", before))
+
+	return s.next.ReconcilePayments(ctx, before)
+}
+
+func (s *TelemetryMiddleware) RefundPayment(ctx context.Context, r *RefundRequest) (*Refund, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("RefundPayment: %s amount %d, %d items, by %s", r.PaymentID, r.Amount, len(r.Items), r.Actor))
+
+	return s.next.RefundPayment(ctx, r)
+}
+
+func (s *TelemetryMiddleware) RecordedRefunds(ctx context.Context, paymentID string) (int64, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("RecordedRefunds: %s", paymentID))
+
+	return s.next.RecordedRefunds(ctx, paymentID)
+}
+
+func (s *TelemetryMiddleware) ConfirmManualPayment(ctx context.Context, c *ManualConfirmation) (*Payment, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ConfirmManualPayment: %s by %s", c.PaymentID, c.Actor))
+
+	return s.next.ConfirmManualPayment(ctx, c)
+}
+
+func (s *TelemetryMiddleware) ListRiskDecisions(ctx context.Context, status RiskDecisionStatus, limit int) ([]*RiskDecision, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ListRiskDecisions: %s, %d", status, limit))
+
+	return s.next.ListRiskDecisions(ctx, status, limit)
+}
+
+func (s *TelemetryMiddleware) ReviewRiskDecision(ctx context.Context, r *RiskReview) (*RiskDecision, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ReviewRiskDecision: %s approve %t, by %s", r.DecisionID, r.Approve, r.Actor))
+
+	return s.next.ReviewRiskDecision(ctx, r)
+}
+
+func (s *TelemetryMiddleware) RecordCardUse(ctx context.Context, c *CardUse) error {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("RecordCardUse: customer %s", c.CustomerID))
+
+	return s.next.RecordCardUse(ctx, c)
+}
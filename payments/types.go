@@ -2,10 +2,133 @@ package main
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	pb "github.com/scuba13/oms/common/api"
 )
 
+var (
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrInvalidStatus   = errors.New("invalid payment status transition")
+	ErrPaymentConflict = errors.New("payment was changed concurrently")
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	ErrWebhookExists    = errors.New("webhook already received")
+	ErrMalformedWebhook = errors.New("malformed webhook")
+
+	ErrRiskDecisionNotFound = errors.New("risk decision not found")
+	ErrRiskDecisionExists   = errors.New("risk decision already recorded")
+	ErrCardUseExists        = errors.New("card use already recorded")
+)
+
 type PaymentsService interface {
 	CreatePayment(context.Context, *pb.Order) (string, error)
+	GetPayment(ctx context.Context, id string) (*Payment, error)
+	ListPaymentsForOrder(ctx context.Context, orderID string) ([]*Payment, error)
+	// UpdatePayment applies what a webhook event tells about a payment.
+	// Events already applied to the payment are ignored.
+	UpdatePayment(ctx context.Context, u *PaymentUpdate) (*Payment, error)
+	// RequeueWebhooks sends failed webhooks back to be processed, those with
+	// the given IDs or all of them.
+	RequeueWebhooks(ctx context.Context, ids []string) (int64, error)
+	// ReconcilePayments checks the payments created before a time that are
+	// still open or processing against the processor.
+	ReconcilePayments(ctx context.Context, before time.Time) (*ReconciliationReport, error)
+	RefundPayment(ctx context.Context, r *RefundRequest) (*Refund, error)
+	// RecordedRefunds adds up the refunds of a payment made, or being made,
+	// through RefundPayment, which publishes payment.refunded for them.
+	RecordedRefunds(ctx context.Context, paymentID string) (int64, error)
+	// ConfirmManualPayment takes in the confirmation of a payment made at
+	// the counter. It is processed like a processor webhook, which moves the
+	// payment to paid and publishes order.paid.
+	ConfirmManualPayment(ctx context.Context, c *ManualConfirmation) (*Payment, error)
+	// ListRiskDecisions returns the latest risk decisions, only those with a
+	// status when it is not empty.
+	ListRiskDecisions(ctx context.Context, status RiskDecisionStatus, limit int) ([]*RiskDecision, error)
+	ReviewRiskDecision(ctx context.Context, r *RiskReview) (*RiskDecision, error)
+	// RecordCardUse records a card charged for an order, the risk rules
+	// count the distinct cards of a customer.
+	RecordCardUse(ctx context.Context, c *CardUse) error
+}
+
+type PaymentsStore interface {
+	Create(ctx context.Context, p *Payment) error
+	Get(ctx context.Context, id string) (*Payment, error)
+	GetBySession(ctx context.Context, processor, sessionID string) (*Payment, error)
+	GetByPaymentIntent(ctx context.Context, processor, paymentIntentID string) (*Payment, error)
+	// ListByOrder returns the payments of an order, the oldest first.
+	ListByOrder(ctx context.Context, orderID string) ([]*Payment, error)
+	// Update replaces a payment and bumps its version, or fails with
+	// ErrPaymentConflict when the stored version is not the one it was read
+	// at.
+	Update(ctx context.Context, p *Payment) error
+	// ListStale returns up to limit open or processing payments created
+	// before a time, the ones never reconciled or reconciled the longest ago
+	// first, then the oldest. Cash payments are left out until they expire.
+	ListStale(ctx context.Context, before time.Time, limit int) ([]*Payment, error)
+	// MarkReconciled records when payments were last checked with their
+	// processor, which sends them to the back of ListStale.
+	MarkReconciled(ctx context.Context, ids []string, at time.Time) error
+	SaveReconciliation(ctx context.Context, r *ReconciliationReport) error
+	CreateRefund(ctx context.Context, r *Refund) error
+	// UpdateRefund replaces a refund.
+	UpdateRefund(ctx context.Context, r *Refund) error
+	// ListRefunds returns the refunds of a payment, the oldest first.
+	ListRefunds(ctx context.Context, paymentID string) ([]*Refund, error)
+	// CountOrders returns how many orders of a customer were checked against
+	// the risk rules since a time.
+	CountOrders(ctx context.Context, customerID string, since time.Time) (int64, error)
+	// HasPaid tells whether a customer ever paid an order.
+	HasPaid(ctx context.Context, customerID string) (bool, error)
+	// SaveCardUse records a card use, or fails with ErrCardUseExists when it
+	// was recorded before.
+	SaveCardUse(ctx context.Context, c *CardUse) error
+	// CountCards returns how many distinct cards a customer used since a
+	// time.
+	CountCards(ctx context.Context, customerID string, since time.Time) (int64, error)
+	// CreateRiskDecision records the risk decision of an order, or fails
+	// with ErrRiskDecisionExists when the order already has one.
+	CreateRiskDecision(ctx context.Context, d *RiskDecision) error
+	GetRiskDecision(ctx context.Context, id string) (*RiskDecision, error)
+	// GetRiskDecisionByOrder returns the risk decision of an order, or fails
+	// with ErrRiskDecisionNotFound.
+	GetRiskDecisionByOrder(ctx context.Context, orderID string) (*RiskDecision, error)
+	// ListRiskDecisions returns up to limit decisions, the latest first,
+	// only those with a status when it is not empty.
+	ListRiskDecisions(ctx context.Context, status RiskDecisionStatus, limit int) ([]*RiskDecision, error)
+	// UpdateRiskDecision stores the review of a held decision, or fails
+	// with ErrInvalidStatus when it was reviewed in the meantime.
+	UpdateRiskDecision(ctx context.Context, d *RiskDecision) error
+}
+
+type WebhookStore interface {
+	// SaveWebhook stores a webhook received from a processor, or fails with
+	// ErrWebhookExists when an event with its ID was stored before.
+	SaveWebhook(ctx context.Context, w *Webhook) error
+	// ClaimWebhook takes the pending webhook due the longest, counting an
+	// attempt and hiding it from other claims for lease. It returns nil when
+	// no webhook is due.
+	ClaimWebhook(ctx context.Context, now time.Time, lease time.Duration) (*Webhook, error)
+	// UpdateWebhook stores the outcome of processing a claimed webhook.
+	UpdateWebhook(ctx context.Context, w *Webhook) error
+	// RequeueWebhooks makes the failed webhooks with the given IDs, or every
+	// failed one without IDs, pending again with no attempts counted. It
+	// returns how many were requeued.
+	RequeueWebhooks(ctx context.Context, ids []string, now time.Time) (int64, error)
+}
+
+// ConfigStore reads configuration values by key, such as Consul KV.
+type ConfigStore interface {
+	GetValue(ctx context.Context, key string) (string, error)
+}
+
+// RiskRulesSource gives the risk rules in force.
+type RiskRulesSource interface {
+	RiskRules() RiskRules
+}
+
+type EventPublisher interface {
+	// Publish sends v as JSON to a broker exchange.
+	Publish(ctx context.Context, exchange string, v any) error
 }
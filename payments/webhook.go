@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	otelCodes "go.opentelemetry.io/otel/codes"
+)
+
+const (
+	// webhookPollInterval is how often stored webhooks due for a retry are
+	// looked for when no new webhook arrived.
+	webhookPollInterval = 5 * time.Second
+	// webhookLease is how long a claimed webhook is left to the instance
+	// processing it before another instance may claim it again.
+	webhookLease = time.Minute
+	// webhookTimeout bounds the processing of a single webhook.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is how many times a webhook is processed before it
+	// is marked failed and left for an operator.
+	webhookMaxAttempts = 20
+	webhookMaxBackoff  = 10 * time.Minute
+)
+
+type WebhookStatus string
+
+const (
+	WebhookPending   WebhookStatus = "pending"
+	WebhookProcessed WebhookStatus = "processed"
+	WebhookFailed    WebhookStatus = "failed"
+)
+
+// Webhook is a verified processor event, stored before it is acknowledged,
+// or the ManualConfirmation of a cash payment. Its ID is the processor name
+// and the processor event ID, so an event sent again is only stored once and
+// processors can't clash on their event IDs.
+type Webhook struct {
+	ID string `bson:"_id"`
+	// EventID is the processor event ID. Webhooks stored before it was kept
+	// have it as their ID.
+	EventID       string        `bson:"eventID,omitempty"`
+	Processor     string        `bson:"processor"`
+	Type          string        `bson:"type"`
+	Payload       []byte        `bson:"payload"`
+	Status        WebhookStatus `bson:"status"`
+	Attempts      int           `bson:"attempts"`
+	NextAttemptAt time.Time     `bson:"nextAttemptAt"`
+	LastError     string        `bson:"lastError,omitempty"`
+	ReceivedAt    time.Time     `bson:"receivedAt"`
+	ProcessedAt   *time.Time    `bson:"processedAt,omitempty"`
+}
+
+func NewWebhook(processor, id, eventType string, payload []byte) *Webhook {
+	now := time.Now()
+	return &Webhook{
+		ID:            processor + ":" + id,
+		EventID:       id,
+		Processor:     processor,
+		Type:          eventType,
+		Payload:       payload,
+		Status:        WebhookPending,
+		NextAttemptAt: now,
+		ReceivedAt:    now,
+	}
+}
+
+// webhookBackoff is how long to wait before processing a webhook again after
+// its nth attempt failed.
+func webhookBackoff(attempts int) time.Duration {
+	d := time.Second << min(attempts, 10)
+	return min(d, webhookMaxBackoff)
+}
+
+// webhookInbox is the webhook store that wakes RunWebhooks whenever a
+// webhook is saved, wherever it comes from: a processor route or a cash
+// confirmation, and whenever failed webhooks are requeued.
+type webhookInbox struct {
+	WebhookStore
+	wake chan struct{}
+}
+
+func NewWebhookInbox(store WebhookStore) *webhookInbox {
+	return &webhookInbox{store, make(chan struct{}, 1)}
+}
+
+func (i *webhookInbox) SaveWebhook(ctx context.Context, w *Webhook) error {
+	if err := i.WebhookStore.SaveWebhook(ctx, w); err != nil {
+		return err
+	}
+
+	i.wakeUp()
+	return nil
+}
+
+func (i *webhookInbox) RequeueWebhooks(ctx context.Context, ids []string, now time.Time) (int64, error) {
+	requeued, err := i.WebhookStore.RequeueWebhooks(ctx, ids, now)
+	if requeued > 0 {
+		i.wakeUp()
+	}
+
+	return requeued, err
+}
+
+// wakeUp tells ProcessWebhooks a webhook is waiting.
+func (i *webhookInbox) wakeUp() {
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunWebhooks processes the stored webhooks as they arrive, and looks for
+// the ones due for a retry every poll interval, until ctx is done.
+func (h *PaymentHTTPHandler) RunWebhooks(ctx context.Context) {
+	for {
+		processed, err := h.ProcessWebhooks(ctx)
+		if err != nil {
+			log.Printf("Failed to process webhooks: %v", err)
+		} else if processed > 0 {
+			log.Printf("Processed %d webhooks", processed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.webhooks.wake:
+		case <-time.After(webhookPollInterval):
+		}
+	}
+}
+
+// ProcessWebhooks processes the stored webhooks that are due, one at a time
+// and the oldest first, until none is left. A webhook that fails is tried
+// again later with a growing backoff. It returns how many were processed.
+func (h *PaymentHTTPHandler) ProcessWebhooks(ctx context.Context) (int, error) {
+	processed := 0
+	for {
+		w, err := h.webhooks.ClaimWebhook(ctx, time.Now(), webhookLease)
+		if err != nil {
+			return processed, err
+		}
+		if w == nil {
+			return processed, nil
+		}
+
+		if err := h.processWebhook(ctx, w); err != nil {
+			return processed, err
+		}
+		if w.Status == WebhookProcessed {
+			processed++
+		}
+	}
+}
+
+// processWebhook handles a claimed webhook and stores the outcome. Only a
+// failure to store the outcome is returned, the webhook then comes back once
+// its lease is over.
+func (h *PaymentHTTPHandler) processWebhook(ctx context.Context, w *Webhook) error {
+	tr := otel.Tracer("webhook")
+	ctx, span := tr.Start(ctx, fmt.Sprintf("webhook - process - %s", w.Type))
+	defer span.End()
+
+	handleCtx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	err := h.handleWebhook(handleCtx, w)
+	cancel()
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		w.Status = WebhookProcessed
+		w.LastError = ""
+		w.ProcessedAt = &now
+	case errors.Is(err, ErrMalformedWebhook), w.Attempts >= webhookMaxAttempts:
+		span.SetStatus(otelCodes.Error, err.Error())
+		log.Printf("Giving up on %s webhook %s after %d attempts: %v", w.Type, w.ID, w.Attempts, err)
+
+		w.Status = WebhookFailed
+		w.LastError = err.Error()
+	default:
+		span.SetStatus(otelCodes.Error, err.Error())
+		log.Printf("Failed to process %s webhook %s, attempt %d: %v", w.Type, w.ID, w.Attempts, err)
+
+		w.LastError = err.Error()
+		w.NextAttemptAt = now.Add(webhookBackoff(w.Attempts))
+	}
+
+	return h.webhooks.UpdateWebhook(ctx, w)
+}
+
+// handleWebhook translates a webhook with the provider of its processor and
+// handles the payment event it tells about, if any.
+func (h *PaymentHTTPHandler) handleWebhook(ctx context.Context, w *Webhook) error {
+	p, ok := h.providers.Provider(w.Processor)
+	if !ok {
+		return fmt.Errorf("%w: no webhook provider for processor %s", ErrMalformedWebhook, w.Processor)
+	}
+
+	e, err := p.Translator.Translate(w.Type, w.Payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedWebhook, err)
+	}
+	if e == nil {
+		return nil
+	}
+
+	eventID := w.EventID
+	if eventID == "" {
+		eventID = w.ID
+	}
+
+	return h.handleEvent(ctx, w.Processor, eventID, e)
+}
+
+// RequeueWebhooks sends failed webhooks back to be processed. They are failed
+// when processing gave up on them, and requeued once what they failed on is
+// fixed, such as a broker outage. They are picked up right away.
+func (s *service) RequeueWebhooks(ctx context.Context, ids []string) (int64, error) {
+	return s.webhooks.RequeueWebhooks(ctx, ids, time.Now())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scuba13/oms/common/broker"
+	"github.com/scuba13/oms/payments/processor"
+	"github.com/scuba13/oms/payments/processor/counter"
+	stripeProcessor "github.com/scuba13/oms/payments/processor/stripe"
+)
+
+// newWebhookProviders registers the webhook providers main does.
+func newWebhookProviders(t *testing.T) *processor.WebhookRegistry {
+	t.Helper()
+
+	providers := processor.NewWebhookRegistry()
+	for _, p := range []*processor.WebhookProvider{
+		stripeProcessor.NewWebhookProvider("/webhook", endpointStripeSecret),
+		counter.NewWebhookProvider(),
+	} {
+		if err := providers.Register(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return providers
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{9, 512 * time.Second},
+		{10, webhookMaxBackoff},
+		{30, webhookMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff after %d attempts is %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// failingPayments fails every payment update, as when the database is down.
+type failingPayments struct {
+	PaymentsService
+}
+
+func (failingPayments) UpdatePayment(ctx context.Context, u *PaymentUpdate) (*Payment, error) {
+	return nil, errors.New("database is down")
+}
+
+// sessionCompleted is a checkout.session.completed event of a session still
+// waiting for its payment, which publishes nothing.
+func sessionCompleted(eventID, sessionID string) []byte {
+	return []byte(fmt.Sprintf(`{"id": %q, "type": "checkout.session.completed", "data": {"object": {"id": %q, "object": "checkout.session", "payment_status": "unpaid"}}}`, eventID, sessionID))
+}
+
+func TestProcessWebhooks(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	svc := NewService(byMethod(nil), &memoryOrders{}, store, store, &memoryPublisher{}, noRiskRules{})
+	if err := store.Create(ctx, &Payment{ID: "p1", Processor: stripeProcessor.ProcessorName, SessionID: "cs_1", Status: PaymentOpen}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range []*Webhook{
+		NewWebhook(stripeProcessor.ProcessorName, "evt_1", "checkout.session.completed", sessionCompleted("evt_1", "cs_1")),
+		NewWebhook(stripeProcessor.ProcessorName, "evt_bad", "checkout.session.completed", []byte("not json")),
+	} {
+		if err := store.SaveWebhook(ctx, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	again := NewWebhook(stripeProcessor.ProcessorName, "evt_1", "checkout.session.completed", sessionCompleted("evt_1", "cs_1"))
+	if err := store.SaveWebhook(ctx, again); !errors.Is(err, ErrWebhookExists) {
+		t.Fatalf("saving an event twice returned %v, want %v", err, ErrWebhookExists)
+	}
+
+	// a failure is tried again later, a payload that can't be read is not
+	failing := NewPaymentHTTPHandler(&memoryPublisher{}, failingPayments{}, NewWebhookInbox(store), newWebhookProviders(t))
+	if processed, err := failing.ProcessWebhooks(ctx); err != nil || processed != 0 {
+		t.Fatalf("processed %d webhooks, %v, want none", processed, err)
+	}
+	if w := store.webhook("stripe:evt_1"); w.Status != WebhookPending || w.Attempts != 1 || w.LastError == "" || !w.NextAttemptAt.After(time.Now()) {
+		t.Errorf("got webhook %+v, want it pending a retry", w)
+	}
+	if w := store.webhook("stripe:evt_bad"); w.Status != WebhookFailed {
+		t.Errorf("the malformed webhook is %s, want %s", w.Status, WebhookFailed)
+	}
+
+	// giving up after the last attempt leaves the webhook to an operator
+	w := store.webhook("stripe:evt_1")
+	w.Attempts = webhookMaxAttempts - 1
+	w.NextAttemptAt = time.Now()
+	if err := store.UpdateWebhook(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := failing.ProcessWebhooks(ctx); err != nil {
+		t.Fatalf("processing: %v", err)
+	}
+	if w := store.webhook("stripe:evt_1"); w.Status != WebhookFailed {
+		t.Fatalf("the webhook is %s after %d attempts, want %s", w.Status, w.Attempts, WebhookFailed)
+	}
+
+	requeued, err := svc.RequeueWebhooks(ctx, []string{"stripe:evt_1"})
+	if err != nil || requeued != 1 {
+		t.Fatalf("requeued %d webhooks, %v, want 1", requeued, err)
+	}
+	if w := store.webhook("stripe:evt_1"); w.Status != WebhookPending || w.Attempts != 0 {
+		t.Errorf("got webhook %+v, want it pending with no attempts", w)
+	}
+	if w := store.webhook("stripe:evt_bad"); w.Status != WebhookFailed {
+		t.Errorf("the webhook that wasn't named is %s, want it left %s", w.Status, WebhookFailed)
+	}
+
+	handler := NewPaymentHTTPHandler(&memoryPublisher{}, svc, NewWebhookInbox(store), newWebhookProviders(t))
+	if processed, err := handler.ProcessWebhooks(ctx); err != nil || processed != 1 {
+		t.Fatalf("processed %d webhooks, %v, want 1", processed, err)
+	}
+	if p, _ := store.Get(ctx, "p1"); p.Status != PaymentProcessing {
+		t.Errorf("the payment is %s, want %s", p.Status, PaymentProcessing)
+	}
+}
+
+// acmeWebhooks reads the webhooks of a made-up processor, signed with a
+// header and naming the paid session in their body.
+type acmeWebhooks struct{}
+
+func (acmeWebhooks) Verify(header http.Header, payload []byte) (string, string, error) {
+	if header.Get("Acme-Signature") != "valid" {
+		return "", "", errors.New("bad signature")
+	}
+	return header.Get("Acme-Event"), "session.paid", nil
+}
+
+func (acmeWebhooks) Translate(eventType string, payload []byte) (*processor.Event, error) {
+	return &processor.Event{Kind: processor.EventPaid, SessionID: string(payload), Amount: 999, Currency: "eur"}, nil
+}
+
+func TestWebhookProviders(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	publisher := &memoryPublisher{}
+	inbox := NewWebhookInbox(store)
+	if err := store.Create(ctx, &Payment{ID: "p1", OrderID: "order-1", Processor: "acme", SessionID: "acme_1", Amount: 1250, Currency: "usd", Status: PaymentOpen}); err != nil {
+		t.Fatal(err)
+	}
+
+	providers := newWebhookProviders(t)
+	if err := providers.Register(&processor.WebhookProvider{Processor: "acme", Route: "/acme", Verifier: acmeWebhooks{}, Translator: acmeWebhooks{}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewPaymentHTTPHandler(publisher, NewService(byMethod(nil), &memoryOrders{}, store, inbox, publisher, noRiskRules{}), inbox, providers)
+	mux := http.NewServeMux()
+	handler.registerRoutes(mux)
+
+	post := func(signature string) int {
+		r := httptest.NewRequest(http.MethodPost, "/acme", strings.NewReader("acme_1"))
+		r.Header.Set("Acme-Signature", signature)
+		r.Header.Set("Acme-Event", "evt_1")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := post("forged"); code != http.StatusBadRequest {
+		t.Errorf("a forged webhook got %d, want 400", code)
+	}
+	if code := post("valid"); code != http.StatusOK {
+		t.Fatalf("the webhook got %d, want 200", code)
+	}
+	// event IDs of different processors can't clash
+	if w := store.webhook("acme:evt_1"); w.EventID != "evt_1" {
+		t.Fatalf("got webhook %+v, want acme event evt_1", w)
+	}
+
+	if processed, err := handler.ProcessWebhooks(ctx); err != nil || processed != 1 {
+		t.Fatalf("processed %d webhooks, %v, want 1", processed, err)
+	}
+	// only amounts collected replace the recorded one
+	if p, _ := store.Get(ctx, "p1"); p.Status != PaymentPaid || p.Amount != 1250 || p.Currency != "usd" {
+		t.Errorf("the payment is %s for %d %s, want 1250 usd paid", p.Status, p.Amount, p.Currency)
+	}
+	if paid := publisher.published(broker.OrderPaidEvent); len(paid) != 1 {
+		t.Errorf("published %d %s, want 1", len(paid), broker.OrderPaidEvent)
+	}
+}
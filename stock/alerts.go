@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"go.opentelemetry.io/otel"
+)
+
+type AlertPublisher interface {
+	// PublishAlert sends a stock alert with the stock.low or stock.depleted
+	// event as its routing key.
+	PublishAlert(ctx context.Context, event string, a *pb.StockAlert) error
+	// PublishBackInStock sends the stock.back_in_stock event of an item
+	// with a waitlist.
+	PublishBackInStock(ctx context.Context, b *pb.BackInStock) error
+}
+
+type amqpAlertPublisher struct {
+	channel *amqp.Channel
+}
+
+func NewAlertPublisher(channel *amqp.Channel) *amqpAlertPublisher {
+	return &amqpAlertPublisher{channel}
+}
+
+func (p *amqpAlertPublisher) PublishAlert(ctx context.Context, event string, a *pb.StockAlert) error {
+	tr := otel.Tracer("amqp")
+	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", event))
+	defer messageSpan.End()
+
+	marshalledAlert, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	headers := broker.InjectAMQPHeaders(amqpContext)
+
+	return p.channel.PublishWithContext(amqpContext, broker.StockAlertsExchange, event, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         marshalledAlert,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
+}
+
+func (p *amqpAlertPublisher) PublishBackInStock(ctx context.Context, b *pb.BackInStock) error {
+	tr := otel.Tracer("amqp")
+	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", broker.StockBackInStockEvent))
+	defer messageSpan.End()
+
+	marshalledEvent, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	headers := broker.InjectAMQPHeaders(amqpContext)
+
+	return p.channel.PublishWithContext(amqpContext, broker.StockAlertsExchange, broker.StockBackInStockEvent, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         marshalledEvent,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
+}
+
+// thresholdAlert returns the alert event raised by lowering the available
+// quantity of an item by decrease, given the item as it was before. An item
+// that runs out raises stock.depleted, one that reaches its reorder
+// threshold raises stock.low.
+func thresholdAlert(i *Item, decrease int32) (string, bool) {
+	before := i.Available()
+	after := before - decrease
+
+	switch {
+	case before > 0 && after <= 0:
+		return broker.StockDepletedEvent, true
+	case i.ReorderThreshold > 0 && before > i.ReorderThreshold && after <= i.ReorderThreshold:
+		return broker.StockLowEvent, true
+	}
+
+	return "", false
+}
+
+// raiseAlerts publishes the alerts of the items whose available quantity at
+// a location went down by the given quantities. before holds the items as
+// the store saw them just before the change, so concurrent changes don't
+// hide a crossed threshold or raise one twice. The change is already stored,
+// so failures are only logged.
+func (s *Service) raiseAlerts(ctx context.Context, locationID string, before []*Item, decreases []*ItemQuantity) {
+	for _, i := range before {
+		for _, d := range decreases {
+			if d.ItemID != i.ID {
+				continue
+			}
+
+			event, ok := thresholdAlert(i, d.Quantity)
+			if !ok {
+				continue
+			}
+
+			err := s.alerts.PublishAlert(ctx, event, &pb.StockAlert{
+				ItemID:           i.ID,
+				Name:             i.Name,
+				Available:        i.Available() - d.Quantity,
+				ReorderThreshold: i.ReorderThreshold,
+				CreatedAt:        time.Now().Unix(),
+				LocationID:       locationID,
+			})
+			if err != nil {
+				log.Printf("Failed to publish %s for item %s: %v", event, i.ID, err)
+			}
+		}
+	}
+}
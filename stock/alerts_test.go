@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+)
+
+func TestThresholdAlert(t *testing.T) {
+	tests := []struct {
+		name      string
+		item      Item
+		decrease  int32
+		wantEvent string
+	}{
+		{"above the threshold", Item{Quantity: 10, ReorderThreshold: 3}, 2, ""},
+		{"reaches the threshold", Item{Quantity: 10, ReorderThreshold: 3}, 7, broker.StockLowEvent},
+		{"already below the threshold", Item{Quantity: 3, ReorderThreshold: 3}, 1, ""},
+		{"runs out", Item{Quantity: 10, ReorderThreshold: 3}, 10, broker.StockDepletedEvent},
+		{"runs out below the threshold", Item{Quantity: 2, ReorderThreshold: 3}, 2, broker.StockDepletedEvent},
+		{"already out", Item{Quantity: 0}, 1, ""},
+		{"no threshold", Item{Quantity: 10}, 9, ""},
+		{"reserved quantity counts", Item{Quantity: 10, Reserved: 6, ReorderThreshold: 3}, 1, broker.StockLowEvent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := thresholdAlert(&tt.item, tt.decrease)
+			if event != tt.wantEvent || ok != (tt.wantEvent != "") {
+				t.Errorf("got %q, %v, want %q", event, ok, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestServiceRaisesAlerts(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t,
+		&Item{ID: "burger", Name: "burger", PriceID: "p", Stock: stocked(10), ReorderThreshold: 3},
+		&Item{ID: "fries", Name: "fries", PriceID: "p", Stock: stocked(2)},
+	)
+	alerts := s.alerts.(*alertRecorder)
+
+	_, _, err := s.ReserveItems(ctx, "o1", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 2}, {ID: "fries", Quantity: 1}}, time.Hour)
+	if err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+	if len(alerts.alerts) != 0 {
+		t.Errorf("got alerts %v above the thresholds, want none", alerts.alerts)
+	}
+
+	_, _, err = s.ReserveItems(ctx, "o2", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 5}, {ID: "fries", Quantity: 1}}, time.Hour)
+	if err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+	if _, err := s.AdjustQuantity(ctx, "burger", "", MovementWaste, -3, "dropped", "jane"); err != nil {
+		t.Fatalf("wasting: %v", err)
+	}
+
+	want := []string{
+		broker.StockLowEvent + " burger",
+		broker.StockDepletedEvent + " fries",
+		broker.StockDepletedEvent + " burger",
+	}
+	if !slices.Equal(alerts.alerts, want) {
+		t.Errorf("got alerts %v, want %v", alerts.alerts, want)
+	}
+}
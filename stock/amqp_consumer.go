@@ -2,42 +2,53 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	pb "github.com/scuba13/oms/common/api"
 	"github.com/scuba13/oms/common/broker"
 	"go.opentelemetry.io/otel"
 )
 
-type Consumer struct{}
+// queueName is shared by every stock instance, so each order event is
+// handled once and survives restarts.
+const queueName = "stock.orders"
 
-func NewConsumer() *Consumer {
-	return &Consumer{}
+type Consumer struct {
+	service StockService
+}
+
+func NewConsumer(service StockService) *Consumer {
+	return &Consumer{service}
 }
 
 func (c *Consumer) Listen(ch *amqp.Channel) {
 	q, err := ch.QueueDeclare(
-		"",    // name
-		true,  // durable
-		false, // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = ch.QueueBind(
-		q.Name,                // queue name
-		"",                    // routing key
-		broker.OrderPaidEvent, // exchange
-		false,                 // no-wait
-		nil,
-	)
-	if err != nil {
-		log.Fatal(err)
+	for _, exchange := range []string{broker.OrderPaidEvent, broker.OrderCancelledEvent} {
+		err = ch.QueueBind(
+			q.Name,   // queue name
+			"",       // routing key
+			exchange, // exchange
+			false,    // no-wait
+			nil,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
@@ -54,19 +65,103 @@ func (c *Consumer) Listen(ch *amqp.Channel) {
 
 			// Create a new span
 			tr := otel.Tracer("amqp")
-			_, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", q.Name))
+			ctx, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", q.Name))
+
+			event := broker.DeliveryExchange(&d)
+			log.Printf("Received a message from %s: %s", event, d.Body)
+
+			o := &pb.Order{}
+			if err := json.Unmarshal(d.Body, o); err != nil {
+				log.Printf("failed to unmarshal order: %v", err)
+				d.Nack(false, false)
+				messageSpan.End()
+				continue
+			}
 
-			log.Printf("Received a message: %s", d.Body)
+			if err := c.handleOrderEvent(ctx, event, o); err != nil {
+				log.Printf("failed to handle %s for order %s: %v", event, o.ID, err)
 
-			orderID := string(d.Body)
+				if err := broker.HandleQueueRetry(ch, &d, q.Name); err != nil {
+					log.Printf("Error handling retry: %v", err)
+					d.Nack(false, true)
+				} else {
+					d.Ack(false)
+				}
+
+				messageSpan.End()
+				continue
+			}
 
 			d.Ack(false)
 
+			messageSpan.AddEvent(fmt.Sprintf("%s handled: %s", event, o.ID))
 			messageSpan.End()
-			log.Printf("Order received: %s", orderID)
 		}
 	}()
 
 	log.Printf("AMQP Listening. To exit press CTRL+C")
 	<-forever
 }
+
+func (c *Consumer) handleOrderEvent(ctx context.Context, event string, o *pb.Order) error {
+	switch event {
+	case broker.OrderPaidEvent:
+		return c.service.CommitOrder(ctx, o)
+	case broker.OrderCancelledEvent:
+		err := c.service.ReleaseReservation(ctx, o.ID)
+
+		// the reservation was already closed by an earlier delivery or has
+		// expired, there is nothing left to release
+		if errors.Is(err, ErrReservationNotFound) || errors.Is(err, ErrReservationClosed) {
+			log.Printf("Skipping %s for order %s: %v", event, o.ID, err)
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// ListenChanges passes the stock changes published by every stock instance
+// to the service. Each instance has its own queue, which goes away with it.
+func (c *Consumer) ListenChanges(ch *amqp.Channel) {
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ch.QueueBind(q.Name, "", broker.StockChangedEvent, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	msgs, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for d := range msgs {
+		ctx := broker.ExtractAMQPHeader(context.Background(), d.Headers)
+
+		tr := otel.Tracer("amqp")
+		ctx, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - consume - %s", broker.StockChangedEvent))
+
+		change := &StockChange{}
+		if err := json.Unmarshal(d.Body, change); err != nil {
+			log.Printf("failed to unmarshal stock change: %v", err)
+			messageSpan.End()
+			continue
+		}
+
+		c.service.StockChanged(ctx, change)
+		messageSpan.End()
+	}
+}
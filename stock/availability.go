@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// AvailabilityWindow is a time of day range in which an item can be ordered,
+// for example breakfast items from 07:00 to 11:00.
+type AvailabilityWindow struct {
+	// Days are the weekdays the window applies to. No days means every day.
+	Days []time.Weekday `bson:"days,omitempty" json:"days,omitempty"`
+	// Start and End are HH:MM times. End is exclusive and may be before
+	// Start for windows that cross midnight.
+	Start string `bson:"start" json:"start"`
+	End   string `bson:"end" json:"end"`
+}
+
+func (w *AvailabilityWindow) Validate() error {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("availability window %s-%s is empty", w.Start, w.End)
+	}
+	for _, d := range w.Days {
+		if d < time.Sunday || d > time.Saturday {
+			return fmt.Errorf("invalid weekday %d", d)
+		}
+	}
+
+	return nil
+}
+
+// Contains reports whether t falls inside the window. Windows are expected
+// to be valid.
+func (w *AvailabilityWindow) Contains(t time.Time) bool {
+	if len(w.Days) > 0 && !containsWeekday(w.Days, t.Weekday()) {
+		return false
+	}
+
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	now := t.Hour()*60 + t.Minute()
+
+	if start < end {
+		return start <= now && now < end
+	}
+
+	// the window crosses midnight
+	return now >= start || now < end
+}
+
+func (w *AvailabilityWindow) ToProto() *pb.AvailabilityWindow {
+	days := make([]int32, 0, len(w.Days))
+	for _, d := range w.Days {
+		days = append(days, int32(d))
+	}
+
+	return &pb.AvailabilityWindow{
+		Days:  days,
+		Start: w.Start,
+		End:   w.End,
+	}
+}
+
+func availabilityFromProto(windows []*pb.AvailabilityWindow) []*AvailabilityWindow {
+	res := make([]*AvailabilityWindow, 0, len(windows))
+	for _, w := range windows {
+		days := make([]time.Weekday, 0, len(w.Days))
+		for _, d := range w.Days {
+			days = append(days, time.Weekday(d))
+		}
+
+		res = append(res, &AvailabilityWindow{
+			Days:  days,
+			Start: w.Start,
+			End:   w.End,
+		})
+	}
+
+	return res
+}
+
+// parseClock returns the minutes since midnight of an HH:MM time.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func containsWeekday(days []time.Weekday, d time.Weekday) bool {
+	for _, day := range days {
+		if day == d {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAvailabilityWindowContains(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(clock string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", "2024-01-01 "+clock)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name   string
+		window AvailabilityWindow
+		at     time.Time
+		want   bool
+	}{
+		{"inside", AvailabilityWindow{Start: "07:00", End: "11:00"}, at("08:30"), true},
+		{"at the start", AvailabilityWindow{Start: "07:00", End: "11:00"}, at("07:00"), true},
+		{"at the end", AvailabilityWindow{Start: "07:00", End: "11:00"}, at("11:00"), false},
+		{"before", AvailabilityWindow{Start: "07:00", End: "11:00"}, at("06:59"), false},
+		{"late across midnight", AvailabilityWindow{Start: "22:00", End: "02:00"}, at("23:30"), true},
+		{"early across midnight", AvailabilityWindow{Start: "22:00", End: "02:00"}, at("01:00"), true},
+		{"outside across midnight", AvailabilityWindow{Start: "22:00", End: "02:00"}, at("12:00"), false},
+		{"on one of its days", AvailabilityWindow{Days: []time.Weekday{time.Monday}, Start: "07:00", End: "11:00"}, at("08:00"), true},
+		{"on another day", AvailabilityWindow{Days: []time.Weekday{time.Saturday, time.Sunday}, Start: "07:00", End: "11:00"}, at("08:00"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Contains(tt.at); got != tt.want {
+				t.Errorf("%s-%s contains %s: got %v, want %v", tt.window.Start, tt.window.End, tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvailabilityWindowValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  AvailabilityWindow
+		wantErr bool
+	}{
+		{"valid", AvailabilityWindow{Start: "07:00", End: "11:00"}, false},
+		{"across midnight", AvailabilityWindow{Start: "22:00", End: "02:00"}, false},
+		{"empty", AvailabilityWindow{Start: "07:00", End: "07:00"}, true},
+		{"invalid start", AvailabilityWindow{Start: "7am", End: "11:00"}, true},
+		{"invalid end", AvailabilityWindow{Start: "07:00", End: "25:00"}, true},
+		{"invalid weekday", AvailabilityWindow{Days: []time.Weekday{7}, Start: "07:00", End: "11:00"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CatalogFormatJSON = "json"
+	CatalogFormatCSV  = "csv"
+)
+
+// catalogColumns are the columns of a CSV catalog, in the order they are
+// exported. Only id, name and priceID are required.
+var catalogColumns = []string{
+	"id", "name", "priceID", "category", "description", "imageURL", "allergens",
+	"sortOrder", "reorderThreshold", "availability", "recipe", "isIngredient",
+	"stock", "archived",
+}
+
+// catalogRow is an item read from a catalog file along with what is wrong
+// with it. Row is the line of a CSV file, the header being line 1, or the
+// position of the item in a JSON array, counted from 1.
+type catalogRow struct {
+	Row  int
+	Item *Item
+	Err  error
+}
+
+// CatalogFormat picks the format of a catalog file from its extension.
+func CatalogFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return CatalogFormatJSON, nil
+	case ".csv":
+		return CatalogFormatCSV, nil
+	default:
+		return "", fmt.Errorf("unsupported catalog format %q", filepath.Ext(path))
+	}
+}
+
+// LoadCatalog reads the items of a catalog file. The format is picked from
+// the file extension: a JSON array of items, or a CSV file whose header names
+// at least the id, name and priceID columns, see parseCSVCatalog. Quantities
+// without a location are stocked at the default location.
+func LoadCatalog(path string) ([]*Item, error) {
+	format, err := CatalogFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, err := readCatalog(f, format)
+	if err != nil {
+		return nil, fmt.Errorf("parsing catalog %s: %w", path, err)
+	}
+
+	validateCatalogRows(rows, nil)
+
+	items := make([]*Item, 0, len(rows))
+	for _, r := range rows {
+		if r.Err != nil {
+			return nil, fmt.Errorf("catalog %s: row %d: %w", path, r.Row, r.Err)
+		}
+		items = append(items, r.Item)
+	}
+
+	return items, nil
+}
+
+// readCatalog parses a catalog in the given format. Problems with a single
+// item are left on its row, the error is for files that can't be read at
+// all.
+func readCatalog(r io.Reader, format string) ([]*catalogRow, error) {
+	switch format {
+	case CatalogFormatJSON:
+		return parseJSONCatalog(r)
+	case CatalogFormatCSV:
+		return parseCSVCatalog(r)
+	default:
+		return nil, fmt.Errorf("unsupported catalog format %q", format)
+	}
+}
+
+// validateCatalogRows checks each item on its own and against the rest of
+// the catalog, setting the error of the rows that are wrong. Recipes may use
+// the plain items of the catalog or, when importing, the existing ones.
+func validateCatalogRows(rows []*catalogRow, existing map[string]*Item) {
+	byID := make(map[string]*Item, len(rows))
+	for _, r := range rows {
+		if r.Err != nil {
+			continue
+		}
+		if err := validateCatalogItem(r.Item); err != nil {
+			r.Err = err
+			continue
+		}
+		if _, ok := byID[r.Item.ID]; ok {
+			r.Err = fmt.Errorf("duplicated item ID %s", r.Item.ID)
+			continue
+		}
+		byID[r.Item.ID] = r.Item
+	}
+
+	for _, r := range rows {
+		if r.Err != nil {
+			continue
+		}
+		i := r.Item
+
+		for _, ing := range i.Recipe {
+			ingredient, ok := byID[ing.ItemID]
+			if !ok {
+				ingredient, ok = existing[ing.ItemID]
+			}
+			if !ok || ingredient.ID == i.ID || len(ingredient.Recipe) > 0 {
+				r.Err = fmt.Errorf("item %s has an invalid ingredient %s", i.ID, ing.ItemID)
+				break
+			}
+		}
+	}
+}
+
+// validateCatalogItem checks what can be told about an item without looking
+// at the rest of the catalog.
+func validateCatalogItem(i *Item) error {
+	if i.ID == "" {
+		return errors.New("item ID is required")
+	}
+	if err := validateItemDetails(i); err != nil {
+		return fmt.Errorf("item %s: %w", i.ID, err)
+	}
+
+	for locationID, l := range i.Stock {
+		if !locationIDPattern.MatchString(locationID) {
+			return fmt.Errorf("item %s has an invalid location ID %q", i.ID, locationID)
+		}
+		if l == nil || l.Quantity < 0 || l.Reserved != 0 {
+			return fmt.Errorf("item %s has an invalid quantity at %s", i.ID, locationID)
+		}
+	}
+
+	if len(i.Recipe) == 0 {
+		return nil
+	}
+	if i.IsIngredient {
+		return fmt.Errorf("ingredient %s can't have a recipe", i.ID)
+	}
+	if i.Stocked() {
+		return fmt.Errorf("item %s has a recipe and a quantity", i.ID)
+	}
+	seen := make(map[string]bool, len(i.Recipe))
+	for _, r := range i.Recipe {
+		if r.Quantity <= 0 {
+			return fmt.Errorf("item %s needs a positive quantity of %s", i.ID, r.ItemID)
+		}
+		if seen[r.ItemID] {
+			return fmt.Errorf("item %s has the ingredient %s twice", i.ID, r.ItemID)
+		}
+		seen[r.ItemID] = true
+	}
+
+	return nil
+}
+
+// catalogItem is an item of a JSON catalog. Its stock is either given per
+// location or as a single quantity for the default location.
+type catalogItem struct {
+	*Item
+	Quantity int32 `json:"quantity"`
+}
+
+func parseJSONCatalog(r io.Reader) ([]*catalogRow, error) {
+	var entries []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	rows := make([]*catalogRow, 0, len(entries))
+	for idx, raw := range entries {
+		row := &catalogRow{Row: idx + 1}
+		rows = append(rows, row)
+
+		var e catalogItem
+		if err := json.Unmarshal(raw, &e); err != nil {
+			row.Err = err
+			continue
+		}
+		if e.Item == nil {
+			row.Err = errors.New("empty catalog entry")
+			continue
+		}
+		row.Item = e.Item
+
+		if e.Quantity != 0 {
+			if len(e.Stock) > 0 {
+				row.Err = fmt.Errorf("item %s has both a quantity and stock per location", e.ID)
+				continue
+			}
+			e.Level(defaultLocationID).Quantity = e.Quantity
+		}
+	}
+
+	return rows, nil
+}
+
+// parseCSVCatalog reads a CSV catalog. Allergens are separated by "|" and
+// availability windows by ";", each written as HH:MM-HH:MM, optionally after
+// the weekdays it applies to as in 1,2,3,4,5@07:00-11:00. Recipes list their
+// ingredients as itemID:quantity separated by "|". The quantity column stocks
+// the default location, the stock column lists locationID:quantity pairs
+// separated by "|".
+func parseCSVCatalog(r io.Reader) ([]*catalogRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for idx, name := range records[0] {
+		name = strings.TrimSpace(name)
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("duplicated column %q", name)
+		}
+		columns[name] = idx
+	}
+	for _, name := range []string{"id", "name", "priceID"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	rows := make([]*catalogRow, 0, len(records)-1)
+	for line, record := range records[1:] {
+		i, err := parseCSVItem(columns, record)
+		rows = append(rows, &catalogRow{Row: line + 2, Item: i, Err: err})
+	}
+
+	return rows, nil
+}
+
+func parseCSVItem(columns map[string]int, record []string) (*Item, error) {
+	if len(record) != len(columns) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(columns), len(record))
+	}
+
+	field := func(name string) string {
+		idx, ok := columns[name]
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(record[idx])
+	}
+
+	i := &Item{
+		ID:          field("id"),
+		Name:        field("name"),
+		PriceID:     field("priceID"),
+		Category:    field("category"),
+		Description: field("description"),
+		ImageURL:    field("imageURL"),
+	}
+
+	if quantity := field("quantity"); quantity != "" {
+		n, err := strconv.ParseInt(quantity, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity: %w", err)
+		}
+		if n != 0 {
+			i.Level(defaultLocationID).Quantity = int32(n)
+		}
+	}
+
+	if stock := field("stock"); stock != "" {
+		if len(i.Stock) > 0 {
+			return nil, fmt.Errorf("item %s has both a quantity and stock per location", i.ID)
+		}
+		for _, entry := range strings.Split(stock, "|") {
+			locationID, q, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid stock entry %q", entry)
+			}
+			n, err := strconv.ParseInt(q, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stock quantity: %w", err)
+			}
+			if _, ok := i.Stock[locationID]; ok {
+				return nil, fmt.Errorf("location %s is stocked twice", locationID)
+			}
+			i.Level(locationID).Quantity = int32(n)
+		}
+	}
+
+	if allergens := field("allergens"); allergens != "" {
+		for _, a := range strings.Split(allergens, "|") {
+			i.Allergens = append(i.Allergens, strings.TrimSpace(a))
+		}
+	}
+
+	if sortOrder := field("sortOrder"); sortOrder != "" {
+		n, err := strconv.ParseInt(sortOrder, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sort order: %w", err)
+		}
+		i.SortOrder = int32(n)
+	}
+
+	if threshold := field("reorderThreshold"); threshold != "" {
+		n, err := strconv.ParseInt(threshold, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reorder threshold: %w", err)
+		}
+		i.ReorderThreshold = int32(n)
+	}
+
+	if availability := field("availability"); availability != "" {
+		for _, window := range strings.Split(availability, ";") {
+			w, err := parseCSVWindow(strings.TrimSpace(window))
+			if err != nil {
+				return nil, err
+			}
+			i.Availability = append(i.Availability, w)
+		}
+	}
+
+	if recipe := field("recipe"); recipe != "" {
+		for _, entry := range strings.Split(recipe, "|") {
+			itemID, q, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid recipe entry %q", entry)
+			}
+			quantity, err := strconv.ParseInt(q, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipe quantity: %w", err)
+			}
+			i.Recipe = append(i.Recipe, &ItemQuantity{ItemID: itemID, Quantity: int32(quantity)})
+		}
+	}
+
+	var err error
+	if isIngredient := field("isIngredient"); isIngredient != "" {
+		i.IsIngredient, err = strconv.ParseBool(isIngredient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid isIngredient: %w", err)
+		}
+	}
+
+	if archived := field("archived"); archived != "" {
+		i.Archived, err = strconv.ParseBool(archived)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archived: %w", err)
+		}
+	}
+
+	return i, nil
+}
+
+func parseCSVWindow(s string) (*AvailabilityWindow, error) {
+	w := &AvailabilityWindow{}
+
+	if days, clock, ok := strings.Cut(s, "@"); ok {
+		for _, d := range strings.Split(days, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(d))
+			if err != nil {
+				return nil, fmt.Errorf("invalid availability window %q", s)
+			}
+			w.Days = append(w.Days, time.Weekday(n))
+		}
+		s = clock
+	}
+
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid availability window %q", s)
+	}
+	w.Start = start
+	w.End = end
+
+	return w, nil
+}
+
+// writeCatalog writes items in a format readCatalog reads back. Reserved
+// quantities are left out, only what is on hand is part of a catalog.
+func writeCatalog(w io.Writer, format string, items []*Item) error {
+	switch format {
+	case CatalogFormatJSON:
+		exported := make([]*Item, 0, len(items))
+		for _, i := range items {
+			c := *i
+			c.Stock = make(map[string]*StockLevel, len(i.Stock))
+			for locationID, l := range i.Stock {
+				c.Stock[locationID] = &StockLevel{Quantity: l.Quantity}
+			}
+			exported = append(exported, &c)
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exported)
+	case CatalogFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(catalogColumns); err != nil {
+			return err
+		}
+		for _, i := range items {
+			if err := cw.Write(csvRecord(i)); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unsupported catalog format %q", format)
+	}
+}
+
+// csvRecord is the row of an item, in the order of catalogColumns.
+func csvRecord(i *Item) []string {
+	windows := make([]string, 0, len(i.Availability))
+	for _, w := range i.Availability {
+		clock := w.Start + "-" + w.End
+		if len(w.Days) > 0 {
+			days := make([]string, 0, len(w.Days))
+			for _, d := range w.Days {
+				days = append(days, strconv.Itoa(int(d)))
+			}
+			clock = strings.Join(days, ",") + "@" + clock
+		}
+		windows = append(windows, clock)
+	}
+
+	recipe := make([]string, 0, len(i.Recipe))
+	for _, r := range i.Recipe {
+		recipe = append(recipe, fmt.Sprintf("%s:%d", r.ItemID, r.Quantity))
+	}
+
+	locationIDs := make([]string, 0, len(i.Stock))
+	for locationID := range i.Stock {
+		locationIDs = append(locationIDs, locationID)
+	}
+	sort.Strings(locationIDs)
+	stock := make([]string, 0, len(locationIDs))
+	for _, locationID := range locationIDs {
+		stock = append(stock, fmt.Sprintf("%s:%d", locationID, i.Stock[locationID].Quantity))
+	}
+
+	return []string{
+		i.ID,
+		i.Name,
+		i.PriceID,
+		i.Category,
+		i.Description,
+		i.ImageURL,
+		strings.Join(i.Allergens, "|"),
+		strconv.Itoa(int(i.SortOrder)),
+		strconv.Itoa(int(i.ReorderThreshold)),
+		strings.Join(windows, ";"),
+		strings.Join(recipe, "|"),
+		strconv.FormatBool(i.IsIngredient),
+		strings.Join(stock, "|"),
+		strconv.FormatBool(i.Archived),
+	}
+}
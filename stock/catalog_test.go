@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCatalogRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		err     string
+	}{
+		{"unknown format", "catalog.yaml", "", "unsupported catalog format"},
+		{"malformed JSON", "catalog.json", `[{"id": "1"`, "parsing catalog"},
+		{"missing ID", "catalog.json", `[{"name": "burger", "priceID": "p", "quantity": 1}]`, "row 1: item ID is required"},
+		{"missing name", "catalog.json", `[{"id": "1", "priceID": "p"}]`, "item name is required"},
+		{"duplicated ID", "catalog.json", `[{"id": "1", "name": "a", "priceID": "p"}, {"id": "1", "name": "b", "priceID": "p"}]`, "row 2: duplicated item ID 1"},
+		{"negative quantity", "catalog.json", `[{"id": "1", "name": "a", "priceID": "p", "quantity": -1}]`, "invalid quantity at main"},
+		{"negative location quantity", "catalog.json", `[{"id": "1", "name": "a", "priceID": "p", "stock": {"downtown": {"quantity": -1}}}]`, "invalid quantity at downtown"},
+		{"invalid location ID", "catalog.json", `[{"id": "1", "name": "a", "priceID": "p", "stock": {"Down Town": {"quantity": 1}}}]`, "invalid location ID"},
+		{"quantity and stock", "catalog.json", `[{"id": "1", "name": "a", "priceID": "p", "quantity": 1, "stock": {"main": {"quantity": 1}}}]`, "both a quantity and stock per location"},
+		{"missing column", "catalog.csv", "id,name\n1,burger\n", `missing column "priceID"`},
+		{"invalid quantity", "catalog.csv", "id,name,priceID,quantity\n1,burger,price_burger,many\n", "row 2: invalid quantity"},
+		{"duplicated column", "catalog.csv", "id,name,priceID,name\n1,burger,price_burger,b\n", `duplicated column "name"`},
+		{"short row", "catalog.csv", "id,name,priceID\n1,burger\n", "row 2: expected 3 fields, got 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("writing the catalog: %v", err)
+			}
+
+			_, err := LoadCatalog(path)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("loading returned %v, want an error about %q", err, tt.err)
+			}
+		})
+	}
+}
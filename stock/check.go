@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// StockReason tells why a requested item can't be served.
+type StockReason string
+
+const (
+	ReasonNotFound          StockReason = "not_found"
+	ReasonArchived          StockReason = "archived"
+	ReasonNotOrderable      StockReason = "not_orderable"
+	ReasonUnavailable       StockReason = "unavailable"
+	ReasonOutOfStock        StockReason = "out_of_stock"
+	ReasonInsufficientStock StockReason = "insufficient_stock"
+)
+
+type StockCheck struct {
+	InStock bool
+	Items   []*pb.Item
+	// Lines has one result per requested item ID, in request order.
+	Lines []*StockCheckLine
+}
+
+type StockCheckLine struct {
+	ItemID    string
+	Found     bool
+	Requested int32
+	Available int32
+	// Reason is empty when the line can be served.
+	Reason StockReason
+}
+
+func (l *StockCheckLine) ToProto() *pb.StockCheckLine {
+	return &pb.StockCheckLine{
+		ItemID:    l.ItemID,
+		Found:     l.Found,
+		Requested: l.Requested,
+		Available: l.Available,
+		Reason:    string(l.Reason),
+	}
+}
+
+// StockCheckError is the common.ErrNoStock of a reservation that was
+// refused, with the result of each requested item.
+type StockCheckError struct {
+	Lines []*StockCheckLine
+}
+
+func (e *StockCheckError) Error() string {
+	return common.ErrNoStock.Error()
+}
+
+func (e *StockCheckError) Unwrap() error {
+	return common.ErrNoStock
+}
+
+// checkLines works out the result of each requested item. The stock is
+// checked for the whole request at once, so a line can be short even though
+// its item alone would be served, when it shares ingredients with other
+// lines. The items of a failed reservation are short whatever the stock
+// reads now, shortage names them.
+func (s *Service) checkLines(ctx context.Context, locationID string, itemsInStock []*Item, merged []*pb.ItemsWithQuantity, shortage *ShortageError) ([]*StockCheckLine, error) {
+	byID := make(map[string]*Item, len(itemsInStock))
+	for _, i := range itemsInStock {
+		byID[i.ID] = i
+	}
+
+	lines := stockLines(itemsInStock, merged)
+	stock, err := s.itemsAt(ctx, locationID, lineItemIDs(lines))
+	if err != nil {
+		return nil, err
+	}
+
+	stockByID := make(map[string]*Item, len(stock))
+	for _, i := range stock {
+		stockByID[i.ID] = i
+	}
+
+	short := make(map[string]bool)
+	for _, l := range lines {
+		i, ok := stockByID[l.ItemID]
+		if !ok || i.Archived || i.Available() < l.Quantity {
+			short[l.ItemID] = true
+		}
+	}
+	if shortage != nil {
+		for _, id := range shortage.ItemIDs {
+			short[id] = true
+		}
+	}
+
+	now := s.now()
+	res := make([]*StockCheckLine, 0, len(merged))
+	for _, reqItem := range merged {
+		line := &StockCheckLine{ItemID: reqItem.ID, Requested: reqItem.Quantity}
+		res = append(res, line)
+
+		i, ok := byID[reqItem.ID]
+		line.Found = ok
+		switch {
+		case !ok:
+			line.Reason = ReasonNotFound
+			continue
+		case i.Archived:
+			line.Reason = ReasonArchived
+			continue
+		case i.IsIngredient:
+			line.Reason = ReasonNotOrderable
+			continue
+		}
+
+		isShort := short[i.ID]
+		if len(i.Recipe) > 0 {
+			if line.Available, err = recipeAvailable(i, stockByID); err != nil {
+				return nil, err
+			}
+			for _, r := range i.Recipe {
+				isShort = isShort || short[r.ItemID]
+			}
+		} else {
+			line.Available = max(i.Available(), 0)
+		}
+
+		switch {
+		case !i.AvailableAt(now):
+			line.Reason = ReasonUnavailable
+		case isShort && line.Available == 0:
+			line.Reason = ReasonOutOfStock
+		case isShort:
+			line.Reason = ReasonInsufficientStock
+		}
+	}
+
+	return res, nil
+}
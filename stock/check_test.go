@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// newCheckService seeds a menu with every reason a line can fail for.
+func newCheckService(t *testing.T) *Service {
+	t.Helper()
+
+	now := time.Now().UTC()
+	later := AvailabilityWindow{Start: now.Add(time.Hour).Format("15:04"), End: now.Add(2 * time.Hour).Format("15:04")}
+
+	s := newTestService(t,
+		&Item{ID: "burger", Name: "burger", PriceID: "p", Stock: stocked(5)},
+		&Item{ID: "fries", Name: "fries", PriceID: "p", Stock: stocked(0)},
+		&Item{ID: "shake", Name: "shake", PriceID: "p", Stock: stocked(2)},
+		&Item{ID: "bun", Name: "bun", PriceID: "p", Stock: stocked(10), IsIngredient: true},
+		&Item{ID: "pancakes", Name: "pancakes", PriceID: "p", Stock: stocked(4), Availability: []*AvailabilityWindow{&later}},
+		&Item{ID: "old", Name: "old", PriceID: "p", Stock: stocked(4)},
+	)
+	if _, err := s.ArchiveItem(context.Background(), "old", "", "jane"); err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+
+	return s
+}
+
+func TestCheckIfItemAreInStock(t *testing.T) {
+	s := newCheckService(t)
+
+	check, err := s.CheckIfItemAreInStock(context.Background(), "", "", []*pb.ItemsWithQuantity{
+		{ID: "burger", Quantity: 2},
+		{ID: "fries", Quantity: 1},
+		{ID: "shake", Quantity: 1},
+		{ID: "shake", Quantity: 2},
+		{ID: "bun", Quantity: 1},
+		{ID: "pancakes", Quantity: 1},
+		{ID: "old", Quantity: 1},
+		{ID: "unknown", Quantity: 1},
+	})
+	if err != nil {
+		t.Fatalf("checking: %v", err)
+	}
+	if check.InStock {
+		t.Error("got the order in stock, want it refused")
+	}
+
+	want := []StockCheckLine{
+		{ItemID: "burger", Found: true, Requested: 2, Available: 5},
+		{ItemID: "fries", Found: true, Requested: 1, Reason: ReasonOutOfStock},
+		{ItemID: "shake", Found: true, Requested: 3, Available: 2, Reason: ReasonInsufficientStock},
+		{ItemID: "bun", Found: true, Requested: 1, Reason: ReasonNotOrderable},
+		{ItemID: "pancakes", Found: true, Requested: 1, Available: 4, Reason: ReasonUnavailable},
+		{ItemID: "old", Found: true, Requested: 1, Reason: ReasonArchived},
+		{ItemID: "unknown", Requested: 1, Reason: ReasonNotFound},
+	}
+	if len(check.Lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(check.Lines), len(want))
+	}
+	for n, l := range check.Lines {
+		if *l != want[n] {
+			t.Errorf("line %d is %+v, want %+v", n, *l, want[n])
+		}
+	}
+}
+
+func TestReserveItemsReportsLines(t *testing.T) {
+	s := newCheckService(t)
+	ctx := context.Background()
+
+	_, _, err := s.ReserveItems(ctx, "o1", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 1}, {ID: "shake", Quantity: 3}}, time.Hour)
+	if !errors.Is(err, common.ErrNoStock) {
+		t.Fatalf("reserving returned %v, want %v", err, common.ErrNoStock)
+	}
+	var checkErr *StockCheckError
+	if !errors.As(err, &checkErr) {
+		t.Fatalf("reserving returned %v, want the result of each line", err)
+	}
+	if len(checkErr.Lines) != 2 || checkErr.Lines[0].Reason != "" || checkErr.Lines[1].Reason != ReasonInsufficientStock {
+		t.Errorf("got lines %+v, want only the shake short", checkErr.Lines)
+	}
+
+	// unknown items are reported without reserving anything
+	_, _, err = s.ReserveItems(ctx, "o2", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 1}, {ID: "unknown", Quantity: 1}}, time.Hour)
+	if !errors.As(err, &checkErr) || checkErr.Lines[1].Reason != ReasonNotFound {
+		t.Errorf("reserving an unknown item returned %v, want it reported as not found", err)
+	}
+}
+
+func TestCheckLinesShortage(t *testing.T) {
+	s := newCheckService(t)
+	ctx := context.Background()
+
+	merged := []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 1}, {ID: "shake", Quantity: 3}}
+	items, err := s.itemsAt(ctx, defaultLocationID, []string{"burger", "shake"})
+	if err != nil {
+		t.Fatalf("getting the items: %v", err)
+	}
+
+	// the reservation found the burger short, though the stock reads
+	// enough now, and the shake stays short as well
+	lines, err := s.checkLines(ctx, defaultLocationID, items, merged, &ShortageError{ItemIDs: []string{"burger"}})
+	if err != nil {
+		t.Fatalf("checking the lines: %v", err)
+	}
+	if lines[0].Reason != ReasonInsufficientStock || lines[1].Reason != ReasonInsufficientStock {
+		t.Errorf("got lines %+v, want both short", lines)
+	}
+}
@@ -0,0 +1,196 @@
+// Command stockctl imports and exports the catalog and stock of the stock
+// service.
+//
+//	stockctl export [-format json|csv] [-include-archived] [-o file]
+//	stockctl import [-apply] [-remove-missing] [-actor name] file
+//
+// Imports are previewed unless -apply is given. The stock service is found
+// through Consul, or dialled directly with -addr.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/discovery"
+	"github.com/scuba13/oms/common/discovery/consul"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var consulAddr = common.EnvString("CONSUL_ADDR", "localhost:8500")
+
+const timeout = time.Minute
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stockctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: stockctl export|import [flags]")
+	os.Exit(2)
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	addr := fs.String("addr", "", "stock service address, discovered through Consul when empty")
+	format := fs.String("format", "", "json or csv, picked from the -o extension when empty")
+	includeArchived := fs.Bool("include-archived", false, "export archived items too")
+	out := fs.String("o", "", "output file, stdout when empty")
+	fs.Parse(args)
+
+	if *format == "" {
+		*format = "json"
+		if *out != "" {
+			*format = formatOf(*out)
+		}
+	}
+
+	conn, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := pb.NewStockServiceClient(conn).ExportCatalog(ctx, &pb.ExportCatalogRequest{
+		Format:          *format,
+		IncludeArchived: *includeArchived,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(res.Data)
+		return err
+	}
+
+	return os.WriteFile(*out, res.Data, 0o644)
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	addr := fs.String("addr", "", "stock service address, discovered through Consul when empty")
+	format := fs.String("format", "", "json or csv, picked from the file extension when empty")
+	apply := fs.Bool("apply", false, "apply the changes instead of previewing them")
+	removeMissing := fs.Bool("remove-missing", false, "archive the items that are not in the file")
+	actor := fs.String("actor", os.Getenv("USER"), "who the stock changes are recorded for")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("import takes one file")
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = formatOf(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := pb.NewStockServiceClient(conn).ImportCatalog(ctx, &pb.ImportCatalogRequest{
+		Data:          data,
+		Format:        *format,
+		DryRun:        !*apply,
+		RemoveMissing: *removeMissing,
+		Actor:         *actor,
+	})
+	if err != nil {
+		return err
+	}
+
+	printChanges(os.Stdout, res.Changes)
+
+	if len(res.Errors) > 0 {
+		for _, e := range res.Errors {
+			if e.ItemID != "" {
+				fmt.Fprintf(os.Stderr, "row %d (item %s): %s\n", e.Row, e.ItemID, e.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "row %d: %s\n", e.Row, e.Message)
+			}
+		}
+		return fmt.Errorf("%d rows can't be imported, nothing was applied", len(res.Errors))
+	}
+
+	switch {
+	case res.Applied:
+		fmt.Println("Changes applied.")
+	case *apply:
+		fmt.Println("Nothing to apply.")
+	default:
+		fmt.Println("Preview only, run again with -apply to apply the changes.")
+	}
+
+	return nil
+}
+
+func printChanges(w io.Writer, changes []*pb.CatalogChange) {
+	counts := make(map[string]int)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tITEM\tFIELDS")
+	for _, c := range changes {
+		counts[c.Action]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Action, c.ItemID, strings.Join(c.Fields, ", "))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d created, %d updated, %d unchanged, %d removed\n",
+		counts["created"], counts["updated"], counts["unchanged"], counts["removed"])
+}
+
+func formatOf(path string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+}
+
+func dial(addr string) (*grpc.ClientConn, error) {
+	if addr != "" {
+		return grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	registry, err := consul.NewRegistry(consulAddr, "stockctl")
+	if err != nil {
+		return nil, err
+	}
+
+	return discovery.ServiceConnection(context.Background(), "stock", registry)
+}
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+)
+
+// fileStore keeps the whole stock in memory and writes it back to a JSON
+// file after every change. It is meant for local runs without a database.
+type fileStore struct {
+	sync.RWMutex
+	path         string
+	items        map[string]*Item
+	reservations map[string]*Reservation
+	sales        map[string]*Sale
+	movements    []*Movement
+	locations    map[string]*Location
+	priceLists   map[string]*PriceList
+	waitlist     map[string]*WaitlistEntry
+}
+
+type fileStoreData struct {
+	Items        map[string]*Item          `json:"items"`
+	Reservations map[string]*Reservation   `json:"reservations"`
+	Sales        map[string]*Sale          `json:"sales"`
+	Movements    []*Movement               `json:"movements"`
+	Locations    map[string]*Location      `json:"locations"`
+	PriceLists   map[string]*PriceList     `json:"priceLists"`
+	Waitlist     map[string]*WaitlistEntry `json:"waitlist"`
+}
+
+// legacyFileStoreData holds the quantities written before there were
+// locations, see migrateLegacyStock.
+type legacyFileStoreData struct {
+	Items map[string]*struct {
+		Quantity int32 `json:"quantity"`
+		Reserved int32 `json:"reserved"`
+	} `json:"items"`
+}
+
+func NewFileStore(path string) (*fileStore, error) {
+	s := &fileStore{
+		path:         path,
+		items:        map[string]*Item{},
+		reservations: map[string]*Reservation{},
+		sales:        map[string]*Sale{},
+		locations:    map[string]*Location{},
+		priceLists:   map[string]*PriceList{},
+		waitlist:     map[string]*WaitlistEntry{},
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data fileStoreData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	if data.Items != nil {
+		s.items = data.Items
+	}
+	if data.Reservations != nil {
+		s.reservations = data.Reservations
+	}
+	if data.Sales != nil {
+		s.sales = data.Sales
+	}
+	s.movements = data.Movements
+	if data.Locations != nil {
+		s.locations = data.Locations
+	}
+	if data.PriceLists != nil {
+		s.priceLists = data.PriceLists
+	}
+	if data.Waitlist != nil {
+		s.waitlist = data.Waitlist
+	}
+
+	var legacy legacyFileStoreData
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return nil, err
+	}
+	s.migrateLegacyStock(&legacy)
+
+	if s.migrateOpeningBalances() {
+		if err := s.persist(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// migrateOpeningBalances records the opening balance of the items stocked
+// before there was a ledger, so their ledger adds up to their stock. It
+// reports whether any was recorded.
+func (s *fileStore) migrateOpeningBalances() bool {
+	balances := make(map[string]map[string]StockLevel)
+	keys := make(map[string]bool)
+	for _, m := range s.movements {
+		keys[m.Key] = true
+		if balances[m.ItemID] == nil {
+			balances[m.ItemID] = make(map[string]StockLevel)
+		}
+		b := balances[m.ItemID][m.LocationID]
+		b.Quantity += m.Quantity
+		b.Reserved += m.Reserved
+		balances[m.ItemID][m.LocationID] = b
+	}
+
+	ids := make([]string, 0, len(s.items))
+	for id := range s.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	recorded := false
+	for _, id := range ids {
+		for _, m := range openingMovements(s.items[id], balances[id]) {
+			if !keys[m.Key] {
+				s.movements = append(s.movements, m)
+				recorded = true
+			}
+		}
+	}
+
+	return recorded
+}
+
+// migrateLegacyStock moves the quantities stored before there were
+// locations to the default location, and tags the reservations, sales and
+// movements of that time with it.
+func (s *fileStore) migrateLegacyStock(legacy *legacyFileStoreData) {
+	for id, i := range s.items {
+		if i.Stock != nil {
+			continue
+		}
+		l := i.Level(defaultLocationID)
+		if li, ok := legacy.Items[id]; ok {
+			l.Quantity = li.Quantity
+			l.Reserved = li.Reserved
+		}
+	}
+	for _, r := range s.reservations {
+		if r.LocationID == "" {
+			r.LocationID = defaultLocationID
+		}
+	}
+	for _, sale := range s.sales {
+		if sale.LocationID == "" {
+			sale.LocationID = defaultLocationID
+		}
+	}
+	for _, m := range s.movements {
+		if m.LocationID == "" {
+			m.LocationID = defaultLocationID
+		}
+	}
+}
+
+func (s *fileStore) GetItem(ctx context.Context, id string) (*Item, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	i, ok := s.items[id]
+	if !ok {
+		return nil, common.ErrItemNotFound
+	}
+
+	return copyItem(i), nil
+}
+
+func (s *fileStore) GetItems(ctx context.Context, ids []string) ([]*Item, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var res []*Item
+	for _, id := range ids {
+		if i, ok := s.items[id]; ok {
+			res = append(res, copyItem(i))
+		}
+	}
+
+	return res, nil
+}
+
+func (s *fileStore) Seed(ctx context.Context, items []*Item) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := make([]string, 0, len(items))
+	for _, i := range items {
+		ids = append(ids, i.ID)
+	}
+	undo := s.checkpoint(ids...)
+
+	var inserted []string
+	changed := 0
+	for _, i := range items {
+		c := copyItem(i)
+		c.CatalogRecipe = c.Recipe
+
+		stored, ok := s.items[i.ID]
+		if !ok {
+			s.items[i.ID] = c
+			s.movements = append(s.movements, stockMovements(c, "catalog seed", systemActor)...)
+			inserted = append(inserted, i.ID)
+			continue
+		}
+
+		// items seeded before the catalog recipe was kept start from the
+		// recipe they have
+		seeded := stored.CatalogRecipe
+		if seeded == nil {
+			seeded = stored.Recipe
+		}
+		if !sameRecipe(seeded, c.CatalogRecipe) {
+			stored.Recipe = c.Recipe
+			stored.CatalogRecipe = c.CatalogRecipe
+			s.movements = append(s.movements, NewMovement(i.ID, "", MovementUpdate, 0, 0, "catalog recipe changed", systemActor, ""))
+			changed++
+		}
+
+		// locations the catalog added to the item are stocked, the others
+		// keep their quantities
+		for _, locationID := range sortedLocationIDs(c.Stock) {
+			if _, ok := stored.Stock[locationID]; ok {
+				continue
+			}
+			stored.Level(locationID).Quantity = c.Stock[locationID].Quantity
+			added := &Item{ID: i.ID, Stock: map[string]*StockLevel{locationID: c.Stock[locationID]}}
+			s.movements = append(s.movements, stockMovements(added, "catalog seed", systemActor)...)
+			changed++
+		}
+	}
+
+	if len(inserted) == 0 && changed == 0 {
+		return 0, nil
+	}
+
+	if err := s.persist(); err != nil {
+		undo()
+		for _, id := range inserted {
+			delete(s.items, id)
+		}
+		return 0, err
+	}
+
+	return len(inserted), nil
+}
+
+func (s *fileStore) Reserve(ctx context.Context, r *Reservation) ([]*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.reservations[r.OrderID]; ok {
+		return nil, ErrReservationExists
+	}
+
+	var short []string
+	for _, ri := range r.Items {
+		i, ok := s.items[ri.ItemID]
+		if !ok || i.Archived || i.Level(r.LocationID).Available() < ri.Quantity {
+			short = append(short, ri.ItemID)
+		}
+	}
+	if len(short) > 0 {
+		return nil, &ShortageError{ItemIDs: short}
+	}
+
+	undo := s.checkpoint(itemQuantityIDs(r.Items)...)
+	before := make([]*Item, 0, len(r.Items))
+	for _, ri := range r.Items {
+		before = append(before, copyItem(s.items[ri.ItemID]).At(r.LocationID))
+		s.items[ri.ItemID].Level(r.LocationID).Reserved += ri.Quantity
+		s.movements = append(s.movements, NewMovement(ri.ItemID, r.LocationID, MovementReservation, 0, ri.Quantity, "order created", systemActor, r.OrderID))
+	}
+	s.reservations[r.OrderID] = copyReservation(r)
+
+	if err := s.persist(); err != nil {
+		undo()
+		delete(s.reservations, r.OrderID)
+		return nil, err
+	}
+
+	return before, nil
+}
+
+func (s *fileStore) CloseReservation(ctx context.Context, orderID string, status ReservationStatus) error {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.reservations[orderID]
+	if !ok {
+		return ErrReservationNotFound
+	}
+	if r.Status != ReservationActive {
+		return ErrReservationClosed
+	}
+
+	undo := s.checkpoint(itemQuantityIDs(r.Items)...)
+	for _, ri := range r.Items {
+		i, ok := s.items[ri.ItemID]
+		if !ok {
+			continue
+		}
+		m := closingMovement(r, ri, status)
+		l := i.Level(r.LocationID)
+		l.Quantity += m.Quantity
+		l.Reserved += m.Reserved
+		s.movements = append(s.movements, m)
+	}
+	r.Status = status
+
+	if err := s.persist(); err != nil {
+		undo()
+		r.Status = ReservationActive
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) GetReservation(ctx context.Context, orderID string) (*Reservation, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	r, ok := s.reservations[orderID]
+	if !ok {
+		return nil, ErrReservationNotFound
+	}
+
+	return copyReservation(r), nil
+}
+
+func (s *fileStore) ExpiredReservations(ctx context.Context, now time.Time) ([]*Reservation, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var res []*Reservation
+	for _, r := range s.reservations {
+		if r.Status == ReservationActive && !r.ExpiresAt.After(now) {
+			res = append(res, copyReservation(r))
+		}
+	}
+
+	return res, nil
+}
+
+func (s *fileStore) Sell(ctx context.Context, orderID, locationID string, items []*ItemQuantity) ([]*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.sales[orderID]; ok {
+		return nil, ErrAlreadySold
+	}
+
+	for _, si := range items {
+		i, ok := s.items[si.ItemID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", common.ErrItemNotFound, si.ItemID)
+		}
+		if i.Level(locationID).Available() < si.Quantity {
+			return nil, fmt.Errorf("%w: %s", common.ErrNoStock, si.ItemID)
+		}
+	}
+
+	undo := s.checkpoint(itemQuantityIDs(items)...)
+	sale := &Sale{OrderID: orderID, LocationID: locationID, CreatedAt: time.Now()}
+	before := make([]*Item, 0, len(items))
+	for _, si := range items {
+		before = append(before, copyItem(s.items[si.ItemID]).At(locationID))
+		s.items[si.ItemID].Level(locationID).Quantity -= si.Quantity
+		s.movements = append(s.movements, NewMovement(si.ItemID, locationID, MovementSale, -si.Quantity, 0, "order paid", systemActor, orderID))
+		c := *si
+		sale.Items = append(sale.Items, &c)
+	}
+	s.sales[orderID] = sale
+
+	if err := s.persist(); err != nil {
+		undo()
+		delete(s.sales, orderID)
+		return nil, err
+	}
+
+	return before, nil
+}
+
+func (s *fileStore) ListMovements(ctx context.Context, itemID, locationID string, limit int, pageToken string) ([]*Movement, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var res []*Movement
+	for idx := len(s.movements) - 1; idx >= 0 && len(res) < limit; idx-- {
+		m := s.movements[idx]
+		if m.ItemID != itemID || (locationID != "" && m.LocationID != locationID) || (pageToken != "" && m.ID >= pageToken) {
+			continue
+		}
+		c := *m
+		res = append(res, &c)
+	}
+
+	return res, nil
+}
+
+func (s *fileStore) LedgerBalance(ctx context.Context, itemID, locationID string) (int32, int32, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var onHand, reserved int32
+	for _, m := range s.movements {
+		if m.ItemID == itemID && (locationID == "" || m.LocationID == locationID) {
+			onHand += m.Quantity
+			reserved += m.Reserved
+		}
+	}
+
+	return onHand, reserved, nil
+}
+
+func (s *fileStore) CreateItem(ctx context.Context, i *Item, actor string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.items[i.ID]; ok {
+		return ErrItemExists
+	}
+
+	undo := s.checkpoint()
+	s.items[i.ID] = copyItem(i)
+	s.movements = append(s.movements, stockMovements(i, "item created", actor)...)
+
+	if err := s.persist(); err != nil {
+		undo()
+		delete(s.items, i.ID)
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) UpdateItem(ctx context.Context, u *Item, fields []string, actor string) (*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	i, ok := s.items[u.ID]
+	if !ok {
+		return nil, common.ErrItemNotFound
+	}
+
+	undo := s.checkpoint(u.ID)
+	i = mergeItem(i, u, fields)
+	s.items[u.ID] = i
+	s.movements = append(s.movements, NewMovement(u.ID, "", MovementUpdate, 0, 0, "item updated", actor, ""))
+
+	if err := s.persist(); err != nil {
+		undo()
+		return nil, err
+	}
+
+	return copyItem(i), nil
+}
+
+func (s *fileStore) ArchiveItem(ctx context.Context, id, actor string) (*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	i, ok := s.items[id]
+	if !ok {
+		return nil, common.ErrItemNotFound
+	}
+
+	undo := s.checkpoint(id)
+	i.Archived = true
+	s.movements = append(s.movements, NewMovement(id, "", MovementArchive, 0, 0, "item archived", actor, ""))
+
+	if err := s.persist(); err != nil {
+		undo()
+		return nil, err
+	}
+
+	return copyItem(i), nil
+}
+
+func (s *fileStore) AdjustQuantity(ctx context.Context, m *Movement) (*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	i, ok := s.items[m.ItemID]
+	if !ok {
+		return nil, common.ErrItemNotFound
+	}
+	l := i.Level(m.LocationID)
+	if l.Quantity+m.Quantity < l.Reserved {
+		return nil, ErrQuantityBelowReserved
+	}
+
+	undo := s.checkpoint(m.ItemID)
+	l.Quantity += m.Quantity
+	s.movements = append(s.movements, m)
+
+	if err := s.persist(); err != nil {
+		undo()
+		return nil, err
+	}
+
+	return copyItem(i), nil
+}
+
+func (s *fileStore) ImportCatalog(ctx context.Context, changes []*CatalogChange) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// check everything first, so that nothing is applied when a change
+	// no longer fits
+	for _, c := range changes {
+		i, ok := s.items[c.ItemID]
+		if c.Action == CatalogCreated {
+			if ok {
+				return ErrItemExists
+			}
+			continue
+		}
+		if !ok {
+			return common.ErrItemNotFound
+		}
+		if len(catalogDiff(i, c.Before)) > 0 {
+			return fmt.Errorf("%w: %s", ErrImportConflict, c.ItemID)
+		}
+		for _, m := range c.Movements {
+			var l StockLevel
+			if current, ok := i.Stock[m.LocationID]; ok {
+				l = *current
+			}
+			if l.Quantity+m.Quantity < l.Reserved {
+				return ErrQuantityBelowReserved
+			}
+		}
+	}
+
+	previous := make(map[string]*Item, len(changes))
+	movements := len(s.movements)
+	for _, c := range changes {
+		i, ok := s.items[c.ItemID]
+		previous[c.ItemID] = i
+		if !ok {
+			s.items[c.ItemID] = copyItem(c.After)
+			s.movements = append(s.movements, c.Movements...)
+			continue
+		}
+
+		updated := copyItem(c.After)
+		updated.Stock = copyItem(i).Stock
+		for _, m := range c.Movements {
+			updated.Level(m.LocationID).Quantity += m.Quantity
+		}
+		s.items[c.ItemID] = updated
+		s.movements = append(s.movements, c.Movements...)
+	}
+
+	if err := s.persist(); err != nil {
+		for id, i := range previous {
+			if i == nil {
+				delete(s.items, id)
+				continue
+			}
+			s.items[id] = i
+		}
+		s.movements = s.movements[:movements]
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileStore) ListItems(ctx context.Context, limit int, pageToken string, includeArchived bool) ([]*Item, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ids := make([]string, 0, len(s.items))
+	for id, i := range s.items {
+		if id <= pageToken || (i.Archived && !includeArchived) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	res := make([]*Item, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, copyItem(s.items[id]))
+	}
+
+	return res, nil
+}
+
+func (s *fileStore) SeedLocations(ctx context.Context, locations []*Location) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	inserted := 0
+	for _, l := range locations {
+		if _, ok := s.locations[l.ID]; ok {
+			continue
+		}
+		c := *l
+		s.locations[l.ID] = &c
+		inserted++
+	}
+
+	if inserted == 0 {
+		return 0, nil
+	}
+
+	return inserted, s.persist()
+}
+
+func (s *fileStore) GetLocation(ctx context.Context, id string) (*Location, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	l, ok := s.locations[id]
+	if !ok {
+		return nil, ErrLocationNotFound
+	}
+
+	c := *l
+	return &c, nil
+}
+
+func (s *fileStore) ListLocations(ctx context.Context) ([]*Location, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	res := make([]*Location, 0, len(s.locations))
+	for _, l := range s.locations {
+		c := *l
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].ID < res[b].ID })
+
+	return res, nil
+}
+
+func (s *fileStore) SeedPriceLists(ctx context.Context, lists []*PriceList) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	inserted := 0
+	for _, l := range lists {
+		if _, ok := s.priceLists[l.ID]; ok {
+			continue
+		}
+		c := *l
+		s.priceLists[l.ID] = &c
+		inserted++
+	}
+
+	if inserted == 0 {
+		return 0, nil
+	}
+
+	return inserted, s.persist()
+}
+
+func (s *fileStore) PutPriceList(ctx context.Context, l *PriceList) error {
+	s.Lock()
+	defer s.Unlock()
+
+	c := *l
+	s.priceLists[l.ID] = &c
+
+	return s.persist()
+}
+
+func (s *fileStore) DeletePriceList(ctx context.Context, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.priceLists[id]; !ok {
+		return ErrPriceListNotFound
+	}
+	delete(s.priceLists, id)
+
+	return s.persist()
+}
+
+func (s *fileStore) ListPriceLists(ctx context.Context) ([]*PriceList, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	res := make([]*PriceList, 0, len(s.priceLists))
+	for _, l := range s.priceLists {
+		c := *l
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].ID < res[b].ID })
+
+	return res, nil
+}
+
+func (s *fileStore) JoinWaitlist(ctx context.Context, e *WaitlistEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	c := *e
+	s.waitlist[e.ID] = &c
+
+	return s.persist()
+}
+
+func (s *fileStore) LeaveWaitlist(ctx context.Context, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.waitlist[id]; !ok {
+		return ErrWaitlistEntryNotFound
+	}
+	delete(s.waitlist, id)
+
+	return s.persist()
+}
+
+func (s *fileStore) WaitlistedItems(ctx context.Context, locationID string) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, e := range s.waitlist {
+		if e.LocationID == locationID && !seen[e.ItemID] {
+			seen[e.ItemID] = true
+			ids = append(ids, e.ItemID)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *fileStore) TakeWaitlist(ctx context.Context, itemID, locationID string) ([]*WaitlistEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var taken []*WaitlistEntry
+	for id, e := range s.waitlist {
+		if e.ItemID == itemID && e.LocationID == locationID {
+			taken = append(taken, e)
+			delete(s.waitlist, id)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	sort.Slice(taken, func(a, b int) bool { return taken[a].CreatedAt.Before(taken[b].CreatedAt) })
+
+	if err := s.persist(); err != nil {
+		for _, e := range taken {
+			s.waitlist[e.ID] = e
+		}
+		return nil, err
+	}
+
+	return taken, nil
+}
+
+// persist writes the current state to a temporary file and renames it over
+// the previous one, so a crash mid-write never leaves a truncated file.
+// Callers must hold the write lock.
+func (s *fileStore) persist() error {
+	b, err := json.MarshalIndent(fileStoreData{
+		Items:        s.items,
+		Reservations: s.reservations,
+		Sales:        s.sales,
+		Movements:    s.movements,
+		Locations:    s.locations,
+		PriceLists:   s.priceLists,
+		Waitlist:     s.waitlist,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// checkpoint remembers the items with the given IDs and the length of the
+// ledger, and returns a function that puts them back. Changes call it when
+// persist fails, so memory never holds a change the file doesn't. Callers
+// must hold the write lock.
+func (s *fileStore) checkpoint(itemIDs ...string) func() {
+	items := make(map[string]*Item, len(itemIDs))
+	for _, id := range itemIDs {
+		if i, ok := s.items[id]; ok {
+			items[id] = copyItem(i)
+		}
+	}
+	movements := len(s.movements)
+
+	return func() {
+		for id, i := range items {
+			s.items[id] = i
+		}
+		s.movements = s.movements[:movements]
+	}
+}
+
+func itemQuantityIDs(items []*ItemQuantity) []string {
+	ids := make([]string, 0, len(items))
+	for _, i := range items {
+		ids = append(ids, i.ItemID)
+	}
+
+	return ids
+}
+
+func copyItem(i *Item) *Item {
+	c := *i
+	c.Allergens = append([]string(nil), i.Allergens...)
+	c.Availability = make([]*AvailabilityWindow, 0, len(i.Availability))
+	for _, w := range i.Availability {
+		cw := *w
+		cw.Days = append([]time.Weekday(nil), w.Days...)
+		c.Availability = append(c.Availability, &cw)
+	}
+	c.Stock = make(map[string]*StockLevel, len(i.Stock))
+	for id, l := range i.Stock {
+		cl := *l
+		c.Stock[id] = &cl
+	}
+	c.Recipe = make([]*ItemQuantity, 0, len(i.Recipe))
+	for _, r := range i.Recipe {
+		cr := *r
+		c.Recipe = append(c.Recipe, &cr)
+	}
+	return &c
+}
+
+func copyReservation(r *Reservation) *Reservation {
+	c := *r
+	c.Items = make([]*ItemQuantity, 0, len(r.Items))
+	for _, i := range r.Items {
+		ci := *i
+		c.Items = append(c.Items, &ci)
+	}
+	return &c
+}
@@ -0,0 +1,11 @@
+package gateway
+
+import (
+	"context"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+type OrdersGateway interface {
+	GetOrder(ctx context.Context, orderID, customerID string) (*pb.Order, error)
+}
@@ -0,0 +1,32 @@
+package gateway
+
+import (
+	"context"
+	"log"
+
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/discovery"
+)
+
+type Gateway struct {
+	registry discovery.Registry
+}
+
+func NewGateway(registry discovery.Registry) *Gateway {
+	return &Gateway{registry}
+}
+
+func (g *Gateway) GetOrder(ctx context.Context, orderID, customerID string) (*pb.Order, error) {
+	conn, err := discovery.ServiceConnection(context.Background(), "orders", g.registry)
+	if err != nil {
+		log.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewOrderServiceClient(conn)
+
+	return c.GetOrder(ctx, &pb.GetOrderRequest{
+		OrderID:    orderID,
+		CustomerID: customerID,
+	})
+}
@@ -2,10 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"go.opentelemetry.io/otel"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type StockGrpcHandler struct {
@@ -29,19 +39,20 @@ func NewGRPCHandler(
 }
 
 func (s *StockGrpcHandler) CheckIfItemIsInStock(ctx context.Context, p *pb.CheckIfItemIsInStockRequest) (*pb.CheckIfItemIsInStockResponse, error) {
-	inStock, items, err := s.service.CheckIfItemAreInStock(ctx, p.Items)
+	check, err := s.service.CheckIfItemAreInStock(ctx, p.LocationID, p.Channel, p.Items)
 	if err != nil {
 		return nil, err
 	}
 
 	return &pb.CheckIfItemIsInStockResponse{
-		InStock: inStock,
-		Items:   items,
+		InStock: check.InStock,
+		Items:   check.Items,
+		Lines:   toProtoLines(check.Lines),
 	}, nil
 }
 
 func (s *StockGrpcHandler) GetItems(ctx context.Context, payload *pb.GetItemsRequest) (*pb.GetItemsResponse, error) {
-	items, err := s.service.GetItems(ctx, payload.ItemIDs)
+	items, err := s.service.GetItems(ctx, payload.LocationID, payload.Channel, payload.ItemIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -50,3 +61,363 @@ func (s *StockGrpcHandler) GetItems(ctx context.Context, payload *pb.GetItemsReq
 		Items: items,
 	}, nil
 }
+
+func (s *StockGrpcHandler) ReserveItems(ctx context.Context, p *pb.ReserveItemsRequest) (*pb.ReserveItemsResponse, error) {
+	if p.OrderID == "" {
+		return nil, status.Error(codes.InvalidArgument, "order ID is required")
+	}
+	if len(p.Items) == 0 {
+		return nil, status.Error(codes.InvalidArgument, common.ErrNoItems.Error())
+	}
+
+	r, items, err := s.service.ReserveItems(ctx, p.OrderID, p.LocationID, p.Channel, p.Items, time.Duration(p.TTLSeconds)*time.Second)
+	var checkErr *StockCheckError
+	if errors.As(err, &checkErr) {
+		// tell the caller which lines failed
+		return &pb.ReserveItemsResponse{Reserved: false, Lines: toProtoLines(checkErr.Lines)}, nil
+	}
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.ReserveItemsResponse{
+		Reserved:   true,
+		Items:      items,
+		ExpiresAt:  r.ExpiresAt.Unix(),
+		LocationID: r.LocationID,
+	}, nil
+}
+
+func (s *StockGrpcHandler) ReleaseReservation(ctx context.Context, p *pb.ReleaseReservationRequest) (*pb.ReleaseReservationResponse, error) {
+	if err := s.service.ReleaseReservation(ctx, p.OrderID); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.ReleaseReservationResponse{}, nil
+}
+
+func (s *StockGrpcHandler) ListStockMovements(ctx context.Context, p *pb.ListStockMovementsRequest) (*pb.ListStockMovementsResponse, error) {
+	if p.ItemID == "" {
+		return nil, status.Error(codes.InvalidArgument, "item ID is required")
+	}
+
+	page, err := s.service.ListMovements(ctx, p.ItemID, p.LocationID, int(p.PageSize), p.PageToken)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	movements := make([]*pb.StockMovement, 0, len(page.Movements))
+	for _, m := range page.Movements {
+		movements = append(movements, m.ToProto())
+	}
+
+	return &pb.ListStockMovementsResponse{
+		Movements:     movements,
+		NextPageToken: page.NextPageToken,
+		OnHand:        page.OnHand,
+	}, nil
+}
+
+func (s *StockGrpcHandler) CreateItem(ctx context.Context, p *pb.CreateItemRequest) (*pb.Item, error) {
+	i, err := s.service.CreateItem(ctx, &Item{
+		ID:               p.ID,
+		Name:             p.Name,
+		PriceID:          p.PriceID,
+		Quantity:         p.Quantity,
+		Category:         p.Category,
+		Description:      p.Description,
+		ImageURL:         p.ImageURL,
+		Allergens:        p.Allergens,
+		SortOrder:        p.SortOrder,
+		Availability:     availabilityFromProto(p.Availability),
+		ReorderThreshold: p.ReorderThreshold,
+		Recipe:           recipeFromProto(p.Recipe),
+		IsIngredient:     p.IsIngredient,
+		LocationID:       p.LocationID,
+	}, p.Actor)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return s.itemUpdated(ctx, i), nil
+}
+
+func (s *StockGrpcHandler) UpdateItem(ctx context.Context, p *pb.UpdateItemRequest) (*pb.Item, error) {
+	i, err := s.service.UpdateItem(ctx, &Item{
+		ID:               p.ID,
+		Name:             p.Name,
+		PriceID:          p.PriceID,
+		Category:         p.Category,
+		Description:      p.Description,
+		ImageURL:         p.ImageURL,
+		Allergens:        p.Allergens,
+		SortOrder:        p.SortOrder,
+		Availability:     availabilityFromProto(p.Availability),
+		ReorderThreshold: p.ReorderThreshold,
+		Recipe:           recipeFromProto(p.Recipe),
+		IsIngredient:     p.IsIngredient,
+	}, p.Fields, p.LocationID, p.Actor)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return s.itemUpdated(ctx, i), nil
+}
+
+func (s *StockGrpcHandler) DeleteItem(ctx context.Context, p *pb.DeleteItemRequest) (*pb.Item, error) {
+	i, err := s.service.ArchiveItem(ctx, p.ID, p.LocationID, p.Actor)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return s.itemUpdated(ctx, i), nil
+}
+
+func (s *StockGrpcHandler) AdjustQuantity(ctx context.Context, p *pb.AdjustQuantityRequest) (*pb.Item, error) {
+	i, err := s.service.AdjustQuantity(ctx, p.ItemID, p.LocationID, MovementType(p.Type), p.Delta, p.Reason, p.Actor)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return s.itemUpdated(ctx, i), nil
+}
+
+func (s *StockGrpcHandler) ListItems(ctx context.Context, p *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	page, err := s.service.ListItems(ctx, p.LocationID, int(p.PageSize), p.PageToken, p.IncludeArchived)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.ListItemsResponse{
+		Items:         toProtoItems(page.Items),
+		NextPageToken: page.NextPageToken,
+	}, nil
+}
+
+func (s *StockGrpcHandler) GetMenu(ctx context.Context, p *pb.GetMenuRequest) (*pb.GetMenuResponse, error) {
+	menu, err := s.service.GetMenu(ctx, p.LocationID, p.Channel)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	categories := make([]*pb.MenuCategory, 0, len(menu))
+	for _, c := range menu {
+		categories = append(categories, &pb.MenuCategory{
+			Name:  c.Name,
+			Items: toProtoItems(c.Items),
+		})
+	}
+
+	return &pb.GetMenuResponse{Categories: categories}, nil
+}
+
+func (s *StockGrpcHandler) ListLocations(ctx context.Context, p *pb.ListLocationsRequest) (*pb.ListLocationsResponse, error) {
+	locations, err := s.service.ListLocations(ctx)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	res := make([]*pb.Location, 0, len(locations))
+	for _, l := range locations {
+		res = append(res, l.ToProto())
+	}
+
+	return &pb.ListLocationsResponse{Locations: res}, nil
+}
+
+func (s *StockGrpcHandler) FindFulfillmentLocation(ctx context.Context, p *pb.FindFulfillmentLocationRequest) (*pb.FindFulfillmentLocationResponse, error) {
+	var origin *Coordinates
+	if p.Origin != nil {
+		origin = &Coordinates{Latitude: p.Origin.Latitude, Longitude: p.Origin.Longitude}
+	}
+
+	options, err := s.service.FindFulfillmentLocations(ctx, p.Items, origin)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	if len(options) == 0 {
+		return nil, status.Error(codes.NotFound, "no location can fulfil the items")
+	}
+
+	candidates := make([]*pb.FulfillmentCandidate, 0, len(options))
+	for _, o := range options {
+		candidates = append(candidates, &pb.FulfillmentCandidate{
+			Location:   o.Location.ToProto(),
+			DistanceKm: o.DistanceKm,
+		})
+	}
+
+	return &pb.FindFulfillmentLocationResponse{
+		Location:   candidates[0].Location,
+		Candidates: candidates,
+	}, nil
+}
+
+func (s *StockGrpcHandler) ListPriceLists(ctx context.Context, p *pb.ListPriceListsRequest) (*pb.ListPriceListsResponse, error) {
+	lists, err := s.service.ListPriceLists(ctx)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	res := make([]*pb.PriceList, 0, len(lists))
+	for _, l := range lists {
+		res = append(res, l.ToProto())
+	}
+
+	return &pb.ListPriceListsResponse{PriceLists: res}, nil
+}
+
+func (s *StockGrpcHandler) PutPriceList(ctx context.Context, p *pb.PriceList) (*pb.PriceList, error) {
+	l, err := s.service.PutPriceList(ctx, priceListFromProto(p))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return l.ToProto(), nil
+}
+
+func (s *StockGrpcHandler) DeletePriceList(ctx context.Context, p *pb.DeletePriceListRequest) (*pb.DeletePriceListResponse, error) {
+	if err := s.service.DeletePriceList(ctx, p.ID); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.DeletePriceListResponse{}, nil
+}
+
+func (s *StockGrpcHandler) ImportCatalog(ctx context.Context, p *pb.ImportCatalogRequest) (*pb.ImportCatalogResponse, error) {
+	res, err := s.service.ImportCatalog(ctx, p.Data, p.Format, ImportOptions{
+		DryRun:        p.DryRun,
+		RemoveMissing: p.RemoveMissing,
+		Actor:         p.Actor,
+	})
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	changes := make([]*pb.CatalogChange, 0, len(res.Changes))
+	for _, c := range res.Changes {
+		changes = append(changes, c.ToProto())
+		if res.Applied && c.Action != CatalogUnchanged {
+			s.itemUpdated(ctx, c.After.At(defaultLocationID))
+		}
+	}
+
+	errs := make([]*pb.ImportRowError, 0, len(res.Errors))
+	for _, e := range res.Errors {
+		errs = append(errs, e.ToProto())
+	}
+
+	return &pb.ImportCatalogResponse{
+		Changes: changes,
+		Errors:  errs,
+		Applied: res.Applied,
+	}, nil
+}
+
+func (s *StockGrpcHandler) ExportCatalog(ctx context.Context, p *pb.ExportCatalogRequest) (*pb.ExportCatalogResponse, error) {
+	data, err := s.service.ExportCatalog(ctx, p.Format, p.IncludeArchived)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.ExportCatalogResponse{Data: data}, nil
+}
+
+func (s *StockGrpcHandler) WatchStock(p *pb.WatchStockRequest, stream pb.StockService_WatchStockServer) error {
+	updates, err := s.service.WatchStock(stream.Context(), p.LocationID, p.ItemIDs)
+	if err != nil {
+		return toStatusError(err)
+	}
+
+	for u := range updates {
+		if err := stream.Send(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StockGrpcHandler) JoinWaitlist(ctx context.Context, p *pb.JoinWaitlistRequest) (*pb.WaitlistEntry, error) {
+	e, err := s.service.JoinWaitlist(ctx, p.ItemID, p.LocationID, p.CustomerID, p.Email)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return e.ToProto(), nil
+}
+
+func (s *StockGrpcHandler) LeaveWaitlist(ctx context.Context, p *pb.LeaveWaitlistRequest) (*pb.LeaveWaitlistResponse, error) {
+	if err := s.service.LeaveWaitlist(ctx, p.ItemID, p.LocationID, p.CustomerID); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &pb.LeaveWaitlistResponse{}, nil
+}
+
+// itemUpdated publishes the stock.item_updated event for a changed item and
+// returns it as a proto message. The change is already stored, so a failed
+// publish is only logged.
+func (s *StockGrpcHandler) itemUpdated(ctx context.Context, i *Item) *pb.Item {
+	item := i.ToProto()
+
+	tr := otel.Tracer("amqp")
+	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", broker.StockItemUpdatedEvent))
+	defer messageSpan.End()
+
+	marshalledItem, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("Failed to marshal item %s: %v", i.ID, err)
+		return item
+	}
+
+	headers := broker.InjectAMQPHeaders(amqpContext)
+
+	err = s.channel.PublishWithContext(amqpContext, broker.StockItemUpdatedEvent, "", false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         marshalledItem,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
+	if err != nil {
+		log.Printf("Failed to publish %s for item %s: %v", broker.StockItemUpdatedEvent, i.ID, err)
+	}
+
+	return item
+}
+
+func toProtoLines(lines []*StockCheckLine) []*pb.StockCheckLine {
+	res := make([]*pb.StockCheckLine, 0, len(lines))
+	for _, l := range lines {
+		res = append(res, l.ToProto())
+	}
+
+	return res
+}
+
+func recipeFromProto(lines []*pb.ItemsWithQuantity) []*ItemQuantity {
+	recipe := make([]*ItemQuantity, 0, len(lines))
+	for _, l := range lines {
+		recipe = append(recipe, &ItemQuantity{ItemID: l.ID, Quantity: l.Quantity})
+	}
+
+	return recipe
+}
+
+// toStatusError maps the stock service errors to gRPC status codes.
+func toStatusError(err error) error {
+	switch {
+	case errors.Is(err, ErrInvalidArgument):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, common.ErrItemNotFound), errors.Is(err, ErrReservationNotFound), errors.Is(err, ErrLocationNotFound), errors.Is(err, ErrPriceListNotFound), errors.Is(err, ErrWaitlistEntryNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrItemExists), errors.Is(err, ErrReservationExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrReservationClosed), errors.Is(err, ErrQuantityBelowReserved), errors.Is(err, ErrItemInStock), errors.Is(err, ErrIngredientNotFound):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrImportConflict):
+		return status.Error(codes.Aborted, err.Error())
+	}
+
+	return err
+}
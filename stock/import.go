@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// importReason is the reason recorded on the stock movements of an import.
+const importReason = "catalog import"
+
+type CatalogAction string
+
+const (
+	CatalogCreated   CatalogAction = "created"
+	CatalogUpdated   CatalogAction = "updated"
+	CatalogUnchanged CatalogAction = "unchanged"
+	CatalogRemoved   CatalogAction = "removed"
+)
+
+// CatalogChange is what an import does to one item.
+type CatalogChange struct {
+	ItemID string
+	Action CatalogAction
+	// Fields are the fields an update changes, stock changes are named
+	// stock.<locationID>.
+	Fields []string
+	// Before is the stored item, nil for created items. After is the item
+	// once the change is applied.
+	Before *Item
+	After  *Item
+	// Movements are the ledger entries of the stock changes.
+	Movements []*Movement
+}
+
+func (c *CatalogChange) ToProto() *pb.CatalogChange {
+	return &pb.CatalogChange{
+		ItemID: c.ItemID,
+		Action: string(c.Action),
+		Fields: c.Fields,
+	}
+}
+
+type ImportOptions struct {
+	// DryRun works out the changes without applying them.
+	DryRun bool
+	// RemoveMissing archives the active items that are not in the file.
+	RemoveMissing bool
+	Actor         string
+}
+
+type ImportRowError struct {
+	// Row is 0 for stored items that are missing from the file.
+	Row     int
+	ItemID  string
+	Message string
+}
+
+func (e *ImportRowError) ToProto() *pb.ImportRowError {
+	return &pb.ImportRowError{
+		Row:     int32(e.Row),
+		ItemID:  e.ItemID,
+		Message: e.Message,
+	}
+}
+
+type ImportResult struct {
+	Changes []*CatalogChange
+	// Errors are the rows that can't be imported. Nothing is applied when
+	// there is any.
+	Errors  []*ImportRowError
+	Applied bool
+}
+
+// ImportCatalog compares a catalog file with the stored items and, unless
+// it is a dry run or some row is wrong, applies every change at once. Stock
+// quantities in the file are the quantities on hand at each location, the
+// difference is recorded as an adjustment. Locations left out of the file
+// keep their stock, and importing an archived item restores it.
+func (s *Service) ImportCatalog(ctx context.Context, data []byte, format string, opts ImportOptions) (*ImportResult, error) {
+	if !opts.DryRun && opts.Actor == "" {
+		return nil, fmt.Errorf("%w: actor is required", ErrInvalidArgument)
+	}
+
+	rows, err := readCatalog(bytes.NewReader(data), format)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	stored, err := s.allItems(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*Item, len(stored))
+	for _, i := range stored {
+		existing[i.ID] = i
+	}
+
+	locations, err := s.store.ListLocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(locations))
+	for _, l := range locations {
+		known[l.ID] = true
+	}
+
+	validateCatalogRows(rows, existing)
+
+	res := &ImportResult{}
+	imported := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		if r.Err == nil {
+			for locationID := range r.Item.Stock {
+				if !known[locationID] {
+					r.Err = fmt.Errorf("item %s is stocked at the unknown location %s", r.Item.ID, locationID)
+				}
+			}
+		}
+
+		var change *CatalogChange
+		if r.Err == nil {
+			change, r.Err = diffItem(existing[r.Item.ID], r.Item, opts.Actor)
+		}
+
+		if r.Err != nil {
+			rowErr := &ImportRowError{Row: r.Row, Message: r.Err.Error()}
+			if r.Item != nil {
+				rowErr.ItemID = r.Item.ID
+			}
+			res.Errors = append(res.Errors, rowErr)
+			continue
+		}
+
+		res.Changes = append(res.Changes, change)
+		imported[change.ItemID] = true
+	}
+
+	if opts.RemoveMissing {
+		// ingredients still used by an active recipe can't be removed
+		used := make(map[string]string)
+		for _, c := range res.Changes {
+			if !c.After.Archived {
+				for _, r := range c.After.Recipe {
+					used[r.ItemID] = c.ItemID
+				}
+			}
+		}
+
+		for _, i := range stored {
+			if imported[i.ID] || i.Archived {
+				continue
+			}
+			if itemID, ok := used[i.ID]; ok {
+				res.Errors = append(res.Errors, &ImportRowError{
+					ItemID:  i.ID,
+					Message: fmt.Sprintf("item %s is missing from the file but is an ingredient of %s", i.ID, itemID),
+				})
+				continue
+			}
+			after := copyItem(i)
+			after.Archived = true
+			res.Changes = append(res.Changes, &CatalogChange{
+				ItemID: i.ID,
+				Action: CatalogRemoved,
+				Fields: []string{"archived"},
+				Before: i,
+				After:  after,
+			})
+		}
+	}
+
+	if len(res.Errors) > 0 || opts.DryRun {
+		return res, nil
+	}
+
+	var changes []*CatalogChange
+	for _, c := range res.Changes {
+		if c.Action != CatalogUnchanged {
+			changes = append(changes, c)
+		}
+	}
+	if len(changes) == 0 {
+		return res, nil
+	}
+
+	if err := s.store.ImportCatalog(ctx, changes); err != nil {
+		return nil, err
+	}
+	res.Applied = true
+	log.Printf("Catalog imported by %s: %d items changed", opts.Actor, len(changes))
+
+	// stock that went down may cross a reorder threshold, stock that went up
+	// may be awaited. The changes were only applied to the items as they
+	// were before them.
+	decreases := make(map[string][]*ItemQuantity)
+	before := make(map[string][]*Item)
+	increases := make(map[string]bool)
+	for _, c := range changes {
+		for _, m := range c.Movements {
+			if m.Quantity < 0 {
+				decreases[m.LocationID] = append(decreases[m.LocationID], &ItemQuantity{ItemID: m.ItemID, Quantity: -m.Quantity})
+				before[m.LocationID] = append(before[m.LocationID], copyItem(c.Before).At(m.LocationID))
+			} else {
+				increases[m.LocationID] = true
+			}
+		}
+	}
+	for locationID, items := range decreases {
+		s.raiseAlerts(ctx, locationID, before[locationID], items)
+	}
+	for locationID := range increases {
+		s.notifyWaitlists(ctx, locationID)
+	}
+
+	changed := make([]string, 0, len(changes))
+	for _, c := range changes {
+		changed = append(changed, c.ItemID)
+	}
+	s.stockChanged(ctx, "", changed...)
+
+	return res, nil
+}
+
+// ExportCatalog writes the items and their stock in a format ImportCatalog
+// reads back.
+func (s *Service) ExportCatalog(ctx context.Context, format string, includeArchived bool) ([]byte, error) {
+	items, err := s.allItems(ctx, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeCatalog(&buf, format, items); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// diffItem works out the change that turns the stored item into the
+// imported one.
+func diffItem(before, i *Item, actor string) (*CatalogChange, error) {
+	if before == nil {
+		after := copyItem(i)
+		movements := stockMovements(after, importReason, actor)
+
+		return &CatalogChange{ItemID: i.ID, Action: CatalogCreated, After: after, Movements: movements}, nil
+	}
+
+	after := copyItem(before)
+	fields := catalogDiff(before, i)
+
+	after.Name = i.Name
+	after.PriceID = i.PriceID
+	after.Category = i.Category
+	after.Description = i.Description
+	after.ImageURL = i.ImageURL
+	after.Allergens = i.Allergens
+	after.SortOrder = i.SortOrder
+	after.Availability = i.Availability
+	after.ReorderThreshold = i.ReorderThreshold
+	after.Recipe = i.Recipe
+	after.IsIngredient = i.IsIngredient
+	after.Archived = i.Archived
+
+	locationIDs := make([]string, 0, len(i.Stock))
+	for locationID := range i.Stock {
+		locationIDs = append(locationIDs, locationID)
+	}
+	sort.Strings(locationIDs)
+
+	var movements []*Movement
+	for _, locationID := range locationIDs {
+		l := after.Level(locationID)
+		quantity := i.Stock[locationID].Quantity
+		if quantity == l.Quantity {
+			continue
+		}
+		if quantity < l.Reserved {
+			return nil, fmt.Errorf("item %s has %d reserved at %s, more than the %d imported", i.ID, l.Reserved, locationID, quantity)
+		}
+
+		movements = append(movements, NewMovement(i.ID, locationID, MovementAdjustment, quantity-l.Quantity, 0, importReason, actor, ""))
+		l.Quantity = quantity
+		fields = append(fields, "stock."+locationID)
+	}
+
+	if len(after.Recipe) > 0 && after.Stocked() {
+		return nil, fmt.Errorf("take item %s out of stock before giving it a recipe", i.ID)
+	}
+
+	action := CatalogUpdated
+	if len(fields) == 0 {
+		action = CatalogUnchanged
+	}
+
+	return &CatalogChange{
+		ItemID:    i.ID,
+		Action:    action,
+		Fields:    fields,
+		Before:    before,
+		After:     after,
+		Movements: movements,
+	}, nil
+}
+
+// catalogDiff names the catalog fields, archived included, that differ
+// between two items.
+func catalogDiff(a, b *Item) []string {
+	var fields []string
+	set := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+
+	set("name", a.Name != b.Name)
+	set("priceID", a.PriceID != b.PriceID)
+	set("category", a.Category != b.Category)
+	set("description", a.Description != b.Description)
+	set("imageURL", a.ImageURL != b.ImageURL)
+	set("allergens", !slices.Equal(a.Allergens, b.Allergens))
+	set("sortOrder", a.SortOrder != b.SortOrder)
+	set("availability", !sameWindows(a.Availability, b.Availability))
+	set("reorderThreshold", a.ReorderThreshold != b.ReorderThreshold)
+	set("recipe", !sameRecipe(a.Recipe, b.Recipe))
+	set("isIngredient", a.IsIngredient != b.IsIngredient)
+	set("archived", a.Archived != b.Archived)
+
+	return fields
+}
+
+func sameWindows(a, b []*AvailabilityWindow) bool {
+	return slices.EqualFunc(a, b, func(x, y *AvailabilityWindow) bool {
+		return x.Start == y.Start && x.End == y.End && slices.Equal(x.Days, y.Days)
+	})
+}
+
+// allItems pages through every item of the store.
+func (s *Service) allItems(ctx context.Context, includeArchived bool) ([]*Item, error) {
+	var items []*Item
+	pageToken := ""
+	for {
+		page, err := s.store.ListItems(ctx, maxPageSize, pageToken, includeArchived)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+
+		if len(page) < maxPageSize {
+			return items, nil
+		}
+		pageToken = page[len(page)-1].ID
+	}
+}
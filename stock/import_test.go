@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// newImportService seeds the items a catalog import is compared with, and
+// the main and downtown locations.
+func newImportService(t *testing.T) *Service {
+	t.Helper()
+
+	s := newTestService(t,
+		&Item{ID: "burger", Name: "burger", PriceID: "price_burger", Stock: stocked(5)},
+		&Item{ID: "fries", Name: "fries", PriceID: "price_fries", Stock: stocked(3)},
+		&Item{ID: "dough", Name: "dough", PriceID: "price_dough", Stock: stocked(10), IsIngredient: true},
+		&Item{ID: "pizza", Name: "pizza", PriceID: "price_pizza", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}}},
+	)
+	_, err := s.store.SeedLocations(context.Background(), []*Location{{ID: "main", Name: "Main"}, {ID: "downtown", Name: "Downtown"}})
+	if err != nil {
+		t.Fatalf("seeding the locations: %v", err)
+	}
+
+	return s
+}
+
+const importCSV = `id,name,priceID,isIngredient,recipe,stock
+burger,cheeseburger,price_burger,,,main:8|downtown:2
+fries,fries,price_fries,,,main:3
+dough,dough,price_dough,true,,main:10
+pizza,pizza,price_pizza,,dough:1,
+shake,shake,price_shake,,,main:4
+`
+
+func TestImportCatalog(t *testing.T) {
+	s := newImportService(t)
+	ctx := context.Background()
+
+	// a dry run works the changes out without applying them
+	res, err := s.ImportCatalog(ctx, []byte(importCSV), CatalogFormatCSV, ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	if res.Applied || len(res.Errors) != 0 {
+		t.Fatalf("got %+v, want a dry run without errors", res)
+	}
+
+	actions := make(map[string]CatalogAction)
+	for _, c := range res.Changes {
+		actions[c.ItemID] = c.Action
+	}
+	want := map[string]CatalogAction{
+		"burger": CatalogUpdated,
+		"fries":  CatalogUnchanged,
+		"dough":  CatalogUnchanged,
+		"pizza":  CatalogUnchanged,
+		"shake":  CatalogCreated,
+	}
+	for id, action := range want {
+		if actions[id] != action {
+			t.Errorf("%s is %q, want %q", id, actions[id], action)
+		}
+	}
+	burger := res.Changes[slices.IndexFunc(res.Changes, func(c *CatalogChange) bool { return c.ItemID == "burger" })]
+	if !slices.Equal(burger.Fields, []string{"name", "stock.downtown", "stock.main"}) {
+		t.Errorf("the burger changes %v, want its name and both locations", burger.Fields)
+	}
+	if _, err := s.store.GetItem(ctx, "shake"); err == nil {
+		t.Error("the dry run created the shake")
+	}
+
+	if _, err := s.ImportCatalog(ctx, []byte(importCSV), CatalogFormatCSV, ImportOptions{}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("importing without an actor returned %v, want %v", err, ErrInvalidArgument)
+	}
+
+	res, err = s.ImportCatalog(ctx, []byte(importCSV), CatalogFormatCSV, ImportOptions{Actor: "jane"})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	if !res.Applied {
+		t.Fatalf("got %+v, want the import applied", res)
+	}
+
+	i, err := s.store.GetItem(ctx, "burger")
+	if err != nil {
+		t.Fatalf("getting the burger: %v", err)
+	}
+	if i.Name != "cheeseburger" || i.Stock["main"].Quantity != 8 || i.Stock["downtown"].Quantity != 2 {
+		t.Errorf("got %+v, want the imported name and stock", i)
+	}
+	movements, err := s.store.ListMovements(ctx, "burger", "main", 1, "")
+	if err != nil {
+		t.Fatalf("listing the movements: %v", err)
+	}
+	if len(movements) != 1 || movements[0].Type != MovementAdjustment || movements[0].Quantity != 3 || movements[0].Actor != "jane" {
+		t.Errorf("movements are %+v, want an adjustment of 3 by jane", movements)
+	}
+	if _, err := s.store.GetItem(ctx, "shake"); err != nil {
+		t.Errorf("getting the imported shake: %v", err)
+	}
+}
+
+func TestImportCatalogRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		opts    ImportOptions
+		wantErr string
+	}{
+		{"an unknown location", "id,name,priceID,stock\nburger,burger,price_burger,airport:1\n", ImportOptions{}, "unknown location airport"},
+		{"less than is reserved", "id,name,priceID,quantity\nburger,burger,price_burger,1\n", ImportOptions{}, "has 2 reserved at main"},
+		{"a recipe on stocked items", "id,name,priceID,recipe\nburger,burger,price_burger,dough:1\n", ImportOptions{}, "take item burger out of stock"},
+		{"removing a used ingredient", "id,name,priceID,recipe\npizza,pizza,price_pizza,dough:1\n", ImportOptions{RemoveMissing: true}, "ingredient of pizza"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newImportService(t)
+			ctx := context.Background()
+			if _, _, err := s.ReserveItems(ctx, "o1", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 2}}, time.Hour); err != nil {
+				t.Fatalf("reserving: %v", err)
+			}
+
+			tt.opts.Actor = "jane"
+			res, err := s.ImportCatalog(ctx, []byte(tt.csv), CatalogFormatCSV, tt.opts)
+			if err != nil {
+				t.Fatalf("importing: %v", err)
+			}
+			if res.Applied {
+				t.Error("the import was applied")
+			}
+			found := slices.ContainsFunc(res.Errors, func(e *ImportRowError) bool { return strings.Contains(e.Message, tt.wantErr) })
+			if !found {
+				t.Errorf("got errors %+v, want one about %q", res.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImportCatalogRemoveMissing(t *testing.T) {
+	s := newImportService(t)
+	ctx := context.Background()
+
+	data := "id,name,priceID,isIngredient,recipe\ndough,dough,price_dough,true,\npizza,pizza,price_pizza,,dough:1\n"
+	res, err := s.ImportCatalog(ctx, []byte(data), CatalogFormatCSV, ImportOptions{RemoveMissing: true, Actor: "jane"})
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	if !res.Applied {
+		t.Fatalf("got errors %+v, want the import applied", res.Errors)
+	}
+
+	for id, archived := range map[string]bool{"burger": true, "fries": true, "dough": false, "pizza": false} {
+		i, err := s.store.GetItem(ctx, id)
+		if err != nil {
+			t.Fatalf("getting %s: %v", id, err)
+		}
+		if i.Archived != archived {
+			t.Errorf("%s is archived %v, want %v", id, i.Archived, archived)
+		}
+	}
+}
+
+func TestExportCatalogRoundTrip(t *testing.T) {
+	for _, format := range []string{CatalogFormatJSON, CatalogFormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			s := newImportService(t)
+			ctx := context.Background()
+
+			data, err := s.ExportCatalog(ctx, format, false)
+			if err != nil {
+				t.Fatalf("exporting: %v", err)
+			}
+
+			res, err := s.ImportCatalog(ctx, data, format, ImportOptions{DryRun: true})
+			if err != nil {
+				t.Fatalf("importing: %v", err)
+			}
+			if len(res.Errors) != 0 || len(res.Changes) != 4 {
+				t.Fatalf("got %+v, want the 4 exported items back", res)
+			}
+			for _, c := range res.Changes {
+				if c.Action != CatalogUnchanged {
+					t.Errorf("%s is %q with %v, want it unchanged", c.ItemID, c.Action, c.Fields)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// defaultLocationID is used by requests that don't name a location, and
+// holds the stock that was kept before there were locations.
+const defaultLocationID = "main"
+
+// locationIDPattern keeps location IDs usable as document field names.
+var locationIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Location is a kitchen or warehouse that holds stock.
+type Location struct {
+	ID          string       `bson:"_id" json:"id"`
+	Name        string       `bson:"name" json:"name"`
+	Coordinates *Coordinates `bson:"coordinates,omitempty" json:"coordinates,omitempty"`
+}
+
+type Coordinates struct {
+	Latitude  float64 `bson:"latitude" json:"latitude"`
+	Longitude float64 `bson:"longitude" json:"longitude"`
+}
+
+// FulfillmentOption is a location that can fulfil a basket.
+type FulfillmentOption struct {
+	Location *Location
+	// DistanceKm is zero when there is no origin to measure from, or the
+	// location has no coordinates.
+	DistanceKm float64
+}
+
+func (l *Location) ToProto() *pb.Location {
+	res := &pb.Location{
+		ID:   l.ID,
+		Name: l.Name,
+	}
+	if l.Coordinates != nil {
+		res.Coordinates = &pb.Coordinates{
+			Latitude:  l.Coordinates.Latitude,
+			Longitude: l.Coordinates.Longitude,
+		}
+	}
+
+	return res
+}
+
+// LoadLocations reads a JSON array of locations.
+func LoadLocations(path string) ([]*Location, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []*Location
+	if err := json.Unmarshal(b, &locations); err != nil {
+		return nil, fmt.Errorf("parsing locations %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, l := range locations {
+		if !locationIDPattern.MatchString(l.ID) {
+			return nil, fmt.Errorf("locations %s: invalid location ID %q", path, l.ID)
+		}
+		if seen[l.ID] {
+			return nil, fmt.Errorf("locations %s: duplicated location ID %s", path, l.ID)
+		}
+		seen[l.ID] = true
+	}
+
+	return locations, nil
+}
+
+// distanceKm is the great-circle distance between two points.
+func distanceKm(a, b *Coordinates) float64 {
+	const earthRadiusKm = 6371
+
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// newLocationService seeds a burger stocked at three locations, the airport
+// having no coordinates.
+func newLocationService(t *testing.T) *Service {
+	t.Helper()
+
+	s := newTestService(t, &Item{ID: "burger", Name: "burger", PriceID: "p", Stock: map[string]*StockLevel{
+		"main":     {Quantity: 5},
+		"downtown": {Quantity: 2},
+		"airport":  {Quantity: 5},
+	}})
+	_, err := s.store.SeedLocations(context.Background(), []*Location{
+		{ID: "main", Name: "Main Kitchen", Coordinates: &Coordinates{Latitude: -23.5614, Longitude: -46.6559}},
+		{ID: "downtown", Name: "Downtown Kitchen", Coordinates: &Coordinates{Latitude: -23.5489, Longitude: -46.6388}},
+		{ID: "airport", Name: "Airport Kitchen"},
+	})
+	if err != nil {
+		t.Fatalf("seeding the locations: %v", err)
+	}
+
+	return s
+}
+
+func TestFindFulfillmentLocations(t *testing.T) {
+	s := newLocationService(t)
+	ctx := context.Background()
+	nearDowntown := &Coordinates{Latitude: -23.5475, Longitude: -46.6361}
+
+	tests := []struct {
+		name     string
+		quantity int32
+		origin   *Coordinates
+		want     []string
+	}{
+		{"sorted by ID without an origin", 2, nil, []string{"airport", "downtown", "main"}},
+		{"nearest first, no coordinates last", 2, nearDowntown, []string{"downtown", "main", "airport"}},
+		{"only the locations holding enough", 3, nearDowntown, []string{"main", "airport"}},
+		{"no location holds enough", 6, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := s.FindFulfillmentLocations(ctx, []*pb.ItemsWithQuantity{{ID: "burger", Quantity: tt.quantity}}, tt.origin)
+			if err != nil {
+				t.Fatalf("finding locations: %v", err)
+			}
+
+			var got []string
+			for _, o := range options {
+				got = append(got, o.Location.ID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got locations %v, want %v", got, tt.want)
+			}
+			for n := range got {
+				if got[n] != tt.want[n] {
+					t.Fatalf("got locations %v, want %v", got, tt.want)
+				}
+			}
+			if tt.origin != nil && options[0].DistanceKm <= 0 {
+				t.Errorf("got no distance to %s, want it measured from the origin", got[0])
+			}
+		})
+	}
+}
+
+func TestReserveItemsAtLocation(t *testing.T) {
+	s := newLocationService(t)
+	ctx := context.Background()
+
+	r, _, err := s.ReserveItems(ctx, "o1", "downtown", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 2}}, time.Hour)
+	if err != nil {
+		t.Fatalf("reserving downtown: %v", err)
+	}
+	if r.LocationID != "downtown" {
+		t.Errorf("reserved at %q, want downtown", r.LocationID)
+	}
+
+	i, err := s.store.GetItem(ctx, "burger")
+	if err != nil {
+		t.Fatalf("getting the burger: %v", err)
+	}
+	if i.Stock["downtown"].Reserved != 2 || i.Stock["main"].Reserved != 0 {
+		t.Errorf("got stock %+v %+v, want only downtown reserved", i.Stock["downtown"], i.Stock["main"])
+	}
+
+	// the stock of other locations doesn't make up for a short one
+	_, _, err = s.ReserveItems(ctx, "o2", "downtown", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 1}}, time.Hour)
+	if !errors.Is(err, common.ErrNoStock) {
+		t.Errorf("reserving more than downtown holds returned %v, want %v", err, common.ErrNoStock)
+	}
+
+	// without a location the order is reserved at the default one
+	if r, _, err = s.ReserveItems(ctx, "o3", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 1}}, time.Hour); err != nil {
+		t.Fatalf("reserving at the default location: %v", err)
+	}
+	if r.LocationID != defaultLocationID {
+		t.Errorf("reserved at %q, want %s", r.LocationID, defaultLocationID)
+	}
+
+	if _, _, err := s.ReserveItems(ctx, "o4", "moon", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 1}}, time.Hour); !errors.Is(err, ErrLocationNotFound) {
+		t.Errorf("reserving at an unknown location returned %v, want %v", err, ErrLocationNotFound)
+	}
+}
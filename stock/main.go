@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"time"
 
@@ -10,21 +11,36 @@ import (
 	"github.com/scuba13/oms/common/broker"
 	"github.com/scuba13/oms/common/discovery"
 	"github.com/scuba13/oms/common/discovery/consul"
+	"github.com/scuba13/oms/stock/gateway"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
 var (
-	serviceName = "stock"
-	grpcAddr    = common.EnvString("GRPC_ADDR", "localhost:2002")
-	consulAddr  = common.EnvString("CONSUL_ADDR", "localhost:8500")
-	amqpUser    = common.EnvString("RABBITMQ_USER", "guest")
-	amqpPass    = common.EnvString("RABBITMQ_PASS", "guest")
-	amqpHost    = common.EnvString("RABBITMQ_HOST", "localhost")
-	amqpPort    = common.EnvString("RABBITMQ_PORT", "5672")
-	jaegerAddr  = common.EnvString("JAEGER_ADDR", "localhost:4318")
+	serviceName    = "stock"
+	grpcAddr       = common.EnvString("GRPC_ADDR", "localhost:2002")
+	consulAddr     = common.EnvString("CONSUL_ADDR", "localhost:8500")
+	amqpUser       = common.EnvString("RABBITMQ_USER", "guest")
+	amqpPass       = common.EnvString("RABBITMQ_PASS", "guest")
+	amqpHost       = common.EnvString("RABBITMQ_HOST", "localhost")
+	amqpPort       = common.EnvString("RABBITMQ_PORT", "5672")
+	mongoUser      = common.EnvString("MONGO_DB_USER", "root")
+	mongoPass      = common.EnvString("MONGO_DB_PASS", "example")
+	mongoAddr      = common.EnvString("MONGO_DB_HOST", "localhost:27017")
+	jaegerAddr     = common.EnvString("JAEGER_ADDR", "localhost:4318")
+	storeKind      = common.EnvString("STOCK_STORE", "mongo")
+	storeFile      = common.EnvString("STOCK_STORE_FILE", "stock.db.json")
+	catalogFile    = common.EnvString("STOCK_CATALOG_FILE", "catalog.json")
+	locationsFile  = common.EnvString("STOCK_LOCATIONS_FILE", "locations.json")
+	priceListsFile = common.EnvString("STOCK_PRICE_LISTS_FILE", "price_lists.json")
+	menuTZ         = common.EnvString("STOCK_MENU_TZ", "Local")
 )
 
+const reservationSweepInterval = 30 * time.Second
+
 func main() {
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
@@ -71,14 +87,78 @@ func main() {
 	}
 	defer l.Close()
 
-	store := NewStore()
-	svc := NewService(store)
+	store, err := newStockStore()
+	if err != nil {
+		logger.Fatal("failed to set up the stock store", zap.Error(err))
+	}
+
+	locations := []*Location{{ID: defaultLocationID, Name: "Main"}}
+	if locationsFile != "" {
+		locations, err = LoadLocations(locationsFile)
+		if err != nil {
+			logger.Fatal("failed to load the locations", zap.Error(err))
+		}
+	}
+
+	insertedLocations, err := store.SeedLocations(ctx, locations)
+	if err != nil {
+		logger.Fatal("failed to seed the locations", zap.Error(err))
+	}
+	logger.Info("Locations seeded", zap.String("file", locationsFile), zap.Int("inserted", insertedLocations))
+
+	if catalogFile != "" {
+		items, err := LoadCatalog(catalogFile)
+		if err != nil {
+			logger.Fatal("failed to load the catalog", zap.Error(err))
+		}
+
+		inserted, err := store.Seed(ctx, items)
+		if err != nil {
+			logger.Fatal("failed to seed the stock", zap.Error(err))
+		}
+		logger.Info("Stock seeded", zap.String("catalog", catalogFile), zap.Int("inserted", inserted))
+	}
+
+	if priceListsFile != "" {
+		lists, err := LoadPriceLists(priceListsFile)
+		if err != nil {
+			logger.Fatal("failed to load the price lists", zap.Error(err))
+		}
+
+		inserted, err := store.SeedPriceLists(ctx, lists)
+		if err != nil {
+			logger.Fatal("failed to seed the price lists", zap.Error(err))
+		}
+		logger.Info("Price lists seeded", zap.String("file", priceListsFile), zap.Int("inserted", inserted))
+	}
+
+	timeZone, err := time.LoadLocation(menuTZ)
+	if err != nil {
+		logger.Fatal("failed to load the menu time zone", zap.Error(err))
+	}
+
+	gateway := gateway.NewGateway(registry)
+
+	svc := NewService(store, gateway, NewAlertPublisher(ch), NewChangePublisher(ch), timeZone)
 	svcWithTelemetry := NewTelemetryMiddleware(svc)
 
 	NewGRPCHandler(grpcServer, ch, svcWithTelemetry)
 
-	consumer := NewConsumer()
+	consumer := NewConsumer(svcWithTelemetry)
 	go consumer.Listen(ch)
+	go consumer.ListenChanges(ch)
+
+	go func() {
+		for {
+			released, err := svcWithTelemetry.ReleaseExpiredReservations(ctx)
+			if err != nil {
+				logger.Error("Failed to release expired reservations", zap.Error(err))
+			} else if released > 0 {
+				logger.Info("Released expired reservations", zap.Int("count", released))
+			}
+			time.Sleep(reservationSweepInterval)
+		}
+	}()
 
 	logger.Info("Starting gRPC server", zap.String("port", grpcAddr))
 
@@ -86,3 +166,40 @@ func main() {
 		logger.Fatal("failed to serve", zap.Error(err))
 	}
 }
+
+func newStockStore() (StockStore, error) {
+	switch storeKind {
+	case "mongo":
+		uri := fmt.Sprintf("mongodb://%s:%s@%s", mongoUser, mongoPass, mongoAddr)
+		mongoClient, err := connectToMongoDB(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		s := NewStore(mongoClient)
+		if err := s.ensureIndexes(context.Background()); err != nil {
+			return nil, fmt.Errorf("creating the stock indexes: %w", err)
+		}
+		if err := s.migrateLegacyStock(context.Background()); err != nil {
+			return nil, fmt.Errorf("migrating legacy stock: %w", err)
+		}
+
+		return s, nil
+	case "file":
+		return NewFileStore(storeFile)
+	default:
+		return nil, fmt.Errorf("unknown stock store %q", storeKind)
+	}
+}
+
+func connectToMongoDB(uri string) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Ping(ctx, readpref.Primary())
+	return client, err
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+var (
+	// priceListIDPattern keeps price list IDs usable in URLs.
+	priceListIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	// channelPattern matches the channels orders name, such as web or kiosk.
+	channelPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// PriceList overrides the base price of some items, for a channel, between
+// effective dates and at times of the day. Happy hours are lists with
+// windows, scheduled price changes are lists with an effective date.
+type PriceList struct {
+	ID   string `bson:"_id" json:"id"`
+	Name string `bson:"name" json:"name"`
+	// Channel limits the list to the orders of one channel, such as web or
+	// kiosk. An empty channel applies to every channel.
+	Channel  string `bson:"channel,omitempty" json:"channel,omitempty"`
+	Priority int32  `bson:"priority" json:"priority"`
+	// EffectiveFrom and EffectiveUntil bound the list in time, a zero time
+	// leaves it open on that side. EffectiveUntil is exclusive.
+	EffectiveFrom  time.Time `bson:"effectiveFrom,omitempty" json:"effectiveFrom,omitempty"`
+	EffectiveUntil time.Time `bson:"effectiveUntil,omitempty" json:"effectiveUntil,omitempty"`
+	// Windows limit the list to times of the day. A list without windows
+	// applies all day.
+	Windows []*AvailabilityWindow `bson:"windows,omitempty" json:"windows,omitempty"`
+	Prices  []*ItemPrice          `bson:"prices" json:"prices"`
+}
+
+type ItemPrice struct {
+	ItemID  string `bson:"itemID" json:"itemID"`
+	PriceID string `bson:"priceID" json:"priceID"`
+}
+
+func (l *PriceList) Validate() error {
+	if !priceListIDPattern.MatchString(l.ID) {
+		return fmt.Errorf("invalid price list ID %q", l.ID)
+	}
+	if l.Channel != "" && !channelPattern.MatchString(l.Channel) {
+		return fmt.Errorf("price list %s: invalid channel %q", l.ID, l.Channel)
+	}
+	if !l.EffectiveFrom.IsZero() && !l.EffectiveUntil.IsZero() && !l.EffectiveFrom.Before(l.EffectiveUntil) {
+		return fmt.Errorf("price list %s ends before it starts", l.ID)
+	}
+	for _, w := range l.Windows {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("price list %s: %w", l.ID, err)
+		}
+	}
+
+	seen := make(map[string]bool, len(l.Prices))
+	for _, p := range l.Prices {
+		if p.ItemID == "" || p.PriceID == "" {
+			return fmt.Errorf("price list %s: prices need an item ID and a price ID", l.ID)
+		}
+		if seen[p.ItemID] {
+			return fmt.Errorf("price list %s: duplicated price for item %s", l.ID, p.ItemID)
+		}
+		seen[p.ItemID] = true
+	}
+
+	return nil
+}
+
+// AppliesTo reports whether the list prices the orders of a channel at the
+// given time.
+func (l *PriceList) AppliesTo(channel string, t time.Time) bool {
+	if l.Channel != "" && l.Channel != channel {
+		return false
+	}
+	if !l.EffectiveFrom.IsZero() && t.Before(l.EffectiveFrom) {
+		return false
+	}
+	if !l.EffectiveUntil.IsZero() && !t.Before(l.EffectiveUntil) {
+		return false
+	}
+	if len(l.Windows) == 0 {
+		return true
+	}
+
+	for _, w := range l.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *PriceList) priceOf(itemID string) (string, bool) {
+	for _, p := range l.Prices {
+		if p.ItemID == itemID {
+			return p.PriceID, true
+		}
+	}
+
+	return "", false
+}
+
+func (l *PriceList) ToProto() *pb.PriceList {
+	windows := make([]*pb.AvailabilityWindow, 0, len(l.Windows))
+	for _, w := range l.Windows {
+		windows = append(windows, w.ToProto())
+	}
+
+	prices := make([]*pb.ItemPrice, 0, len(l.Prices))
+	for _, p := range l.Prices {
+		prices = append(prices, &pb.ItemPrice{ItemID: p.ItemID, PriceID: p.PriceID})
+	}
+
+	return &pb.PriceList{
+		ID:             l.ID,
+		Name:           l.Name,
+		Channel:        l.Channel,
+		Priority:       l.Priority,
+		EffectiveFrom:  unixOrZero(l.EffectiveFrom),
+		EffectiveUntil: unixOrZero(l.EffectiveUntil),
+		Windows:        windows,
+		Prices:         prices,
+	}
+}
+
+func priceListFromProto(p *pb.PriceList) *PriceList {
+	prices := make([]*ItemPrice, 0, len(p.Prices))
+	for _, ip := range p.Prices {
+		prices = append(prices, &ItemPrice{ItemID: ip.ItemID, PriceID: ip.PriceID})
+	}
+
+	l := &PriceList{
+		ID:       p.ID,
+		Name:     p.Name,
+		Channel:  p.Channel,
+		Priority: p.Priority,
+		Windows:  availabilityFromProto(p.Windows),
+		Prices:   prices,
+	}
+	if p.EffectiveFrom != 0 {
+		l.EffectiveFrom = time.Unix(p.EffectiveFrom, 0).UTC()
+	}
+	if p.EffectiveUntil != 0 {
+		l.EffectiveUntil = time.Unix(p.EffectiveUntil, 0).UTC()
+	}
+
+	return l
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// LoadPriceLists reads a JSON array of price lists. Effective dates are
+// RFC 3339 times.
+func LoadPriceLists(path string) ([]*PriceList, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lists []*PriceList
+	if err := json.Unmarshal(b, &lists); err != nil {
+		return nil, fmt.Errorf("parsing price lists %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, l := range lists {
+		if err := l.Validate(); err != nil {
+			return nil, fmt.Errorf("price lists %s: %w", path, err)
+		}
+		if seen[l.ID] {
+			return nil, fmt.Errorf("price lists %s: duplicated price list ID %s", path, l.ID)
+		}
+		seen[l.ID] = true
+	}
+
+	return lists, nil
+}
+
+// activePriceLists are the lists that apply to a channel at the given time,
+// the one that wins first: highest priority, then the latest to take
+// effect, then by ID.
+func activePriceLists(lists []*PriceList, channel string, t time.Time) []*PriceList {
+	var active []*PriceList
+	for _, l := range lists {
+		if l.AppliesTo(channel, t) {
+			active = append(active, l)
+		}
+	}
+
+	sort.Slice(active, func(a, b int) bool {
+		la, lb := active[a], active[b]
+		if la.Priority != lb.Priority {
+			return la.Priority > lb.Priority
+		}
+		if !la.EffectiveFrom.Equal(lb.EffectiveFrom) {
+			return la.EffectiveFrom.After(lb.EffectiveFrom)
+		}
+		return la.ID < lb.ID
+	})
+
+	return active
+}
+
+// withPrices replaces the base price of the items with the price of the
+// winning list for the channel at the current time. The items keep the ID of
+// that list, so orders record which price they were charged.
+func (s *Service) withPrices(ctx context.Context, channel string, items []*Item) ([]*Item, error) {
+	active, err := s.priceListsFor(ctx, channel, s.now())
+	if err != nil {
+		return nil, err
+	}
+	applyPrices(active, items)
+
+	return items, nil
+}
+
+// priceListsFor reads the lists that apply to a channel at the given
+// time, for requests that price items more than once.
+func (s *Service) priceListsFor(ctx context.Context, channel string, t time.Time) ([]*PriceList, error) {
+	lists, err := s.store.ListPriceLists(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return activePriceLists(lists, channel, t), nil
+}
+
+// applyPrices gives each item the price of the first active list that
+// prices it.
+func applyPrices(active []*PriceList, items []*Item) {
+	for _, i := range items {
+		for _, l := range active {
+			if priceID, ok := l.priceOf(i.ID); ok {
+				i.PriceID = priceID
+				i.PriceListID = l.ID
+				break
+			}
+		}
+	}
+}
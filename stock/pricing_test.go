@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPriceListAppliesTo(t *testing.T) {
+	noon := time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		list    PriceList
+		channel string
+		want    bool
+	}{
+		{"every channel", PriceList{}, "kiosk", true},
+		{"its channel", PriceList{Channel: "web"}, "web", true},
+		{"another channel", PriceList{Channel: "web"}, "kiosk", false},
+		{"not effective yet", PriceList{EffectiveFrom: noon.Add(time.Hour)}, "web", false},
+		{"effective from now", PriceList{EffectiveFrom: noon}, "web", true},
+		{"ended", PriceList{EffectiveUntil: noon}, "web", false},
+		{"inside a window", PriceList{Windows: []*AvailabilityWindow{{Start: "11:00", End: "13:00"}}}, "web", true},
+		{"outside its windows", PriceList{Windows: []*AvailabilityWindow{{Start: "17:00", End: "19:00"}}}, "web", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.list.AppliesTo(tt.channel, noon); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriceListValidate(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		list PriceList
+	}{
+		{"an invalid ID", PriceList{ID: "happy hour"}},
+		{"an invalid channel", PriceList{ID: "happy-hour", Channel: "Web"}},
+		{"ends before it starts", PriceList{ID: "happy-hour", EffectiveFrom: now, EffectiveUntil: now.Add(-time.Hour)}},
+		{"an invalid window", PriceList{ID: "happy-hour", Windows: []*AvailabilityWindow{{Start: "25:00", End: "26:00"}}}},
+		{"a price without a price ID", PriceList{ID: "happy-hour", Prices: []*ItemPrice{{ItemID: "1"}}}},
+		{"a duplicated item", PriceList{ID: "happy-hour", Prices: []*ItemPrice{{ItemID: "1", PriceID: "a"}, {ItemID: "1", PriceID: "b"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.list.Validate(); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+
+	valid := PriceList{ID: "summer.2026", Channel: "web", Prices: []*ItemPrice{{ItemID: "1", PriceID: "a"}}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("validating a valid list: %v", err)
+	}
+}
+
+func TestActivePriceLists(t *testing.T) {
+	now := time.Now()
+	lists := []*PriceList{
+		{ID: "b", Priority: 1},
+		{ID: "kiosk", Priority: 5, Channel: "kiosk"},
+		{ID: "a", Priority: 1},
+		{ID: "newer", Priority: 1, EffectiveFrom: now.Add(-time.Hour)},
+		{ID: "high", Priority: 2},
+		{ID: "ended", Priority: 9, EffectiveUntil: now.Add(-time.Hour)},
+	}
+
+	var got []string
+	for _, l := range activePriceLists(lists, "web", now) {
+		got = append(got, l.ID)
+	}
+	want := []string{"high", "newer", "a", "b"}
+	if len(got) != len(want) {
+		t.Fatalf("got lists %v, want %v", got, want)
+	}
+	for n := range want {
+		if got[n] != want[n] {
+			t.Fatalf("got lists %v, want %v", got, want)
+		}
+	}
+}
+
+func TestServicePricesItems(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t,
+		&Item{ID: "burger", Name: "burger", PriceID: "price_burger", Stock: stocked(5)},
+		&Item{ID: "fries", Name: "fries", PriceID: "price_fries", Stock: stocked(5)},
+	)
+	list := &PriceList{ID: "web", Channel: "web", Prices: []*ItemPrice{{ItemID: "burger", PriceID: "price_burger_web"}}}
+	if _, err := s.PutPriceList(ctx, list); err != nil {
+		t.Fatalf("putting the price list: %v", err)
+	}
+
+	tests := []struct {
+		channel   string
+		wantPrice string
+		wantList  string
+	}{
+		{"web", "price_burger_web", "web"},
+		{"kiosk", "price_burger", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.channel, func(t *testing.T) {
+			items, err := s.GetItems(ctx, "", tt.channel, []string{"burger", "fries"})
+			if err != nil {
+				t.Fatalf("getting the items: %v", err)
+			}
+			for _, i := range items {
+				switch i.ID {
+				case "burger":
+					if i.PriceID != tt.wantPrice || i.PriceListID != tt.wantList {
+						t.Errorf("the burger costs %s from %q, want %s from %q", i.PriceID, i.PriceListID, tt.wantPrice, tt.wantList)
+					}
+				case "fries":
+					if i.PriceID != "price_fries" || i.PriceListID != "" {
+						t.Errorf("the fries cost %s from %q, want the base price", i.PriceID, i.PriceListID)
+					}
+				}
+			}
+		})
+	}
+
+	unknown := &PriceList{ID: "web", Prices: []*ItemPrice{{ItemID: "shake", PriceID: "price_shake"}}}
+	if _, err := s.PutPriceList(ctx, unknown); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("pricing an unknown item returned %v, want %v", err, ErrInvalidArgument)
+	}
+
+	if err := s.DeletePriceList(ctx, "web"); err != nil {
+		t.Fatalf("deleting the price list: %v", err)
+	}
+	if err := s.DeletePriceList(ctx, "web"); !errors.Is(err, ErrPriceListNotFound) {
+		t.Errorf("deleting it again returned %v, want %v", err, ErrPriceListNotFound)
+	}
+}
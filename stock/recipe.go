@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// stockLines expands the ordered quantities into the stock they take out:
+// items with a recipe take their ingredients, the others take themselves.
+// Lines for the same stock item, like an ingredient shared by two menu items
+// of one order, are summed. Items missing from ordered are left out.
+func stockLines(ordered []*Item, p []*pb.ItemsWithQuantity) []*ItemQuantity {
+	byID := make(map[string]*Item, len(ordered))
+	for _, i := range ordered {
+		byID[i.ID] = i
+	}
+
+	lines := make([]*ItemQuantity, 0, len(p))
+	add := func(itemID string, quantity int32) {
+		for _, l := range lines {
+			if l.ItemID == itemID {
+				l.Quantity += quantity
+				return
+			}
+		}
+		lines = append(lines, &ItemQuantity{ItemID: itemID, Quantity: quantity})
+	}
+
+	for _, reqItem := range p {
+		i, ok := byID[reqItem.ID]
+		if !ok {
+			continue
+		}
+
+		if len(i.Recipe) == 0 {
+			add(i.ID, reqItem.Quantity)
+			continue
+		}
+		for _, r := range i.Recipe {
+			add(r.ItemID, r.Quantity*reqItem.Quantity)
+		}
+	}
+
+	return lines
+}
+
+// sameRecipe reports whether two recipes list the same ingredients in the
+// same order.
+func sameRecipe(a, b []*ItemQuantity) bool {
+	return slices.EqualFunc(a, b, func(x, y *ItemQuantity) bool {
+		return *x == *y
+	})
+}
+
+// recipeAvailable is how many units of an item with a recipe can be made
+// from the available quantity of its ingredients. Archived ingredients make
+// none, an ingredient missing from stock is an error.
+func recipeAvailable(i *Item, stock map[string]*Item) (int32, error) {
+	available := int32(-1)
+	for _, r := range i.Recipe {
+		ingredient, ok := stock[r.ItemID]
+		if !ok {
+			return 0, fmt.Errorf("%w: %s of item %s", ErrIngredientNotFound, r.ItemID, i.ID)
+		}
+		if ingredient.Archived {
+			return 0, nil
+		}
+
+		units := max(ingredient.Available(), 0) / r.Quantity
+		if available < 0 || units < available {
+			available = units
+		}
+	}
+
+	return max(available, 0), nil
+}
+
+// withRecipeQuantities sets the quantity of the items with a recipe to the
+// units their ingredients allow at a location, looking the ingredients up in
+// the store.
+func (s *Service) withRecipeQuantities(ctx context.Context, locationID string, items []*Item) ([]*Item, error) {
+	var ids []string
+	for _, i := range items {
+		for _, r := range i.Recipe {
+			ids = append(ids, r.ItemID)
+		}
+	}
+	if len(ids) == 0 {
+		return items, nil
+	}
+
+	ingredients, err := s.itemsAt(ctx, locationID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	stock := make(map[string]*Item, len(ingredients))
+	for _, i := range ingredients {
+		stock[i.ID] = i
+	}
+	for _, i := range items {
+		if len(i.Recipe) == 0 {
+			continue
+		}
+		if i.Quantity, err = recipeAvailable(i, stock); err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// validateRecipe checks that every ingredient of an item exists and is
+// stocked on its own. Recipes are one level deep, an ingredient can't have a
+// recipe itself.
+func (s *Service) validateRecipe(ctx context.Context, i *Item) error {
+	if len(i.Recipe) == 0 {
+		return nil
+	}
+	if i.IsIngredient {
+		return fmt.Errorf("%w: an ingredient can't have a recipe", ErrInvalidArgument)
+	}
+	if i.Quantity != 0 || i.ReorderThreshold != 0 {
+		return fmt.Errorf("%w: items with a recipe are stocked through their ingredients", ErrInvalidArgument)
+	}
+
+	ids := make([]string, 0, len(i.Recipe))
+	for _, r := range i.Recipe {
+		switch {
+		case r.ItemID == i.ID:
+			return fmt.Errorf("%w: an item can't be an ingredient of itself", ErrInvalidArgument)
+		case r.Quantity <= 0:
+			return fmt.Errorf("%w: ingredient %s must have a positive quantity", ErrInvalidArgument, r.ItemID)
+		}
+		for _, id := range ids {
+			if id == r.ItemID {
+				return fmt.Errorf("%w: duplicated ingredient %s", ErrInvalidArgument, r.ItemID)
+			}
+		}
+		ids = append(ids, r.ItemID)
+	}
+
+	ingredients, err := s.store.GetItems(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		found := false
+		for _, ingredient := range ingredients {
+			if ingredient.ID != id {
+				continue
+			}
+			if len(ingredient.Recipe) > 0 {
+				return fmt.Errorf("%w: ingredient %s has a recipe of its own", ErrInvalidArgument, id)
+			}
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("%w: ingredient %s does not exist", ErrInvalidArgument, id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+)
+
+func TestStockLines(t *testing.T) {
+	ordered := []*Item{
+		{ID: "pizza", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}, {ItemID: "cheese", Quantity: 2}}},
+		{ID: "calzone", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 2}}},
+		{ID: "water"},
+	}
+	lines := stockLines(ordered, []*pb.ItemsWithQuantity{
+		{ID: "pizza", Quantity: 2},
+		{ID: "calzone", Quantity: 1},
+		{ID: "water", Quantity: 3},
+		{ID: "unknown", Quantity: 1},
+	})
+
+	want := []ItemQuantity{{ItemID: "dough", Quantity: 4}, {ItemID: "cheese", Quantity: 4}, {ItemID: "water", Quantity: 3}}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %v", len(lines), want)
+	}
+	for n, l := range lines {
+		if *l != want[n] {
+			t.Errorf("line %d is %+v, want %+v", n, *l, want[n])
+		}
+	}
+}
+
+func TestRecipeAvailable(t *testing.T) {
+	pizza := &Item{ID: "pizza", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}, {ItemID: "cheese", Quantity: 2}}}
+
+	tests := []struct {
+		name    string
+		stock   map[string]*Item
+		want    int32
+		wantErr error
+	}{
+		{"the scarcest ingredient", map[string]*Item{
+			"dough":  {ID: "dough", Quantity: 10},
+			"cheese": {ID: "cheese", Quantity: 7, Reserved: 2},
+		}, 2, nil},
+		{"an ingredient ran out", map[string]*Item{
+			"dough":  {ID: "dough", Quantity: 10},
+			"cheese": {ID: "cheese", Quantity: 1},
+		}, 0, nil},
+		{"an archived ingredient", map[string]*Item{
+			"dough":  {ID: "dough", Quantity: 10},
+			"cheese": {ID: "cheese", Quantity: 10, Archived: true},
+		}, 0, nil},
+		{"a missing ingredient", map[string]*Item{
+			"dough": {ID: "dough", Quantity: 10},
+		}, 0, ErrIngredientNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := recipeAvailable(pizza, tt.stock)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d units, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserveRecipeItems(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t,
+		&Item{ID: "dough", Name: "dough", PriceID: "p", Stock: stocked(5), IsIngredient: true},
+		&Item{ID: "cheese", Name: "cheese", PriceID: "p", Stock: stocked(6), IsIngredient: true},
+		&Item{ID: "pizza", Name: "pizza", PriceID: "p", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}, {ItemID: "cheese", Quantity: 2}}},
+	)
+
+	if _, _, err := s.ReserveItems(ctx, "o1", "", "", []*pb.ItemsWithQuantity{{ID: "pizza", Quantity: 2}}, time.Hour); err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+	for id, want := range map[string]int32{"dough": 2, "cheese": 4} {
+		i, err := s.store.GetItem(ctx, id)
+		if err != nil {
+			t.Fatalf("getting %s: %v", id, err)
+		}
+		if i.At(defaultLocationID).Reserved != want {
+			t.Errorf("%s has %d reserved, want %d", id, i.Reserved, want)
+		}
+	}
+
+	// one pizza is left in the cheese
+	if _, _, err := s.ReserveItems(ctx, "o2", "", "", []*pb.ItemsWithQuantity{{ID: "pizza", Quantity: 2}}, time.Hour); !errors.Is(err, common.ErrNoStock) {
+		t.Errorf("reserving more than the cheese allows returned %v, want %v", err, common.ErrNoStock)
+	}
+
+	// ingredients can't be ordered on their own
+	if _, _, err := s.ReserveItems(ctx, "o3", "", "", []*pb.ItemsWithQuantity{{ID: "dough", Quantity: 1}}, time.Hour); !errors.Is(err, common.ErrNoStock) {
+		t.Errorf("reserving an ingredient returned %v, want %v", err, common.ErrNoStock)
+	}
+
+	menu, err := s.GetMenu(ctx, "", "")
+	if err != nil {
+		t.Fatalf("getting the menu: %v", err)
+	}
+	if len(menu) != 1 || len(menu[0].Items) != 1 || menu[0].Items[0].ID != "pizza" || menu[0].Items[0].Quantity != 1 {
+		t.Errorf("got menu %+v, want one pizza and no ingredients", menu)
+	}
+
+	// an archived ingredient leaves nothing to make
+	if _, err := s.ArchiveItem(ctx, "cheese", "", "jane"); err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+	if menu, err = s.GetMenu(ctx, "", ""); err != nil {
+		t.Fatalf("getting the menu: %v", err)
+	}
+	if len(menu) != 1 || menu[0].Items[0].Quantity != 0 {
+		t.Errorf("got menu %+v, want the pizza with none left", menu)
+	}
+}
+
+func TestValidateRecipe(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t,
+		&Item{ID: "dough", Name: "dough", PriceID: "p", Stock: stocked(5), IsIngredient: true},
+		&Item{ID: "pizza", Name: "pizza", PriceID: "p", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}}},
+	)
+
+	tests := []struct {
+		name string
+		item *Item
+	}{
+		{"an ingredient with a recipe", &Item{IsIngredient: true, Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}}}},
+		{"stock of its own", &Item{Quantity: 3, Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}}}},
+		{"itself as an ingredient", &Item{Recipe: []*ItemQuantity{{ItemID: "calzone", Quantity: 1}}}},
+		{"no quantity", &Item{Recipe: []*ItemQuantity{{ItemID: "dough"}}}},
+		{"a duplicated ingredient", &Item{Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 1}, {ItemID: "dough", Quantity: 1}}}},
+		{"an unknown ingredient", &Item{Recipe: []*ItemQuantity{{ItemID: "flour", Quantity: 1}}}},
+		{"a nested recipe", &Item{Recipe: []*ItemQuantity{{ItemID: "pizza", Quantity: 1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.item.ID, tt.item.Name, tt.item.PriceID = "calzone", "calzone", "p"
+			if _, err := s.CreateItem(ctx, tt.item, "jane"); !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("creating returned %v, want %v", err, ErrInvalidArgument)
+			}
+		})
+	}
+
+	calzone := &Item{ID: "calzone", Name: "calzone", PriceID: "p", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 2}}}
+	if _, err := s.CreateItem(ctx, calzone, "jane"); err != nil {
+		t.Errorf("creating a valid recipe item: %v", err)
+	}
+}
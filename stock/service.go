@@ -2,56 +2,812 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
 
+	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/stock/gateway"
 )
 
+const (
+	defaultReservationTTL = 30 * time.Minute
+	defaultPageSize       = 20
+	maxPageSize           = 100
+)
+
+// menuCategoryOther groups the menu items that have no category.
+const menuCategoryOther = "Other"
+
 type Service struct {
-	store StockStore
+	store   StockStore
+	gateway gateway.OrdersGateway
+	alerts  AlertPublisher
+	changes ChangePublisher
+	// timeZone is the time zone the availability windows are read in.
+	timeZone *time.Location
+	hub      *stockHub
 }
 
-func NewService(store StockStore) *Service {
-	return &Service{store}
+func NewService(store StockStore, gateway gateway.OrdersGateway, alerts AlertPublisher, changes ChangePublisher, timeZone *time.Location) *Service {
+	return &Service{store, gateway, alerts, changes, timeZone, newStockHub()}
 }
 
-func (s *Service) CheckIfItemAreInStock(ctx context.Context, p []*pb.ItemsWithQuantity) (bool, []*pb.Item, error) {
-	itemIDs := make([]string, 0)
-	for _, item := range p {
+func (s *Service) CheckIfItemAreInStock(ctx context.Context, locationID, channel string, p []*pb.ItemsWithQuantity) (*StockCheck, error) {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := mergeItemsQuantities(p)
+
+	itemIDs := make([]string, 0, len(merged))
+	for _, item := range merged {
 		itemIDs = append(itemIDs, item.ID)
 	}
 
-	itemsInStock, err := s.store.GetItems(ctx, itemIDs)
+	itemsInStock, err := s.itemsAt(ctx, locationID, itemIDs)
 	if err != nil {
-		return false, nil, err
+		return nil, err
 	}
 
-	// Check if all items are in stock
-	for _, stockItem := range itemsInStock {
-		for _, reqItem := range p {
-			if stockItem.ID == reqItem.ID && stockItem.Quantity < reqItem.Quantity {
-				return false, itemsInStock, nil
+	itemsInStock, err = s.withPrices(ctx, channel, itemsInStock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if all items are in stock, items with a recipe are when their
+	// ingredients are
+	lines, err := s.checkLines(ctx, locationID, itemsInStock, merged, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range lines {
+		if l.Reason != "" {
+			return &StockCheck{InStock: false, Items: toProtoItems(itemsInStock), Lines: lines}, nil
+		}
+	}
+
+	return &StockCheck{InStock: true, Items: orderedItems(itemsInStock, p), Lines: lines}, nil
+}
+
+// ReserveItems holds the requested quantities for an order until the
+// reservation is committed, released or reaches its expiry.
+// The order items come back with the prices that apply at this point, which
+// are the prices the order is charged.
+func (s *Service) ReserveItems(ctx context.Context, orderID, locationID, channel string, p []*pb.ItemsWithQuantity, ttl time.Duration) (*Reservation, []*pb.Item, error) {
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	merged := mergeItemsQuantities(p)
+
+	itemIDs := make([]string, 0, len(merged))
+	for _, item := range merged {
+		itemIDs = append(itemIDs, item.ID)
+	}
+
+	itemsInStock, err := s.itemsAt(ctx, locationID, itemIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(itemsInStock) < len(merged) {
+		// unknown items have no stock to hold
+		return nil, nil, s.stockCheckError(ctx, locationID, itemsInStock, merged, nil)
+	}
+
+	itemsInStock, err = s.withPrices(ctx, channel, itemsInStock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	for _, i := range itemsInStock {
+		if !orderable(i, now.In(s.timeZone)) {
+			return nil, nil, s.stockCheckError(ctx, locationID, itemsInStock, merged, nil)
+		}
+	}
+
+	// the reservation holds the ingredients of the items with a recipe
+	r := &Reservation{
+		OrderID:    orderID,
+		LocationID: locationID,
+		Items:      stockLines(itemsInStock, merged),
+		Status:     ReservationActive,
+		ExpiresAt:  now.Add(ttl),
+		CreatedAt:  now,
+	}
+
+	before, err := s.store.Reserve(ctx, r)
+	var shortage *ShortageError
+	if errors.As(err, &shortage) {
+		return nil, nil, s.stockCheckError(ctx, locationID, itemsInStock, merged, shortage)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	s.raiseAlerts(ctx, locationID, before, r.Items)
+	s.stockChanged(ctx, locationID, itemQuantityIDs(r.Items)...)
+
+	return r, orderedItems(itemsInStock, merged), nil
+}
+
+// stockCheckError is the error of a refused reservation, with the result of
+// each line.
+func (s *Service) stockCheckError(ctx context.Context, locationID string, itemsInStock []*Item, merged []*pb.ItemsWithQuantity, shortage *ShortageError) error {
+	lines, err := s.checkLines(ctx, locationID, itemsInStock, merged, shortage)
+	if err != nil {
+		return err
+	}
+
+	return &StockCheckError{Lines: lines}
+}
+
+func (s *Service) CommitOrder(ctx context.Context, o *pb.Order) error {
+	err := s.store.CloseReservation(ctx, o.ID, ReservationCommitted)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrReservationNotFound) && !errors.Is(err, ErrReservationClosed) {
+		return err
+	}
+
+	if errors.Is(err, ErrReservationClosed) {
+		r, err := s.store.GetReservation(ctx, o.ID)
+		if err != nil {
+			return err
+		}
+		if r.Status == ReservationCommitted {
+			// redelivered event, the stock was already taken out
+			return nil
+		}
+	}
+
+	// The reservation expired or was released before the payment arrived,
+	// so the items are looked up on the order and taken out directly.
+	order, err := s.gateway.GetOrder(ctx, o.ID, o.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	merged := mergeOrderItems(order.Items)
+	itemIDs := make([]string, 0, len(merged))
+	for _, i := range merged {
+		itemIDs = append(itemIDs, i.ID)
+	}
+
+	ordered, err := s.store.GetItems(ctx, itemIDs)
+	if err != nil {
+		return err
+	}
+	items := stockLines(ordered, merged)
+
+	// orders placed before there were locations have none
+	locationID := order.LocationID
+	if locationID == "" {
+		locationID = defaultLocationID
+	}
+
+	before, err := s.store.Sell(ctx, o.ID, locationID, items)
+	if errors.Is(err, ErrAlreadySold) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.raiseAlerts(ctx, locationID, before, items)
+	s.stockChanged(ctx, locationID, itemQuantityIDs(items)...)
+
+	log.Printf("Order %s was paid without an active reservation, stock taken out directly", o.ID)
+	return nil
+}
+
+func (s *Service) ReleaseReservation(ctx context.Context, orderID string) error {
+	if err := s.store.CloseReservation(ctx, orderID, ReservationReleased); err != nil {
+		return err
+	}
+	s.reservationClosed(ctx, orderID)
+
+	return nil
+}
+
+func (s *Service) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	expired, err := s.store.ExpiredReservations(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	locations := make(map[string]bool)
+	defer func() {
+		for locationID := range locations {
+			s.notifyWaitlists(ctx, locationID)
+		}
+	}()
+
+	for _, r := range expired {
+		err := s.store.CloseReservation(ctx, r.OrderID, ReservationExpired)
+		if errors.Is(err, ErrReservationClosed) {
+			// committed or released since it was listed
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+		s.stockChanged(ctx, r.LocationID, itemQuantityIDs(r.Items)...)
+		locations[r.LocationID] = true
+		released++
+	}
+
+	return released, nil
+}
+
+func (s *Service) GetItems(ctx context.Context, locationID, channel string, ids []string) ([]*pb.Item, error) {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.itemsAt(ctx, locationID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = s.withRecipeQuantities(ctx, locationID, items)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err = s.withPrices(ctx, channel, items)
+	if err != nil {
+		return nil, err
+	}
+
+	return toProtoItems(items), nil
+}
+
+func (s *Service) ListMovements(ctx context.Context, itemID, locationID string, pageSize int, pageToken string) (*MovementsPage, error) {
+	if _, err := s.store.GetItem(ctx, itemID); err != nil {
+		return nil, err
+	}
+	if locationID != "" {
+		if _, err := s.store.GetLocation(ctx, locationID); err != nil {
+			return nil, err
+		}
+	}
+
+	pageSize = normalizePageSize(pageSize)
+
+	movements, err := s.store.ListMovements(ctx, itemID, locationID, pageSize, pageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	onHand, _, err := s.store.LedgerBalance(ctx, itemID, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MovementsPage{Movements: movements, OnHand: onHand}
+	if len(movements) == pageSize {
+		page.NextPageToken = movements[len(movements)-1].ID
+	}
+
+	return page, nil
+}
+
+func (s *Service) CreateItem(ctx context.Context, i *Item, actor string) (*Item, error) {
+	if i.ID == "" {
+		return nil, fmt.Errorf("%w: item ID is required", ErrInvalidArgument)
+	}
+	if err := validateItemDetails(i); err != nil {
+		return nil, err
+	}
+	if i.Quantity < 0 {
+		return nil, fmt.Errorf("%w: quantity cannot be negative", ErrInvalidArgument)
+	}
+	if err := s.validateRecipe(ctx, i); err != nil {
+		return nil, err
+	}
+
+	locationID, err := s.resolveLocation(ctx, i.LocationID)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Item{
+		ID:               i.ID,
+		Name:             i.Name,
+		PriceID:          i.PriceID,
+		Stock:            map[string]*StockLevel{locationID: {Quantity: i.Quantity}},
+		Category:         i.Category,
+		Description:      i.Description,
+		ImageURL:         i.ImageURL,
+		Allergens:        i.Allergens,
+		SortOrder:        i.SortOrder,
+		Availability:     i.Availability,
+		ReorderThreshold: i.ReorderThreshold,
+		Recipe:           i.Recipe,
+		IsIngredient:     i.IsIngredient,
+	}
+	if err := s.store.CreateItem(ctx, item, actor); err != nil {
+		return nil, err
+	}
+
+	s.stockChanged(ctx, "", item.ID)
+
+	return item.At(locationID), nil
+}
+
+func (s *Service) UpdateItem(ctx context.Context, i *Item, fields []string, locationID, actor string) (*Item, error) {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 {
+		for _, f := range fields {
+			if _, ok := itemFields[f]; !ok {
+				return nil, fmt.Errorf("%w: item field %q can't be updated", ErrInvalidArgument, f)
 			}
 		}
+
+		// the fields left out are validated as they are stored
+		current, err := s.store.GetItem(ctx, i.ID)
+		if err != nil {
+			return nil, err
+		}
+		i = mergeItem(current, i, fields)
+	}
+
+	if err := validateItemDetails(i); err != nil {
+		return nil, err
+	}
+	if err := s.validateRecipe(ctx, i); err != nil {
+		return nil, err
+	}
+	if len(i.Recipe) > 0 {
+		current, err := s.store.GetItem(ctx, i.ID)
+		if err != nil {
+			return nil, err
+		}
+		if current.Stocked() {
+			return nil, fmt.Errorf("%w: take item %s out of stock before giving it a recipe", ErrInvalidArgument, i.ID)
+		}
 	}
 
-	// create items with prices from stock
+	updated, err := s.store.UpdateItem(ctx, i, fields, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stockChanged(ctx, "", i.ID)
+
+	return updated.At(locationID), nil
+}
+
+func (s *Service) ArchiveItem(ctx context.Context, id, locationID, actor string) (*Item, error) {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.ArchiveItem(ctx, id, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stockChanged(ctx, "", id)
+
+	return i.At(locationID), nil
+}
+
+func (s *Service) AdjustQuantity(ctx context.Context, itemID, locationID string, t MovementType, delta int32, reason, actor string) (*Item, error) {
+	switch {
+	case delta == 0:
+		return nil, fmt.Errorf("%w: delta cannot be zero", ErrInvalidArgument)
+	case t == MovementRestock && delta < 0:
+		return nil, fmt.Errorf("%w: a restock must add quantity", ErrInvalidArgument)
+	case t == MovementWaste && delta > 0:
+		return nil, fmt.Errorf("%w: waste must remove quantity", ErrInvalidArgument)
+	case t != MovementRestock && t != MovementWaste && t != MovementAdjustment:
+		return nil, fmt.Errorf("%w: unsupported adjustment type %q", ErrInvalidArgument, t)
+	case t != MovementRestock && reason == "":
+		return nil, fmt.Errorf("%w: a reason is required for %s", ErrInvalidArgument, t)
+	case actor == "":
+		return nil, fmt.Errorf("%w: actor is required", ErrInvalidArgument)
+	}
+
+	current, err := s.store.GetItem(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if len(current.Recipe) > 0 {
+		return nil, fmt.Errorf("%w: item %s is stocked through its ingredients", ErrInvalidArgument, itemID)
+	}
+
+	locationID, err = s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := s.store.AdjustQuantity(ctx, NewMovement(itemID, locationID, t, delta, 0, reason, actor, ""))
+	if err != nil {
+		return nil, err
+	}
+	if delta < 0 {
+		// the item comes back as the adjustment left it
+		before := copyItem(i).At(locationID)
+		before.Quantity -= delta
+		s.raiseAlerts(ctx, locationID, []*Item{before}, []*ItemQuantity{{ItemID: itemID, Quantity: -delta}})
+	}
+	s.stockChanged(ctx, locationID, itemID)
+	if delta > 0 {
+		s.notifyWaitlists(ctx, locationID)
+	}
+
+	return i.At(locationID), nil
+}
+
+func (s *Service) ListItems(ctx context.Context, locationID string, pageSize int, pageToken string, includeArchived bool) (*ItemsPage, error) {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize = normalizePageSize(pageSize)
+
+	items, err := s.store.ListItems(ctx, pageSize, pageToken, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range items {
+		i.At(locationID)
+	}
+
+	items, err = s.withRecipeQuantities(ctx, locationID, items)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ItemsPage{Items: items}
+	if len(items) == pageSize {
+		page.NextPageToken = items[len(items)-1].ID
+	}
+
+	return page, nil
+}
+
+// GetMenu pages through every active item and keeps the ones inside one of
+// their availability windows. Categories and the items in them are sorted by
+// sort order, then by name.
+func (s *Service) GetMenu(ctx context.Context, locationID, channel string) ([]*MenuCategory, error) {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// archived items are listed too, they are left off the menu but make
+	// the recipes using them unavailable
+	items, err := s.allItems(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range items {
+		i.At(locationID)
+	}
+
+	// ingredients are listed too, so the units of the items with a recipe
+	// are worked out from the same page of stock
+	stock := make(map[string]*Item, len(items))
+	for _, i := range items {
+		c := *i
+		stock[i.ID] = &c
+	}
+
+	// the menu is priced at the same time its availability is checked
+	now := s.now()
+	active, err := s.priceListsFor(ctx, channel, now)
+	if err != nil {
+		return nil, err
+	}
+
+	categories := make(map[string]*MenuCategory)
+	for _, i := range items {
+		if !orderable(i, now) {
+			continue
+		}
+
+		name := i.Category
+		if name == "" {
+			name = menuCategoryOther
+		}
+		c, ok := categories[name]
+		if !ok {
+			c = &MenuCategory{Name: name}
+			categories[name] = c
+		}
+
+		// the menu shows what can still be ordered, not what is on hand
+		if len(i.Recipe) > 0 {
+			var err error
+			if i.Quantity, err = recipeAvailable(i, stock); err != nil {
+				return nil, err
+			}
+		} else {
+			i.Quantity = max(i.Available(), 0)
+		}
+		c.Items = append(c.Items, i)
+	}
+
+	menu := make([]*MenuCategory, 0, len(categories))
+	for _, c := range categories {
+		applyPrices(active, c.Items)
+
+		sort.Slice(c.Items, func(a, b int) bool {
+			return lessItem(c.Items[a], c.Items[b])
+		})
+		menu = append(menu, c)
+	}
+	sort.Slice(menu, func(a, b int) bool {
+		// categories follow their first item
+		if menu[a].Items[0].SortOrder != menu[b].Items[0].SortOrder {
+			return menu[a].Items[0].SortOrder < menu[b].Items[0].SortOrder
+		}
+		return menu[a].Name < menu[b].Name
+	})
+
+	return menu, nil
+}
+
+func (s *Service) ListLocations(ctx context.Context) ([]*Location, error) {
+	return s.store.ListLocations(ctx)
+}
+
+// FindFulfillmentLocations checks the basket at every location. Without an
+// origin the candidates are sorted by location ID.
+func (s *Service) FindFulfillmentLocations(ctx context.Context, p []*pb.ItemsWithQuantity, origin *Coordinates) ([]*FulfillmentOption, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, common.ErrNoItems)
+	}
+
+	locations, err := s.store.ListLocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var options []*FulfillmentOption
+	for _, l := range locations {
+		check, err := s.CheckIfItemAreInStock(ctx, l.ID, "", p)
+		if err != nil {
+			return nil, err
+		}
+		if !check.InStock {
+			continue
+		}
+
+		option := &FulfillmentOption{Location: l}
+		if origin != nil && l.Coordinates != nil {
+			option.DistanceKm = distanceKm(origin, l.Coordinates)
+		}
+		options = append(options, option)
+	}
+
+	if origin != nil {
+		// locations without coordinates can't be ranked, they go last
+		sort.SliceStable(options, func(a, b int) bool {
+			la, lb := options[a].Location, options[b].Location
+			if (la.Coordinates == nil) != (lb.Coordinates == nil) {
+				return lb.Coordinates == nil
+			}
+			return options[a].DistanceKm < options[b].DistanceKm
+		})
+	}
+
+	return options, nil
+}
+
+func (s *Service) ListPriceLists(ctx context.Context) ([]*PriceList, error) {
+	return s.store.ListPriceLists(ctx)
+}
+
+func (s *Service) PutPriceList(ctx context.Context, l *PriceList) (*PriceList, error) {
+	if err := l.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	ids := make([]string, 0, len(l.Prices))
+	for _, p := range l.Prices {
+		ids = append(ids, p.ItemID)
+	}
+	items, err := s.store.GetItems(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		found := false
+		for _, i := range items {
+			if i.ID == id {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: price list %s prices the unknown item %s", ErrInvalidArgument, l.ID, id)
+		}
+	}
+
+	if err := s.store.PutPriceList(ctx, l); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (s *Service) DeletePriceList(ctx context.Context, id string) error {
+	return s.store.DeletePriceList(ctx, id)
+}
+
+// resolveLocation returns the default location for an empty ID, and checks
+// that any other location exists.
+func (s *Service) resolveLocation(ctx context.Context, locationID string) (string, error) {
+	if locationID == "" {
+		return defaultLocationID, nil
+	}
+	if _, err := s.store.GetLocation(ctx, locationID); err != nil {
+		return "", err
+	}
+
+	return locationID, nil
+}
+
+// reservationClosed tells the watchers and the waitlists that the stock held
+// by a reservation is available again.
+func (s *Service) reservationClosed(ctx context.Context, orderID string) {
+	r, err := s.store.GetReservation(ctx, orderID)
+	if err != nil {
+		log.Printf("Failed to get the released reservation of order %s: %v", orderID, err)
+		return
+	}
+
+	s.stockChanged(ctx, r.LocationID, itemQuantityIDs(r.Items)...)
+	s.notifyWaitlists(ctx, r.LocationID)
+}
+
+// itemsAt gets items from the store viewed at a location.
+func (s *Service) itemsAt(ctx context.Context, locationID string, ids []string) ([]*Item, error) {
+	items, err := s.store.GetItems(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range items {
+		i.At(locationID)
+	}
+
+	return items, nil
+}
+
+// orderable reports whether customers can order the item at the given time,
+// leaving its stock aside.
+func orderable(i *Item, t time.Time) bool {
+	return !i.Archived && !i.IsIngredient && i.AvailableAt(t)
+}
+
+func (s *Service) now() time.Time {
+	return time.Now().In(s.timeZone)
+}
+
+func lessItem(a, b *Item) bool {
+	if a.SortOrder != b.SortOrder {
+		return a.SortOrder < b.SortOrder
+	}
+	return a.Name < b.Name
+}
+
+func validateItemDetails(i *Item) error {
+	if i.Name == "" {
+		return fmt.Errorf("%w: item name is required", ErrInvalidArgument)
+	}
+	if i.PriceID == "" && !i.IsIngredient {
+		return fmt.Errorf("%w: item price ID is required", ErrInvalidArgument)
+	}
+	if i.ReorderThreshold < 0 {
+		return fmt.Errorf("%w: reorder threshold cannot be negative", ErrInvalidArgument)
+	}
+	for _, w := range i.Availability {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+	}
+
+	return nil
+}
+
+func normalizePageSize(pageSize int) int {
+	if pageSize <= 0 {
+		return defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		return maxPageSize
+	}
+
+	return pageSize
+}
+
+func lineItemIDs(lines []*ItemQuantity) []string {
+	ids := make([]string, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ItemID)
+	}
+
+	return ids
+}
+
+func toProtoItems(items []*Item) []*pb.Item {
+	res := make([]*pb.Item, 0, len(items))
+	for _, i := range items {
+		res = append(res, i.ToProto())
+	}
+
+	return res
+}
+
+// orderedItems creates the order items with the prices from stock and the
+// requested quantities.
+func orderedItems(itemsInStock []*Item, p []*pb.ItemsWithQuantity) []*pb.Item {
 	items := make([]*pb.Item, 0)
 	for _, stockItem := range itemsInStock {
 		for _, reqItem := range p {
 			if stockItem.ID == reqItem.ID {
 				items = append(items, &pb.Item{
-					ID:       stockItem.ID,
-					Name:     stockItem.Name,
-					PriceID:  stockItem.PriceID,
-					Quantity: reqItem.Quantity,
+					ID:          stockItem.ID,
+					Name:        stockItem.Name,
+					PriceID:     stockItem.PriceID,
+					Quantity:    reqItem.Quantity,
+					PriceListID: stockItem.PriceListID,
 				})
 			}
 		}
 	}
 
-	return true, items, nil
+	return items
 }
 
-func (s *Service) GetItems(ctx context.Context, ids []string) ([]*pb.Item, error) {
-	return s.store.GetItems(ctx, ids)
+func mergeOrderItems(items []*pb.Item) []*pb.ItemsWithQuantity {
+	p := make([]*pb.ItemsWithQuantity, 0, len(items))
+	for _, i := range items {
+		p = append(p, &pb.ItemsWithQuantity{ID: i.ID, Quantity: i.Quantity})
+	}
+
+	return mergeItemsQuantities(p)
+}
+
+func mergeItemsQuantities(items []*pb.ItemsWithQuantity) []*pb.ItemsWithQuantity {
+	merged := make([]*pb.ItemsWithQuantity, 0)
+
+	for _, item := range items {
+		found := false
+		for _, finalItem := range merged {
+			if finalItem.ID == item.ID {
+				finalItem.Quantity += item.Quantity
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			merged = append(merged, &pb.ItemsWithQuantity{ID: item.ID, Quantity: item.Quantity})
+		}
+	}
+
+	return merged
 }
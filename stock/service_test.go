@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// alertRecorder keeps the alerts and back in stock events published to it.
+type alertRecorder struct {
+	sync.Mutex
+	alerts      []string
+	backInStock []*pb.BackInStock
+}
+
+func (r *alertRecorder) PublishAlert(ctx context.Context, event string, a *pb.StockAlert) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.alerts = append(r.alerts, event+" "+a.ItemID)
+	return nil
+}
+
+func (r *alertRecorder) PublishBackInStock(ctx context.Context, b *pb.BackInStock) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.backInStock = append(r.backInStock, b)
+	return nil
+}
+
+// localChanges hands stock changes straight back to the service, as the
+// change consumer of a single instance would.
+type localChanges struct {
+	s *Service
+}
+
+func (c *localChanges) PublishChange(ctx context.Context, change *StockChange) error {
+	c.s.StockChanged(ctx, change)
+	return nil
+}
+
+// newTestService returns a service on a new file store seeded with items.
+func newTestService(t *testing.T, items ...*Item) *Service {
+	t.Helper()
+
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "stock.db.json"))
+	if err != nil {
+		t.Fatalf("opening the file store: %v", err)
+	}
+	if _, err := store.Seed(context.Background(), items); err != nil {
+		t.Fatalf("seeding: %v", err)
+	}
+
+	changes := &localChanges{}
+	changes.s = NewService(store, nil, &alertRecorder{}, changes, time.UTC)
+
+	return changes.s
+}
+
+// stocked is the stock of an item holding quantity at the default location.
+func stocked(quantity int32) map[string]*StockLevel {
+	return map[string]*StockLevel{defaultLocationID: {Quantity: quantity}}
+}
+
+func TestUpdateItemFields(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t, &Item{ID: "burger", Name: "burger", PriceID: "price_burger", Category: "Mains", Stock: stocked(5)})
+
+	breakfast := []*AvailabilityWindow{{Start: "07:00", End: "11:00"}}
+	i, err := s.UpdateItem(ctx, &Item{ID: "burger", Availability: breakfast}, []string{"Availability"}, "", "jane")
+	if err != nil {
+		t.Fatalf("updating the availability: %v", err)
+	}
+	if i.Name != "burger" || i.PriceID != "price_burger" || i.Category != "Mains" || len(i.Availability) != 1 || i.Quantity != 5 {
+		t.Errorf("got %+v, want the new availability and every other field kept", i)
+	}
+
+	_, err = s.UpdateItem(ctx, &Item{ID: "burger", Quantity: 50}, []string{"Quantity"}, "", "jane")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("updating the quantity returned %v, want %v", err, ErrInvalidArgument)
+	}
+
+	// the merged item is validated as a whole
+	_, err = s.UpdateItem(ctx, &Item{ID: "burger"}, []string{"Name"}, "", "jane")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("clearing the name returned %v, want %v", err, ErrInvalidArgument)
+	}
+
+	// without fields the update replaces every catalog field
+	i, err = s.UpdateItem(ctx, &Item{ID: "burger", Name: "cheeseburger", PriceID: "price_2"}, nil, "", "jane")
+	if err != nil {
+		t.Fatalf("replacing: %v", err)
+	}
+	if i.Category != "" || len(i.Availability) != 0 || i.Quantity != 5 {
+		t.Errorf("got %+v, want the catalog fields cleared and the quantity kept", i)
+	}
+}
+
+func TestGetMenu(t *testing.T) {
+	now := time.Now().UTC()
+	later := AvailabilityWindow{Start: now.Add(time.Hour).Format("15:04"), End: now.Add(2 * time.Hour).Format("15:04")}
+
+	s := newTestService(t,
+		&Item{ID: "fries", Name: "fries", PriceID: "p", Category: "Sides", SortOrder: 2, Stock: stocked(3)},
+		&Item{ID: "burger", Name: "burger", PriceID: "p", Category: "Mains", SortOrder: 1, Stock: stocked(5)},
+		&Item{ID: "cheeseburger", Name: "cheeseburger", PriceID: "p", Category: "Mains", SortOrder: 1, Stock: stocked(0)},
+		&Item{ID: "water", Name: "water", PriceID: "p", SortOrder: 3, Stock: stocked(9)},
+		&Item{ID: "pancakes", Name: "pancakes", PriceID: "p", Category: "Mains", Stock: stocked(4), Availability: []*AvailabilityWindow{&later}},
+		&Item{ID: "old", Name: "old", PriceID: "p", Category: "Mains", Stock: stocked(4)},
+	)
+	ctx := context.Background()
+	if _, err := s.ArchiveItem(ctx, "old", "", "jane"); err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+	// the menu shows what can still be ordered
+	r := &Reservation{OrderID: "o1", LocationID: defaultLocationID, Items: []*ItemQuantity{{ItemID: "burger", Quantity: 2}}, Status: ReservationActive, ExpiresAt: now.Add(time.Hour)}
+	if _, err := s.store.Reserve(ctx, r); err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+
+	menu, err := s.GetMenu(ctx, "", "")
+	if err != nil {
+		t.Fatalf("getting the menu: %v", err)
+	}
+
+	type entry struct {
+		category, item string
+		quantity       int32
+	}
+	var got []entry
+	for _, c := range menu {
+		for _, i := range c.Items {
+			got = append(got, entry{c.Name, i.ID, i.Quantity})
+		}
+	}
+	want := []entry{
+		{"Mains", "burger", 3},
+		{"Mains", "cheeseburger", 0},
+		{"Sides", "fries", 3},
+		{menuCategoryOther, "water", 9},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got menu %v, want %v", got, want)
+	}
+	for n := range want {
+		if got[n] != want[n] {
+			t.Errorf("got menu %v, want %v", got, want)
+			break
+		}
+	}
+}
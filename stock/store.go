@@ -2,51 +2,1139 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"time"
 
-	pb "github.com/scuba13/oms/common/api"
+	common "github.com/scuba13/oms/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type Store struct {
-	stock map[string]*pb.Item
-}
-
-func NewStore() *Store {
-	return &Store{
-		stock: map[string]*pb.Item{
-			"2": {
-				ID:       "2",
-				Name:     "Potato Chips",
-				PriceID:  "price_1POfNkRwn3euj82DKWL4l8fb",
-				Quantity: 10,
-			},
-			"1": {
-				ID:       "1",
-				Name:     "Cheese Burger",
-				PriceID:  "price_1POfMZRwn3euj82DyisErgyS",
-				Quantity: 20,
-			},
+const (
+	DbName               = "stock"
+	CollName             = "items"
+	ReservationsCollName = "reservations"
+	SalesCollName        = "sales"
+	MovementsCollName    = "movements"
+	LocationsCollName    = "locations"
+	PriceListsCollName   = "price_lists"
+	WaitlistCollName     = "waitlist"
+)
+
+type store struct {
+	db *mongo.Client
+}
+
+func NewStore(db *mongo.Client) *store {
+	return &store{db}
+}
+
+func (s *store) GetItem(ctx context.Context, id string) (*Item, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	var i Item
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(&i)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, common.ErrItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (s *store) GetItems(ctx context.Context, ids []string) ([]*Item, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	cursor, err := col.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*Item
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) Seed(ctx context.Context, items []*Item) (int, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	inserted := 0
+	for _, i := range items {
+		i = copyItem(i)
+		i.CatalogRecipe = i.Recipe
+
+		// $setOnInsert leaves documents that already exist untouched
+		res, err := col.UpdateOne(ctx,
+			bson.M{"_id": i.ID},
+			bson.M{"$setOnInsert": i},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return inserted, err
+		}
+		if res.UpsertedCount > 0 {
+			inserted++
+
+			if err := s.record(ctx, stockMovements(i, "catalog seed", systemActor)...); err != nil {
+				return inserted, err
+			}
+			continue
+		}
+
+		// items seeded before the catalog recipe was kept start from the
+		// recipe they have
+		if _, err := col.UpdateOne(ctx,
+			bson.M{"_id": i.ID, "catalogRecipe": nil},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{"catalogRecipe": bson.M{"$ifNull": bson.A{"$recipe", bson.A{}}}}}}}); err != nil {
+			return inserted, err
+		}
+
+		res, err = col.UpdateOne(ctx,
+			bson.M{"_id": i.ID, "catalogRecipe": bson.M{"$ne": i.CatalogRecipe}},
+			bson.M{"$set": bson.M{"recipe": i.Recipe, "catalogRecipe": i.CatalogRecipe}})
+		if err != nil {
+			return inserted, err
+		}
+		if res.ModifiedCount > 0 {
+			if err := s.record(ctx, NewMovement(i.ID, "", MovementUpdate, 0, 0, "catalog recipe changed", systemActor, "")); err != nil {
+				return inserted, err
+			}
+		}
+
+		// locations the catalog added to the item are stocked, the others
+		// keep their quantities. Items without stock have a null stock
+		// field, which a $set of the location can't create a field in.
+		for _, locationID := range sortedLocationIDs(i.Stock) {
+			l := i.Stock[locationID]
+			res, err := col.UpdateOne(ctx,
+				bson.M{"_id": i.ID, "stock." + locationID: bson.M{"$exists": false}},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"stock": bson.M{"$mergeObjects": bson.A{
+					bson.M{"$ifNull": bson.A{"$stock", bson.M{}}},
+					bson.M{locationID: l},
+				}}}}}})
+			if err != nil {
+				return inserted, err
+			}
+			if res.ModifiedCount > 0 {
+				seeded := &Item{ID: i.ID, Stock: map[string]*StockLevel{locationID: l}}
+				if err := s.record(ctx, stockMovements(seeded, "catalog seed", systemActor)...); err != nil {
+					return inserted, err
+				}
+			}
+		}
+	}
+
+	return inserted, nil
+}
+
+func (s *store) Reserve(ctx context.Context, r *Reservation) ([]*Item, error) {
+	db := s.db.Database(DbName)
+
+	// The reservation document is inserted first so that a second attempt
+	// for the same order fails on the duplicated _id before touching stock.
+	if _, err := db.Collection(ReservationsCollName).InsertOne(ctx, r); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrReservationExists
+		}
+		return nil, err
+	}
+
+	// every item is tried before giving up, so the error names all the
+	// items that are short and not only the first one
+	held := make([]*ItemQuantity, 0, len(r.Items))
+	before := make([]*Item, 0, len(r.Items))
+	var short []string
+	for _, i := range r.Items {
+		item, err := s.holdItem(ctx, r, i)
+		if err != nil {
+			return nil, errors.Join(err, s.undoHold(ctx, r, held))
+		}
+		if item == nil {
+			short = append(short, i.ItemID)
+			continue
+		}
+		held = append(held, i)
+		before = append(before, item.At(r.LocationID))
+	}
+	if len(short) > 0 {
+		return nil, errors.Join(&ShortageError{ItemIDs: short}, s.undoHold(ctx, r, held))
+	}
+
+	movements := make([]*Movement, 0, len(r.Items))
+	for _, i := range r.Items {
+		movements = append(movements, NewMovement(i.ItemID, r.LocationID, MovementReservation, 0, i.Quantity, "order created", systemActor, r.OrderID))
+	}
+	if err := s.record(ctx, movements...); err != nil {
+		return nil, errors.Join(err, s.undoHold(ctx, r, held))
+	}
+
+	return before, nil
+}
+
+// holdItem increments the reserved quantity of an item at a location only
+// if the available quantity there covers the request. The condition and the
+// increment are evaluated by a single update, so concurrent reservations
+// cannot both take the last units. The order is added to the heldBy list of
+// the item, which tells the reservation items that hold stock apart from
+// the ones that don't. It returns the item as it was before the hold, or nil
+// when it can't be held.
+func (s *store) holdItem(ctx context.Context, r *Reservation, i *ItemQuantity) (*Item, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	var item Item
+	err := col.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":      i.ItemID,
+			"archived": bson.M{"$ne": true},
+			"heldBy":   bson.M{"$ne": r.OrderID},
+			"$expr": bson.M{"$gte": bson.A{
+				bson.M{"$subtract": bson.A{
+					bson.M{"$ifNull": bson.A{"$" + stockField(r.LocationID, "quantity"), 0}},
+					bson.M{"$ifNull": bson.A{"$" + stockField(r.LocationID, "reserved"), 0}},
+				}},
+				i.Quantity,
+			}},
+		},
+		bson.M{
+			"$inc":  bson.M{stockField(r.LocationID, "reserved"): i.Quantity},
+			"$push": bson.M{"heldBy": r.OrderID},
 		},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
 }
 
-func (s *Store) GetItem(ctx context.Context, id string) (*pb.Item, error) {
-	for _, item := range s.stock {
-		if item.ID == id {
-			return item, nil
+// undoHold gives back the items a failed reservation holds and deletes it.
+// When an item can't be given back the reservation is left active, so it
+// expires and the reservation sweep gives back what it still holds.
+func (s *store) undoHold(ctx context.Context, r *Reservation, held []*ItemQuantity) error {
+	db := s.db.Database(DbName)
+
+	var errs []error
+	for _, i := range held {
+		_, err := db.Collection(CollName).UpdateOne(ctx,
+			bson.M{"_id": i.ItemID, "heldBy": r.OrderID},
+			bson.M{
+				"$inc":  bson.M{stockField(r.LocationID, "reserved"): -i.Quantity},
+				"$pull": bson.M{"heldBy": r.OrderID},
+			})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("giving back item %s of order %s: %w", i.ItemID, r.OrderID, err))
 		}
 	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 
-	return nil, fmt.Errorf("item not found")
+	if _, err := db.Collection(ReservationsCollName).DeleteOne(ctx, bson.M{"_id": r.OrderID}); err != nil {
+		return fmt.Errorf("deleting the reservation of order %s: %w", r.OrderID, err)
+	}
+
+	return nil
 }
 
-func (s *Store) GetItems(ctx context.Context, ids []string) ([]*pb.Item, error) {
-	var res []*pb.Item
-	for _, id := range ids {
-		if i, ok := s.stock[id]; ok {
-			res = append(res, i)
+// CloseReservation claims the reservation for the status first, then
+// gives back or takes out each item it still holds, and only marks it
+// closed once every item is done. Each item is only changed while the order
+// is in its heldBy list, so a close that fails halfway is finished by
+// calling it again with the same status, without changing any item twice.
+func (s *store) CloseReservation(ctx context.Context, orderID string, status ReservationStatus) error {
+	db := s.db.Database(DbName)
+
+	var r Reservation
+	err := db.Collection(ReservationsCollName).FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":     orderID,
+			"status":  ReservationActive,
+			"closing": bson.M{"$in": closableBy(status)},
+		},
+		bson.M{"$set": bson.M{"closing": status}},
+	).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := s.GetReservation(ctx, orderID); err != nil {
+			return err
+		}
+		return ErrReservationClosed
+	}
+	if err != nil {
+		return err
+	}
+
+	movements := make([]*Movement, 0, len(r.Items))
+	for _, i := range r.Items {
+		m := closingMovement(&r, i, status)
+
+		_, err := db.Collection(CollName).UpdateOne(ctx,
+			bson.M{"_id": i.ItemID, "heldBy": orderID},
+			bson.M{
+				"$inc": bson.M{
+					stockField(r.LocationID, "quantity"): m.Quantity,
+					stockField(r.LocationID, "reserved"): m.Reserved,
+				},
+				"$pull": bson.M{"heldBy": orderID},
+			})
+		if err != nil {
+			return err
 		}
+		movements = append(movements, m)
+	}
+
+	// movements recorded by an earlier attempt are skipped by their key
+	if err := s.record(ctx, movements...); err != nil {
+		return err
+	}
+
+	_, err = db.Collection(ReservationsCollName).UpdateOne(ctx,
+		bson.M{"_id": orderID, "status": ReservationActive},
+		bson.M{
+			"$set":   bson.M{"status": status},
+			"$unset": bson.M{"closing": ""},
+		})
+	return err
+}
+
+// closableBy are the closing statuses a reservation can be closed with the
+// given status from. A release or an expiry can finish the other, as both
+// give the items back, while a commit only finishes a commit.
+func closableBy(status ReservationStatus) bson.A {
+	if status == ReservationCommitted {
+		return bson.A{nil, ReservationCommitted}
+	}
+
+	return bson.A{nil, ReservationReleased, ReservationExpired}
+}
+
+func (s *store) GetReservation(ctx context.Context, orderID string) (*Reservation, error) {
+	col := s.db.Database(DbName).Collection(ReservationsCollName)
+
+	var r Reservation
+	err := col.FindOne(ctx, bson.M{"_id": orderID}).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (s *store) ExpiredReservations(ctx context.Context, now time.Time) ([]*Reservation, error) {
+	col := s.db.Database(DbName).Collection(ReservationsCollName)
+
+	cursor, err := col.Find(ctx, bson.M{
+		"status":    ReservationActive,
+		"expiresAt": bson.M{"$lte": now},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*Reservation
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
 	}
 
 	return res, nil
 }
+
+// Sell records the sale as pending before touching stock, and only marks it
+// done once every item was taken out. Each item is only taken out while the
+// order is not in its soldTo list and enough of it is available, so a sale
+// that failed halfway is finished by calling it again, without taking any
+// item out twice. A sale that finds an item unknown or short gives back what
+// it took and is deleted.
+func (s *store) Sell(ctx context.Context, orderID, locationID string, items []*ItemQuantity) ([]*Item, error) {
+	db := s.db.Database(DbName)
+
+	sale := &Sale{
+		OrderID:    orderID,
+		LocationID: locationID,
+		Items:      items,
+		Pending:    true,
+		CreatedAt:  time.Now(),
+	}
+	_, err := db.Collection(SalesCollName).InsertOne(ctx, sale)
+	if mongo.IsDuplicateKeyError(err) {
+		sale = &Sale{}
+		if err := db.Collection(SalesCollName).FindOne(ctx, bson.M{"_id": orderID}).Decode(sale); err != nil {
+			return nil, err
+		}
+		if !sale.Pending {
+			return nil, ErrAlreadySold
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	itemIDs := make([]string, 0, len(sale.Items))
+	before := make([]*Item, 0, len(sale.Items))
+	movements := make([]*Movement, 0, len(sale.Items))
+	for _, i := range sale.Items {
+		item, err := s.takeItem(ctx, orderID, locationID, i)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			before = append(before, item.At(locationID))
+		} else {
+			// nothing matched: the item was taken out by an earlier attempt,
+			// or it is unknown or short
+			if err := s.checkTaken(ctx, orderID, i.ItemID); err != nil {
+				return nil, errors.Join(err, s.undoSale(ctx, sale))
+			}
+		}
+		itemIDs = append(itemIDs, i.ItemID)
+		movements = append(movements, NewMovement(i.ItemID, locationID, MovementSale, -i.Quantity, 0, "order paid", systemActor, orderID))
+	}
+
+	// movements of the items an earlier attempt took out are skipped by
+	// their key
+	if err := s.record(ctx, movements...); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Collection(SalesCollName).UpdateOne(ctx,
+		bson.M{"_id": orderID},
+		bson.M{"$unset": bson.M{"pending": ""}})
+	if err != nil {
+		return nil, err
+	}
+
+	// the sale is done, so the soldTo lists are no longer needed to tell
+	// which items were taken out
+	_, err = db.Collection(CollName).UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": itemIDs}},
+		bson.M{"$pull": bson.M{"soldTo": orderID}})
+	if err != nil {
+		log.Printf("Failed to clear the sale of order %s from its items: %v", orderID, err)
+	}
+
+	return before, nil
+}
+
+// takeItem decrements the quantity of an item at a location for a sale only
+// if the available quantity there covers it, and adds the order to its soldTo
+// list. It returns the item as it was before, or nil when it wasn't taken out.
+func (s *store) takeItem(ctx context.Context, orderID, locationID string, i *ItemQuantity) (*Item, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	var item Item
+	err := col.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":    i.ItemID,
+			"soldTo": bson.M{"$ne": orderID},
+			"$expr": bson.M{"$gte": bson.A{
+				bson.M{"$subtract": bson.A{
+					bson.M{"$ifNull": bson.A{"$" + stockField(locationID, "quantity"), 0}},
+					bson.M{"$ifNull": bson.A{"$" + stockField(locationID, "reserved"), 0}},
+				}},
+				i.Quantity,
+			}},
+		},
+		bson.M{
+			"$inc":  bson.M{stockField(locationID, "quantity"): -i.Quantity},
+			"$push": bson.M{"soldTo": orderID},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+// checkTaken tells why an item could not be taken out for a sale. It
+// returns nil when the order is in the soldTo list of the item, that is, an
+// earlier attempt of the sale took it out, and common.ErrItemNotFound or
+// common.ErrNoStock otherwise.
+func (s *store) checkTaken(ctx context.Context, orderID, itemID string) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	var item struct {
+		SoldTo []string `bson:"soldTo"`
+	}
+	err := col.FindOne(ctx, bson.M{"_id": itemID}).Decode(&item)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("%w: %s", common.ErrItemNotFound, itemID)
+	}
+	if err != nil {
+		return err
+	}
+	if slices.Contains(item.SoldTo, orderID) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", common.ErrNoStock, itemID)
+}
+
+// undoSale gives back the items a failed sale took out and deletes it, so
+// the order can be sold again once the stock is there.
+func (s *store) undoSale(ctx context.Context, sale *Sale) error {
+	db := s.db.Database(DbName)
+
+	var errs []error
+	for _, i := range sale.Items {
+		_, err := db.Collection(CollName).UpdateOne(ctx,
+			bson.M{"_id": i.ItemID, "soldTo": sale.OrderID},
+			bson.M{
+				"$inc":  bson.M{stockField(sale.LocationID, "quantity"): i.Quantity},
+				"$pull": bson.M{"soldTo": sale.OrderID},
+			})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("giving back item %s of order %s: %w", i.ItemID, sale.OrderID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if _, err := db.Collection(SalesCollName).DeleteOne(ctx, bson.M{"_id": sale.OrderID}); err != nil {
+		return fmt.Errorf("deleting the sale of order %s: %w", sale.OrderID, err)
+	}
+
+	return nil
+}
+
+func (s *store) ListMovements(ctx context.Context, itemID, locationID string, limit int, pageToken string) ([]*Movement, error) {
+	col := s.db.Database(DbName).Collection(MovementsCollName)
+
+	filter := bson.M{"itemID": itemID}
+	if locationID != "" {
+		filter["locationID"] = locationID
+	}
+	if pageToken != "" {
+		filter["_id"] = bson.M{"$lt": pageToken}
+	}
+
+	cursor, err := col.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"_id": -1}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*Movement
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) LedgerBalance(ctx context.Context, itemID, locationID string) (int32, int32, error) {
+	col := s.db.Database(DbName).Collection(MovementsCollName)
+
+	match := bson.M{"itemID": itemID}
+	if locationID != "" {
+		match["locationID"] = locationID
+	}
+
+	cursor, err := col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$itemID",
+			"quantity": bson.M{"$sum": "$quantity"},
+			"reserved": bson.M{"$sum": "$reserved"},
+		}}},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var res []struct {
+		Quantity int32 `bson:"quantity"`
+		Reserved int32 `bson:"reserved"`
+	}
+	if err := cursor.All(ctx, &res); err != nil {
+		return 0, 0, err
+	}
+	if len(res) == 0 {
+		return 0, 0, nil
+	}
+
+	return res[0].Quantity, res[0].Reserved, nil
+}
+
+func (s *store) CreateItem(ctx context.Context, i *Item, actor string) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	if _, err := col.InsertOne(ctx, i); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrItemExists
+		}
+		return err
+	}
+
+	return s.record(ctx, stockMovements(i, "item created", actor)...)
+}
+
+func (s *store) UpdateItem(ctx context.Context, i *Item, fields []string, actor string) (*Item, error) {
+	set := catalogFields(i)
+	if len(fields) > 0 {
+		// only the named fields are written, so concurrent updates of the
+		// other fields are kept
+		named := bson.M{}
+		for _, f := range fields {
+			named[itemFields[f]] = set[itemFields[f]]
+		}
+		set = named
+	}
+
+	updated, err := s.findAndUpdateItem(ctx, bson.M{"_id": i.ID}, bson.M{"$set": set})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, s.record(ctx, NewMovement(i.ID, "", MovementUpdate, 0, 0, "item updated", actor, ""))
+}
+
+func (s *store) ArchiveItem(ctx context.Context, id, actor string) (*Item, error) {
+	i, err := s.findAndUpdateItem(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"archived": true}})
+	if err != nil {
+		return nil, err
+	}
+
+	return i, s.record(ctx, NewMovement(id, "", MovementArchive, 0, 0, "item archived", actor, ""))
+}
+
+func (s *store) AdjustQuantity(ctx context.Context, m *Movement) (*Item, error) {
+	i, err := s.findAndUpdateItem(ctx,
+		bson.M{
+			"_id": m.ItemID,
+			"$expr": bson.M{"$gte": bson.A{
+				bson.M{"$add": bson.A{
+					bson.M{"$ifNull": bson.A{"$" + stockField(m.LocationID, "quantity"), 0}},
+					m.Quantity,
+				}},
+				bson.M{"$ifNull": bson.A{"$" + stockField(m.LocationID, "reserved"), 0}},
+			}},
+		},
+		bson.M{"$inc": bson.M{stockField(m.LocationID, "quantity"): m.Quantity}})
+	if errors.Is(err, common.ErrItemNotFound) {
+		// tell a missing item apart from a failed quantity condition
+		if _, err := s.GetItem(ctx, m.ItemID); err != nil {
+			return nil, err
+		}
+		return nil, ErrQuantityBelowReserved
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return i, s.record(ctx, m)
+}
+
+// ImportCatalog applies the changes one by one. The Mongo deployment of the
+// project is a standalone server without multi-document transactions, so
+// when a write fails the ones made before it are undone.
+func (s *store) ImportCatalog(ctx context.Context, changes []*CatalogChange) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	// Without transactions each item is written by a conditional update on
+	// the values the import was worked out from, and the items written before
+	// a refused one are put back the same way.
+	applied := make([]*CatalogChange, 0, len(changes))
+	err := func() error {
+		for _, c := range changes {
+			if c.Action == CatalogCreated {
+				if _, err := col.InsertOne(ctx, c.After); err != nil {
+					if mongo.IsDuplicateKeyError(err) {
+						return ErrItemExists
+					}
+					return err
+				}
+				applied = append(applied, c)
+				continue
+			}
+
+			if err := s.applyCatalogChange(ctx, c.ItemID, c.Before, c.After, c.Movements, 1); err != nil {
+				return err
+			}
+			applied = append(applied, c)
+		}
+
+		var movements []*Movement
+		for _, c := range changes {
+			movements = append(movements, c.Movements...)
+		}
+		return s.record(ctx, movements...)
+	}()
+	if err == nil {
+		return nil
+	}
+
+	errs := []error{err}
+	for idx := len(applied) - 1; idx >= 0; idx-- {
+		if undoErr := s.undoCatalogChange(ctx, applied[idx]); undoErr != nil {
+			errs = append(errs, fmt.Errorf("undo the import of item %s: %w", applied[idx].ItemID, undoErr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// applyCatalogChange turns the catalog fields of an item from one snapshot
+// into another and applies the stock movements, times sign. It fails with
+// ErrImportConflict when the stored fields are no longer the from snapshot,
+// and with ErrQuantityBelowReserved when the stock no longer fits.
+func (s *store) applyCatalogChange(ctx context.Context, itemID string, from, to *Item, movements []*Movement, sign int32) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	filter := catalogFilter(from)
+	filter["_id"] = itemID
+
+	fields := catalogFields(to)
+	fields["archived"] = to.Archived
+	update := bson.M{"$set": fields}
+
+	inc := bson.M{}
+	var fit bson.A
+	for _, m := range movements {
+		inc[stockField(m.LocationID, "quantity")] = sign * m.Quantity
+		fit = append(fit, bson.M{"$gte": bson.A{
+			bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$" + stockField(m.LocationID, "quantity"), 0}},
+				sign * m.Quantity,
+			}},
+			bson.M{"$ifNull": bson.A{"$" + stockField(m.LocationID, "reserved"), 0}},
+		}})
+	}
+	if len(fit) > 0 {
+		filter["$expr"] = bson.M{"$and": fit}
+		update["$inc"] = inc
+	}
+
+	res, err := col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	// tell a changed item from stock that no longer fits
+	i, err := s.GetItem(ctx, itemID)
+	if err != nil {
+		return err
+	}
+	if len(catalogDiff(i, from)) > 0 {
+		return fmt.Errorf("%w: %s", ErrImportConflict, itemID)
+	}
+
+	return ErrQuantityBelowReserved
+}
+
+// undoCatalogChange puts back an applied change, only while the item is
+// still as the import left it.
+func (s *store) undoCatalogChange(ctx context.Context, c *CatalogChange) error {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	if c.Action == CatalogCreated {
+		filter := catalogFilter(c.After)
+		filter["_id"] = c.ItemID
+		res, err := col.DeleteOne(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount == 0 {
+			return fmt.Errorf("%w: %s", ErrImportConflict, c.ItemID)
+		}
+		return nil
+	}
+
+	return s.applyCatalogChange(ctx, c.ItemID, c.After, c.Before, c.Movements, -1)
+}
+
+func (s *store) ListItems(ctx context.Context, limit int, pageToken string, includeArchived bool) ([]*Item, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	filter := bson.M{}
+	if pageToken != "" {
+		filter["_id"] = bson.M{"$gt": pageToken}
+	}
+	if !includeArchived {
+		filter["archived"] = bson.M{"$ne": true}
+	}
+
+	cursor, err := col.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*Item
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) SeedLocations(ctx context.Context, locations []*Location) (int, error) {
+	col := s.db.Database(DbName).Collection(LocationsCollName)
+
+	inserted := 0
+	for _, l := range locations {
+		res, err := col.UpdateOne(ctx,
+			bson.M{"_id": l.ID},
+			bson.M{"$setOnInsert": l},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return inserted, err
+		}
+		inserted += int(res.UpsertedCount)
+	}
+
+	return inserted, nil
+}
+
+func (s *store) GetLocation(ctx context.Context, id string) (*Location, error) {
+	col := s.db.Database(DbName).Collection(LocationsCollName)
+
+	var l Location
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(&l)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrLocationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+func (s *store) ListLocations(ctx context.Context) ([]*Location, error) {
+	col := s.db.Database(DbName).Collection(LocationsCollName)
+
+	cursor, err := col.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*Location
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) SeedPriceLists(ctx context.Context, lists []*PriceList) (int, error) {
+	col := s.db.Database(DbName).Collection(PriceListsCollName)
+
+	inserted := 0
+	for _, l := range lists {
+		res, err := col.UpdateOne(ctx,
+			bson.M{"_id": l.ID},
+			bson.M{"$setOnInsert": l},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return inserted, err
+		}
+		inserted += int(res.UpsertedCount)
+	}
+
+	return inserted, nil
+}
+
+func (s *store) PutPriceList(ctx context.Context, l *PriceList) error {
+	col := s.db.Database(DbName).Collection(PriceListsCollName)
+
+	_, err := col.ReplaceOne(ctx, bson.M{"_id": l.ID}, l, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *store) DeletePriceList(ctx context.Context, id string) error {
+	col := s.db.Database(DbName).Collection(PriceListsCollName)
+
+	res, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrPriceListNotFound
+	}
+
+	return nil
+}
+
+func (s *store) ListPriceLists(ctx context.Context) ([]*PriceList, error) {
+	col := s.db.Database(DbName).Collection(PriceListsCollName)
+
+	cursor, err := col.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*PriceList
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *store) JoinWaitlist(ctx context.Context, e *WaitlistEntry) error {
+	col := s.db.Database(DbName).Collection(WaitlistCollName)
+
+	_, err := col.ReplaceOne(ctx, bson.M{"_id": e.ID}, e, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *store) LeaveWaitlist(ctx context.Context, id string) error {
+	col := s.db.Database(DbName).Collection(WaitlistCollName)
+
+	res, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrWaitlistEntryNotFound
+	}
+
+	return nil
+}
+
+func (s *store) WaitlistedItems(ctx context.Context, locationID string) ([]string, error) {
+	col := s.db.Database(DbName).Collection(WaitlistCollName)
+
+	values, err := col.Distinct(ctx, "itemID", bson.M{"locationID": locationID})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// TakeWaitlist deletes the entries one by one, so two instances taking the
+// same waitlist never both get an entry.
+func (s *store) TakeWaitlist(ctx context.Context, itemID, locationID string) ([]*WaitlistEntry, error) {
+	col := s.db.Database(DbName).Collection(WaitlistCollName)
+
+	var taken []*WaitlistEntry
+	for {
+		var e WaitlistEntry
+		err := col.FindOneAndDelete(ctx, bson.M{"itemID": itemID, "locationID": locationID}).Decode(&e)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return taken, nil
+		}
+		if err != nil {
+			return taken, err
+		}
+		taken = append(taken, &e)
+	}
+}
+
+// migrateLegacyStock moves the quantities stored before there were
+// locations to the default location, and tags the reservations, sales and
+// movements of that time with it. It then records the opening balances the
+// ledger is missing, per location.
+func (s *store) migrateLegacyStock(ctx context.Context) error {
+	db := s.db.Database(DbName)
+
+	_, err := db.Collection(CollName).UpdateMany(ctx,
+		bson.M{"stock": bson.M{"$exists": false}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				stockField(defaultLocationID, "quantity"): bson.M{"$ifNull": bson.A{"$quantity", 0}},
+				stockField(defaultLocationID, "reserved"): bson.M{"$ifNull": bson.A{"$reserved", 0}},
+			}}},
+			{{Key: "$unset", Value: bson.A{"quantity", "reserved"}}},
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{ReservationsCollName, SalesCollName, MovementsCollName} {
+		_, err := db.Collection(name).UpdateMany(ctx,
+			bson.M{"locationID": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"locationID": defaultLocationID}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.migrateOpeningBalances(ctx)
+}
+
+func (s *store) findAndUpdateItem(ctx context.Context, filter, update bson.M) (*Item, error) {
+	col := s.db.Database(DbName).Collection(CollName)
+
+	var i Item
+	err := col.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&i)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, common.ErrItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// record appends movements to the ledger. Movements are never updated or
+// deleted once written. Movements whose key was already recorded are
+// skipped, so a retried change records its movements once.
+func (s *store) record(ctx context.Context, movements ...*Movement) error {
+	if len(movements) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, 0, len(movements))
+	for _, m := range movements {
+		docs = append(docs, m)
+	}
+
+	_, err := s.db.Database(DbName).Collection(MovementsCollName).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, e := range bulkErr.WriteErrors {
+			if !mongo.IsDuplicateKeyError(e) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return err
+}
+
+// migrateOpeningBalances records the opening balance of the items stocked
+// before there was a ledger, so their ledger adds up to their stock.
+func (s *store) migrateOpeningBalances(ctx context.Context) error {
+	db := s.db.Database(DbName)
+
+	cursor, err := db.Collection(MovementsCollName).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":      bson.M{"itemID": "$itemID", "locationID": "$locationID"},
+			"quantity": bson.M{"$sum": "$quantity"},
+			"reserved": bson.M{"$sum": "$reserved"},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var sums []struct {
+		ID struct {
+			ItemID     string `bson:"itemID"`
+			LocationID string `bson:"locationID"`
+		} `bson:"_id"`
+		Quantity int32 `bson:"quantity"`
+		Reserved int32 `bson:"reserved"`
+	}
+	if err := cursor.All(ctx, &sums); err != nil {
+		return err
+	}
+
+	balances := make(map[string]map[string]StockLevel)
+	for _, b := range sums {
+		if balances[b.ID.ItemID] == nil {
+			balances[b.ID.ItemID] = make(map[string]StockLevel)
+		}
+		balances[b.ID.ItemID][b.ID.LocationID] = StockLevel{Quantity: b.Quantity, Reserved: b.Reserved}
+	}
+
+	cursor, err = db.Collection(CollName).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	var items []*Item
+	if err := cursor.All(ctx, &items); err != nil {
+		return err
+	}
+
+	var movements []*Movement
+	for _, i := range items {
+		movements = append(movements, openingMovements(i, balances[i.ID])...)
+	}
+
+	return s.record(ctx, movements...)
+}
+
+// ensureIndexes creates the indexes the store relies on.
+func (s *store) ensureIndexes(ctx context.Context) error {
+	_, err := s.db.Database(DbName).Collection(MovementsCollName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"key": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// catalogFields are the fields of an item document an update may replace,
+// leaving its stock and archived flag alone.
+func catalogFields(i *Item) bson.M {
+	return bson.M{
+		"name":             i.Name,
+		"priceID":          i.PriceID,
+		"category":         i.Category,
+		"description":      i.Description,
+		"imageURL":         i.ImageURL,
+		"allergens":        i.Allergens,
+		"sortOrder":        i.SortOrder,
+		"availability":     i.Availability,
+		"reorderThreshold": i.ReorderThreshold,
+		"recipe":           i.Recipe,
+		"isIngredient":     i.IsIngredient,
+	}
+}
+
+// catalogFilter matches the items whose catalog fields and archived flag are
+// those of i. Empty values also match the fields left out of a document.
+func catalogFilter(i *Item) bson.M {
+	fields := catalogFields(i)
+	fields["archived"] = i.Archived
+
+	filter := bson.M{}
+	for field, value := range fields {
+		v := reflect.ValueOf(value)
+		if v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0) {
+			filter[field] = bson.M{"$in": bson.A{value, nil}}
+			continue
+		}
+		filter[field] = value
+	}
+
+	return filter
+}
+
+// stockField is the path of a stock level field of a location in an item
+// document.
+func stockField(locationID, field string) string {
+	return "stock." + locationID + "." + field
+}
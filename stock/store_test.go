@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFileStore(t *testing.T) {
+	testStockStore(t, func(t *testing.T) StockStore {
+		s, err := NewFileStore(filepath.Join(t.TempDir(), "stock.db.json"))
+		if err != nil {
+			t.Fatalf("opening the file store: %v", err)
+		}
+		return s
+	})
+}
+
+// TestFileStoreOpeningBalances opens a file written before there was a
+// ledger or locations, whose items are stocked without any movement.
+func TestFileStoreOpeningBalances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stock.db.json")
+	data := `{"items": {"burger": {"id": "burger", "name": "burger", "quantity": 5, "reserved": 2}}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("writing the store file: %v", err)
+	}
+
+	for range 2 {
+		s, err := NewFileStore(path)
+		if err != nil {
+			t.Fatalf("opening the file store: %v", err)
+		}
+
+		movements, err := s.ListMovements(context.Background(), "burger", "", 10, "")
+		if err != nil {
+			t.Fatalf("listing the movements: %v", err)
+		}
+		if len(movements) != 1 || movements[0].Type != MovementOpening || movements[0].LocationID != defaultLocationID ||
+			movements[0].Quantity != 5 || movements[0].Reserved != 2 {
+			t.Errorf("movements are %+v, want one opening of 5 on hand and 2 reserved at %s", movements, defaultLocationID)
+		}
+
+		f := &stockFixture{StockStore: s}
+		f.expectStock(t, "burger", 5, 2)
+	}
+}
+
+// TestMongoStore runs against the database at STOCK_TEST_MONGO_URI. The
+// test items and orders get IDs of their own, so it can share the stock
+// database of a local run.
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("STOCK_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("STOCK_TEST_MONGO_URI is not set")
+	}
+
+	client, err := connectToMongoDB(uri)
+	if err != nil {
+		t.Fatalf("connecting to MongoDB: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+
+	s := NewStore(client)
+	testStockStore(t, func(t *testing.T) StockStore { return s })
+}
+
+// stockFixture is the store a subtest of testStockStore runs against, with
+// a prefix that keeps the IDs it makes its own.
+type stockFixture struct {
+	StockStore
+	prefix string
+}
+
+// id makes a name unique to the fixture.
+func (f *stockFixture) id(name string) string {
+	return f.prefix + name
+}
+
+func (f *stockFixture) item(name string, quantity int32) *Item {
+	return &Item{
+		ID:      f.id(name),
+		Name:    name,
+		PriceID: "price_" + name,
+		Stock:   stocked(quantity),
+	}
+}
+
+func (f *stockFixture) seed(t *testing.T, name string, quantity int32) string {
+	t.Helper()
+
+	i := f.item(name, quantity)
+	if _, err := f.Seed(context.Background(), []*Item{i}); err != nil {
+		t.Fatalf("seeding %s: %v", name, err)
+	}
+
+	return i.ID
+}
+
+func (f *stockFixture) reservation(orderID string, items ...*ItemQuantity) *Reservation {
+	now := time.Now()
+	return &Reservation{
+		OrderID:    orderID,
+		LocationID: defaultLocationID,
+		Items:      items,
+		Status:     ReservationActive,
+		ExpiresAt:  now.Add(15 * time.Minute),
+		CreatedAt:  now,
+	}
+}
+
+// expectStock checks the quantity on hand and the reserved quantity of an
+// item at the default location, and that its ledger adds up to them.
+func (f *stockFixture) expectStock(t *testing.T, itemID string, quantity, reserved int32) {
+	t.Helper()
+	f.expectStockAt(t, itemID, defaultLocationID, quantity, reserved)
+}
+
+// expectStockAt checks the stock of an item at a location, and that the
+// ledger of that location adds up to it.
+func (f *stockFixture) expectStockAt(t *testing.T, itemID, locationID string, quantity, reserved int32) {
+	t.Helper()
+
+	i, err := f.GetItem(context.Background(), itemID)
+	if err != nil {
+		t.Fatalf("getting %s: %v", itemID, err)
+	}
+	if i.At(locationID); i.Quantity != quantity || i.Reserved != reserved {
+		t.Errorf("%s has %d on hand and %d reserved at %s, want %d and %d", itemID, i.Quantity, i.Reserved, locationID, quantity, reserved)
+	}
+
+	q, r, err := f.LedgerBalance(context.Background(), itemID, locationID)
+	if err != nil {
+		t.Fatalf("getting the ledger balance of %s: %v", itemID, err)
+	}
+	if q != quantity || r != reserved {
+		t.Errorf("the ledger of %s at %s adds up to %d on hand and %d reserved, want %d and %d", itemID, locationID, q, r, quantity, reserved)
+	}
+}
+
+// movementTypes lists the types of the movements of an item, newest first.
+func (f *stockFixture) movementTypes(t *testing.T, itemID string) []MovementType {
+	t.Helper()
+
+	movements, err := f.ListMovements(context.Background(), itemID, "", 100, "")
+	if err != nil {
+		t.Fatalf("listing the movements of %s: %v", itemID, err)
+	}
+
+	types := make([]MovementType, 0, len(movements))
+	for _, m := range movements {
+		types = append(types, m.Type)
+	}
+
+	return types
+}
+
+// testStockStore is the behaviour every StockStore has to share, newStore
+// gives the store a subtest runs against.
+func testStockStore(t *testing.T, newStore func(t *testing.T) StockStore) {
+	ctx := context.Background()
+
+	fixture := func(t *testing.T) *stockFixture {
+		return &stockFixture{StockStore: newStore(t), prefix: "test-" + primitive.NewObjectID().Hex() + "-"}
+	}
+
+	t.Run("seed inserts new items only", func(t *testing.T) {
+		f := fixture(t)
+
+		inserted, err := f.Seed(ctx, []*Item{f.item("burger", 5), f.item("fries", 3)})
+		if err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+		if inserted != 2 {
+			t.Errorf("seeding inserted %d items, want 2", inserted)
+		}
+
+		// a restart seeds the catalog again
+		inserted, err = f.Seed(ctx, []*Item{f.item("burger", 20), f.item("shake", 1)})
+		if err != nil {
+			t.Fatalf("seeding again: %v", err)
+		}
+		if inserted != 1 {
+			t.Errorf("seeding again inserted %d items, want 1", inserted)
+		}
+		f.expectStock(t, f.id("burger"), 5, 0)
+		f.expectStock(t, f.id("shake"), 1, 0)
+	})
+
+	t.Run("seed replaces recipes the catalog changed", func(t *testing.T) {
+		f := fixture(t)
+		flour := f.seed(t, "flour", 10)
+		pizza := f.item("pizza", 0)
+		pizza.Stock = nil
+		pizza.Recipe = []*ItemQuantity{{ItemID: flour, Quantity: 2}}
+		if _, err := f.Seed(ctx, []*Item{pizza}); err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+
+		// a recipe edited since is kept while the catalog is unchanged
+		edited := []*ItemQuantity{{ItemID: flour, Quantity: 3}}
+		if _, err := f.UpdateItem(ctx, &Item{ID: pizza.ID, Recipe: edited}, []string{"Recipe"}, "jane"); err != nil {
+			t.Fatalf("editing the recipe: %v", err)
+		}
+		if _, err := f.Seed(ctx, []*Item{pizza}); err != nil {
+			t.Fatalf("seeding again: %v", err)
+		}
+		i, err := f.GetItem(ctx, pizza.ID)
+		if err != nil {
+			t.Fatalf("getting %s: %v", pizza.ID, err)
+		}
+		if !sameRecipe(i.Recipe, edited) {
+			t.Errorf("got recipe %+v after seeding the same catalog, want the edited one", i.Recipe)
+		}
+
+		// a recipe the catalog changed replaces the stored one
+		pizza.Recipe = []*ItemQuantity{{ItemID: flour, Quantity: 1}}
+		if _, err := f.Seed(ctx, []*Item{pizza}); err != nil {
+			t.Fatalf("seeding the changed catalog: %v", err)
+		}
+		if i, err = f.GetItem(ctx, pizza.ID); err != nil {
+			t.Fatalf("getting %s: %v", pizza.ID, err)
+		}
+		if !sameRecipe(i.Recipe, pizza.Recipe) {
+			t.Errorf("got recipe %+v after the catalog changed, want %+v", i.Recipe, pizza.Recipe)
+		}
+		if got := f.movementTypes(t, pizza.ID); !slices.Equal(got, []MovementType{MovementUpdate, MovementUpdate}) {
+			t.Errorf("movements are %v, want the catalog change and the edit", got)
+		}
+	})
+
+	t.Run("seed stocks the locations the catalog adds", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+
+		// the main kitchen keeps its quantity, downtown is new
+		added := f.item("burger", 20)
+		added.Stock["downtown"] = &StockLevel{Quantity: 3}
+		if _, err := f.Seed(ctx, []*Item{added}); err != nil {
+			t.Fatalf("seeding the new location: %v", err)
+		}
+		f.expectStock(t, burger, 5, 0)
+		f.expectStockAt(t, burger, "downtown", 3, 0)
+
+		// and is left alone on the next restart
+		added.Stock["downtown"].Quantity = 30
+		if _, err := f.Seed(ctx, []*Item{added}); err != nil {
+			t.Fatalf("seeding again: %v", err)
+		}
+		f.expectStockAt(t, burger, "downtown", 3, 0)
+	})
+
+	t.Run("get items", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		fries := f.seed(t, "fries", 3)
+
+		i, err := f.GetItem(ctx, burger)
+		if err != nil {
+			t.Fatalf("getting %s: %v", burger, err)
+		}
+		if i.At(defaultLocationID); i.ID != burger || i.Name != "burger" || i.PriceID != "price_burger" || i.Quantity != 5 {
+			t.Errorf("got %+v, want the seeded %s", i, burger)
+		}
+
+		if _, err := f.GetItem(ctx, f.id("unknown")); !errors.Is(err, common.ErrItemNotFound) {
+			t.Errorf("getting an unknown item returned %v, want %v", err, common.ErrItemNotFound)
+		}
+
+		items, err := f.GetItems(ctx, []string{burger, f.id("unknown"), fries})
+		if err != nil {
+			t.Fatalf("getting items: %v", err)
+		}
+		var ids []string
+		for _, i := range items {
+			ids = append(ids, i.ID)
+		}
+		if len(ids) != 2 || !slices.Contains(ids, burger) || !slices.Contains(ids, fries) {
+			t.Errorf("got items %v, want %s and %s", ids, burger, fries)
+		}
+	})
+
+	t.Run("seed from a catalog file", func(t *testing.T) {
+		f := fixture(t)
+		dir := t.TempDir()
+
+		catalogs := map[string]string{
+			"catalog.json": fmt.Sprintf(`[{"id": %q, "name": "burger", "priceID": "price_burger", "quantity": 20}]`, f.id("json")),
+			"catalog.csv":  fmt.Sprintf("id,name,priceID,quantity\n%s,fries,price_fries,10\n", f.id("csv")),
+		}
+		for name, content := range catalogs {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatalf("writing %s: %v", name, err)
+			}
+
+			items, err := LoadCatalog(path)
+			if err != nil {
+				t.Fatalf("loading %s: %v", name, err)
+			}
+			if inserted, err := f.Seed(ctx, items); err != nil || inserted != 1 {
+				t.Fatalf("seeding %s inserted %d items, %v, want 1", name, inserted, err)
+			}
+		}
+		f.expectStock(t, f.id("json"), 20, 0)
+		f.expectStock(t, f.id("csv"), 10, 0)
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+
+		const workers = 16
+		var wg sync.WaitGroup
+		inserted := make(chan int, workers)
+		errs := make(chan error, 2*workers)
+		for n := range workers {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+
+				// every worker seeds the same item and one of its own
+				res, err := f.Seed(ctx, []*Item{f.item("shared", 1), f.item(fmt.Sprintf("item-%d", n), int32(n))})
+				if err != nil {
+					errs <- err
+					return
+				}
+				inserted <- res
+			}()
+			go func() {
+				defer wg.Done()
+
+				if _, err := f.GetItem(ctx, burger); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(inserted)
+		close(errs)
+
+		for err := range errs {
+			t.Errorf("concurrent call: %v", err)
+		}
+		total := 0
+		for n := range inserted {
+			total += n
+		}
+		if total != workers+1 {
+			t.Errorf("seeding inserted %d items, want %d", total, workers+1)
+		}
+		for n := range workers {
+			f.expectStock(t, f.id(fmt.Sprintf("item-%d", n)), int32(n), 0)
+		}
+		f.expectStock(t, f.id("shared"), 1, 0)
+	})
+
+	t.Run("reserve holds the items", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		before, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 2}))
+		if err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		f.expectStock(t, burger, 5, 2)
+		if len(before) != 1 || before[0].ID != burger || before[0].Reserved != 0 {
+			t.Errorf("got items %+v, want burger as it was before the hold", before)
+		}
+
+		r, err := f.GetReservation(ctx, orderID)
+		if err != nil {
+			t.Fatalf("getting the reservation: %v", err)
+		}
+		if r.Status != ReservationActive {
+			t.Errorf("reservation is %s, want %s", r.Status, ReservationActive)
+		}
+	})
+
+	t.Run("reserve is once per order", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		if _, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 2})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		_, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 2}))
+		if !errors.Is(err, ErrReservationExists) {
+			t.Fatalf("reserving again returned %v, want %v", err, ErrReservationExists)
+		}
+		f.expectStock(t, burger, 5, 2)
+	})
+
+	t.Run("reserve holds nothing on a shortage", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		fries := f.seed(t, "fries", 1)
+		shake := f.seed(t, "shake", 0)
+		orderID := f.id("order")
+
+		_, err := f.Reserve(ctx, f.reservation(orderID,
+			&ItemQuantity{ItemID: burger, Quantity: 2},
+			&ItemQuantity{ItemID: fries, Quantity: 3},
+			&ItemQuantity{ItemID: shake, Quantity: 1}))
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Fatalf("reserving returned %v, want %v", err, common.ErrNoStock)
+		}
+		// the error names every short item, not only the first one
+		var shortage *ShortageError
+		if !errors.As(err, &shortage) || !slices.Equal(shortage.ItemIDs, []string{fries, shake}) {
+			t.Errorf("reserving returned %v, want a shortage of %s and %s", err, fries, shake)
+		}
+		f.expectStock(t, burger, 5, 0)
+		f.expectStock(t, fries, 1, 0)
+		f.expectStock(t, shake, 0, 0)
+
+		if _, err := f.GetReservation(ctx, orderID); !errors.Is(err, ErrReservationNotFound) {
+			t.Errorf("getting the reservation returned %v, want %v", err, ErrReservationNotFound)
+		}
+
+		// the order can reserve again once it fits
+		_, err = f.Reserve(ctx, f.reservation(orderID,
+			&ItemQuantity{ItemID: burger, Quantity: 2},
+			&ItemQuantity{ItemID: fries, Quantity: 1}))
+		if err != nil {
+			t.Fatalf("reserving again: %v", err)
+		}
+		f.expectStock(t, burger, 5, 2)
+		f.expectStock(t, fries, 1, 1)
+	})
+
+	t.Run("reserve fails on unknown items", func(t *testing.T) {
+		f := fixture(t)
+
+		_, err := f.Reserve(ctx, f.reservation(f.id("order"), &ItemQuantity{ItemID: f.id("unknown"), Quantity: 1}))
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Errorf("reserving returned %v, want %v", err, common.ErrNoStock)
+		}
+	})
+
+	t.Run("only one order gets the last unit", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 1)
+
+		const orders = 16
+		var wg sync.WaitGroup
+		errs := make(chan error, orders)
+		for n := range orders {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				orderID := f.id(fmt.Sprintf("order-%d", n))
+				_, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 1}))
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		reserved := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				reserved++
+			case !errors.Is(err, common.ErrNoStock):
+				t.Errorf("reserving returned %v, want %v", err, common.ErrNoStock)
+			}
+		}
+		if reserved != 1 {
+			t.Errorf("%d orders reserved the last unit, want 1", reserved)
+		}
+		f.expectStock(t, burger, 1, 1)
+	})
+
+	t.Run("commit takes the items out once", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		if _, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 2})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		if err := f.CloseReservation(ctx, orderID, ReservationCommitted); err != nil {
+			t.Fatalf("committing: %v", err)
+		}
+		f.expectStock(t, burger, 3, 0)
+
+		if err := f.CloseReservation(ctx, orderID, ReservationCommitted); !errors.Is(err, ErrReservationClosed) {
+			t.Errorf("committing again returned %v, want %v", err, ErrReservationClosed)
+		}
+		if err := f.CloseReservation(ctx, orderID, ReservationReleased); !errors.Is(err, ErrReservationClosed) {
+			t.Errorf("releasing the committed reservation returned %v, want %v", err, ErrReservationClosed)
+		}
+		f.expectStock(t, burger, 3, 0)
+
+		r, err := f.GetReservation(ctx, orderID)
+		if err != nil {
+			t.Fatalf("getting the reservation: %v", err)
+		}
+		if r.Status != ReservationCommitted {
+			t.Errorf("reservation is %s, want %s", r.Status, ReservationCommitted)
+		}
+	})
+
+	t.Run("release gives the items back once", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		if _, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 2})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		if err := f.CloseReservation(ctx, orderID, ReservationReleased); err != nil {
+			t.Fatalf("releasing: %v", err)
+		}
+		f.expectStock(t, burger, 5, 0)
+
+		if err := f.CloseReservation(ctx, orderID, ReservationExpired); !errors.Is(err, ErrReservationClosed) {
+			t.Errorf("expiring the released reservation returned %v, want %v", err, ErrReservationClosed)
+		}
+		f.expectStock(t, burger, 5, 0)
+	})
+
+	t.Run("close fails on an unknown reservation", func(t *testing.T) {
+		f := fixture(t)
+
+		if err := f.CloseReservation(ctx, f.id("order"), ReservationCommitted); !errors.Is(err, ErrReservationNotFound) {
+			t.Errorf("committing returned %v, want %v", err, ErrReservationNotFound)
+		}
+	})
+
+	t.Run("expired reservations are listed", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		expired, active := f.id("expired"), f.id("active")
+
+		r := f.reservation(expired, &ItemQuantity{ItemID: burger, Quantity: 1})
+		r.ExpiresAt = time.Now().Add(-time.Minute)
+		if _, err := f.Reserve(ctx, r); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		if _, err := f.Reserve(ctx, f.reservation(active, &ItemQuantity{ItemID: burger, Quantity: 1})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+
+		res, err := f.ExpiredReservations(ctx, time.Now())
+		if err != nil {
+			t.Fatalf("listing the expired reservations: %v", err)
+		}
+		var orderIDs []string
+		for _, r := range res {
+			orderIDs = append(orderIDs, r.OrderID)
+		}
+		if !slices.Contains(orderIDs, expired) || slices.Contains(orderIDs, active) {
+			t.Errorf("expired reservations are %v, want %s and not %s", orderIDs, expired, active)
+		}
+	})
+
+	t.Run("sell takes the items out once", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		before, err := f.Sell(ctx, orderID, defaultLocationID, []*ItemQuantity{{ItemID: burger, Quantity: 2}})
+		if err != nil {
+			t.Fatalf("selling: %v", err)
+		}
+		f.expectStock(t, burger, 3, 0)
+		if len(before) != 1 || before[0].ID != burger || before[0].Quantity != 5 {
+			t.Errorf("got items %+v, want burger as it was before the sale", before)
+		}
+
+		_, err = f.Sell(ctx, orderID, defaultLocationID, []*ItemQuantity{{ItemID: burger, Quantity: 2}})
+		if !errors.Is(err, ErrAlreadySold) {
+			t.Errorf("selling again returned %v, want %v", err, ErrAlreadySold)
+		}
+		f.expectStock(t, burger, 3, 0)
+	})
+
+	t.Run("sell fails on unknown items", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		_, err := f.Sell(ctx, orderID, defaultLocationID, []*ItemQuantity{
+			{ItemID: burger, Quantity: 1},
+			{ItemID: f.id("unknown"), Quantity: 1},
+		})
+		if !errors.Is(err, common.ErrItemNotFound) {
+			t.Fatalf("selling returned %v, want %v", err, common.ErrItemNotFound)
+		}
+		f.expectStock(t, burger, 5, 0)
+
+		// nothing was recorded, so the order can still be sold
+		if _, err := f.Sell(ctx, orderID, defaultLocationID, []*ItemQuantity{{ItemID: burger, Quantity: 1}}); err != nil {
+			t.Fatalf("selling again: %v", err)
+		}
+		f.expectStock(t, burger, 4, 0)
+	})
+
+	t.Run("sell refuses to oversell", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		fries := f.seed(t, "fries", 5)
+
+		// the reservation of another order holds most of the fries
+		if _, err := f.Reserve(ctx, f.reservation(f.id("reserved"), &ItemQuantity{ItemID: fries, Quantity: 4})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+
+		_, err := f.Sell(ctx, f.id("order"), defaultLocationID, []*ItemQuantity{
+			{ItemID: burger, Quantity: 2},
+			{ItemID: fries, Quantity: 2},
+		})
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Fatalf("selling returned %v, want %v", err, common.ErrNoStock)
+		}
+		f.expectStock(t, burger, 5, 0)
+		f.expectStock(t, fries, 5, 4)
+	})
+
+	t.Run("stock is kept per location", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.item("burger", 5)
+		burger.Stock["downtown"] = &StockLevel{Quantity: 2}
+		if _, err := f.Seed(ctx, []*Item{burger}); err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+
+		r := f.reservation(f.id("reserved"), &ItemQuantity{ItemID: burger.ID, Quantity: 2})
+		r.LocationID = "downtown"
+		if _, err := f.Reserve(ctx, r); err != nil {
+			t.Fatalf("reserving downtown: %v", err)
+		}
+		f.expectStockAt(t, burger.ID, "downtown", 2, 2)
+		f.expectStock(t, burger.ID, 5, 0)
+
+		// downtown has nothing left to sell, the main kitchen does
+		_, err := f.Sell(ctx, f.id("downtown"), "downtown", []*ItemQuantity{{ItemID: burger.ID, Quantity: 1}})
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Errorf("selling downtown returned %v, want %v", err, common.ErrNoStock)
+		}
+		if _, err := f.Sell(ctx, f.id("main"), defaultLocationID, []*ItemQuantity{{ItemID: burger.ID, Quantity: 1}}); err != nil {
+			t.Fatalf("selling at %s: %v", defaultLocationID, err)
+		}
+		f.expectStock(t, burger.ID, 4, 0)
+
+		if err := f.CloseReservation(ctx, r.OrderID, ReservationCommitted); err != nil {
+			t.Fatalf("committing: %v", err)
+		}
+		f.expectStockAt(t, burger.ID, "downtown", 0, 0)
+
+		// the ledger of every location adds up to the whole stock
+		q, reserved, err := f.LedgerBalance(ctx, burger.ID, "")
+		if err != nil {
+			t.Fatalf("getting the ledger balance: %v", err)
+		}
+		if q != 4 || reserved != 0 {
+			t.Errorf("the ledger adds up to %d on hand and %d reserved, want 4 and 0", q, reserved)
+		}
+	})
+
+	t.Run("movements are listed newest first", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		orderID := f.id("order")
+
+		if _, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 2})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		if err := f.CloseReservation(ctx, orderID, ReservationCommitted); err != nil {
+			t.Fatalf("committing: %v", err)
+		}
+		if _, err := f.Sell(ctx, f.id("sold"), defaultLocationID, []*ItemQuantity{{ItemID: burger, Quantity: 1}}); err != nil {
+			t.Fatalf("selling: %v", err)
+		}
+		f.expectStock(t, burger, 2, 0)
+
+		want := []MovementType{MovementSale, MovementSale, MovementReservation, MovementRestock}
+		if got := f.movementTypes(t, burger); !slices.Equal(got, want) {
+			t.Errorf("movements are %v, want %v", got, want)
+		}
+
+		// pages carry on from the last movement of the previous one
+		first, err := f.ListMovements(ctx, burger, "", 3, "")
+		if err != nil {
+			t.Fatalf("listing the first page: %v", err)
+		}
+		if len(first) != 3 || first[0].OrderID != f.id("sold") || first[1].Reason != "order paid" || first[1].OrderID != orderID {
+			t.Fatalf("the first page is %+v, want the sale, then the commit of %s", first, orderID)
+		}
+		rest, err := f.ListMovements(ctx, burger, "", 3, first[2].ID)
+		if err != nil {
+			t.Fatalf("listing the second page: %v", err)
+		}
+		if len(rest) != 1 || rest[0].Type != MovementRestock || rest[0].Actor != systemActor {
+			t.Errorf("the second page is %+v, want the catalog seed", rest)
+		}
+	})
+
+	t.Run("released reservations are recorded", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		released, expired := f.id("released"), f.id("expired")
+
+		for _, orderID := range []string{released, expired} {
+			if _, err := f.Reserve(ctx, f.reservation(orderID, &ItemQuantity{ItemID: burger, Quantity: 1})); err != nil {
+				t.Fatalf("reserving: %v", err)
+			}
+		}
+		if err := f.CloseReservation(ctx, released, ReservationReleased); err != nil {
+			t.Fatalf("releasing: %v", err)
+		}
+		if err := f.CloseReservation(ctx, expired, ReservationExpired); err != nil {
+			t.Fatalf("expiring: %v", err)
+		}
+		f.expectStock(t, burger, 5, 0)
+
+		movements, err := f.ListMovements(ctx, burger, "", 2, "")
+		if err != nil {
+			t.Fatalf("listing the movements: %v", err)
+		}
+		if len(movements) != 2 || movements[0].Reason != "reservation expired" || movements[1].Reason != "order cancelled" {
+			t.Errorf("movements are %+v, want the expiry and the release", movements)
+		}
+	})
+
+	t.Run("failed changes record nothing", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 1)
+
+		_, err := f.Reserve(ctx, f.reservation(f.id("order"), &ItemQuantity{ItemID: burger, Quantity: 2}))
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Fatalf("reserving returned %v, want %v", err, common.ErrNoStock)
+		}
+		_, err = f.Sell(ctx, f.id("order"), defaultLocationID, []*ItemQuantity{{ItemID: burger, Quantity: 2}})
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Fatalf("selling returned %v, want %v", err, common.ErrNoStock)
+		}
+		f.expectStock(t, burger, 1, 0)
+
+		if got := f.movementTypes(t, burger); !slices.Equal(got, []MovementType{MovementRestock}) {
+			t.Errorf("movements are %v, want the catalog seed only", got)
+		}
+	})
+	t.Run("create items", func(t *testing.T) {
+		f := fixture(t)
+		shake := f.item("shake", 4)
+
+		if err := f.CreateItem(ctx, shake, "jane"); err != nil {
+			t.Fatalf("creating: %v", err)
+		}
+		f.expectStock(t, shake.ID, 4, 0)
+
+		if err := f.CreateItem(ctx, f.item("shake", 1), "jane"); !errors.Is(err, ErrItemExists) {
+			t.Errorf("creating again returned %v, want %v", err, ErrItemExists)
+		}
+		f.expectStock(t, shake.ID, 4, 0)
+
+		movements, err := f.ListMovements(ctx, shake.ID, "", 10, "")
+		if err != nil {
+			t.Fatalf("listing the movements: %v", err)
+		}
+		if len(movements) != 1 || movements[0].Type != MovementRestock || movements[0].Actor != "jane" {
+			t.Errorf("movements are %+v, want a restock by jane", movements)
+		}
+	})
+
+	t.Run("update items", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+
+		// only the named fields are written
+		i, err := f.UpdateItem(ctx, &Item{ID: burger, Name: "cheeseburger"}, []string{"Name"}, "jane")
+		if err != nil {
+			t.Fatalf("updating the name: %v", err)
+		}
+		if i.At(defaultLocationID); i.Name != "cheeseburger" || i.PriceID != "price_burger" || i.Quantity != 5 {
+			t.Errorf("got %+v, want the new name and the seeded price and quantity", i)
+		}
+
+		// every field is written when none is named
+		i, err = f.UpdateItem(ctx, &Item{ID: burger, Name: "burger", PriceID: "price_2"}, nil, "joe")
+		if err != nil {
+			t.Fatalf("replacing: %v", err)
+		}
+		if i.Name != "burger" || i.PriceID != "price_2" {
+			t.Errorf("got %+v, want every field replaced", i)
+		}
+		f.expectStock(t, burger, 5, 0)
+
+		if _, err := f.UpdateItem(ctx, &Item{ID: f.id("unknown"), Name: "x"}, nil, "jane"); !errors.Is(err, common.ErrItemNotFound) {
+			t.Errorf("updating an unknown item returned %v, want %v", err, common.ErrItemNotFound)
+		}
+
+		movements, err := f.ListMovements(ctx, burger, "", 2, "")
+		if err != nil {
+			t.Fatalf("listing the movements: %v", err)
+		}
+		if len(movements) != 2 || movements[0].Actor != "joe" || movements[1].Actor != "jane" || movements[0].Type != MovementUpdate {
+			t.Errorf("movements are %+v, want the updates by joe and jane", movements)
+		}
+	})
+
+	t.Run("archived items can't be reserved", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+
+		i, err := f.ArchiveItem(ctx, burger, "jane")
+		if err != nil {
+			t.Fatalf("archiving: %v", err)
+		}
+		if !i.Archived {
+			t.Errorf("got %+v, want it archived", i)
+		}
+		if got := f.movementTypes(t, burger); !slices.Equal(got, []MovementType{MovementArchive, MovementRestock}) {
+			t.Errorf("movements are %v, want the archive and the catalog seed", got)
+		}
+
+		_, err = f.Reserve(ctx, f.reservation(f.id("order"), &ItemQuantity{ItemID: burger, Quantity: 1}))
+		if !errors.Is(err, common.ErrNoStock) {
+			t.Errorf("reserving returned %v, want %v", err, common.ErrNoStock)
+		}
+		f.expectStock(t, burger, 5, 0)
+
+		if _, err := f.ArchiveItem(ctx, f.id("unknown"), "jane"); !errors.Is(err, common.ErrItemNotFound) {
+			t.Errorf("archiving an unknown item returned %v, want %v", err, common.ErrItemNotFound)
+		}
+	})
+
+	t.Run("adjust quantities", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+
+		if _, err := f.Reserve(ctx, f.reservation(f.id("order"), &ItemQuantity{ItemID: burger, Quantity: 3})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+
+		if _, err := f.AdjustQuantity(ctx, NewMovement(burger, defaultLocationID, MovementRestock, 10, 0, "", "jane", "")); err != nil {
+			t.Fatalf("restocking: %v", err)
+		}
+		if _, err := f.AdjustQuantity(ctx, NewMovement(burger, defaultLocationID, MovementWaste, -4, 0, "dropped", "jane", "")); err != nil {
+			t.Fatalf("wasting: %v", err)
+		}
+		f.expectStock(t, burger, 11, 3)
+
+		// what is reserved can't be wasted
+		_, err := f.AdjustQuantity(ctx, NewMovement(burger, defaultLocationID, MovementWaste, -9, 0, "dropped", "jane", ""))
+		if !errors.Is(err, ErrQuantityBelowReserved) {
+			t.Errorf("wasting reserved units returned %v, want %v", err, ErrQuantityBelowReserved)
+		}
+		f.expectStock(t, burger, 11, 3)
+
+		_, err = f.AdjustQuantity(ctx, NewMovement(f.id("unknown"), defaultLocationID, MovementRestock, 1, 0, "", "jane", ""))
+		if !errors.Is(err, common.ErrItemNotFound) {
+			t.Errorf("restocking an unknown item returned %v, want %v", err, common.ErrItemNotFound)
+		}
+	})
+
+	t.Run("list items", func(t *testing.T) {
+		f := fixture(t)
+		a := f.seed(t, "a", 1)
+		b := f.seed(t, "b", 1)
+		c := f.seed(t, "c", 1)
+		if _, err := f.ArchiveItem(ctx, b, "jane"); err != nil {
+			t.Fatalf("archiving: %v", err)
+		}
+
+		// the store may hold other items, so pages start before the fixture
+		ids := func(pageToken string, includeArchived bool) []string {
+			t.Helper()
+
+			items, err := f.ListItems(ctx, 2, pageToken, includeArchived)
+			if err != nil {
+				t.Fatalf("listing the items: %v", err)
+			}
+			var ids []string
+			for _, i := range items {
+				ids = append(ids, i.ID)
+			}
+			return ids
+		}
+		start := f.id("")
+		if got := ids(start, false); !slices.Equal(got, []string{a, c}) {
+			t.Errorf("got items %v, want %s and %s", got, a, c)
+		}
+		if got := ids(start, true); !slices.Equal(got, []string{a, b}) {
+			t.Errorf("got items %v with the archived ones, want %s and %s", got, a, b)
+		}
+		if got := ids(a, true); !slices.Equal(got, []string{b, c}) {
+			t.Errorf("got items %v after %s, want %s and %s", got, a, b, c)
+		}
+	})
+
+	t.Run("menu details are stored", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.item("burger", 5)
+		burger.Category = "Mains"
+		burger.Allergens = []string{"gluten"}
+		burger.SortOrder = 2
+		if err := f.CreateItem(ctx, burger, "jane"); err != nil {
+			t.Fatalf("creating: %v", err)
+		}
+
+		// a named update leaves the other menu details alone
+		breakfast := []*AvailabilityWindow{{Days: []time.Weekday{time.Monday}, Start: "07:00", End: "11:00"}}
+		if _, err := f.UpdateItem(ctx, &Item{ID: burger.ID, Availability: breakfast}, []string{"Availability"}, "jane"); err != nil {
+			t.Fatalf("updating the availability: %v", err)
+		}
+
+		i, err := f.GetItem(ctx, burger.ID)
+		if err != nil {
+			t.Fatalf("getting %s: %v", burger.ID, err)
+		}
+		if i.Category != "Mains" || !slices.Equal(i.Allergens, []string{"gluten"}) || i.SortOrder != 2 || i.Name != "burger" {
+			t.Errorf("got %+v, want the menu details it was created with", i)
+		}
+		if len(i.Availability) != 1 || i.Availability[0].Start != "07:00" || !slices.Equal(i.Availability[0].Days, []time.Weekday{time.Monday}) {
+			t.Errorf("got availability %+v, want %+v", i.Availability, breakfast)
+		}
+	})
+
+	t.Run("price lists", func(t *testing.T) {
+		f := fixture(t)
+		id := f.id("happy-hour")
+		list := &PriceList{ID: id, Name: "Happy hour", Prices: []*ItemPrice{{ItemID: f.id("burger"), PriceID: "price_1"}}}
+
+		// seeding keeps a list that already exists
+		if n, err := f.SeedPriceLists(ctx, []*PriceList{list}); err != nil || n != 1 {
+			t.Fatalf("seeding returned %d, %v, want 1 list", n, err)
+		}
+		seeded := *list
+		seeded.Name = "Changed"
+		if n, err := f.SeedPriceLists(ctx, []*PriceList{&seeded}); err != nil || n != 0 {
+			t.Fatalf("seeding again returned %d, %v, want none", n, err)
+		}
+
+		list.Prices[0].PriceID = "price_2"
+		if err := f.PutPriceList(ctx, list); err != nil {
+			t.Fatalf("putting: %v", err)
+		}
+		lists, err := f.ListPriceLists(ctx)
+		if err != nil {
+			t.Fatalf("listing: %v", err)
+		}
+		i := slices.IndexFunc(lists, func(l *PriceList) bool { return l.ID == id })
+		if i < 0 || lists[i].Name != "Happy hour" || lists[i].Prices[0].PriceID != "price_2" {
+			t.Errorf("got lists %+v, want %s replaced", lists, id)
+		}
+
+		if err := f.DeletePriceList(ctx, id); err != nil {
+			t.Fatalf("deleting: %v", err)
+		}
+		if err := f.DeletePriceList(ctx, id); !errors.Is(err, ErrPriceListNotFound) {
+			t.Errorf("deleting again returned %v, want %v", err, ErrPriceListNotFound)
+		}
+	})
+
+	t.Run("waitlists are taken once", func(t *testing.T) {
+		f := fixture(t)
+		burger, fries := f.id("burger"), f.id("fries")
+
+		for _, e := range []*WaitlistEntry{
+			NewWaitlistEntry(burger, defaultLocationID, "c1", ""),
+			NewWaitlistEntry(burger, defaultLocationID, "c1", "c1@example.com"),
+			NewWaitlistEntry(burger, defaultLocationID, "c2", ""),
+			NewWaitlistEntry(fries, "downtown", "c1", ""),
+		} {
+			if err := f.JoinWaitlist(ctx, e); err != nil {
+				t.Fatalf("joining: %v", err)
+			}
+		}
+
+		items, err := f.WaitlistedItems(ctx, defaultLocationID)
+		if err != nil {
+			t.Fatalf("listing the waitlisted items: %v", err)
+		}
+		if !slices.Contains(items, burger) || slices.Contains(items, fries) {
+			t.Errorf("got waitlisted items %v, want %s only", items, burger)
+		}
+
+		if err := f.LeaveWaitlist(ctx, waitlistEntryID(burger, defaultLocationID, "c2")); err != nil {
+			t.Fatalf("leaving: %v", err)
+		}
+		if err := f.LeaveWaitlist(ctx, waitlistEntryID(burger, defaultLocationID, "c2")); !errors.Is(err, ErrWaitlistEntryNotFound) {
+			t.Errorf("leaving again returned %v, want %v", err, ErrWaitlistEntryNotFound)
+		}
+
+		taken, err := f.TakeWaitlist(ctx, burger, defaultLocationID)
+		if err != nil {
+			t.Fatalf("taking: %v", err)
+		}
+		if len(taken) != 1 || taken[0].CustomerID != "c1" || taken[0].Email != "c1@example.com" {
+			t.Errorf("took %+v, want c1 joined once with the latest email", taken)
+		}
+		if taken, err := f.TakeWaitlist(ctx, burger, defaultLocationID); err != nil || len(taken) != 0 {
+			t.Errorf("taking again returned %+v, %v, want nothing", taken, err)
+		}
+	})
+
+	t.Run("imports are applied whole or not at all", func(t *testing.T) {
+		f := fixture(t)
+		burger := f.seed(t, "burger", 5)
+		fries := f.seed(t, "fries", 3)
+
+		change := func(id, name string, quantity int32) *CatalogChange {
+			t.Helper()
+			before, err := f.GetItem(ctx, id)
+			if err != nil {
+				t.Fatalf("getting %s: %v", id, err)
+			}
+			imported := copyItem(before)
+			imported.Name = name
+			imported.Stock = stocked(quantity)
+			c, err := diffItem(before, imported, "jane")
+			if err != nil {
+				t.Fatalf("working out the change of %s: %v", id, err)
+			}
+			return c
+		}
+
+		// the burger was renamed since the import was worked out
+		changes := []*CatalogChange{change(fries, "curly fries", 4), change(burger, "cheeseburger", 6)}
+		if _, err := f.UpdateItem(ctx, &Item{ID: burger, Name: "veggie burger"}, []string{"Name"}, "joe"); err != nil {
+			t.Fatalf("renaming: %v", err)
+		}
+		if err := f.ImportCatalog(ctx, changes); !errors.Is(err, ErrImportConflict) {
+			t.Fatalf("importing returned %v, want %v", err, ErrImportConflict)
+		}
+		i, err := f.GetItem(ctx, fries)
+		if err != nil {
+			t.Fatalf("getting %s: %v", fries, err)
+		}
+		if i.Name != "fries" {
+			t.Errorf("the fries are named %q, want the import undone", i.Name)
+		}
+		f.expectStock(t, fries, 3, 0)
+
+		// stock reserved since can't be imported away
+		changes = []*CatalogChange{change(fries, "curly fries", 4), change(burger, "cheeseburger", 1)}
+		if _, err := f.Reserve(ctx, f.reservation(f.id("order"), &ItemQuantity{ItemID: burger, Quantity: 2})); err != nil {
+			t.Fatalf("reserving: %v", err)
+		}
+		if err := f.ImportCatalog(ctx, changes); !errors.Is(err, ErrQuantityBelowReserved) {
+			t.Fatalf("importing returned %v, want %v", err, ErrQuantityBelowReserved)
+		}
+		f.expectStock(t, fries, 3, 0)
+		f.expectStock(t, burger, 5, 2)
+
+		changes = []*CatalogChange{change(fries, "curly fries", 4), change(burger, "cheeseburger", 6)}
+		if err := f.ImportCatalog(ctx, changes); err != nil {
+			t.Fatalf("importing: %v", err)
+		}
+		f.expectStock(t, fries, 4, 0)
+		f.expectStock(t, burger, 6, 2)
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	pb "github.com/scuba13/oms/common/api"
 	"go.opentelemetry.io/otel/trace"
@@ -16,16 +17,170 @@ func NewTelemetryMiddleware(next StockService) StockService {
 	return &TelemetryMiddleware{next}
 }
 
-func (s *TelemetryMiddleware) GetItems(ctx context.Context, ids []string) ([]*pb.Item, error) {
+func (s *TelemetryMiddleware) GetItems(ctx context.Context, locationID, channel string, ids []string) ([]*pb.Item, error) {
 	span := trace.SpanFromContext(ctx)
-	span.AddEvent(fmt.Sprintf("GetItems: %v", ids))
+	span.AddEvent(fmt.Sprintf("GetItems: %v, location: %s, channel: %s", ids, locationID, channel))
 
-	return s.next.GetItems(ctx, ids)
+	return s.next.GetItems(ctx, locationID, channel, ids)
 }
 
-func (s *TelemetryMiddleware) CheckIfItemAreInStock(ctx context.Context, p []*pb.ItemsWithQuantity) (bool, []*pb.Item, error) {
+func (s *TelemetryMiddleware) CheckIfItemAreInStock(ctx context.Context, locationID, channel string, p []*pb.ItemsWithQuantity) (*StockCheck, error) {
 	span := trace.SpanFromContext(ctx)
-	span.AddEvent(fmt.Sprintf("CheckIfItemAreInStock: %v", p))
+	span.AddEvent(fmt.Sprintf("CheckIfItemAreInStock: %v, location: %s, channel: %s", p, locationID, channel))
 
-	return s.next.CheckIfItemAreInStock(ctx, p)
+	return s.next.CheckIfItemAreInStock(ctx, locationID, channel, p)
+}
+
+func (s *TelemetryMiddleware) ReserveItems(ctx context.Context, orderID, locationID, channel string, p []*pb.ItemsWithQuantity, ttl time.Duration) (*Reservation, []*pb.Item, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ReserveItems: %s, location: %s, channel: %s, items: %v, ttl: %s", orderID, locationID, channel, p, ttl))
+
+	return s.next.ReserveItems(ctx, orderID, locationID, channel, p, ttl)
+}
+
+func (s *TelemetryMiddleware) CommitOrder(ctx context.Context, o *pb.Order) error {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("CommitOrder: %v", o))
+
+	return s.next.CommitOrder(ctx, o)
+}
+
+func (s *TelemetryMiddleware) ReleaseReservation(ctx context.Context, orderID string) error {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ReleaseReservation: %s", orderID))
+
+	return s.next.ReleaseReservation(ctx, orderID)
+}
+
+func (s *TelemetryMiddleware) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("ReleaseExpiredReservations")
+
+	return s.next.ReleaseExpiredReservations(ctx)
+}
+
+func (s *TelemetryMiddleware) ListMovements(ctx context.Context, itemID, locationID string, pageSize int, pageToken string) (*MovementsPage, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ListMovements: %s, location: %s, page size: %d, page token: %s", itemID, locationID, pageSize, pageToken))
+
+	return s.next.ListMovements(ctx, itemID, locationID, pageSize, pageToken)
+}
+
+func (s *TelemetryMiddleware) CreateItem(ctx context.Context, i *Item, actor string) (*Item, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("CreateItem: %v, actor: %s", i, actor))
+
+	return s.next.CreateItem(ctx, i, actor)
+}
+
+func (s *TelemetryMiddleware) UpdateItem(ctx context.Context, i *Item, fields []string, locationID, actor string) (*Item, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("UpdateItem: %s, name: %s, price ID: %s, fields: %v, location: %s, actor: %s", i.ID, i.Name, i.PriceID, fields, locationID, actor))
+
+	return s.next.UpdateItem(ctx, i, fields, locationID, actor)
+}
+
+func (s *TelemetryMiddleware) ArchiveItem(ctx context.Context, id, locationID, actor string) (*Item, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ArchiveItem: %s, location: %s, actor: %s", id, locationID, actor))
+
+	return s.next.ArchiveItem(ctx, id, locationID, actor)
+}
+
+func (s *TelemetryMiddleware) AdjustQuantity(ctx context.Context, itemID, locationID string, t MovementType, delta int32, reason, actor string) (*Item, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("AdjustQuantity: %s, location: %s, %s %d, reason: %s, actor: %s", itemID, locationID, t, delta, reason, actor))
+
+	return s.next.AdjustQuantity(ctx, itemID, locationID, t, delta, reason, actor)
+}
+
+func (s *TelemetryMiddleware) ListItems(ctx context.Context, locationID string, pageSize int, pageToken string, includeArchived bool) (*ItemsPage, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ListItems: location: %s, page size: %d, page token: %s, include archived: %t", locationID, pageSize, pageToken, includeArchived))
+
+	return s.next.ListItems(ctx, locationID, pageSize, pageToken, includeArchived)
+}
+
+func (s *TelemetryMiddleware) GetMenu(ctx context.Context, locationID, channel string) ([]*MenuCategory, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("GetMenu: location: %s, channel: %s", locationID, channel))
+
+	return s.next.GetMenu(ctx, locationID, channel)
+}
+
+func (s *TelemetryMiddleware) ListLocations(ctx context.Context) ([]*Location, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("ListLocations")
+
+	return s.next.ListLocations(ctx)
+}
+
+func (s *TelemetryMiddleware) FindFulfillmentLocations(ctx context.Context, p []*pb.ItemsWithQuantity, origin *Coordinates) ([]*FulfillmentOption, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("FindFulfillmentLocations: %v, origin: %v", p, origin))
+
+	return s.next.FindFulfillmentLocations(ctx, p, origin)
+}
+
+func (s *TelemetryMiddleware) ListPriceLists(ctx context.Context) ([]*PriceList, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("ListPriceLists")
+
+	return s.next.ListPriceLists(ctx)
+}
+
+func (s *TelemetryMiddleware) PutPriceList(ctx context.Context, l *PriceList) (*PriceList, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("PutPriceList: %s, channel: %s, priority: %d, prices: %d", l.ID, l.Channel, l.Priority, len(l.Prices)))
+
+	return s.next.PutPriceList(ctx, l)
+}
+
+func (s *TelemetryMiddleware) DeletePriceList(ctx context.Context, id string) error {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("DeletePriceList: %s", id))
+
+	return s.next.DeletePriceList(ctx, id)
+}
+
+func (s *TelemetryMiddleware) ImportCatalog(ctx context.Context, data []byte, format string, opts ImportOptions) (*ImportResult, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ImportCatalog: %d bytes of %s, dry run: %t, remove missing: %t, actor: %s", len(data), format, opts.DryRun, opts.RemoveMissing, opts.Actor))
+
+	return s.next.ImportCatalog(ctx, data, format, opts)
+}
+
+func (s *TelemetryMiddleware) ExportCatalog(ctx context.Context, format string, includeArchived bool) ([]byte, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("ExportCatalog: %s, include archived: %t", format, includeArchived))
+
+	return s.next.ExportCatalog(ctx, format, includeArchived)
+}
+
+func (s *TelemetryMiddleware) WatchStock(ctx context.Context, locationID string, itemIDs []string) (<-chan *pb.StockUpdate, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("WatchStock: location: %s, items: %v", locationID, itemIDs))
+
+	return s.next.WatchStock(ctx, locationID, itemIDs)
+}
+
+func (s *TelemetryMiddleware) StockChanged(ctx context.Context, c *StockChange) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("StockChanged: location: %s, items: %v", c.LocationID, c.ItemIDs))
+
+	s.next.StockChanged(ctx, c)
+}
+
+func (s *TelemetryMiddleware) JoinWaitlist(ctx context.Context, itemID, locationID, customerID, email string) (*WaitlistEntry, error) {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("JoinWaitlist: item: %s, location: %s, customer: %s", itemID, locationID, customerID))
+
+	return s.next.JoinWaitlist(ctx, itemID, locationID, customerID, email)
+}
+
+func (s *TelemetryMiddleware) LeaveWaitlist(ctx context.Context, itemID, locationID, customerID string) error {
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent(fmt.Sprintf("LeaveWaitlist: item: %s, location: %s, customer: %s", itemID, locationID, customerID))
+
+	return s.next.LeaveWaitlist(ctx, itemID, locationID, customerID)
 }
@@ -2,16 +2,574 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	common "github.com/scuba13/oms/common"
 	pb "github.com/scuba13/oms/common/api"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+var (
+	ErrReservationExists   = errors.New("order already has a reservation")
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationClosed   = errors.New("reservation is no longer active")
+	ErrAlreadySold         = errors.New("order stock was already taken out")
+
+	ErrInvalidArgument       = errors.New("invalid argument")
+	ErrItemExists            = errors.New("item already exists")
+	ErrQuantityBelowReserved = errors.New("quantity would fall below the reserved quantity")
+	ErrIngredientNotFound    = errors.New("recipe ingredient not found")
+	ErrLocationNotFound      = errors.New("location not found")
+	ErrPriceListNotFound     = errors.New("price list not found")
+	ErrItemInStock           = errors.New("item is in stock")
+	ErrWaitlistEntryNotFound = errors.New("customer is not on the waitlist")
+	ErrImportConflict        = errors.New("item changed since the import was worked out")
+)
+
+// ShortageError is the common.ErrNoStock of a reservation, naming the items
+// that couldn't be held.
+type ShortageError struct {
+	ItemIDs []string
+}
+
+func (e *ShortageError) Error() string {
+	return fmt.Sprintf("%v: %s", common.ErrNoStock, strings.Join(e.ItemIDs, ", "))
+}
+
+func (e *ShortageError) Unwrap() error {
+	return common.ErrNoStock
+}
+
+// The item prices returned by the stock service are resolved from the price
+// lists of the given channel at the time of the call.
 type StockService interface {
-	CheckIfItemAreInStock(context.Context, []*pb.ItemsWithQuantity) (bool, []*pb.Item, error)
-	GetItems(ctx context.Context, ids []string) ([]*pb.Item, error)
+	CheckIfItemAreInStock(ctx context.Context, locationID, channel string, items []*pb.ItemsWithQuantity) (*StockCheck, error)
+	GetItems(ctx context.Context, locationID, channel string, ids []string) ([]*pb.Item, error)
+	ReserveItems(ctx context.Context, orderID, locationID, channel string, items []*pb.ItemsWithQuantity, ttl time.Duration) (*Reservation, []*pb.Item, error)
+	// CommitOrder takes the items of a paid order out of stock. It is
+	// idempotent per order ID, so redelivered events are harmless.
+	CommitOrder(ctx context.Context, o *pb.Order) error
+	ReleaseReservation(ctx context.Context, orderID string) error
+	ReleaseExpiredReservations(ctx context.Context) (int, error)
+	ListMovements(ctx context.Context, itemID, locationID string, pageSize int, pageToken string) (*MovementsPage, error)
+	CreateItem(ctx context.Context, i *Item, actor string) (*Item, error)
+	// UpdateItem replaces the catalog details of an item, or only the
+	// fields it names when fields is not empty. UpdateItem and ArchiveItem
+	// return the item with its stock at the given location, or at the
+	// default location when it is empty.
+	UpdateItem(ctx context.Context, i *Item, fields []string, locationID, actor string) (*Item, error)
+	ArchiveItem(ctx context.Context, id, locationID, actor string) (*Item, error)
+	AdjustQuantity(ctx context.Context, itemID, locationID string, t MovementType, delta int32, reason, actor string) (*Item, error)
+	ListItems(ctx context.Context, locationID string, pageSize int, pageToken string, includeArchived bool) (*ItemsPage, error)
+	// GetMenu returns the items that can be ordered right now at a location
+	// grouped by category, sold out items included.
+	GetMenu(ctx context.Context, locationID, channel string) ([]*MenuCategory, error)
+	ListLocations(ctx context.Context) ([]*Location, error)
+	// FindFulfillmentLocations returns the locations that can fulfil every
+	// item of a basket, the nearest to origin first when it is given.
+	FindFulfillmentLocations(ctx context.Context, items []*pb.ItemsWithQuantity, origin *Coordinates) ([]*FulfillmentOption, error)
+	ListPriceLists(ctx context.Context) ([]*PriceList, error)
+	// PutPriceList creates or replaces a price list.
+	PutPriceList(ctx context.Context, l *PriceList) (*PriceList, error)
+	DeletePriceList(ctx context.Context, id string) error
+	ImportCatalog(ctx context.Context, data []byte, format string, opts ImportOptions) (*ImportResult, error)
+	ExportCatalog(ctx context.Context, format string, includeArchived bool) ([]byte, error)
+	// WatchStock streams the stock of items at a location until ctx is
+	// done.
+	WatchStock(ctx context.Context, locationID string, itemIDs []string) (<-chan *pb.StockUpdate, error)
+	// StockChanged is called with the stock changes published by any stock
+	// instance.
+	StockChanged(ctx context.Context, c *StockChange)
+	// JoinWaitlist puts a customer on the waitlist of an out of stock item,
+	// they are told once it is back in stock.
+	JoinWaitlist(ctx context.Context, itemID, locationID, customerID, email string) (*WaitlistEntry, error)
+	LeaveWaitlist(ctx context.Context, itemID, locationID, customerID string) error
 }
 
 type StockStore interface {
-	GetItem(ctx context.Context, id string) (*pb.Item, error)
-	GetItems(ctx context.Context, ids []string) ([]*pb.Item, error)
+	GetItem(ctx context.Context, id string) (*Item, error)
+	GetItems(ctx context.Context, ids []string) ([]*Item, error)
+	// Seed inserts the given items unless an item with the same ID already
+	// exists, so restarting the service never resets the stored quantities.
+	// The recipe of an existing item is replaced when the catalog changed
+	// it since it was last seeded, recipes edited since are kept otherwise.
+	Seed(ctx context.Context, items []*Item) (int, error)
+	// Reserve holds the reservation items if every one of them has enough
+	// available quantity, or fails with a ShortageError naming every item
+	// that doesn't, without holding anything. The check and the hold happen
+	// atomically. It returns the items as they were just before the hold.
+	Reserve(ctx context.Context, r *Reservation) ([]*Item, error)
+	// CloseReservation moves an active reservation to the given status,
+	// taking the reserved quantities out of stock when it is committed and
+	// giving them back otherwise. The reservation is only closed once every
+	// item was changed, a close that failed is finished by calling it again
+	// with the same status.
+	CloseReservation(ctx context.Context, orderID string, status ReservationStatus) error
+	GetReservation(ctx context.Context, orderID string) (*Reservation, error)
+	ExpiredReservations(ctx context.Context, now time.Time) ([]*Reservation, error)
+	// Sell takes the items of an order that has no active reservation out of
+	// the stock of a location. It records the order ID and fails with
+	// ErrAlreadySold when it is called again for the same order once every
+	// item was taken out, a sale that failed is finished by calling it
+	// again. It fails with common.ErrItemNotFound or common.ErrNoStock,
+	// without taking anything out, when an item is unknown or less of it is
+	// available at the location than sold. It returns the items it took out
+	// as they were at the location just before.
+	Sell(ctx context.Context, orderID, locationID string, items []*ItemQuantity) ([]*Item, error)
+	// ListMovements pages through the ledger of an item, newest first, at
+	// one location or at every location when locationID is empty. The page
+	// token is the ID of the last movement of the previous page.
+	ListMovements(ctx context.Context, itemID, locationID string, limit int, pageToken string) ([]*Movement, error)
+	// LedgerBalance sums the movements of an item at one location, or at
+	// every location when locationID is empty, which gives back the quantity
+	// on hand and the reserved quantity.
+	LedgerBalance(ctx context.Context, itemID, locationID string) (onHand int32, reserved int32, err error)
+	// CreateItem fails with ErrItemExists when the ID is taken, archived
+	// items included. The stock of the item is recorded as restocked by
+	// the actor.
+	CreateItem(ctx context.Context, i *Item, actor string) error
+	// UpdateItem replaces the catalog details, reorder threshold and recipe
+	// of an item, or only the fields it names when fields is not empty,
+	// leaving its quantities and archived flag untouched. The update and the
+	// archive are recorded in the ledger with their actor.
+	UpdateItem(ctx context.Context, i *Item, fields []string, actor string) (*Item, error)
+	ArchiveItem(ctx context.Context, id, actor string) (*Item, error)
+	// AdjustQuantity applies the quantity change of a restock, waste or
+	// adjustment movement and records it, and returns the item as it was
+	// just after. A change that would leave less on hand than is reserved
+	// fails with ErrQuantityBelowReserved.
+	AdjustQuantity(ctx context.Context, m *Movement) (*Item, error)
+	// ListItems pages through the items ordered by ID. The page token is
+	// the ID of the last item of the previous page.
+	ListItems(ctx context.Context, limit int, pageToken string, includeArchived bool) ([]*Item, error)
+	// SeedLocations inserts the given locations unless a location with the
+	// same ID already exists.
+	SeedLocations(ctx context.Context, locations []*Location) (int, error)
+	GetLocation(ctx context.Context, id string) (*Location, error)
+	ListLocations(ctx context.Context) ([]*Location, error)
+	// SeedPriceLists inserts the given price lists unless a list with the
+	// same ID already exists.
+	SeedPriceLists(ctx context.Context, lists []*PriceList) (int, error)
+	PutPriceList(ctx context.Context, l *PriceList) error
+	DeletePriceList(ctx context.Context, id string) error
+	ListPriceLists(ctx context.Context) ([]*PriceList, error)
+	// ImportCatalog applies the changes of a catalog import, all of them or
+	// none. The catalog fields of an item are only written while they still
+	// are the Before of its change, otherwise it fails with
+	// ErrImportConflict. Stock changes are applied as their movements, so
+	// reservations made since the changes were worked out are kept, and fail
+	// with ErrQuantityBelowReserved when they no longer fit.
+	ImportCatalog(ctx context.Context, changes []*CatalogChange) error
+	// JoinWaitlist adds or replaces a waitlist entry.
+	JoinWaitlist(ctx context.Context, e *WaitlistEntry) error
+	LeaveWaitlist(ctx context.Context, id string) error
+	// WaitlistedItems are the IDs of the items with a waitlist at a
+	// location.
+	WaitlistedItems(ctx context.Context, locationID string) ([]string, error)
+	// TakeWaitlist removes and returns the waitlist of an item at a
+	// location. Each entry is only ever taken once.
+	TakeWaitlist(ctx context.Context, itemID, locationID string) ([]*WaitlistEntry, error)
+}
+
+type Item struct {
+	ID       string `bson:"_id" json:"id"`
+	Name     string `bson:"name" json:"name"`
+	PriceID  string `bson:"priceID" json:"priceID"`
+	Archived bool   `bson:"archived" json:"archived"`
+
+	// Stock holds the quantities of the item at each location.
+	Stock map[string]*StockLevel `bson:"stock" json:"stock"`
+	// LocationID, Quantity and Reserved are the stock of the item at one
+	// location, filled in by At. They are not stored.
+	LocationID string `bson:"-" json:"-"`
+	Quantity   int32  `bson:"-" json:"-"`
+	Reserved   int32  `bson:"-" json:"-"`
+	// PriceListID is the price list PriceID was resolved from, empty for
+	// the base price. It is not stored.
+	PriceListID string `bson:"-" json:"-"`
+
+	Category     string                `bson:"category,omitempty" json:"category,omitempty"`
+	Description  string                `bson:"description,omitempty" json:"description,omitempty"`
+	ImageURL     string                `bson:"imageURL,omitempty" json:"imageURL,omitempty"`
+	Allergens    []string              `bson:"allergens,omitempty" json:"allergens,omitempty"`
+	SortOrder    int32                 `bson:"sortOrder" json:"sortOrder"`
+	Availability []*AvailabilityWindow `bson:"availability,omitempty" json:"availability,omitempty"`
+
+	// ReorderThreshold is the available quantity at or below which a
+	// stock.low alert is raised. Zero turns the alert off.
+	ReorderThreshold int32 `bson:"reorderThreshold" json:"reorderThreshold"`
+
+	// Recipe lists the ingredients taken out of stock for each unit sold.
+	// Items with a recipe keep no stock of their own.
+	Recipe []*ItemQuantity `bson:"recipe,omitempty" json:"recipe,omitempty"`
+	// IsIngredient items are only stocked to be used in recipes.
+	IsIngredient bool `bson:"isIngredient" json:"isIngredient"`
+	// CatalogRecipe is the recipe the catalog file gave the item when it
+	// was last seeded, which tells a changed catalog from an edited recipe.
+	// It is nil for items seeded before it was kept.
+	CatalogRecipe []*ItemQuantity `bson:"catalogRecipe" json:"catalogRecipe"`
+}
+
+// Available is the quantity that can still be sold at the location the item
+// is viewed at, that is, the quantity on hand minus what is held by active
+// reservations.
+func (i *Item) Available() int32 {
+	return i.Quantity - i.Reserved
+}
+
+// At views the item at a location, filling in its quantities from the stock
+// of that location.
+func (i *Item) At(locationID string) *Item {
+	i.LocationID = locationID
+	i.Quantity = 0
+	i.Reserved = 0
+	if l, ok := i.Stock[locationID]; ok {
+		i.Quantity = l.Quantity
+		i.Reserved = l.Reserved
+	}
+
+	return i
+}
+
+// Level returns the stock of the item at a location, adding an empty one
+// when the item was never stocked there.
+func (i *Item) Level(locationID string) *StockLevel {
+	if i.Stock == nil {
+		i.Stock = make(map[string]*StockLevel)
+	}
+	l, ok := i.Stock[locationID]
+	if !ok {
+		l = &StockLevel{}
+		i.Stock[locationID] = l
+	}
+
+	return l
+}
+
+// Stocked reports whether the item has stock on hand or reserved at any
+// location.
+func (i *Item) Stocked() bool {
+	for _, l := range i.Stock {
+		if l.Quantity != 0 || l.Reserved != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+type StockLevel struct {
+	Quantity int32 `bson:"quantity" json:"quantity"`
+	Reserved int32 `bson:"reserved" json:"reserved,omitempty"`
+}
+
+func (l *StockLevel) Available() int32 {
+	return l.Quantity - l.Reserved
+}
+
+// AvailableAt reports whether the item can be ordered at the given time
+// according to its availability windows.
+func (i *Item) AvailableAt(t time.Time) bool {
+	if len(i.Availability) == 0 {
+		return true
+	}
+
+	for _, w := range i.Availability {
+		if w.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (i *Item) ToProto() *pb.Item {
+	availability := make([]*pb.AvailabilityWindow, 0, len(i.Availability))
+	for _, w := range i.Availability {
+		availability = append(availability, w.ToProto())
+	}
+
+	recipe := make([]*pb.ItemsWithQuantity, 0, len(i.Recipe))
+	for _, r := range i.Recipe {
+		recipe = append(recipe, &pb.ItemsWithQuantity{ID: r.ItemID, Quantity: r.Quantity})
+	}
+
+	return &pb.Item{
+		ID:               i.ID,
+		Name:             i.Name,
+		PriceID:          i.PriceID,
+		Quantity:         i.Quantity,
+		Archived:         i.Archived,
+		Category:         i.Category,
+		Description:      i.Description,
+		ImageURL:         i.ImageURL,
+		Allergens:        i.Allergens,
+		SortOrder:        i.SortOrder,
+		Availability:     availability,
+		ReorderThreshold: i.ReorderThreshold,
+		Recipe:           recipe,
+		IsIngredient:     i.IsIngredient,
+		LocationID:       i.LocationID,
+		PriceListID:      i.PriceListID,
+	}
+}
+
+type MenuCategory struct {
+	Name  string
+	Items []*Item
+}
+
+// itemFields are the fields of an item an update can name, with the
+// document fields they are stored in.
+var itemFields = map[string]string{
+	"Name":             "name",
+	"PriceID":          "priceID",
+	"Category":         "category",
+	"Description":      "description",
+	"ImageURL":         "imageURL",
+	"Allergens":        "allergens",
+	"SortOrder":        "sortOrder",
+	"Availability":     "availability",
+	"ReorderThreshold": "reorderThreshold",
+	"Recipe":           "recipe",
+	"IsIngredient":     "isIngredient",
+}
+
+// mergeItem copies the named fields of u over a copy of i, or every catalog
+// field when fields is empty. The quantities and archived flag of i are
+// kept.
+func mergeItem(i, u *Item, fields []string) *Item {
+	if len(fields) == 0 {
+		fields = make([]string, 0, len(itemFields))
+		for f := range itemFields {
+			fields = append(fields, f)
+		}
+	}
+
+	m := copyItem(i)
+	for _, f := range fields {
+		switch f {
+		case "Name":
+			m.Name = u.Name
+		case "PriceID":
+			m.PriceID = u.PriceID
+		case "Category":
+			m.Category = u.Category
+		case "Description":
+			m.Description = u.Description
+		case "ImageURL":
+			m.ImageURL = u.ImageURL
+		case "Allergens":
+			m.Allergens = u.Allergens
+		case "SortOrder":
+			m.SortOrder = u.SortOrder
+		case "Availability":
+			m.Availability = u.Availability
+		case "ReorderThreshold":
+			m.ReorderThreshold = u.ReorderThreshold
+		case "Recipe":
+			m.Recipe = u.Recipe
+		case "IsIngredient":
+			m.IsIngredient = u.IsIngredient
+		}
+	}
+
+	return m
+}
+
+type ItemsPage struct {
+	Items         []*Item
+	NextPageToken string
+}
+
+type ReservationStatus string
+
+const (
+	ReservationActive    ReservationStatus = "active"
+	ReservationCommitted ReservationStatus = "committed"
+	ReservationReleased  ReservationStatus = "released"
+	ReservationExpired   ReservationStatus = "expired"
+)
+
+type Reservation struct {
+	OrderID    string            `bson:"_id" json:"orderID"`
+	LocationID string            `bson:"locationID" json:"locationID"`
+	Items      []*ItemQuantity   `bson:"items" json:"items"`
+	Status     ReservationStatus `bson:"status" json:"status"`
+	// Closing is the status an active reservation is being closed with,
+	// set until every item has been given back or taken out.
+	Closing   ReservationStatus `bson:"closing,omitempty" json:"closing,omitempty"`
+	ExpiresAt time.Time         `bson:"expiresAt" json:"expiresAt"`
+	CreatedAt time.Time         `bson:"createdAt" json:"createdAt"`
+}
+
+type ItemQuantity struct {
+	ItemID   string `bson:"itemID" json:"itemID"`
+	Quantity int32  `bson:"quantity" json:"quantity"`
+}
+
+type Sale struct {
+	OrderID    string          `bson:"_id" json:"orderID"`
+	LocationID string          `bson:"locationID" json:"locationID"`
+	Items      []*ItemQuantity `bson:"items" json:"items"`
+	// Pending is set until every item of the sale was taken out of stock.
+	Pending   bool      `bson:"pending,omitempty" json:"pending,omitempty"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+type MovementType string
+
+const (
+	MovementSale        MovementType = "sale"
+	MovementReservation MovementType = "reservation"
+	MovementRelease     MovementType = "release"
+	MovementRestock     MovementType = "restock"
+	MovementWaste       MovementType = "waste"
+	MovementAdjustment  MovementType = "adjustment"
+	// MovementUpdate and MovementArchive record who changed the catalog
+	// details of an item or archived it. They change no quantity.
+	MovementUpdate  MovementType = "update"
+	MovementArchive MovementType = "archive"
+	// MovementOpening brings the ledger of an item stocked before there was
+	// a ledger in line with its stock.
+	MovementOpening MovementType = "opening"
+)
+
+// systemActor is recorded on movements that the stock service makes on its
+// own, such as reservations expiring or the catalog being seeded.
+const systemActor = "system"
+
+// Movement is an immutable ledger entry. Quantity and Reserved are the
+// signed changes it made to the item, so summing every movement of an item
+// gives its current quantity on hand and reserved quantity.
+type Movement struct {
+	ID         string       `bson:"_id" json:"id"`
+	ItemID     string       `bson:"itemID" json:"itemID"`
+	LocationID string       `bson:"locationID" json:"locationID"`
+	Type       MovementType `bson:"type" json:"type"`
+	Quantity   int32        `bson:"quantity" json:"quantity"`
+	Reserved   int32        `bson:"reserved" json:"reserved"`
+	Reason     string       `bson:"reason" json:"reason"`
+	Actor      string       `bson:"actor" json:"actor"`
+	OrderID    string       `bson:"orderID,omitempty" json:"orderID,omitempty"`
+	// Key tells apart the movements an order makes, so recording them
+	// again when a change is retried has no effect.
+	Key       string    `bson:"key,omitempty" json:"key,omitempty"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+type MovementsPage struct {
+	Movements     []*Movement
+	NextPageToken string
+	// OnHand is the quantity on hand derived from the ledger.
+	OnHand int32
+}
+
+func NewMovement(itemID, locationID string, t MovementType, quantity, reserved int32, reason, actor, orderID string) *Movement {
+	var key string
+	if orderID != "" {
+		key = orderID + "/" + itemID + "/" + string(t)
+	}
+
+	return &Movement{
+		ID:         primitive.NewObjectID().Hex(),
+		ItemID:     itemID,
+		LocationID: locationID,
+		Type:       t,
+		Quantity:   quantity,
+		Reserved:   reserved,
+		Reason:     reason,
+		Actor:      actor,
+		OrderID:    orderID,
+		Key:        key,
+		CreatedAt:  time.Now(),
+	}
+}
+
+func (m *Movement) ToProto() *pb.StockMovement {
+	return &pb.StockMovement{
+		ID:         m.ID,
+		ItemID:     m.ItemID,
+		LocationID: m.LocationID,
+		Type:       string(m.Type),
+		Quantity:   m.Quantity,
+		Reserved:   m.Reserved,
+		Reason:     m.Reason,
+		Actor:      m.Actor,
+		OrderID:    m.OrderID,
+		CreatedAt:  m.CreatedAt.Unix(),
+	}
+}
+
+// openingMovements are the entries that make the ledger of an item add up
+// to its stock at every location, given the ledger balances by location.
+// They are keyed by item and location, so an opening is only ever recorded
+// once.
+func openingMovements(i *Item, balances map[string]StockLevel) []*Movement {
+	locationIDs := make([]string, 0, len(i.Stock))
+	for id := range i.Stock {
+		locationIDs = append(locationIDs, id)
+	}
+	sort.Strings(locationIDs)
+
+	var movements []*Movement
+	for _, id := range locationIDs {
+		l, balance := i.Stock[id], balances[id]
+		if l.Quantity == balance.Quantity && l.Reserved == balance.Reserved {
+			continue
+		}
+
+		m := NewMovement(i.ID, id, MovementOpening, l.Quantity-balance.Quantity, l.Reserved-balance.Reserved, "opening balance", systemActor, "")
+		m.Key = "opening/" + i.ID + "/" + id
+		movements = append(movements, m)
+	}
+
+	return movements
+}
+
+// sortedLocationIDs returns the locations of a stock map in order.
+func sortedLocationIDs(stock map[string]*StockLevel) []string {
+	ids := make([]string, 0, len(stock))
+	for id := range stock {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// stockMovements are the restock entries of a new item, one per location it
+// is stocked at.
+func stockMovements(i *Item, reason, actor string) []*Movement {
+	locationIDs := make([]string, 0, len(i.Stock))
+	for id, l := range i.Stock {
+		if l.Quantity != 0 {
+			locationIDs = append(locationIDs, id)
+		}
+	}
+	sort.Strings(locationIDs)
+
+	movements := make([]*Movement, 0, len(locationIDs))
+	for _, id := range locationIDs {
+		movements = append(movements, NewMovement(i.ID, id, MovementRestock, i.Stock[id].Quantity, 0, reason, actor, ""))
+	}
+
+	return movements
+}
+
+// closingMovement is the ledger entry for an item of a reservation that is
+// closed with the given status.
+func closingMovement(r *Reservation, i *ItemQuantity, status ReservationStatus) *Movement {
+	switch status {
+	case ReservationCommitted:
+		return NewMovement(i.ItemID, r.LocationID, MovementSale, -i.Quantity, -i.Quantity, "order paid", systemActor, r.OrderID)
+	case ReservationExpired:
+		return NewMovement(i.ItemID, r.LocationID, MovementRelease, 0, -i.Quantity, "reservation expired", systemActor, r.OrderID)
+	default:
+		return NewMovement(i.ItemID, r.LocationID, MovementRelease, 0, -i.Quantity, "order cancelled", systemActor, r.OrderID)
+	}
 }
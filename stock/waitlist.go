@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+)
+
+// WaitlistEntry is a customer waiting for an item to be back in stock at a
+// location. A customer is on the waitlist of an item once per location.
+type WaitlistEntry struct {
+	ID         string    `bson:"_id" json:"id"`
+	ItemID     string    `bson:"itemID" json:"itemID"`
+	LocationID string    `bson:"locationID" json:"locationID"`
+	CustomerID string    `bson:"customerID" json:"customerID"`
+	Email      string    `bson:"email,omitempty" json:"email,omitempty"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+func NewWaitlistEntry(itemID, locationID, customerID, email string) *WaitlistEntry {
+	return &WaitlistEntry{
+		ID:         waitlistEntryID(itemID, locationID, customerID),
+		ItemID:     itemID,
+		LocationID: locationID,
+		CustomerID: customerID,
+		Email:      email,
+		CreatedAt:  time.Now(),
+	}
+}
+
+func waitlistEntryID(itemID, locationID, customerID string) string {
+	return fmt.Sprintf("%s/%s/%s", locationID, itemID, customerID)
+}
+
+func (e *WaitlistEntry) ToProto() *pb.WaitlistEntry {
+	return &pb.WaitlistEntry{
+		ItemID:     e.ItemID,
+		LocationID: e.LocationID,
+		CustomerID: e.CustomerID,
+		Email:      e.Email,
+		CreatedAt:  e.CreatedAt.Unix(),
+	}
+}
+
+// JoinWaitlist puts a customer on the waitlist of an item that is out of
+// stock at a location. Joining again only updates the email.
+func (s *Service) JoinWaitlist(ctx context.Context, itemID, locationID, customerID, email string) (*WaitlistEntry, error) {
+	switch {
+	case itemID == "":
+		return nil, fmt.Errorf("%w: item ID is required", ErrInvalidArgument)
+	case customerID == "":
+		return nil, fmt.Errorf("%w: customer ID is required", ErrInvalidArgument)
+	}
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return nil, fmt.Errorf("%w: invalid email %q", ErrInvalidArgument, email)
+		}
+	}
+
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.itemsAt(ctx, locationID, []string{itemID})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 || items[0].Archived || items[0].IsIngredient {
+		return nil, common.ErrItemNotFound
+	}
+
+	items, err = s.withRecipeQuantities(ctx, locationID, items)
+	if err != nil {
+		return nil, err
+	}
+	if items[0].Available() > 0 {
+		return nil, fmt.Errorf("%w: %s can be ordered at %s", ErrItemInStock, itemID, locationID)
+	}
+
+	e := NewWaitlistEntry(itemID, locationID, customerID, email)
+	if err := s.store.JoinWaitlist(ctx, e); err != nil {
+		return nil, err
+	}
+
+	// the item may have been restocked since it was checked, in which case
+	// nobody else is going to tell the customer
+	s.notifyWaitlists(ctx, locationID, itemID)
+
+	return e, nil
+}
+
+func (s *Service) LeaveWaitlist(ctx context.Context, itemID, locationID, customerID string) error {
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return err
+	}
+
+	return s.store.LeaveWaitlist(ctx, waitlistEntryID(itemID, locationID, customerID))
+}
+
+// notifyWaitlists publishes stock.back_in_stock for the items with a
+// waitlist that are available at a location again, and takes everyone
+// waiting for them off the waitlist. Without item IDs every item with a
+// waitlist at the location is checked. The stock change is already stored,
+// so failures are only logged.
+func (s *Service) notifyWaitlists(ctx context.Context, locationID string, itemIDs ...string) {
+	if len(itemIDs) == 0 {
+		var err error
+		itemIDs, err = s.store.WaitlistedItems(ctx, locationID)
+		if err != nil {
+			log.Printf("Failed to list the waitlisted items at %s: %v", locationID, err)
+			return
+		}
+		if len(itemIDs) == 0 {
+			return
+		}
+	}
+
+	items, err := s.itemsAt(ctx, locationID, itemIDs)
+	if err == nil {
+		items, err = s.withRecipeQuantities(ctx, locationID, items)
+	}
+	if err != nil {
+		log.Printf("Failed to check the waitlisted items %v at %s: %v", itemIDs, locationID, err)
+		return
+	}
+
+	for _, i := range items {
+		if i.Archived || i.Available() <= 0 {
+			continue
+		}
+
+		waitlist, err := s.store.TakeWaitlist(ctx, i.ID, locationID)
+		if err != nil {
+			log.Printf("Failed to take the waitlist of item %s at %s: %v", i.ID, locationID, err)
+			continue
+		}
+		if len(waitlist) == 0 {
+			continue
+		}
+
+		entries := make([]*pb.WaitlistEntry, 0, len(waitlist))
+		for _, e := range waitlist {
+			entries = append(entries, e.ToProto())
+		}
+
+		err = s.alerts.PublishBackInStock(ctx, &pb.BackInStock{
+			ItemID:     i.ID,
+			Name:       i.Name,
+			LocationID: locationID,
+			Available:  i.Available(),
+			Waitlist:   entries,
+			CreatedAt:  time.Now().Unix(),
+		})
+		if err != nil {
+			log.Printf("Failed to publish %s for item %s: %v", broker.StockBackInStockEvent, i.ID, err)
+
+			// back on the waitlist, so the next restock tries again
+			for _, e := range waitlist {
+				if err := s.store.JoinWaitlist(ctx, e); err != nil {
+					log.Printf("Failed to put customer %s back on the waitlist of item %s: %v", e.CustomerID, i.ID, err)
+				}
+			}
+			continue
+		}
+
+		log.Printf("Item %s is back in stock at %s, %d customers notified", i.ID, locationID, len(waitlist))
+	}
+}
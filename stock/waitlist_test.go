@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	common "github.com/scuba13/oms/common"
+)
+
+func TestJoinWaitlist(t *testing.T) {
+	s := newTestService(t,
+		&Item{ID: "burger", Name: "burger", PriceID: "p", Stock: stocked(5)},
+		&Item{ID: "fries", Name: "fries", PriceID: "p", Stock: stocked(0)},
+		&Item{ID: "bun", Name: "bun", PriceID: "p", Stock: stocked(0), IsIngredient: true},
+	)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		itemID     string
+		customerID string
+		email      string
+		want       error
+	}{
+		{"no customer", "fries", "", "", ErrInvalidArgument},
+		{"an invalid email", "fries", "c1", "not an email", ErrInvalidArgument},
+		{"an item in stock", "burger", "c1", "", ErrItemInStock},
+		{"an ingredient", "bun", "c1", "", common.ErrItemNotFound},
+		{"an unknown item", "shake", "c1", "", common.ErrItemNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.JoinWaitlist(ctx, tt.itemID, "", tt.customerID, tt.email); !errors.Is(err, tt.want) {
+				t.Errorf("joining returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	e, err := s.JoinWaitlist(ctx, "fries", "", "c1", "c1@example.com")
+	if err != nil {
+		t.Fatalf("joining: %v", err)
+	}
+	if e.LocationID != defaultLocationID {
+		t.Errorf("joined at %q, want %s", e.LocationID, defaultLocationID)
+	}
+
+	if err := s.LeaveWaitlist(ctx, "fries", "", "c1"); err != nil {
+		t.Fatalf("leaving: %v", err)
+	}
+	if err := s.LeaveWaitlist(ctx, "fries", "", "c1"); !errors.Is(err, ErrWaitlistEntryNotFound) {
+		t.Errorf("leaving again returned %v, want %v", err, ErrWaitlistEntryNotFound)
+	}
+}
+
+func TestWaitlistNotifiedOnRestock(t *testing.T) {
+	s := newTestService(t,
+		&Item{ID: "fries", Name: "fries", PriceID: "p", Stock: stocked(0)},
+		&Item{ID: "dough", Name: "dough", PriceID: "p", Stock: stocked(0), IsIngredient: true},
+		&Item{ID: "pizza", Name: "pizza", PriceID: "p", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 2}}},
+	)
+	ctx := context.Background()
+	alerts := s.alerts.(*alertRecorder)
+
+	for _, id := range []string{"fries", "pizza"} {
+		for _, customerID := range []string{"c1", "c2"} {
+			if _, err := s.JoinWaitlist(ctx, id, "", customerID, ""); err != nil {
+				t.Fatalf("joining the %s waitlist: %v", id, err)
+			}
+		}
+	}
+
+	// one unit of dough doesn't make a pizza yet
+	if _, err := s.AdjustQuantity(ctx, "dough", "", MovementRestock, 1, "", "jane"); err != nil {
+		t.Fatalf("restocking: %v", err)
+	}
+	if len(alerts.backInStock) != 0 {
+		t.Fatalf("got %d back in stock events, want none", len(alerts.backInStock))
+	}
+
+	if _, err := s.AdjustQuantity(ctx, "dough", "", MovementRestock, 1, "", "jane"); err != nil {
+		t.Fatalf("restocking: %v", err)
+	}
+	if len(alerts.backInStock) != 1 || alerts.backInStock[0].ItemID != "pizza" || len(alerts.backInStock[0].Waitlist) != 2 {
+		t.Fatalf("got back in stock events %v, want the pizza with 2 customers", alerts.backInStock)
+	}
+
+	// the customers were taken off the waitlist when they were told
+	if _, err := s.AdjustQuantity(ctx, "dough", "", MovementRestock, 2, "", "jane"); err != nil {
+		t.Fatalf("restocking: %v", err)
+	}
+	if len(alerts.backInStock) != 1 {
+		t.Errorf("got %d back in stock events, want the pizza customers told once", len(alerts.backInStock))
+	}
+	if err := s.LeaveWaitlist(ctx, "pizza", "", "c1"); !errors.Is(err, ErrWaitlistEntryNotFound) {
+		t.Errorf("leaving the pizza waitlist returned %v, want %v", err, ErrWaitlistEntryNotFound)
+	}
+}
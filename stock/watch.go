@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+	"github.com/scuba13/oms/common/broker"
+	"go.opentelemetry.io/otel"
+)
+
+// availabilityRecheckInterval is how often watched items are checked again
+// without a stock change, so availability windows opening and closing reach
+// the watchers.
+const availabilityRecheckInterval = time.Minute
+
+// StockChange names the items whose stock changed at a location. An empty
+// location stands for every location, such as when an item is archived.
+type StockChange struct {
+	LocationID string   `json:"locationID,omitempty"`
+	ItemIDs    []string `json:"itemIDs"`
+}
+
+type ChangePublisher interface {
+	// PublishChange tells every stock instance about a stock change.
+	PublishChange(ctx context.Context, c *StockChange) error
+}
+
+type amqpChangePublisher struct {
+	channel *amqp.Channel
+}
+
+func NewChangePublisher(channel *amqp.Channel) *amqpChangePublisher {
+	return &amqpChangePublisher{channel}
+}
+
+func (p *amqpChangePublisher) PublishChange(ctx context.Context, c *StockChange) error {
+	tr := otel.Tracer("amqp")
+	amqpContext, messageSpan := tr.Start(ctx, fmt.Sprintf("AMQP - publish - %s", broker.StockChangedEvent))
+	defer messageSpan.End()
+
+	marshalledChange, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	headers := broker.InjectAMQPHeaders(amqpContext)
+
+	// changes are only useful to the watchers connected right now, so they
+	// are not persisted
+	return p.channel.PublishWithContext(amqpContext, broker.StockChangedEvent, "", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        marshalledChange,
+		Headers:     headers,
+	})
+}
+
+// stockWatch is one WatchStock call. deps are the watched items and their
+// ingredients, the items whose changes wake the watch up.
+type stockWatch struct {
+	locationID string
+	deps       map[string]bool
+	wake       chan struct{}
+}
+
+// stockHub wakes up the watches affected by stock changes. A watch that is
+// woken up again before it has caught up is only woken up once, so bursts of
+// changes are coalesced.
+type stockHub struct {
+	mu      sync.Mutex
+	watches map[*stockWatch]struct{}
+}
+
+func newStockHub() *stockHub {
+	return &stockHub{watches: make(map[*stockWatch]struct{})}
+}
+
+func (h *stockHub) add(w *stockWatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.watches[w] = struct{}{}
+}
+
+func (h *stockHub) remove(w *stockWatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.watches, w)
+}
+
+func (h *stockHub) setDeps(w *stockWatch, deps map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w.deps = deps
+}
+
+func (h *stockHub) notify(c *StockChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watches {
+		if c.LocationID != "" && c.LocationID != w.locationID {
+			continue
+		}
+
+		for _, id := range c.ItemIDs {
+			if w.deps[id] {
+				select {
+				case w.wake <- struct{}{}:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+// WatchStock sends the stock of the given items at a location, then an
+// update whenever the available quantity of one of them or whether it can be
+// ordered changes. The updates channel is closed once ctx is done.
+func (s *Service) WatchStock(ctx context.Context, locationID string, itemIDs []string) (<-chan *pb.StockUpdate, error) {
+	if len(itemIDs) == 0 {
+		return nil, fmt.Errorf("%w: at least one item ID is required", ErrInvalidArgument)
+	}
+	if len(itemIDs) > maxPageSize {
+		return nil, fmt.Errorf("%w: at most %d items can be watched", ErrInvalidArgument, maxPageSize)
+	}
+
+	locationID, err := s.resolveLocation(ctx, locationID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(itemIDs))
+	seen := make(map[string]bool, len(itemIDs))
+	for _, id := range itemIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	w := &stockWatch{locationID: locationID, wake: make(chan struct{}, 1)}
+
+	// the watch is added before the first read, so no change is missed in
+	// between
+	s.hub.add(w)
+	levels, deps, err := s.stockLevels(ctx, locationID, ids)
+	if err != nil {
+		s.hub.remove(w)
+		return nil, err
+	}
+	if len(levels) < len(ids) {
+		s.hub.remove(w)
+		return nil, common.ErrItemNotFound
+	}
+	s.hub.setDeps(w, deps)
+
+	updates := make(chan *pb.StockUpdate)
+	go func() {
+		defer close(updates)
+		defer s.hub.remove(w)
+
+		ticker := time.NewTicker(availabilityRecheckInterval)
+		defer ticker.Stop()
+
+		sent := make(map[string]*pb.StockUpdate, len(ids))
+		for {
+			for _, u := range levels {
+				last, ok := sent[u.ItemID]
+				if ok && last.Available == u.Available && last.Orderable == u.Orderable {
+					continue
+				}
+
+				select {
+				case updates <- u:
+					sent[u.ItemID] = u
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.wake:
+			case <-ticker.C:
+			}
+
+			levels, deps, err = s.stockLevels(ctx, locationID, ids)
+			if err != nil {
+				log.Printf("Failed to read the stock of the watched items %v: %v", ids, err)
+				continue
+			}
+			s.hub.setDeps(w, deps)
+		}
+	}()
+
+	return updates, nil
+}
+
+// StockChanged wakes up the watches of this instance affected by a change.
+func (s *Service) StockChanged(ctx context.Context, c *StockChange) {
+	s.hub.notify(c)
+}
+
+// stockLevels reads the stock of items at a location, along with the items
+// their stock depends on. Unknown items are left out.
+func (s *Service) stockLevels(ctx context.Context, locationID string, ids []string) ([]*pb.StockUpdate, map[string]bool, error) {
+	items, err := s.itemsAt(ctx, locationID, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items, err = s.withRecipeQuantities(ctx, locationID, items)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := s.now()
+	levels := make([]*pb.StockUpdate, 0, len(items))
+	deps := make(map[string]bool)
+	for _, i := range items {
+		deps[i.ID] = true
+		for _, r := range i.Recipe {
+			deps[r.ItemID] = true
+		}
+
+		available := max(i.Available(), 0)
+		levels = append(levels, &pb.StockUpdate{
+			ItemID:     i.ID,
+			LocationID: locationID,
+			Available:  available,
+			Orderable:  available > 0 && orderable(i, now),
+			UpdatedAt:  now.Unix(),
+		})
+	}
+
+	return levels, deps, nil
+}
+
+// stockChanged tells the watchers about a stock change. The change is
+// already stored, so when it can't be published only the watchers of this
+// instance are told.
+func (s *Service) stockChanged(ctx context.Context, locationID string, itemIDs ...string) {
+	if len(itemIDs) == 0 {
+		return
+	}
+
+	c := &StockChange{LocationID: locationID, ItemIDs: itemIDs}
+	if err := s.changes.PublishChange(ctx, c); err != nil {
+		log.Printf("Failed to publish the stock change of %v: %v", itemIDs, err)
+		s.hub.notify(c)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	common "github.com/scuba13/oms/common"
+	pb "github.com/scuba13/oms/common/api"
+)
+
+// nextUpdate waits for the next stock update of a watch.
+func nextUpdate(t *testing.T, updates <-chan *pb.StockUpdate) *pb.StockUpdate {
+	t.Helper()
+
+	select {
+	case u, ok := <-updates:
+		if !ok {
+			t.Fatal("the updates were closed")
+		}
+		return u
+	case <-time.After(5 * time.Second):
+		t.Fatal("got no stock update")
+		return nil
+	}
+}
+
+func TestWatchStock(t *testing.T) {
+	s := newTestService(t,
+		&Item{ID: "burger", Name: "burger", PriceID: "p", Stock: stocked(5)},
+		&Item{ID: "fries", Name: "fries", PriceID: "p", Stock: stocked(5)},
+		&Item{ID: "dough", Name: "dough", PriceID: "p", Stock: stocked(4), IsIngredient: true},
+		&Item{ID: "pizza", Name: "pizza", PriceID: "p", Recipe: []*ItemQuantity{{ItemID: "dough", Quantity: 2}}},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates, err := s.WatchStock(ctx, "", []string{"burger", "pizza", "burger"})
+	if err != nil {
+		t.Fatalf("watching: %v", err)
+	}
+
+	// the current stock is sent first, once per item
+	got := map[string]int32{}
+	for range 2 {
+		u := nextUpdate(t, updates)
+		got[u.ItemID] = u.Available
+	}
+	if got["burger"] != 5 || got["pizza"] != 2 {
+		t.Errorf("got stock %v, want 5 burgers and 2 pizzas", got)
+	}
+
+	// changes of items nobody watches don't wake the watch up
+	if _, err := s.AdjustQuantity(ctx, "fries", "", MovementWaste, -1, "dropped", "jane"); err != nil {
+		t.Fatalf("wasting fries: %v", err)
+	}
+
+	if _, _, err := s.ReserveItems(ctx, "o1", "", "", []*pb.ItemsWithQuantity{{ID: "burger", Quantity: 2}}, time.Hour); err != nil {
+		t.Fatalf("reserving: %v", err)
+	}
+	if u := nextUpdate(t, updates); u.ItemID != "burger" || u.Available != 3 || !u.Orderable {
+		t.Errorf("got update %v, want 3 burgers left", u)
+	}
+
+	// an ingredient running out stops the items made from it
+	if _, err := s.AdjustQuantity(ctx, "dough", "", MovementWaste, -3, "dropped", "jane"); err != nil {
+		t.Fatalf("wasting dough: %v", err)
+	}
+	if u := nextUpdate(t, updates); u.ItemID != "pizza" || u.Available != 0 || u.Orderable {
+		t.Errorf("got update %v, want the pizza gone", u)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Error("got an update after the watch was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the updates weren't closed after the watch was cancelled")
+	}
+}
+
+func TestWatchStockRejects(t *testing.T) {
+	s := newTestService(t, &Item{ID: "burger", Name: "burger", PriceID: "p", Stock: stocked(5)})
+	ctx := context.Background()
+
+	if _, err := s.WatchStock(ctx, "", nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("watching nothing returned %v, want %v", err, ErrInvalidArgument)
+	}
+	if _, err := s.WatchStock(ctx, "", []string{"burger", "unknown"}); !errors.Is(err, common.ErrItemNotFound) {
+		t.Errorf("watching an unknown item returned %v, want %v", err, common.ErrItemNotFound)
+	}
+	if len(s.hub.watches) != 0 {
+		t.Errorf("got %d watches left, want the failed ones removed", len(s.hub.watches))
+	}
+}
+
+func TestStockHubCoalesces(t *testing.T) {
+	h := newStockHub()
+	w := &stockWatch{locationID: "main", deps: map[string]bool{"burger": true}, wake: make(chan struct{}, 1)}
+	h.add(w)
+
+	h.notify(&StockChange{LocationID: "downtown", ItemIDs: []string{"burger"}})
+	h.notify(&StockChange{LocationID: "main", ItemIDs: []string{"fries"}})
+	if len(w.wake) != 0 {
+		t.Fatal("the watch was woken up by changes it doesn't depend on")
+	}
+
+	h.notify(&StockChange{LocationID: "main", ItemIDs: []string{"burger"}})
+	h.notify(&StockChange{ItemIDs: []string{"fries", "burger"}})
+	if len(w.wake) != 1 {
+		t.Errorf("got %d wake ups, want the changes coalesced into one", len(w.wake))
+	}
+}